@@ -0,0 +1,169 @@
+package graphql
+
+import (
+	"strconv"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// query limits defaults
+const (
+	DefaultMaxComplexity = 1000
+	DefaultMaxDepth      = 10
+)
+
+// listSizeArg is the argument sizing the lists of a field
+const listSizeArg = "perPage"
+
+// paginated are the root fields returning pages, of PerPageDefault
+// companies without listSizeArg
+var paginated = map[string]bool{"companies": true}
+
+// Config limits the cost of the operations, rejected before they run
+type Config struct {
+	// MaxComplexity caps the fields an operation may resolve: every field
+	// costs 1, and the fields below a paginated one are counted perPage
+	// times; default 1000
+	MaxComplexity int `json:"max_complexity"`
+
+	// MaxDepth caps the nesting of the fields, default 10
+	MaxDepth int `json:"max_depth"`
+}
+
+func (c Config) maxComplexity() int {
+	if c.MaxComplexity <= 0 {
+		return DefaultMaxComplexity
+	}
+	return c.MaxComplexity
+}
+
+func (c Config) maxDepth() int {
+	if c.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return c.MaxDepth
+}
+
+// costing computes the complexity of an operation, giving up past the
+// limits
+type costing struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+
+	maxComplexity int
+	maxDepth      int
+
+	// visited counts the fields visited, bounding the work on documents
+	// expanding the same fragments over and over
+	visited int
+}
+
+// complexity returns the complexity of the operation of the validated
+// document; an error tells it's past the limits
+func complexity(conf Config, doc *ast.Document, op *ast.OperationDefinition, variables map[string]interface{}) (int, error) {
+	c := &costing{
+		fragments:     map[string]*ast.FragmentDefinition{},
+		variables:     map[string]interface{}{},
+		maxComplexity: conf.maxComplexity(),
+		maxDepth:      conf.maxDepth(),
+	}
+	for _, def := range doc.Definitions {
+		if fd, ok := def.(*ast.FragmentDefinition); ok {
+			c.fragments[fd.Name.Value] = fd
+		}
+	}
+	for _, vd := range op.VariableDefinitions {
+		if v, ok := vd.DefaultValue.(*ast.IntValue); ok {
+			c.variables[vd.Variable.Name.Value], _ = strconv.Atoi(v.Value)
+		}
+	}
+	for name, v := range variables {
+		c.variables[name] = v
+	}
+
+	cost, err := c.selectionSet(op.SelectionSet, 1)
+	if err != nil {
+		return 0, err
+	}
+	if cost > c.maxComplexity {
+		return 0, errors.Errorf("query complexity %d exceeds the limit of %d", cost, c.maxComplexity)
+	}
+	return cost, nil
+}
+
+func (c *costing) selectionSet(ss *ast.SelectionSet, depth int) (int, error) {
+	if ss == nil {
+		return 0, nil
+	}
+
+	cost := 0
+	for _, sel := range ss.Selections {
+		var n int
+		var err error
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if depth > c.maxDepth {
+				return 0, errors.Errorf("query depth exceeds the limit of %d", c.maxDepth)
+			}
+			c.visited++
+			if c.visited > c.maxComplexity {
+				return 0, errors.Errorf("query complexity exceeds the limit of %d", c.maxComplexity)
+			}
+			n, err = c.selectionSet(sel.SelectionSet, depth+1)
+			n = 1 + c.listSize(sel, depth)*n
+
+		case *ast.FragmentSpread:
+			if fd, ok := c.fragments[sel.Name.Value]; ok {
+				n, err = c.selectionSet(fd.SelectionSet, depth)
+			}
+
+		case *ast.InlineFragment:
+			n, err = c.selectionSet(sel.SelectionSet, depth)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		cost += n
+		if cost > c.maxComplexity {
+			return 0, errors.Errorf("query complexity exceeds the limit of %d", c.maxComplexity)
+		}
+	}
+	return cost, nil
+}
+
+// listSize is the number of items a paginated field returns at most, 1 for
+// the others
+func (c *costing) listSize(f *ast.Field, depth int) int {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != listSizeArg {
+			continue
+		}
+
+		var size int
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			size, _ = strconv.Atoi(v.Value)
+		case *ast.Variable:
+			switch value := c.variables[v.Name.Value].(type) {
+			case float64:
+				size = int(value)
+			case int:
+				size = value
+			}
+		}
+		if size < 1 || size > utils.PerPageMax {
+			// rejected when resolved, if not defaulted
+			return utils.PerPageDefault
+		}
+		return size
+	}
+
+	if depth == 1 && paginated[f.Name.Value] {
+		return utils.PerPageDefault
+	}
+	return 1
+}
@@ -0,0 +1,355 @@
+package graphql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/utils"
+)
+
+// memApp keeps the companies in memory, recording the last list query
+type memApp struct {
+	mu        sync.Mutex
+	companies map[string]model.Company
+	lastQuery store.ListQuery
+}
+
+func newMemApp() *memApp {
+	return &memApp{companies: map[string]model.Company{}}
+}
+
+func (a *memApp) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c.ID = "c-" + c.Name
+	if _, ok := a.companies[c.ID]; ok {
+		return "", store.ErrCompanyExists
+	}
+	a.companies[c.ID] = c
+	return c.ID, nil
+}
+
+func (a *memApp) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastQuery = q
+	companies := []model.Company{}
+	for _, c := range a.companies {
+		if store.Matches(q.Filters, &c) {
+			companies = append(companies, c)
+		}
+	}
+	total := len(companies)
+	if q.Skip >= total {
+		return []model.Company{}, total, nil
+	}
+	companies = companies[q.Skip:]
+	if len(companies) > q.Limit {
+		companies = companies[:q.Limit]
+	}
+	return companies, total, nil
+}
+
+func (a *memApp) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.companies[id]
+	if !ok {
+		return nil, store.ErrCompanyNotFound
+	}
+	return &c, nil
+}
+
+func (a *memApp) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.companies[id]
+	if !ok {
+		return store.ErrCompanyNotFound
+	}
+	c.Website, c.Phone = cu.Website, cu.Phone
+	a.companies[id] = c
+	return nil
+}
+
+func (a *memApp) DeleteCompany(ctx context.Context, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.companies[id]; !ok {
+		return store.ErrCompanyNotFound
+	}
+	delete(a.companies, id)
+	return nil
+}
+
+// response is a GraphQL response
+type response struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func (r response) code() string {
+	if len(r.Errors) == 0 {
+		return ""
+	}
+	code, _ := r.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+type client struct {
+	t   *testing.T
+	url string
+}
+
+func (c client) post(query string, vars map[string]interface{}) (int, response) {
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": vars})
+	res, err := http.Post(c.url, "application/json", bytes.NewReader(body))
+	if !assert.NoError(c.t, err) {
+		return 0, response{}
+	}
+	defer res.Body.Close()
+	var r response
+	assert.NoError(c.t, json.NewDecoder(res.Body).Decode(&r))
+	return res.StatusCode, r
+}
+
+func newClient(t *testing.T, h http.Handler) client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return client{t: t, url: srv.URL}
+}
+
+func TestQueriesAndMutations(t *testing.T) {
+	app := newMemApp()
+	h, err := NewHandler(app, nil, nil, nil, Config{})
+	assert.NoError(t, err)
+	c := newClient(t, h)
+
+	status, res := c.post(`mutation($in: CreateCompanyInput!) { createCompany(input: $in) { id name } }`,
+		map[string]interface{}{"in": map[string]interface{}{"name": "xm", "code": "CY", "country": "Cyprus"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, map[string]interface{}{"id": "c-xm", "name": "xm"}, res.Data["createCompany"])
+
+	_, res = c.post(`mutation { createCompany(input: {name: "xm", code: "CY", country: "Cyprus"}) { id } }`, nil)
+	assert.Equal(t, CodeAlreadyExists, res.code())
+	_, res = c.post(`mutation { createCompany(input: {name: "bad", code: "XX", country: "Cyprus"}) { id } }`, nil)
+	assert.Equal(t, CodeBadUserInput, res.code())
+
+	_, res = c.post(`mutation { updateCompany(id: "c-xm", input: {phone: "+35722000000"}) { phone } }`, nil)
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, map[string]interface{}{"phone": "+35722000000"}, res.Data["updateCompany"])
+
+	// several lookups in one request, a missing company is null
+	_, res = c.post(`{
+		xm: company(id: "c-xm") { name phone }
+		missing: company(id: "c-missing") { name }
+		companies(filters: [{attribute: "code", value: "CY"}], sort: {attribute: "name", order: DESC},
+			perPage: 1) { total page perPage hasNext companies { id } }
+	}`, nil)
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, map[string]interface{}{"name": "xm", "phone": "+35722000000"}, res.Data["xm"])
+	assert.Nil(t, res.Data["missing"])
+	assert.Equal(t, map[string]interface{}{"total": 1.0, "page": 1.0, "perPage": 1.0, "hasNext": false,
+		"companies": []interface{}{map[string]interface{}{"id": "c-xm"}}}, res.Data["companies"])
+	assert.Equal(t, store.ListQuery{Limit: 1,
+		Filters: []store.Filter{{AttrName: "code", Value: "CY", Operator: store.Eq}},
+		Sort:    &store.Sort{AttrName: "name"}}, app.lastQuery)
+
+	_, res = c.post(`{ companies(perPage: 501) { total } }`, nil)
+	assert.Equal(t, CodeBadUserInput, res.code())
+
+	_, res = c.post(`mutation { deleteCompany(id: "c-xm") }`, nil)
+	assert.Equal(t, "c-xm", res.Data["deleteCompany"])
+	_, res = c.post(`mutation { deleteCompany(id: "c-xm") }`, nil)
+	assert.Equal(t, CodeNotFound, res.code())
+
+	// mutations aren't sent by GET
+	r, err := http.Get(c.url + "?query=" + url.QueryEscape(`mutation { deleteCompany(id: "c-xm") }`))
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, r.StatusCode)
+
+	status, _ = c.post(`{ unknown }`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestLimits(t *testing.T) {
+	h, err := NewHandler(newMemApp(), nil, nil, nil, Config{MaxComplexity: 100})
+	assert.NoError(t, err)
+	c := newClient(t, h)
+
+	tt := []struct {
+		name  string
+		query string
+		vars  map[string]interface{}
+		code  string
+	}{
+		{name: "cheap", query: `{ companies(perPage: 10) { total companies { id name } } }`},
+		{name: "default page", query: `{ companies { companies { id name code } } }`},
+		{name: "large page", query: `{ companies(perPage: 50) { companies { id name } } }`, code: CodeTooComplex},
+		{name: "large page variable", query: `query($n: Int) { companies(perPage: $n) { companies { id name } } }`,
+			vars: map[string]interface{}{"n": 50}, code: CodeTooComplex},
+		{name: "large page default", query: `query($n: Int = 50) { companies(perPage: $n) { companies { id name } } }`,
+			code: CodeTooComplex},
+		{name: "fragments", query: `{ companies(perPage: 20) { ...page } } fragment page on CompanyPage {
+			companies { id name code country website phone } }`, code: CodeTooComplex},
+		{name: "aliases", query: `{ a: company(id: "1") { id } b: company(id: "1") { id } c: company(id: "1") { id }
+			d: companies { total } e: companies { total } f: companies { total } }`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			status, res := c.post(tc.query, tc.vars)
+			assert.Equal(t, tc.code, res.code(), res.Errors)
+			if tc.code != "" {
+				assert.Equal(t, http.StatusBadRequest, status)
+			}
+		})
+	}
+
+	h, err = NewHandler(newMemApp(), nil, nil, nil, Config{MaxDepth: 2})
+	assert.NoError(t, err)
+	c = newClient(t, h)
+	_, res := c.post(`{ companies { total } }`, nil)
+	assert.Empty(t, res.Errors)
+	_, res = c.post(`{ companies { companies { id } } }`, nil)
+	assert.Equal(t, CodeTooComplex, res.code())
+}
+
+func TestGuards(t *testing.T) {
+	app := newMemApp()
+	app.CreateCompany(context.Background(), model.Company{Name: "xm", Code: "CY", Country: "Cyprus"})
+
+	policies, err := policy.NewEngine([]policy.Config{{
+		Name:      "no-local-deletes",
+		Methods:   []string{"DELETE"},
+		Paths:     []string{"/api/v1/companies/:id"},
+		DenyCIDRs: []string{"127.0.0.0/8", "::1/128"},
+	}}, nil, nil)
+	assert.NoError(t, err)
+	h, err := NewHandler(app, nil, policies, nil, Config{})
+	assert.NoError(t, err)
+
+	reader := &auth.Principal{ID: "r", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesRead}}
+	c := newClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), reader)))
+	}))
+
+	_, res := c.post(`{ company(id: "c-xm") { name } }`, nil)
+	assert.Empty(t, res.Errors)
+
+	_, res = c.post(`mutation { updateCompany(id: "c-xm", input: {phone: "+35722000000"}) { id } }`, nil)
+	assert.Equal(t, CodeForbidden, res.code())
+	assert.Contains(t, res.Errors[0].Message, auth.ScopeCompaniesWrite)
+
+	status, res := c.post(`mutation { deleteCompany(id: "c-xm") }`, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, CodeForbidden, res.code())
+	assert.Len(t, app.companies, 1)
+}
+
+func TestRateLimits(t *testing.T) {
+	app := newMemApp()
+	limits, err := ratelimit.NewEngine([]ratelimit.Config{{
+		Name:     "writes",
+		Methods:  []string{"POST"},
+		Paths:    []string{"/api/v1/companies"},
+		Requests: 2,
+		Period:   utils.Duration(time.Minute),
+	}}, ratelimit.NewMemoryLimiter(), nil)
+	assert.NoError(t, err)
+	h, err := NewHandler(app, nil, nil, limits, Config{})
+	assert.NoError(t, err)
+	c := newClient(t, h)
+
+	// every aliased field takes a token
+	status, res := c.post(`mutation {
+		a: createCompany(input: {name: "a", code: "CY", country: "Cyprus"}) { id }
+		b: createCompany(input: {name: "b", code: "CY", country: "Cyprus"}) { id }
+		c: createCompany(input: {name: "c", code: "CY", country: "Cyprus"}) { id }
+	}`, nil)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, CodeRateLimited, res.code())
+	assert.Empty(t, app.companies)
+
+	// the reads aren't limited
+	_, res = c.post(`{ companies { total } }`, nil)
+	assert.Empty(t, res.Errors)
+}
+
+func TestSubscription(t *testing.T) {
+	broker := stream.NewBroker(stream.Config{})
+	h, err := NewHandler(newMemApp(), broker, nil, nil, Config{})
+	assert.NoError(t, err)
+	c := newClient(t, h)
+
+	q := url.Values{"query": {`subscription {
+		companyEvents(filters: [{attribute: "code", value: "CY"}], lastEventId: "unknown") {
+			resync eventId type company { id code } } }`}}
+	res, err := http.Get(c.url + "?" + q.Encode())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(res.Body)
+	next := func() (string, string) {
+		var event, data string
+		for {
+			line, err := r.ReadString('\n')
+			if !assert.NoError(t, err) {
+				return "", ""
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	// the events since are unknown; subscribed
+	event, data := next()
+	assert.Equal(t, sseNext, event)
+	assert.JSONEq(t, `{"data": {"companyEvents": {"resync": true, "eventId": "", "type": "", "company": null}}}`, data)
+
+	for _, e := range []struct{ id, code string }{{"e1", "GR"}, {"e2", "CY"}} {
+		broker.Handle(context.Background(), model.Event{ID: e.id, Type: model.EventCompanyCreated, CompanyID: "c-" + e.id,
+			Created: &model.CompanyCreated{Company: model.Company{ID: "c-" + e.id, Code: e.code}}})
+	}
+
+	event, data = next()
+	assert.Equal(t, sseNext, event)
+	assert.JSONEq(t, `{"data": {"companyEvents": {"resync": false, "eventId": "e2", "type": "company.created",
+		"company": {"id": "c-e2", "code": "CY"}}}}`, data)
+
+	// completed on shutdown
+	broker.Close()
+	event, _ = next()
+	assert.Equal(t, sseComplete, event)
+}
@@ -0,0 +1,311 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/stream"
+)
+
+const (
+	// maxRequestLen caps the size of the requests
+	maxRequestLen = 64 << 10
+
+	// the messages of a subscription, after the GraphQL over SSE protocol
+	sseNext     = "next"
+	sseComplete = "complete"
+)
+
+// route is the HTTP route a root field stands for
+type route struct {
+	method, path string
+}
+
+// fieldRoutes are the HTTP routes of the root fields, whose rate limits
+// and geo-access policies apply to them
+var fieldRoutes = map[string]route{
+	"company":       {"GET", "/api/v1/companies/:id"},
+	"companies":     {"GET", "/api/v1/companies"},
+	"createCompany": {"POST", "/api/v1/companies"},
+	"updateCompany": {"PUT", "/api/v1/companies/:id"},
+	"deleteCompany": {"DELETE", "/api/v1/companies/:id"},
+	"companyEvents": {"GET", "/api/v1/companies/events"},
+}
+
+// request is a GraphQL request, the body of a POST or the parameters of
+// a GET
+type request struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Handler serves the GraphQL requests over HTTP
+type Handler struct {
+	schema    graphql.Schema
+	conf      Config
+	policies  *policy.Engine
+	limits    *ratelimit.Engine
+	heartbeat time.Duration
+}
+
+// NewHandler returns the handler of the schema of the app. The subscriptions
+// are served with a broker. The operations are throttled by the limits and
+// guarded by the policies as the HTTP routes of their root fields, every
+// field as a request; nil engines apply none.
+func NewHandler(app comp.CompanyApp, broker *stream.Broker, policies *policy.Engine, limits *ratelimit.Engine, conf Config) (*Handler, error) {
+	schema, err := NewSchema(app, broker)
+	if err != nil {
+		return nil, errors.Wrap(err, "graphql: invalid schema")
+	}
+
+	h := &Handler{
+		schema:    schema,
+		conf:      conf,
+		policies:  policies,
+		limits:    limits,
+		heartbeat: stream.DefaultHeartbeat,
+	}
+	if broker != nil {
+		h.heartbeat = broker.Heartbeat()
+	}
+	return h, nil
+}
+
+// writeResult writes the result as JSON with the status
+func writeResult(w http.ResponseWriter, status int, res *graphql.Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// writeError answers with an error, the operation not run
+func writeError(w http.ResponseWriter, status int, err error) {
+	f := gqlerrors.FormatError(err)
+	if ext, ok := err.(gqlerrors.ExtendedError); ok {
+		f.Extensions = ext.Extensions()
+	}
+	writeResult(w, status, &graphql.Result{Errors: []gqlerrors.FormattedError{f}})
+}
+
+func parseRequest(r *http.Request) (request, error) {
+	var req request
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return req, errors.Wrap(err, "failed to decode the variables")
+			}
+		}
+	default:
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestLen)).Decode(&req); err != nil {
+			return req, errors.Wrap(err, "failed to decode request body")
+		}
+	}
+	if req.Query == "" {
+		return req, errors.New("query is empty")
+	}
+	return req, nil
+}
+
+// operation returns the operation of the document to run
+func operation(doc *ast.Document, name string) (*ast.OperationDefinition, error) {
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		od, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			if op != nil {
+				return nil, errors.New("operationName is required with several operations")
+			}
+			op = od
+		} else if od.Name != nil && od.Name.Value == name {
+			op = od
+		}
+	}
+	if op == nil {
+		return nil, errors.New("unknown operation " + name)
+	}
+	return op, nil
+}
+
+// rootFields returns the names of the root fields of the operation
+func rootFields(doc *ast.Document, ss *ast.SelectionSet) []string {
+	var names []string
+	for _, sel := range ss.Selections {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			names = append(names, sel.Name.Value)
+		case *ast.InlineFragment:
+			names = append(names, rootFields(doc, sel.SelectionSet)...)
+		case *ast.FragmentSpread:
+			for _, def := range doc.Definitions {
+				if fd, ok := def.(*ast.FragmentDefinition); ok && fd.Name.Value == sel.Name.Value {
+					names = append(names, rootFields(doc, fd.SelectionSet)...)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// ServeHTTP runs the queries and mutations, and streams the subscriptions
+// as Server-Sent Events. The operations are validated, their complexity
+// checked and their root fields throttled and guarded by the policies of
+// their routes before they run; those failing get 400, 429 or 403. The
+// mutations are POSTed.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := parseRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if res := graphql.ValidateDocument(&h.schema, doc, nil); !res.IsValid {
+		writeResult(w, http.StatusBadRequest, &graphql.Result{Errors: res.Errors})
+		return
+	}
+
+	op, err := operation(doc, req.OperationName)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if op.Operation == ast.OperationTypeMutation && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("mutations are POSTed"))
+		return
+	}
+
+	if _, err := complexity(h.conf, doc, op, req.Variables); err != nil {
+		writeError(w, http.StatusBadRequest, codedError{err, CodeTooComplex})
+		return
+	}
+
+	for _, name := range rootFields(doc, op.SelectionSet) {
+		rt, ok := fieldRoutes[name]
+		if !ok {
+			continue
+		}
+		if err := h.limits.Check(r, rt.method, rt.path); err != nil {
+			if errors.Is(err, ratelimit.ErrLimited) {
+				writeError(w, http.StatusTooManyRequests, codedError{err, CodeRateLimited})
+				return
+			}
+			writeError(w, http.StatusForbidden, codedError{err, CodeForbidden})
+			return
+		}
+		if err := h.policies.Check(r, rt.method, rt.path); err != nil {
+			writeError(w, http.StatusForbidden, codedError{err, CodeForbidden})
+			return
+		}
+	}
+
+	params := graphql.ExecuteParams{
+		Schema:        h.schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       r.Context(),
+	}
+
+	if op.Operation == ast.OperationTypeSubscription {
+		h.serveSubscription(w, r, params)
+		return
+	}
+	writeResult(w, http.StatusOK, graphql.Execute(params))
+}
+
+// writeSSE writes a message of the event stream
+func writeSSE(w io.Writer, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// serveSubscription streams the results of the subscription as "next"
+// events, then a "complete" one once it ends. Idle streams get a comment
+// as a heartbeat.
+func (h *Handler) serveSubscription(w http.ResponseWriter, r *http.Request, params graphql.ExecuteParams) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	params.Context = ctx
+	results := graphql.ExecuteSubscription(params)
+	defer func() {
+		cancel()
+		// the subscription stops once the result it's sending is taken
+		go func() {
+			for range results {
+			}
+		}()
+	}()
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	hdr.Set("Connection", "keep-alive")
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case res, ok := <-results:
+			if !ok {
+				writeSSE(w, sseComplete, []byte("{}"))
+				flusher.Flush()
+				return
+			}
+			data, err := json.Marshal(res)
+			if err != nil {
+				return
+			}
+			if err := writeSSE(w, sseNext, data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Package graphql serves the companies over GraphQL, for the clients
+// picking the fields they need and combining lookups in one request
+package graphql
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/utils"
+)
+
+// error codes, in the extensions of the errors
+const (
+	CodeForbidden     = "FORBIDDEN"
+	CodeNotFound      = "NOT_FOUND"
+	CodeAlreadyExists = "ALREADY_EXISTS"
+	CodeBadUserInput  = "BAD_USER_INPUT"
+	CodeTooComplex    = "TOO_COMPLEX"
+	CodeSlowConsumer  = "SLOW_CONSUMER"
+	CodeRateLimited   = "RATE_LIMITED"
+)
+
+// codedError tells the clients what went wrong in its code
+type codedError struct {
+	error
+	code string
+}
+
+func (e codedError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// appError gives the errors of the app their code
+func appError(err error) error {
+	switch {
+	case errors.Is(err, comp.ErrForbidden):
+		return codedError{err, CodeForbidden}
+	case errors.Is(err, store.ErrCompanyNotFound):
+		return codedError{err, CodeNotFound}
+	case errors.Is(err, store.ErrCompanyExists):
+		return codedError{err, CodeAlreadyExists}
+	}
+	return err
+}
+
+// requireScope checks the caller has the scope of the matching HTTP route;
+// unauthenticated calls are made with authentication disabled
+func requireScope(ctx context.Context, scope string) error {
+	p, ok := auth.PrincipalFromContext(ctx)
+	if !ok || p.HasScope(scope) {
+		return nil
+	}
+	return codedError{errors.New("forbidden: missing scope " + scope), CodeForbidden}
+}
+
+// resolver resolves the root fields over the app
+type resolver struct {
+	app    comp.CompanyApp
+	broker *stream.Broker
+}
+
+// companyPage is a page of the companies query
+type companyPage struct {
+	companies []model.Company
+	total     int
+	page      int
+	perPage   int
+}
+
+// NewSchema returns the schema of the companies; a nil broker leaves out
+// the subscriptions
+func NewSchema(app comp.CompanyApp, broker *stream.Broker) (graphql.Schema, error) {
+	rv := &resolver{app: app, broker: broker}
+
+	companyType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Company",
+		Fields: graphql.Fields{
+			"id":        companyField(graphql.NewNonNull(graphql.ID), func(c *model.Company) interface{} { return c.ID }),
+			"tenantId":  companyField(graphql.String, func(c *model.Company) interface{} { return c.TenantID }),
+			"name":      companyField(graphql.NewNonNull(graphql.String), func(c *model.Company) interface{} { return c.Name }),
+			"code":      companyField(graphql.NewNonNull(graphql.String), func(c *model.Company) interface{} { return c.Code }),
+			"country":   companyField(graphql.NewNonNull(graphql.String), func(c *model.Company) interface{} { return c.Country }),
+			"website":   companyField(graphql.String, func(c *model.Company) interface{} { return c.Website }),
+			"phone":     companyField(graphql.String, func(c *model.Company) interface{} { return c.Phone }),
+			"createdAt": companyField(graphql.DateTime, func(c *model.Company) interface{} { return timeOrNil(c.CreatedTs) }),
+			"updatedAt": companyField(graphql.DateTime, func(c *model.Company) interface{} { return timeOrNil(c.UpdatedTs) }),
+			"createdBy": companyField(graphql.String, func(c *model.Company) interface{} { return c.CreatedBy }),
+			"updatedBy": companyField(graphql.String, func(c *model.Company) interface{} { return c.UpdatedBy }),
+		},
+	})
+
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "CompanyPage",
+		Fields: graphql.Fields{
+			"companies": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(companyType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					page := p.Source.(*companyPage)
+					companies := make([]*model.Company, len(page.companies))
+					for i := range page.companies {
+						companies[i] = &page.companies[i]
+					}
+					return companies, nil
+				},
+			},
+			"total": pageField(func(page *companyPage) interface{} { return page.total }),
+			"page":  pageField(func(page *companyPage) interface{} { return page.page }),
+			"perPage": pageField(func(page *companyPage) interface{} {
+				return page.perPage
+			}),
+			"hasNext": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					page := p.Source.(*companyPage)
+					return page.total > page.page*page.perPage, nil
+				},
+			},
+		},
+	})
+
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "CompanyFilter",
+		Description: "Selects the companies whose attribute, e.g. code, equals the value",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"attribute": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"value":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	sortType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CompanySort",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"attribute": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"order": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewEnum(graphql.EnumConfig{
+					Name: "SortOrder",
+					Values: graphql.EnumValueConfigMap{
+						"ASC":  &graphql.EnumValueConfig{Value: true},
+						"DESC": &graphql.EnumValueConfig{Value: false},
+					},
+				}),
+				DefaultValue: true,
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"company": &graphql.Field{
+				Type:    companyType,
+				Args:    graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: rv.company,
+			},
+			"companies": &graphql.Field{
+				Type: graphql.NewNonNull(pageType),
+				Args: graphql.FieldConfigArgument{
+					"filters": {Type: graphql.NewList(graphql.NewNonNull(filterType))},
+					"sort":    {Type: sortType},
+					"page":    {Type: graphql.Int, DefaultValue: utils.PageDefault},
+					"perPage": {Type: graphql.Int, DefaultValue: utils.PerPageDefault},
+				},
+				Resolve: rv.companies,
+			},
+		},
+	})
+
+	createType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateCompanyInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"code":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"country": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"website": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	updateType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateCompanyInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"website": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createCompany": &graphql.Field{
+				Type:    graphql.NewNonNull(companyType),
+				Args:    graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(createType)}},
+				Resolve: rv.createCompany,
+			},
+			"updateCompany": &graphql.Field{
+				Type: graphql.NewNonNull(companyType),
+				Args: graphql.FieldConfigArgument{
+					"id":    {Type: graphql.NewNonNull(graphql.ID)},
+					"input": {Type: graphql.NewNonNull(updateType)},
+				},
+				Resolve: rv.updateCompany,
+			},
+			"deleteCompany": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.ID),
+				Args:    graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: rv.deleteCompany,
+			},
+		},
+	})
+
+	conf := graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	}
+
+	if broker != nil {
+		changeType := graphql.NewObject(graphql.ObjectConfig{
+			Name: "FieldChange",
+			Fields: graphql.Fields{
+				"field": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"old":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"new":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			},
+		})
+
+		eventType := graphql.NewObject(graphql.ObjectConfig{
+			Name: "CompanyEvent",
+			Fields: graphql.Fields{
+				"id": eventField(graphql.NewNonNull(graphql.String), func(m *stream.Message) interface{} { return m.ID }),
+				"eventId": eventField(graphql.NewNonNull(graphql.String), func(m *stream.Message) interface{} {
+					return m.Event.ID
+				}),
+				"type": eventField(graphql.NewNonNull(graphql.String), func(m *stream.Message) interface{} {
+					return m.Event.Type
+				}),
+				"time": eventField(graphql.DateTime, func(m *stream.Message) interface{} {
+					return timeOrNil(m.Event.Time)
+				}),
+				"companyId": eventField(graphql.NewNonNull(graphql.ID), func(m *stream.Message) interface{} {
+					return m.Event.CompanyID
+				}),
+				"actor": eventField(graphql.String, func(m *stream.Message) interface{} { return m.Event.Actor }),
+				"company": eventField(companyType, func(m *stream.Message) interface{} {
+					if c := m.Event.Company(); c != nil {
+						return c
+					}
+					return nil
+				}),
+				"changes": eventField(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(changeType))),
+					func(m *stream.Message) interface{} {
+						changes := []map[string]interface{}{}
+						if m.Event.Updated != nil {
+							for _, ch := range m.Event.Updated.Changes {
+								changes = append(changes, map[string]interface{}{
+									"field": ch.Field, "old": ch.Old, "new": ch.New})
+							}
+						}
+						return changes
+					}),
+				"resync": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.Boolean),
+					Description: "The events since lastEventId are no longer kept; reload the companies",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*stream.Message).ID == "", nil
+					},
+				},
+			},
+		})
+
+		conf.Subscription = graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"companyEvents": &graphql.Field{
+					Type: graphql.NewNonNull(eventType),
+					Args: graphql.FieldConfigArgument{
+						"companyId":   {Type: graphql.ID},
+						"filters":     {Type: graphql.NewList(graphql.NewNonNull(filterType))},
+						"lastEventId": {Type: graphql.String},
+					},
+					Subscribe: rv.companyEvents,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if err, ok := p.Source.(error); ok {
+							return nil, err
+						}
+						return p.Source, nil
+					},
+				},
+			},
+		})
+	}
+
+	return graphql.NewSchema(conf)
+}
+
+func companyField(typ graphql.Output, get func(c *model.Company) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*model.Company)), nil
+		},
+	}
+}
+
+func pageField(get func(page *companyPage) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Int),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*companyPage)), nil
+		},
+	}
+}
+
+func eventField(typ graphql.Output, get func(m *stream.Message) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*stream.Message)), nil
+		},
+	}
+}
+
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// stringArg returns the string argument, empty when missing
+func stringArg(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// parseFilters returns the equality filters of the argument
+func parseFilters(arg interface{}) []store.Filter {
+	filters := []store.Filter{}
+	list, _ := arg.([]interface{})
+	for _, item := range list {
+		in, _ := item.(map[string]interface{})
+		f := store.Filter{AttrName: stringArg(in, "attribute"), Operator: store.Eq, Value: stringArg(in, "value")}
+		if v, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			f.ValueFloat = &v
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+func (rv *resolver) company(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesRead); err != nil {
+		return nil, err
+	}
+	c, err := rv.app.GetCompany(p.Context, stringArg(p.Args, "id"))
+	if errors.Is(err, store.ErrCompanyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, appError(err)
+	}
+	return c, nil
+}
+
+func (rv *resolver) companies(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesRead); err != nil {
+		return nil, err
+	}
+
+	page, _ := p.Args["page"].(int)
+	perPage, _ := p.Args["perPage"].(int)
+	if page < utils.PageMin {
+		return nil, codedError{errors.New("page must be at least 1"), CodeBadUserInput}
+	}
+	if perPage < utils.PerPageMin || perPage > utils.PerPageMax {
+		return nil, codedError{errors.Errorf("perPage must be within 1 and %d", utils.PerPageMax), CodeBadUserInput}
+	}
+
+	q := store.ListQuery{
+		Skip:    (page - 1) * perPage,
+		Limit:   perPage,
+		Filters: parseFilters(p.Args["filters"]),
+	}
+	if in, ok := p.Args["sort"].(map[string]interface{}); ok {
+		asc, _ := in["order"].(bool)
+		q.Sort = &store.Sort{AttrName: stringArg(in, "attribute"), Ascending: asc}
+	}
+
+	companies, total, err := rv.app.ListCompanies(p.Context, q)
+	if err != nil {
+		return nil, appError(err)
+	}
+	return &companyPage{companies: companies, total: total, page: page, perPage: perPage}, nil
+}
+
+func (rv *resolver) createCompany(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesWrite); err != nil {
+		return nil, err
+	}
+
+	in, _ := p.Args["input"].(map[string]interface{})
+	c := model.Company{
+		Name:    stringArg(in, "name"),
+		Code:    stringArg(in, "code"),
+		Country: stringArg(in, "country"),
+		Website: stringArg(in, "website"),
+		Phone:   stringArg(in, "phone"),
+	}
+	if err := c.Validate(); err != nil {
+		return nil, codedError{err, CodeBadUserInput}
+	}
+
+	id, err := rv.app.CreateCompany(p.Context, c)
+	if err != nil {
+		return nil, appError(err)
+	}
+	c.ID = id
+	return &c, nil
+}
+
+func (rv *resolver) updateCompany(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesWrite); err != nil {
+		return nil, err
+	}
+
+	id := stringArg(p.Args, "id")
+	in, _ := p.Args["input"].(map[string]interface{})
+	cu := model.CompanyUpdate{
+		Website: stringArg(in, "website"),
+		Phone:   stringArg(in, "phone"),
+	}
+	if err := cu.Validate(); err != nil {
+		return nil, codedError{err, CodeBadUserInput}
+	}
+
+	if err := rv.app.UpdateCompany(p.Context, id, cu); err != nil {
+		return nil, appError(err)
+	}
+	c, err := rv.app.GetCompany(p.Context, id)
+	if err != nil {
+		return nil, appError(err)
+	}
+	return c, nil
+}
+
+func (rv *resolver) deleteCompany(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesDelete); err != nil {
+		return nil, err
+	}
+
+	id := stringArg(p.Args, "id")
+	if err := rv.app.DeleteCompany(p.Context, id); err != nil {
+		return nil, appError(err)
+	}
+	return id, nil
+}
+
+// companyEvents subscribes to the company changes visible to the caller,
+// as the SSE endpoint does; a message without id tells the client to
+// resync. The events stop with the context, or the subscription with an
+// error.
+func (rv *resolver) companyEvents(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireScope(p.Context, auth.ScopeCompaniesRead); err != nil {
+		return nil, err
+	}
+
+	ctx := p.Context
+	companyID := stringArg(p.Args, "companyId")
+	var filters []store.Filter
+	if companyID == "" {
+		filters = parseFilters(p.Args["filters"])
+	}
+	v, err := stream.NewVisibility(ctx, rv.app, filters)
+	if err != nil {
+		return nil, appError(err)
+	}
+
+	sub, replay, complete := rv.broker.Subscribe(stringArg(p.Args, "lastEventId"))
+
+	events := make(chan interface{})
+	go func() {
+		defer close(events)
+		defer sub.Close()
+
+		send := func(m stream.Message) bool {
+			if companyID != "" && m.Event.CompanyID != companyID {
+				return true
+			}
+			if m.ID != "" && !v.Visible(m.Event) {
+				return true
+			}
+			select {
+			case events <- &m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if !complete && !send(stream.Message{}) {
+			return
+		}
+		for _, m := range replay {
+			if !send(m) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-sub.C():
+				if !ok {
+					if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+						select {
+						case events <- codedError{sub.Err(), CodeSlowConsumer}:
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+				if !send(m) {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,4 @@
+// Package companypb is the generated code of company.proto
+package companypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative company.proto
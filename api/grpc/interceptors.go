@@ -0,0 +1,279 @@
+package grpc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/tenant"
+)
+
+// the CompanyService methods
+const (
+	methodCreateCompany  = "/xm.company.v1.CompanyService/CreateCompany"
+	methodGetCompany     = "/xm.company.v1.CompanyService/GetCompany"
+	methodUpdateCompany  = "/xm.company.v1.CompanyService/UpdateCompany"
+	methodDeleteCompany  = "/xm.company.v1.CompanyService/DeleteCompany"
+	methodListCompanies  = "/xm.company.v1.CompanyService/ListCompanies"
+	methodWatchCompanies = "/xm.company.v1.CompanyService/WatchCompanies"
+)
+
+// methodScopes are the scopes of the methods, as those of the HTTP routes.
+// The methods missing are denied.
+var methodScopes = map[string]string{
+	methodCreateCompany:  auth.ScopeCompaniesWrite,
+	methodGetCompany:     auth.ScopeCompaniesRead,
+	methodUpdateCompany:  auth.ScopeCompaniesWrite,
+	methodDeleteCompany:  auth.ScopeCompaniesDelete,
+	methodListCompanies:  auth.ScopeCompaniesRead,
+	methodWatchCompanies: auth.ScopeCompaniesRead,
+}
+
+// route is an HTTP route
+type route struct {
+	method, path string
+}
+
+// methodRoutes are the HTTP routes the methods mirror, whose geo-access
+// policies and rate limits apply to them
+var methodRoutes = map[string]route{
+	methodCreateCompany:  {http.MethodPost, "/api/v1/companies"},
+	methodGetCompany:     {http.MethodGet, "/api/v1/companies/:id"},
+	methodUpdateCompany:  {http.MethodPut, "/api/v1/companies/:id"},
+	methodDeleteCompany:  {http.MethodDelete, "/api/v1/companies/:id"},
+	methodListCompanies:  {http.MethodGet, "/api/v1/companies"},
+	methodWatchCompanies: {http.MethodGet, "/api/v1/companies/events"},
+}
+
+// mdRequestID is the metadata key of the request id
+var mdRequestID = strings.ToLower(logging.HdrRequestID)
+
+// serverStream overrides the context of a stream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// logCall gives the call an id, the caller's x-request-id or a new one,
+// sent back in the header. The returned context carries the id and a
+// logger tagging entries with it; done access logs the call.
+func logCall(ctx context.Context, l *logging.Logger, method string) (context.Context, string, func(err error)) {
+	start := time.Now()
+
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(mdRequestID); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+
+	rl := l.With("request_id", id)
+	ctx = logging.WithRequestID(logging.NewContext(ctx, rl), id)
+
+	done := func(err error) {
+		code := status.Code(err)
+		kv := []interface{}{
+			"method", method,
+			"code", code.String(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			kv = append(kv, "remote_addr", p.Addr.String())
+		}
+
+		switch code {
+		case codes.Unknown, codes.Internal, codes.DataLoss, codes.Unavailable:
+			rl.Error("access", append(kv, "error", err.Error())...)
+		default:
+			rl.Info("access", kv...)
+		}
+	}
+	return ctx, id, done
+}
+
+// UnaryLogging is the unary counterpart of logging.Middleware, see logCall
+func UnaryLogging(l *logging.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, id, done := logCall(ctx, l, info.FullMethod)
+		grpc.SetHeader(ctx, metadata.Pairs(mdRequestID, id))
+
+		res, err := handler(ctx, req)
+		done(err)
+		return res, err
+	}
+}
+
+// StreamLogging is the streaming counterpart of logging.Middleware, see
+// logCall
+func StreamLogging(l *logging.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, id, done := logCall(ss.Context(), l, info.FullMethod)
+		ss.SetHeader(metadata.Pairs(mdRequestID, id))
+
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		done(err)
+		return err
+	}
+}
+
+// httpRequest adapts the call to the authenticators, which find the
+// credentials in HTTP requests: the metadata are its headers, the TLS state
+// of the connection is the request's
+func httpRequest(ctx context.Context, method string) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			for _, v := range vs {
+				r.Header.Add(k, v)
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r
+}
+
+// authorize is the counterpart of auth.Middleware and tenant.Middleware:
+// it authenticates the call, checks the principal has the scope of the
+// method, and puts the principal and the tenant in the returned context.
+func authorize(ctx context.Context, a auth.Authenticator, tenancy tenant.Config, method string) (context.Context, error) {
+	if a != nil {
+		scope, ok := methodScopes[method]
+		if !ok {
+			return nil, status.Error(codes.PermissionDenied, "forbidden: unknown method "+method)
+		}
+
+		p, err := a.Authenticate(httpRequest(ctx, method))
+		if err != nil {
+			if errors.Is(err, auth.ErrNoCredentials) || errors.Is(err, auth.ErrInvalidCredentials) {
+				return nil, status.Error(codes.Unauthenticated, "unauthorized: "+err.Error())
+			}
+			return nil, status.Error(codes.Internal, "failed to authenticate the request: "+err.Error())
+		}
+		if !p.HasScope(scope) {
+			return nil, status.Error(codes.PermissionDenied, "forbidden: missing scope "+scope)
+		}
+
+		ctx = auth.WithPrincipal(ctx, p)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("actor", p.Actor()))
+	}
+
+	if tenancy.Mode != tenant.ModeNone {
+		key := strings.ToLower(tenancy.HeaderName())
+		var requested string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if ids := md.Get(key); len(ids) > 0 {
+				requested = ids[0]
+			}
+		}
+
+		id, err := tenant.Resolve(ctx, requested)
+		switch {
+		case errors.Is(err, tenant.ErrForeignTenant):
+			return nil, status.Error(codes.PermissionDenied, "forbidden: tenant "+requested+" is not the caller's")
+		case errors.Is(err, tenant.ErrUnbound):
+			return nil, status.Error(codes.PermissionDenied, "forbidden: "+tenant.ErrUnbound.Error())
+		case errors.Is(err, tenant.ErrNoTenant):
+			return nil, status.Error(codes.InvalidArgument, tenant.ErrNoTenant.Error()+": set the "+key+" metadata")
+		case err != nil:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		ctx = tenant.WithID(ctx, id)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("tenant", id))
+	}
+	return ctx, nil
+}
+
+// UnaryAuth authenticates and authorizes the unary calls, see authorize.
+// A nil Authenticator disables authentication.
+func UnaryAuth(a auth.Authenticator, tenancy tenant.Config) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, a, tenancy, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuth authenticates and authorizes the streaming calls, see
+// authorize. A nil Authenticator disables authentication.
+func StreamAuth(a auth.Authenticator, tenancy tenant.Config) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), a, tenancy, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// guard is the counterpart of the rate limits' and policies' middlewares:
+// the call is throttled and checked against the policies as a request to
+// the HTTP route its method mirrors. The client IP is the peer address, or
+// the one a trusted proxy put in the x-forwarded-for metadata.
+func guard(ctx context.Context, policies *policy.Engine, limits *ratelimit.Engine, method string) error {
+	rt, ok := methodRoutes[method]
+	if !ok {
+		return nil
+	}
+
+	r := httpRequest(ctx, method)
+	if err := limits.Check(r, rt.method, rt.path); err != nil {
+		if errors.Is(err, ratelimit.ErrLimited) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := policies.Check(r, rt.method, rt.path); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// UnaryGuard applies the rate limits and geo-access policies to the unary
+// calls, see guard. Nil engines apply none.
+func UnaryGuard(policies *policy.Engine, limits *ratelimit.Engine) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := guard(ctx, policies, limits, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamGuard applies the rate limits and geo-access policies to the
+// streaming calls, see guard. Nil engines apply none.
+func StreamGuard(policies *policy.Engine, limits *ratelimit.Engine) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := guard(ss.Context(), policies, limits, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,334 @@
+// Package grpc serves the companies over gRPC, for the internal services,
+// see companypb/company.proto
+package grpc
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/arpsch/xm/api/grpc/companypb"
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/utils"
+)
+
+// Options configures the gRPC server, as api/http.RouterOptions does the
+// HTTP API
+type Options struct {
+	// Authenticator authenticates the calls, nil disables authentication
+	Authenticator auth.Authenticator
+
+	Tenancy tenant.Config
+
+	// Policies and RateLimits apply to the calls as to the HTTP routes
+	// they mirror, nil applies none
+	Policies   *policy.Engine
+	RateLimits *ratelimit.Engine
+
+	// Stream serves WatchCompanies, nil leaves it unimplemented
+	Stream *stream.Broker
+
+	// Logger access logs the calls
+	Logger *logging.Logger
+}
+
+// NewServer returns a gRPC server of the companies. The calls are logged,
+// authenticated and put in their tenant, then throttled and checked against
+// the geo-access policies by the interceptors, in that order.
+func NewServer(app comp.CompanyApp, opts Options, grpcOpts ...grpc.ServerOption) *grpc.Server {
+	l := opts.Logger
+	if l == nil {
+		l = logging.Default()
+	}
+
+	grpcOpts = append(grpcOpts,
+		grpc.ChainUnaryInterceptor(
+			UnaryLogging(l),
+			UnaryAuth(opts.Authenticator, opts.Tenancy),
+			UnaryGuard(opts.Policies, opts.RateLimits),
+		),
+		grpc.ChainStreamInterceptor(
+			StreamLogging(l),
+			StreamAuth(opts.Authenticator, opts.Tenancy),
+			StreamGuard(opts.Policies, opts.RateLimits),
+		),
+	)
+
+	s := grpc.NewServer(grpcOpts...)
+	companypb.RegisterCompanyServiceServer(s, NewCompanyServer(app, opts.Stream))
+	return s
+}
+
+// CompanyServer implements the CompanyService over the CompanyApp
+type CompanyServer struct {
+	companypb.UnimplementedCompanyServiceServer
+
+	App    comp.CompanyApp
+	Broker *stream.Broker
+}
+
+func NewCompanyServer(app comp.CompanyApp, broker *stream.Broker) *CompanyServer {
+	return &CompanyServer{
+		App:    app,
+		Broker: broker,
+	}
+}
+
+// statusError maps the errors of the app to their status
+func statusError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, comp.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, store.ErrCompanyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, store.ErrCompanyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (cs *CompanyServer) CreateCompany(ctx context.Context, req *companypb.CreateCompanyRequest) (*companypb.Company, error) {
+	if req.Company == nil {
+		return nil, status.Error(codes.InvalidArgument, "company is empty")
+	}
+	c := model.Company{
+		Name:    req.Company.Name,
+		Code:    req.Company.Code,
+		Country: req.Company.Country,
+		Website: req.Company.Website,
+		Phone:   req.Company.Phone,
+	}
+	if err := c.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	id, err := cs.App.CreateCompany(ctx, c)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	c.ID = id
+	return companyToPB(&c), nil
+}
+
+func (cs *CompanyServer) GetCompany(ctx context.Context, req *companypb.GetCompanyRequest) (*companypb.Company, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is empty")
+	}
+	c, err := cs.App.GetCompany(ctx, req.Id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return companyToPB(c), nil
+}
+
+func (cs *CompanyServer) UpdateCompany(ctx context.Context, req *companypb.UpdateCompanyRequest) (*emptypb.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is empty")
+	}
+	cu := model.CompanyUpdate{
+		Website: req.Website,
+		Phone:   req.Phone,
+	}
+	if err := cu.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := cs.App.UpdateCompany(ctx, req.Id, cu); err != nil {
+		return nil, statusError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *CompanyServer) DeleteCompany(ctx context.Context, req *companypb.DeleteCompanyRequest) (*emptypb.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is empty")
+	}
+	if err := cs.App.DeleteCompany(ctx, req.Id); err != nil {
+		return nil, statusError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *CompanyServer) ListCompanies(ctx context.Context, req *companypb.ListCompaniesRequest) (*companypb.ListCompaniesResponse, error) {
+	page, perPage := req.Page, req.PerPage
+	if page < utils.PageMin {
+		page = utils.PageDefault
+	}
+	if perPage < utils.PerPageMin {
+		perPage = utils.PerPageDefault
+	}
+	if perPage > utils.PerPageMax {
+		return nil, status.Error(codes.InvalidArgument, "per_page too large")
+	}
+
+	filters, err := parseFilters(req.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	companies, total, err := cs.App.ListCompanies(ctx, store.ListQuery{
+		Skip:    int((page - 1) * perPage),
+		Limit:   int(perPage),
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	res := &companypb.ListCompaniesResponse{Total: int64(total)}
+	for i := range companies {
+		res.Companies = append(res.Companies, companyToPB(&companies[i]))
+	}
+	return res, nil
+}
+
+// WatchCompanies streams the company changes visible to the caller, as the
+// SSE endpoint does. A client resuming with the id of the last event it got
+// gets a resync event when the events since are no longer kept. A client
+// falling behind gets ResourceExhausted, and resumes.
+func (cs *CompanyServer) WatchCompanies(req *companypb.WatchCompaniesRequest, ss companypb.CompanyService_WatchCompaniesServer) error {
+	if cs.Broker == nil {
+		return status.Error(codes.Unimplemented, "watching the companies is disabled")
+	}
+	ctx := ss.Context()
+
+	filters, err := parseFilters(req.Filters)
+	if err != nil {
+		return err
+	}
+	if req.CompanyId != "" {
+		filters = nil
+	}
+	v, err := stream.NewVisibility(ctx, cs.App, filters)
+	if err != nil {
+		return statusError(err)
+	}
+
+	sub, replay, complete := cs.Broker.Subscribe(req.LastEventId)
+	defer sub.Close()
+
+	// the header tells the client it's subscribed
+	if err := ss.SendHeader(nil); err != nil {
+		return err
+	}
+
+	if !complete {
+		if err := ss.Send(&companypb.CompanyEvent{Resync: true}); err != nil {
+			return err
+		}
+	}
+
+	send := func(m stream.Message) error {
+		if req.CompanyId != "" && m.Event.CompanyID != req.CompanyId {
+			return nil
+		}
+		if !v.Visible(m.Event) {
+			return nil
+		}
+		return ss.Send(eventToPB(m))
+	}
+
+	for _, m := range replay {
+		if err := send(m); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+
+		case m, ok := <-sub.C():
+			if !ok {
+				if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+					logging.FromContext(ctx).Info("grpc: dropped a slow watcher")
+					return status.Error(codes.ResourceExhausted, "too slow, resume from the last event")
+				}
+				return status.Error(codes.Unavailable, "server shutting down")
+			}
+			if err := send(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseFilters returns the equality filters of the request
+func parseFilters(pfs []*companypb.Filter) ([]store.Filter, error) {
+	filters := []store.Filter{}
+	for _, pf := range pfs {
+		if pf.Attribute == "" {
+			return nil, status.Error(codes.InvalidArgument, "filter attribute is empty")
+		}
+		f := store.Filter{AttrName: pf.Attribute, Operator: store.Eq, Value: pf.Value}
+		if v, err := strconv.ParseFloat(pf.Value, 64); err == nil {
+			f.ValueFloat = &v
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func timestampToPB(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func companyToPB(c *model.Company) *companypb.Company {
+	return &companypb.Company{
+		Id:        c.ID,
+		TenantId:  c.TenantID,
+		Name:      c.Name,
+		Code:      c.Code,
+		Country:   c.Country,
+		Website:   c.Website,
+		Phone:     c.Phone,
+		CreatedTs: timestampToPB(c.CreatedTs),
+		UpdatedTs: timestampToPB(c.UpdatedTs),
+		CreatedBy: c.CreatedBy,
+		UpdatedBy: c.UpdatedBy,
+	}
+}
+
+func eventToPB(m stream.Message) *companypb.CompanyEvent {
+	e := m.Event
+	pe := &companypb.CompanyEvent{
+		Id:        m.ID,
+		EventId:   e.ID,
+		Type:      e.Type,
+		Time:      timestampToPB(e.Time),
+		CompanyId: e.CompanyID,
+		Actor:     e.Actor,
+	}
+	if c := e.Company(); c != nil {
+		pe.Company = companyToPB(c)
+	}
+	if e.Updated != nil {
+		for _, ch := range e.Updated.Changes {
+			pe.Changes = append(pe.Changes, &companypb.FieldChange{Field: ch.Field, Old: ch.Old, New: ch.New})
+		}
+	}
+	return pe
+}
@@ -0,0 +1,345 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/arpsch/xm/api/grpc/companypb"
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/utils"
+)
+
+// memApp keeps the companies of the tenants in memory
+type memApp struct {
+	mu        sync.Mutex
+	companies map[string]model.Company
+}
+
+func (a *memApp) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, other := range a.companies {
+		if other.Name == c.Name {
+			return "", store.ErrCompanyExists
+		}
+	}
+	c.ID = "c" + c.Name
+	c.TenantID, _ = tenant.FromContext(ctx)
+	a.companies[c.ID] = c
+	return c.ID, nil
+}
+
+func (a *memApp) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	companies := []model.Company{}
+	for _, c := range a.companies {
+		if store.Matches(q.Filters, &c) {
+			companies = append(companies, c)
+		}
+	}
+	return companies, len(companies), nil
+}
+
+func (a *memApp) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.companies[id]
+	if !ok {
+		return nil, store.ErrCompanyNotFound
+	}
+	return &c, nil
+}
+
+func (a *memApp) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.companies[id]
+	if !ok {
+		return store.ErrCompanyNotFound
+	}
+	c.Phone = cu.Phone
+	a.companies[id] = c
+	return nil
+}
+
+func (a *memApp) DeleteCompany(ctx context.Context, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.companies[id]; !ok {
+		return store.ErrCompanyNotFound
+	}
+	delete(a.companies, id)
+	return nil
+}
+
+// tokens authenticates the bearer tokens it knows
+type tokens map[string]*auth.Principal
+
+func (ts tokens) Authenticate(r *http.Request) (*auth.Principal, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	p, ok := ts[h]
+	if !ok {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return p, nil
+}
+
+func dial(t *testing.T, srv *grpc.Server) companypb.CompanyServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return companypb.NewCompanyServiceClient(conn)
+}
+
+// dialTCP serves srv on a loopback port, for the calls to have a peer IP
+func dialTCP(t *testing.T, srv *grpc.Server) companypb.CompanyServiceClient {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return companypb.NewCompanyServiceClient(conn)
+}
+
+func TestCompanyService(t *testing.T) {
+	app := &memApp{companies: map[string]model.Company{}}
+	client := dial(t, NewServer(app, Options{Logger: logging.New(io.Discard, logging.LevelInfo)}))
+	ctx := context.Background()
+
+	c, err := client.CreateCompany(ctx, &companypb.CreateCompanyRequest{Company: &companypb.Company{
+		Name: "xm", Code: "CY", Country: "Cyprus", Phone: "+35722000000"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "cxm", c.Id)
+
+	_, err = client.CreateCompany(ctx, &companypb.CreateCompanyRequest{Company: &companypb.Company{
+		Name: "xm", Code: "CY", Country: "Cyprus"}})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.CreateCompany(ctx, &companypb.CreateCompanyRequest{Company: &companypb.Company{Name: "no code"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var header metadata.MD
+	got, err := client.GetCompany(ctx, &companypb.GetCompanyRequest{Id: c.Id}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, "xm", got.Name)
+	assert.Len(t, header.Get(mdRequestID), 1)
+
+	_, err = client.UpdateCompany(ctx, &companypb.UpdateCompanyRequest{Id: c.Id, Phone: "+35722000001"})
+	assert.NoError(t, err)
+	_, err = client.UpdateCompany(ctx, &companypb.UpdateCompanyRequest{Id: c.Id, Phone: "not a phone"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListCompanies(ctx, &companypb.ListCompaniesRequest{
+		Filters: []*companypb.Filter{{Attribute: "code", Value: "CY"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), list.Total)
+	assert.Equal(t, "+35722000001", list.Companies[0].Phone)
+
+	_, err = client.ListCompanies(ctx, &companypb.ListCompaniesRequest{PerPage: 1000})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.DeleteCompany(ctx, &companypb.DeleteCompanyRequest{Id: c.Id})
+	assert.NoError(t, err)
+	_, err = client.GetCompany(ctx, &companypb.GetCompanyRequest{Id: c.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	watch, err := client.WatchCompanies(ctx, &companypb.WatchCompaniesRequest{})
+	assert.NoError(t, err)
+	_, err = watch.Recv()
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAuth(t *testing.T) {
+	app := &memApp{companies: map[string]model.Company{}}
+	authn := tokens{
+		"reader": {ID: "reader", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesRead},
+			Attributes: map[string]string{auth.AttributeTenant: "acme"}},
+		"writer": {ID: "writer", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesWrite},
+			Attributes: map[string]string{auth.AttributeTenant: "acme"}},
+		"admin":   {ID: "admin", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesWrite, auth.ScopeTenantsAll}},
+		"unbound": {ID: "unbound", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesWrite}},
+	}
+	client := dial(t, NewServer(app, Options{
+		Authenticator: authn,
+		Tenancy:       tenant.Config{Mode: tenant.ModeShared},
+		Logger:        logging.New(io.Discard, logging.LevelInfo),
+	}))
+
+	create := func(kv ...string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), kv...)
+		_, err := client.CreateCompany(ctx, &companypb.CreateCompanyRequest{Company: &companypb.Company{
+			Name: "xm" + time.Now().String(), Code: "CY", Country: "Cyprus"}})
+		return err
+	}
+
+	tt := []struct {
+		name string
+		md   []string
+		code codes.Code
+	}{
+		{name: "no credentials", code: codes.Unauthenticated},
+		{name: "unknown token", md: []string{"authorization", "nobody"}, code: codes.Unauthenticated},
+		{name: "missing scope", md: []string{"authorization", "reader"}, code: codes.PermissionDenied},
+		{name: "own tenant", md: []string{"authorization", "writer"}, code: codes.OK},
+		{name: "other tenant", md: []string{"authorization", "writer", "x-tenant-id", "globex"},
+			code: codes.PermissionDenied},
+		{name: "no tenant", md: []string{"authorization", "admin"}, code: codes.InvalidArgument},
+		{name: "named tenant", md: []string{"authorization", "admin", "x-tenant-id", "globex"}, code: codes.OK},
+		{name: "unbound", md: []string{"authorization", "unbound", "x-tenant-id", "globex"},
+			code: codes.PermissionDenied},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.code, status.Code(create(tc.md...)))
+		})
+	}
+
+	tenants := map[string]bool{}
+	for _, c := range app.companies {
+		tenants[c.TenantID] = true
+	}
+	assert.Equal(t, map[string]bool{"acme": true, "globex": true}, tenants)
+}
+
+func TestWatchCompanies(t *testing.T) {
+	broker := stream.NewBroker(stream.Config{})
+	app := &memApp{companies: map[string]model.Company{}}
+	client := dial(t, NewServer(app, Options{Stream: broker, Logger: logging.New(io.Discard, logging.LevelInfo)}))
+
+	publish := func(id, companyID, code string) {
+		broker.Handle(context.Background(), model.Event{ID: id, Type: model.EventCompanyCreated, CompanyID: companyID,
+			Created: &model.CompanyCreated{Company: model.Company{ID: companyID, Code: code}}})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := func(req *companypb.WatchCompaniesRequest) companypb.CompanyService_WatchCompaniesClient {
+		s, err := client.WatchCompanies(ctx, req)
+		assert.NoError(t, err)
+		// subscribed once the headers are in
+		_, err = s.Header()
+		assert.NoError(t, err)
+		return s
+	}
+
+	byCode := watch(&companypb.WatchCompaniesRequest{Filters: []*companypb.Filter{{Attribute: "code", Value: "CY"}}})
+	byID := watch(&companypb.WatchCompaniesRequest{CompanyId: "c1"})
+
+	publish("e1", "c1", "GR")
+	publish("e2", "c2", "CY")
+
+	e, err := byCode.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "e2", e.EventId)
+	assert.Equal(t, "CY", e.Company.Code)
+
+	e, err = byID.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "e1", e.EventId)
+
+	// resumed after the last event received
+	resumed := watch(&companypb.WatchCompaniesRequest{LastEventId: e.Id})
+	e, err = resumed.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "e2", e.EventId)
+
+	e, err = watch(&companypb.WatchCompaniesRequest{LastEventId: "unknown"}).Recv()
+	assert.NoError(t, err)
+	assert.True(t, e.Resync)
+
+	// ended on shutdown
+	broker.Close()
+	_, err = byCode.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGuard(t *testing.T) {
+	geo, err := client.NewStaticLocator(map[string]string{"127.0.0.1": "GR", "10.0.0.0/8": "CY"})
+	assert.NoError(t, err)
+	clientIP, err := utils.NewClientIPResolver([]string{"127.0.0.1"})
+	assert.NoError(t, err)
+
+	policies, err := policy.NewEngine([]policy.Config{{
+		Name:           "cyprus-only",
+		Methods:        []string{"POST", "DELETE"},
+		Paths:          []string{"/api/v1/companies*"},
+		AllowCountries: []string{"CY"},
+	}}, geo, clientIP)
+	assert.NoError(t, err)
+	limits, err := ratelimit.NewEngine([]ratelimit.Config{{
+		Name:     "writes",
+		Methods:  []string{"POST", "PUT", "DELETE"},
+		Paths:    []string{"/api/v1/companies*"},
+		Requests: 1,
+		Period:   utils.Duration(time.Minute),
+	}}, ratelimit.NewMemoryLimiter(), clientIP)
+	assert.NoError(t, err)
+
+	app := &memApp{companies: map[string]model.Company{}}
+	svc := dialTCP(t, NewServer(app, Options{
+		Policies:   policies,
+		RateLimits: limits,
+		Logger:     logging.New(io.Discard, logging.LevelInfo),
+	}))
+
+	create := func(ctx context.Context, name string) error {
+		_, err := svc.CreateCompany(ctx, &companypb.CreateCompanyRequest{Company: &companypb.Company{
+			Name: name, Code: "CY", Country: "Cyprus"}})
+		return err
+	}
+
+	// the peer, not in Cyprus
+	err = create(context.Background(), "xm")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "got %v", err)
+	_, err = svc.ListCompanies(context.Background(), &companypb.ListCompaniesRequest{})
+	assert.NoError(t, err)
+
+	// a client in Cyprus behind the peer, a trusted proxy
+	cy := metadata.AppendToOutgoingContext(context.Background(), "x-forwarded-for", "10.1.2.3")
+	assert.NoError(t, create(cy, "xm"))
+	err = create(cy, "other")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "got %v", err)
+}
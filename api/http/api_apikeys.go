@@ -0,0 +1,115 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+const (
+	APIKeysURLPrefix = "/api/v1/admin/apikeys/"
+)
+
+type APIKeyHandler struct {
+	Keys store.APIKeyStore
+}
+
+func NewAPIKeyHandler(keys store.APIKeyStore) *APIKeyHandler {
+	return &APIKeyHandler{
+		Keys: keys,
+	}
+}
+
+// apiKeyCreated is the response to a key creation, the only time the
+// plain key is shown
+type apiKeyCreated struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+func parseAPIKeyCreate(r *http.Request) (model.APIKeyCreate, error) {
+	kc := model.APIKeyCreate{}
+
+	//decode body
+	err := json.NewDecoder(r.Body).Decode(&kc)
+	if err != nil {
+		return model.APIKeyCreate{}, errors.Wrap(err, "failed to decode request body")
+	}
+
+	if err := kc.Validate(auth.Scopes); err != nil {
+		return model.APIKeyCreate{}, err
+	}
+
+	return kc, nil
+}
+
+// CreateAPIKeyHandler creates an API key and returns it with the plain key
+func (kh *APIKeyHandler) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	kc, err := parseAPIKeyCreate(r)
+	if err != nil {
+		http.Error(w, "failed to parse the payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, k, err := auth.CreateAPIKey(ctx, kh.Keys, kc)
+	if err != nil {
+		http.Error(w, "failed to create the api key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kJ, err := json.Marshal(&apiKeyCreated{APIKey: *k, Key: key})
+	if err != nil {
+		http.Error(w, "internal server error in creating the api key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(kJ)
+}
+
+// ListAPIKeysHandler lists all API keys, without the keys themselves
+func (kh *APIKeyHandler) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := kh.Keys.ListAPIKeys(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kJ, err := json.Marshal(&keys)
+	if err != nil {
+		http.Error(w, "internal server error in retrieving api keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(kJ)
+}
+
+// RevokeAPIKeyHandler revokes an API key by its id
+func (kh *APIKeyHandler) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, APIKeysURLPrefix)
+	if id == "" {
+		http.Error(w, "id path param is empty", http.StatusBadRequest)
+		return
+	}
+
+	err := kh.Keys.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrAPIKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal server error revoking the api key: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
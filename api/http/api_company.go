@@ -1,15 +1,23 @@
 package http
 
 import (
-	"encoding/json"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	ipapi "github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/api/graphql"
+	"github.com/arpsch/xm/auth"
 	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/health"
+	"github.com/arpsch/xm/idempotency"
+	"github.com/arpsch/xm/metrics"
 	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
 	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/tenant"
 	"github.com/arpsch/xm/utils"
 	"github.com/pkg/errors"
 
@@ -18,24 +26,186 @@ import (
 
 type ApiHandler struct {
 	App comp.CompanyApp
+
+	// version is the API version whose wire format the handlers speak
+	version apiVersion
 }
 
 func NewApiHandler(app comp.CompanyApp) *ApiHandler {
 	return &ApiHandler{
-		App: app,
+		App:     app,
+		version: v1,
 	}
 }
 
-func NewRouter(app comp.CompanyApp) *httprouter.Router {
+// NewApiHandlerV2 returns the handlers of the v2 company API
+func NewApiHandlerV2(app comp.CompanyApp) *ApiHandler {
+	return &ApiHandler{
+		App:     app,
+		version: v2,
+	}
+}
+
+// companyID returns the id of the company route requested
+func (ah *ApiHandler) companyID(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, ah.version.prefix)
+}
+
+// RouterOptions holds the optional parts of the router
+type RouterOptions struct {
+	// Policies are the geo-access policies guarding the routes
+	Policies *policy.Engine
+
+	// RateLimits throttle the clients of the routes
+	RateLimits *ratelimit.Engine
+
+	// Authenticator identifies callers, nil disables authentication
+	Authenticator auth.Authenticator
+
+	// APIKeys enables the API key admin endpoints
+	APIKeys store.APIKeyStore
+
+	// Tenancy scopes the company routes to the caller's tenant
+	Tenancy tenant.Config
+
+	// Idempotency replays the responses to creates retried with the same
+	// Idempotency-Key
+	Idempotency *idempotency.Engine
+
+	// Health enables the /healthz and /readyz probes
+	Health *health.Checker
+
+	// Webhooks enables the webhook subscription endpoints
+	Webhooks store.WebhookStore
+
+	// WebhookInsecureHosts are the hosts the webhooks may reach over plain
+	// http, the others must be https
+	WebhookInsecureHosts []string
+
+	// Stream enables the live streams of the company changes
+	Stream *stream.Broker
+
+	// GraphQL enables the /graphql endpoint
+	GraphQL *graphql.Handler
+
+	// V1Deprecation is the date the v1 company routes were deprecated,
+	// announced in their Deprecation header; DefaultV1Deprecation when zero
+	V1Deprecation time.Time
+
+	// V1Sunset is the date the v1 company routes are retired, announced in
+	// their Sunset header; none when zero
+	V1Sunset time.Time
+}
+
+// NewRouter registers the company API; routes are throttled by the IP-keyed
+// rate limits, require the caller to be authenticated with the route's
+// scope, are throttled by the other rate limits and guarded by the geo-access policies matching them. The company and
+// webhook routes run in the caller's tenant, the admin routes are
+// deployment wide. The v1 company routes are deprecated in favor of v2,
+// whose routes are throttled and guarded as their v1 counterparts. The
+// routes' latencies are exposed on /metrics.
+func NewRouter(app comp.CompanyApp, opts RouterOptions) *httprouter.Router {
 	apiHandler := NewApiHandler(app)
+	apiHandlerV2 := NewApiHandlerV2(app)
 
 	router := httprouter.New()
-	router.HandlerFunc("GET", "/api/v1/companies", apiHandler.ListCompaniesHandler)
-	router.HandlerFunc("GET", "/api/v1/companies/:id", apiHandler.GetCompanyHandler)
+	// guarded wraps the handler of a route guarded and throttled as the
+	// route of guardPath
+	guarded := func(method, path, guardPath, scope string, h http.HandlerFunc) http.HandlerFunc {
+		h = opts.Policies.Middleware(method, guardPath, h)
+		h = opts.RateLimits.Middleware(method, guardPath, h)
+		h = auth.Middleware(opts.Authenticator, scope, h)
+		h = opts.RateLimits.IPMiddleware(method, guardPath, h)
+		return instrument(method, path, h)
+	}
+	// handleAs registers a route guarded and throttled as the route of
+	// guardPath
+	handleAs := func(method, path, guardPath, scope string, h http.HandlerFunc) {
+		router.HandlerFunc(method, path, guarded(method, path, guardPath, scope, h))
+	}
+	handle := func(method, path, scope string, h http.HandlerFunc) {
+		handleAs(method, path, path, scope, h)
+	}
 
-	router.HandlerFunc("POST", "/api/v1/companies", apiHandler.CreateCompanyHandler)
-	router.HandlerFunc("PUT", "/api/v1/companies/:id", apiHandler.UpdateCompanyHandler)
-	router.HandlerFunc("DELETE", "/api/v1/companies/:id", apiHandler.DeleteCompanyHandler)
+	tenanted := func(h http.HandlerFunc) http.HandlerFunc {
+		return tenant.Middleware(opts.Tenancy, h)
+	}
+	v1 := func(h http.HandlerFunc) http.HandlerFunc {
+		return tenanted(deprecated(opts.V1Deprecation, opts.V1Sunset, h))
+	}
+
+	handle("GET", "/api/v1/companies", auth.ScopeCompaniesRead, v1(apiHandler.ListCompaniesHandler))
+	if opts.Stream == nil {
+		handle("GET", "/api/v1/companies/:id", auth.ScopeCompaniesRead, v1(apiHandler.GetCompanyHandler))
+	} else {
+		// httprouter can't register /api/v1/companies/events beside
+		// /api/v1/companies/:id, company ids are never "events"; either
+		// route keeps its own guards
+		getCompany := guarded("GET", "/api/v1/companies/:id", "/api/v1/companies/:id", auth.ScopeCompaniesRead,
+			v1(apiHandler.GetCompanyHandler))
+		streamHandler := NewStreamHandler(app, opts.Stream)
+		companyEvents := guarded("GET", "/api/v1/companies/events", "/api/v1/companies/events",
+			auth.ScopeCompaniesRead, tenanted(streamHandler.CompanyEventsHandler))
+		router.HandlerFunc("GET", "/api/v1/companies/:id", func(w http.ResponseWriter, r *http.Request) {
+			if httprouter.ParamsFromContext(r.Context()).ByName("id") == "events" {
+				companyEvents(w, r)
+				return
+			}
+			getCompany(w, r)
+		})
+
+		wsHandler := NewWSHandler(app, opts.Stream, opts.Policies, opts.RateLimits)
+		handle("GET", "/api/v1/ws", auth.ScopeCompaniesRead, tenanted(wsHandler.SessionHandler))
+	}
+
+	handle("POST", "/api/v1/companies", auth.ScopeCompaniesWrite,
+		v1(opts.Idempotency.Middleware(apiHandler.CreateCompanyHandler)))
+	handle("PUT", "/api/v1/companies/:id", auth.ScopeCompaniesWrite, v1(apiHandler.UpdateCompanyHandler))
+	handle("DELETE", "/api/v1/companies/:id", auth.ScopeCompaniesDelete, v1(apiHandler.DeleteCompanyHandler))
+
+	handleAs("GET", "/api/v2/companies", "/api/v1/companies", auth.ScopeCompaniesRead,
+		tenanted(apiHandlerV2.ListCompaniesHandler))
+	handleAs("GET", "/api/v2/companies/:id", "/api/v1/companies/:id", auth.ScopeCompaniesRead,
+		tenanted(apiHandlerV2.GetCompanyHandler))
+	handleAs("POST", "/api/v2/companies", "/api/v1/companies", auth.ScopeCompaniesWrite,
+		tenanted(opts.Idempotency.Middleware(apiHandlerV2.CreateCompanyHandler)))
+	handleAs("PUT", "/api/v2/companies/:id", "/api/v1/companies/:id", auth.ScopeCompaniesWrite,
+		tenanted(apiHandlerV2.UpdateCompanyHandler))
+	handleAs("DELETE", "/api/v2/companies/:id", "/api/v1/companies/:id", auth.ScopeCompaniesDelete,
+		tenanted(apiHandlerV2.DeleteCompanyHandler))
+
+	if opts.GraphQL != nil {
+		// the fields check the scopes of their routes
+		handle("GET", "/graphql", "", tenanted(opts.GraphQL.ServeHTTP))
+		handle("POST", "/graphql", "", tenanted(opts.GraphQL.ServeHTTP))
+	}
+
+	if opts.APIKeys != nil {
+		keyHandler := NewAPIKeyHandler(opts.APIKeys)
+		handle("POST", "/api/v1/admin/apikeys", auth.ScopeAPIKeysAdmin, keyHandler.CreateAPIKeyHandler)
+		handle("GET", "/api/v1/admin/apikeys", auth.ScopeAPIKeysAdmin, keyHandler.ListAPIKeysHandler)
+		handle("DELETE", "/api/v1/admin/apikeys/:id", auth.ScopeAPIKeysAdmin, keyHandler.RevokeAPIKeyHandler)
+	}
+
+	if opts.Webhooks != nil {
+		hookHandler := NewWebhookHandler(opts.Webhooks, opts.WebhookInsecureHosts)
+		handle("POST", "/api/v1/webhooks", auth.ScopeWebhooks, tenanted(hookHandler.CreateWebhookHandler))
+		handle("GET", "/api/v1/webhooks", auth.ScopeWebhooks, tenanted(hookHandler.ListWebhooksHandler))
+		handle("GET", "/api/v1/webhooks/:id", auth.ScopeWebhooks, tenanted(hookHandler.GetWebhookHandler))
+		handle("PUT", "/api/v1/webhooks/:id", auth.ScopeWebhooks, tenanted(hookHandler.UpdateWebhookHandler))
+		handle("DELETE", "/api/v1/webhooks/:id", auth.ScopeWebhooks, tenanted(hookHandler.DeleteWebhookHandler))
+		handle("GET", "/api/v1/webhooks/:id/deliveries", auth.ScopeWebhooks,
+			tenanted(hookHandler.ListDeliveriesHandler))
+		handle("POST", "/api/v1/webhooks/:id/deliveries/:delivery_id/retry", auth.ScopeWebhooks,
+			tenanted(hookHandler.RetryDeliveryHandler))
+	}
+
+	router.Handler("GET", "/metrics", metrics.Handler())
+
+	if opts.Health != nil {
+		router.HandlerFunc("GET", "/healthz", opts.Health.LivenessHandler)
+		router.HandlerFunc("GET", "/readyz", opts.Health.ReadinessHandler)
+	}
 
 	return router
 }
@@ -51,16 +221,14 @@ const (
 	filterEqOperatorIdx      = 0
 )
 
-const (
-	// CYPRUS_CC is the 2-letter Cyprus country code
-	CYPRUS_CC = "CY"
-)
-
-func parseCompany(r *http.Request) (model.Company, error) {
-	comp := model.Company{}
+// isForbidden tells whether the app denied the operation to the caller
+func isForbidden(err error) bool {
+	return errors.Is(err, comp.ErrForbidden)
+}
 
+func (ah *ApiHandler) parseCompany(r *http.Request) (model.Company, error) {
 	//decode body
-	err := json.NewDecoder(r.Body).Decode(&comp)
+	comp, err := ah.version.decodeCompany(r.Body)
 	if err != nil {
 		return model.Company{}, errors.Wrap(err, "failed to decode request body")
 	}
@@ -72,11 +240,9 @@ func parseCompany(r *http.Request) (model.Company, error) {
 	return comp, nil
 }
 
-func parseCompanyUpdate(r *http.Request) (model.CompanyUpdate, error) {
-	compUp := model.CompanyUpdate{}
-
+func (ah *ApiHandler) parseCompanyUpdate(r *http.Request) (model.CompanyUpdate, error) {
 	//decode body
-	err := json.NewDecoder(r.Body).Decode(&compUp)
+	compUp, err := ah.version.decodeUpdate(r.Body)
 	if err != nil {
 		return model.CompanyUpdate{}, errors.Wrap(err, "failed to decode request body")
 	}
@@ -91,7 +257,6 @@ func parseCompanyUpdate(r *http.Request) (model.CompanyUpdate, error) {
 func parseFilterParams(r *http.Request) ([]store.Filter, error) {
 	knownParams := []string{utils.PageName, utils.PerPageName}
 	filters := make([]store.Filter, 0)
-	var filter store.Filter
 	for name := range r.URL.Query() {
 		if utils.ContainsString(name, knownParams) {
 			continue
@@ -100,65 +265,44 @@ func parseFilterParams(r *http.Request) ([]store.Filter, error) {
 		if err != nil {
 			return nil, err
 		}
-		valueStrArray := strings.Split(valueStr, queryParamValueSeparator)
-		filter = store.Filter{AttrName: name}
-		if len(valueStrArray) == 2 {
-			switch valueStrArray[filterEqOperatorIdx] {
-			case "eq":
-				filter.Operator = store.Eq
-			default:
-				return nil, errors.New("invalid filter operator")
-			}
-			filter.Value = valueStrArray[filterEqOperatorIdx+1]
-		} else {
-			filter.Operator = store.Eq
-			filter.Value = valueStr
-		}
-		floatValue, err := strconv.ParseFloat(filter.Value, 64)
-		if err == nil {
-			filter.ValueFloat = &floatValue
+		filter, err := parseFilter(name, valueStr)
+		if err != nil {
+			return nil, err
 		}
-
 		filters = append(filters, filter)
 	}
 	return filters, nil
 }
 
-func validateClientOriginCountry(r *http.Request) (bool, error) {
-	remoteIP, err := utils.RetrievRemoteIP(r)
-	if err != nil {
-		return false, err
-	}
-
-	country, err := ipapi.IPAPI_GetCountryNameByIP(r.Context(), remoteIP)
-	if err != nil {
-		return false, err
+// parseFilter parses the filter on an attribute, "value" or "op:value"
+func parseFilter(name, valueStr string) (store.Filter, error) {
+	valueStrArray := strings.Split(valueStr, queryParamValueSeparator)
+	filter := store.Filter{AttrName: name}
+	if len(valueStrArray) == 2 {
+		switch valueStrArray[filterEqOperatorIdx] {
+		case "eq":
+			filter.Operator = store.Eq
+		default:
+			return store.Filter{}, errors.New("invalid filter operator")
+		}
+		filter.Value = valueStrArray[filterEqOperatorIdx+1]
+	} else {
+		filter.Operator = store.Eq
+		filter.Value = valueStr
 	}
-
-	if country != CYPRUS_CC {
-		return false, err
+	floatValue, err := strconv.ParseFloat(filter.Value, 64)
+	if err == nil {
+		filter.ValueFloat = &floatValue
 	}
-	return true, nil
+	return filter, nil
 }
 
-// CreateCompanyHandler allows to create a company entry in the DB if the client
-// is making request from Cyprus location.
+// CreateCompanyHandler allows to create a company entry in the DB.
 // Return the entry with ID param added
 func (ah *ApiHandler) CreateCompanyHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	b, err := validateClientOriginCountry(r)
-	if err != nil {
-		http.Error(w, "failed to retrieve client country: "+err.Error(), http.StatusForbidden)
-		return
-	}
-
-	if b == false {
-		http.Error(w, "you're not authorized", http.StatusForbidden)
-		return
-	}
-
-	comp, err := parseCompany(r)
+	comp, err := ah.parseCompany(r)
 	if err != nil {
 		http.Error(w, "failed to parse the payload: "+err.Error(), http.StatusBadRequest)
 		return
@@ -166,21 +310,26 @@ func (ah *ApiHandler) CreateCompanyHandler(w http.ResponseWriter, r *http.Reques
 
 	id, err := ah.App.CreateCompany(ctx, comp)
 	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if errors.Is(store.ErrCompanyExists, err) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), ah.version.exists)
 			return
 		}
 		http.Error(w, "failed to create the company entry: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	comp.ID = id
-	cJ, err := json.Marshal(&comp)
-	if err != nil {
-		http.Error(w, "internal server error in creating the db", http.StatusInternalServerError)
-		return
+	if ah.version.stored {
+		if stored, err := ah.App.GetCompany(ctx, id); err == nil {
+			comp = *stored
+		}
+		w.Header().Set("Location", ah.version.prefix+id)
 	}
 
-	w.Write(cJ)
+	writeJSON(w, ah.version.created, ah.version.company(&comp))
 }
 
 // ListCompaniesHandler fetches the all companies in the db.
@@ -200,6 +349,9 @@ func (ah *ApiHandler) ListCompaniesHandler(w http.ResponseWriter, r *http.Reques
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	for i := range filters {
+		filters[i].AttrName = ah.version.attribute(filters[i].AttrName)
+	}
 
 	ld := store.ListQuery{Skip: int((page - 1) * perPage),
 		Limit:   int(perPage),
@@ -208,6 +360,10 @@ func (ah *ApiHandler) ListCompaniesHandler(w http.ResponseWriter, r *http.Reques
 
 	companies, totalCount, err := ah.App.ListCompanies(ctx, ld)
 	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -218,13 +374,7 @@ func (ah *ApiHandler) ListCompaniesHandler(w http.ResponseWriter, r *http.Reques
 		w.Header().Add("Link", l)
 	}
 
-	cJ, err := json.Marshal(&companies)
-	if err != nil {
-		http.Error(w, "internal server error in retrieving companies", http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(cJ)
+	writeJSON(w, http.StatusOK, ah.version.list(companies, totalCount, page, perPage))
 }
 
 // GetCompanyHandler fetches a particular company information based on
@@ -233,7 +383,7 @@ func (ah *ApiHandler) GetCompanyHandler(w http.ResponseWriter, r *http.Request)
 
 	ctx := r.Context()
 
-	id := utils.ParsePathParamId(r)
+	id := ah.companyID(r)
 	if id == "" {
 		http.Error(w, "id path param is empty", http.StatusBadRequest)
 		return
@@ -241,8 +391,12 @@ func (ah *ApiHandler) GetCompanyHandler(w http.ResponseWriter, r *http.Request)
 
 	comp, err := ah.App.GetCompany(ctx, id)
 	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if errors.Is(store.ErrCompanyNotFound, err) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), ah.version.notFound)
 			return
 		}
 
@@ -251,27 +405,20 @@ func (ah *ApiHandler) GetCompanyHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	cJ, err := json.Marshal(&comp)
-	if err != nil {
-		http.Error(w, "internal server error in retrieving company: "+err.Error(),
-			http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(cJ)
+	writeJSON(w, http.StatusOK, ah.version.company(comp))
 }
 
 // UpdateCompanyHandler updates the allowed fields for a selected company by its id
 func (ah *ApiHandler) UpdateCompanyHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	id := utils.ParsePathParamId(r)
+	id := ah.companyID(r)
 	if id == "" {
 		http.Error(w, "id path param is empty", http.StatusBadRequest)
 		return
 	}
 
-	compUp, err := parseCompanyUpdate(r)
+	compUp, err := ah.parseCompanyUpdate(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -279,8 +426,12 @@ func (ah *ApiHandler) UpdateCompanyHandler(w http.ResponseWriter, r *http.Reques
 
 	err = ah.App.UpdateCompany(ctx, id, compUp)
 	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if errors.Is(store.ErrCompanyNotFound, err) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), ah.version.notFound)
 			return
 		}
 
@@ -289,33 +440,39 @@ func (ah *ApiHandler) UpdateCompanyHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-}
-
-// DeleteCompanyHandler deletes a company information by the given id.
-// But the caller must be calling from Cyprus to delete a company information
-func (ah *ApiHandler) DeleteCompanyHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	b, err := validateClientOriginCountry(r)
-	if err != nil {
-		http.Error(w, "failed to retrieve client country: "+err.Error(), http.StatusForbidden)
+	if !ah.version.stored {
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
-
-	if b == false {
-		http.Error(w, "you're not authorized", http.StatusForbidden)
+	comp, err := ah.App.GetCompany(ctx, id)
+	if err != nil {
+		http.Error(w, "internal server error in retrieving the company: "+err.Error(),
+			http.StatusInternalServerError)
 		return
 	}
+	writeJSON(w, http.StatusOK, ah.version.company(comp))
+}
 
-	id := utils.ParsePathParamId(r)
+// DeleteCompanyHandler deletes a company information by the given id
+func (ah *ApiHandler) DeleteCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id := ah.companyID(r)
 	if id == "" {
 		http.Error(w, "id path param is empty", http.StatusBadRequest)
 		return
 	}
 
-	err = ah.App.DeleteCompany(ctx, id)
+	err := ah.App.DeleteCompany(ctx, id)
 	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(store.ErrCompanyNotFound, err) {
+			http.Error(w, err.Error(), ah.version.notFound)
+			return
+		}
 		http.Error(w, "internal server error deleting the company: "+err.Error(),
 			http.StatusInternalServerError)
 		return
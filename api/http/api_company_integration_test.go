@@ -14,7 +14,10 @@ import (
 	"testing"
 
 	api_http "github.com/arpsch/xm/api/http"
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/client/ipapitest"
 	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
 	"github.com/arpsch/xm/store/mongo"
 	"github.com/pkg/errors"
 )
@@ -22,6 +25,13 @@ import (
 var ah *api_http.ApiHandler
 var ds *mongo.MongoStore
 
+// ipapiSrv stands in for ipapi.co
+var ipapiSrv *ipapitest.Server
+
+// createCompany and deleteCompany are the handlers guarded by the
+// cyprus-only policy
+var createCompany, deleteCompany http.HandlerFunc
+
 func testSetup() error {
 	var err error
 
@@ -42,8 +52,32 @@ func testSetup() error {
 		return err
 	}
 
+	ipapiSrv = ipapitest.NewServer(map[string]string{
+		"185.193.151.255": "CY",
+	})
+	geo, err := client.NewGeoLocator(client.GeoLocatorConfig{
+		Provider: client.ProviderIPAPI,
+		IPAPIURL: ipapiSrv.URL(),
+	})
+	if err != nil {
+		return err
+	}
+
 	ah = api_http.NewApiHandler(ds)
 
+	policies, err := policy.NewEngine([]policy.Config{
+		{
+			Name:           "cyprus-only-writes",
+			Methods:        []string{http.MethodPost, http.MethodDelete},
+			AllowCountries: []string{"CY"},
+		},
+	}, geo, nil)
+	if err != nil {
+		return err
+	}
+	createCompany = policies.Middleware(http.MethodPost, "/api/v1/companies", ah.CreateCompanyHandler)
+	deleteCompany = policies.Middleware(http.MethodDelete, "/api/v1/companies/:id", ah.DeleteCompanyHandler)
+
 	return nil
 }
 
@@ -54,6 +88,7 @@ func testTeardown() error {
 		return err
 	}
 	ds.Close(ctx)
+	ipapiSrv.Close()
 	return nil
 }
 
@@ -197,10 +232,10 @@ func TestCreateCompany(t *testing.T) {
 					t.Fatalf("Could not create a prep request %v", err)
 				}
 
-				ah.CreateCompanyHandler(recPrep, reqPrep)
+				createCompany(recPrep, reqPrep)
 			}
 
-			ah.CreateCompanyHandler(rec, req)
+			createCompany(rec, req)
 
 			if rec.Code != tc.statusCode {
 				b, _ := ioutil.ReadAll(rec.Body)
@@ -378,7 +413,7 @@ func TestGetCompanies(t *testing.T) {
 					t.Fatalf("Could not create a prep request %v", err)
 				}
 
-				ah.CreateCompanyHandler(recPrep, reqPrep)
+				createCompany(recPrep, reqPrep)
 			}
 
 			ah.ListCompaniesHandler(rec, req)
@@ -471,7 +506,7 @@ func TestGetCompany(t *testing.T) {
 					t.Fatalf("Could not create a prep request %v", err)
 				}
 
-				ah.CreateCompanyHandler(recPrep, reqPrep)
+				createCompany(recPrep, reqPrep)
 			}
 
 			ah.ListCompaniesHandler(rec, req)
@@ -576,7 +611,7 @@ func TestUpdateCompany(t *testing.T) {
 					t.Fatalf("Could not create a prep request %v", err)
 				}
 
-				ah.CreateCompanyHandler(recPrep, reqPrep)
+				createCompany(recPrep, reqPrep)
 			}
 
 			ah.UpdateCompanyHandler(rec, req)
@@ -687,11 +722,11 @@ func TestDeleteCompany(t *testing.T) {
 					t.Fatalf("Could not create a prep request %v", err)
 				}
 
-				ah.CreateCompanyHandler(recPrep, reqPrep)
+				createCompany(recPrep, reqPrep)
 			}
 
 			req.RemoteAddr = tc.OriginIP
-			ah.DeleteCompanyHandler(rec, req)
+			deleteCompany(rec, req)
 
 			if rec.Code != tc.statusCode {
 				b, _ := ioutil.ReadAll(rec.Body)
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/stream"
+)
+
+const (
+	HdrLastEventID = "Last-Event-ID"
+
+	// eventReset tells a resuming client it missed events, to reload the
+	// companies
+	eventReset = "reset"
+
+	// sseRetry is the reconnection delay suggested to the clients
+	sseRetry = 3 * time.Second
+)
+
+type StreamHandler struct {
+	App    comp.CompanyApp
+	Broker *stream.Broker
+}
+
+func NewStreamHandler(app comp.CompanyApp, broker *stream.Broker) *StreamHandler {
+	return &StreamHandler{
+		App:    app,
+		Broker: broker,
+	}
+}
+
+// writeSSE writes a message of the event stream
+func writeSSE(w io.Writer, id, event string, data []byte) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// CompanyEventsHandler streams the company changes as Server-Sent Events,
+// narrowed by the filters of the list. A client reconnecting with the
+// Last-Event-ID it got resumes the stream, or gets a reset event when the
+// events since are no longer kept. Idle streams get a comment as a
+// heartbeat.
+func (sh *StreamHandler) CompanyEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := logging.FromContext(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filters, err := parseFilterParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, err := stream.NewVisibility(ctx, sh.App, filters)
+	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get(HdrLastEventID)
+	sub, replay, complete := sh.Broker.Subscribe(lastID)
+	defer sub.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	// no buffering by nginx like proxies
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if !complete {
+		writeSSE(w, "", eventReset, []byte("{}"))
+	}
+
+	send := func(m stream.Message) error {
+		if !v.Visible(m.Event) {
+			return nil
+		}
+		data, err := json.Marshal(m.Event)
+		if err != nil {
+			return err
+		}
+		return writeSSE(w, m.ID, m.Event.Type, data)
+	}
+
+	for _, m := range replay {
+		if err := send(m); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sh.Broker.Heartbeat())
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case m, ok := <-sub.C():
+			if !ok {
+				if err := sub.Err(); errors.Is(err, stream.ErrSlowConsumer) {
+					l.Info("stream: dropped a slow subscriber")
+				}
+				// the client reconnects with its Last-Event-ID
+				return
+			}
+			if err := send(m); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
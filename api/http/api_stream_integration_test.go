@@ -0,0 +1,108 @@
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	api_http "github.com/arpsch/xm/api/http"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/utils"
+)
+
+// sseMessage is a message of an event stream
+type sseMessage struct {
+	id, event, data string
+}
+
+// readSSE reads the next message, skipping the comments
+func readSSE(t *testing.T, r *bufio.Reader) sseMessage {
+	var m sseMessage
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return m
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if m.event != "" {
+				return m
+			}
+		case strings.HasPrefix(line, "id: "):
+			m.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			m.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			m.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestCompanyEventsStream(t *testing.T) {
+	broker := stream.NewBroker(stream.Config{Heartbeat: utils.Duration(50 * time.Millisecond)})
+	srv := httptest.NewServer(api_http.NewRouter(ds, api_http.RouterOptions{Stream: broker}))
+	defer srv.Close()
+
+	publish := func(id, typ, code string) {
+		c := model.Company{ID: "c-" + id, Name: id, Code: code}
+		e := model.Event{ID: id, Type: typ, CompanyID: c.ID}
+		switch typ {
+		case model.EventCompanyCreated:
+			e.Created = &model.CompanyCreated{Company: c}
+		case model.EventCompanyDeleted:
+			e.Deleted = &model.CompanyDeleted{Company: c}
+		}
+		broker.Handle(context.Background(), e)
+	}
+
+	subscribe := func(lastID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/companies/events?code=CY", nil)
+		if lastID != "" {
+			req.Header.Set(api_http.HdrLastEventID, lastID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		return res, bufio.NewReader(res.Body)
+	}
+
+	res, r := subscribe("")
+	publish("1", model.EventCompanyCreated, "GR")
+	publish("2", model.EventCompanyCreated, "CY")
+	publish("3", model.EventCompanyDeleted, "CY")
+
+	// filtered
+	m := readSSE(t, r)
+	assert.Equal(t, model.EventCompanyCreated, m.event)
+	assert.Contains(t, m.data, `"id":"2"`)
+	res.Body.Close()
+
+	// resumed after the last event received
+	res, r = subscribe(m.id)
+	m = readSSE(t, r)
+	assert.Equal(t, model.EventCompanyDeleted, m.event)
+	assert.Contains(t, m.data, `"id":"3"`)
+	res.Body.Close()
+
+	// the events since are unknown
+	res, r = subscribe("unknown")
+	m = readSSE(t, r)
+	assert.Equal(t, "reset", m.event)
+
+	// ended on shutdown
+	broker.Close()
+	_, err := r.ReadString('\n')
+	for err == nil {
+		_, err = r.ReadString('\n')
+	}
+	res.Body.Close()
+}
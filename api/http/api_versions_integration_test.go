@@ -0,0 +1,163 @@
+package http_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	api_http "github.com/arpsch/xm/api/http"
+	"github.com/arpsch/xm/model"
+)
+
+func TestAPIVersions(t *testing.T) {
+	deprecation := time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(api_http.NewRouter(ds, api_http.RouterOptions{
+		V1Deprecation: deprecation,
+		V1Sunset:      sunset,
+	}))
+	defer srv.Close()
+	defer ds.DropDatabase(context.Background())
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := do(http.MethodPost, "/api/v2/companies",
+		`{"name": "xm", "code": "CY", "country": "Cyprus", "phone": "+35722111111"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Empty(t, res.Header.Get(api_http.HdrDeprecation))
+
+	var created map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	id, _ := created["id"].(string)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "/api/v2/companies/"+id, res.Header.Get("Location"))
+	assert.Equal(t, "Cyprus", created["country"])
+	assert.Contains(t, created, "created_at")
+	assert.NotContains(t, created, "crated_ts")
+
+	tt := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+
+		status int
+		// contains are fragments of the body
+		contains []string
+	}{
+		{
+			name:   "v2 duplicate",
+			method: http.MethodPost, path: "/api/v2/companies",
+			body:   `{"name": "xm", "code": "CY", "country": "Cyprus"}`,
+			status: http.StatusConflict,
+		},
+		{
+			name:   "v2 server managed field",
+			method: http.MethodPost, path: "/api/v2/companies",
+			body:   `{"id": "1", "name": "other", "code": "CY", "country": "Cyprus"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "v2 get",
+			method: http.MethodGet, path: "/api/v2/companies/" + id,
+			status:   http.StatusOK,
+			contains: []string{`"country":"Cyprus"`, `"created_at"`},
+		},
+		{
+			name:   "v2 list",
+			method: http.MethodGet, path: "/api/v2/companies?code=CY",
+			status:   http.StatusOK,
+			contains: []string{`"total":1`, `"page":1`, `"per_page":20`, `"companies":[{`},
+		},
+		{
+			name:   "v2 update",
+			method: http.MethodPut, path: "/api/v2/companies/" + id,
+			body:     `{"phone": "+35722222222"}`,
+			status:   http.StatusOK,
+			contains: []string{`"phone":"+35722222222"`},
+		},
+		{
+			name:   "v2 missing",
+			method: http.MethodGet, path: "/api/v2/companies/000000000000000000000000",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "v1 get",
+			method: http.MethodGet, path: "/api/v1/companies/" + id,
+			status:   http.StatusOK,
+			contains: []string{`"Country":"Cyprus"`, `"crated_ts"`},
+		},
+		{
+			name:   "v1 list",
+			method: http.MethodGet, path: "/api/v1/companies?code=CY",
+			status:   http.StatusOK,
+			contains: []string{`[{`},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			res, body := do(tc.method, tc.path, tc.body)
+			assert.Equal(t, tc.status, res.StatusCode, body)
+			for _, s := range tc.contains {
+				assert.Contains(t, body, s)
+			}
+
+			if strings.HasPrefix(tc.path, "/api/v1/") {
+				assert.Equal(t, "@1793491200", res.Header.Get(api_http.HdrDeprecation))
+				assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", res.Header.Get(api_http.HdrSunset))
+				assert.Contains(t, res.Header.Get("Link"),
+					`<`+strings.Replace(res.Request.URL.Path, "v1", "v2", 1)+`>; rel="successor-version"`)
+			} else {
+				assert.Empty(t, res.Header.Get(api_http.HdrDeprecation))
+			}
+		})
+	}
+
+	res, _ = do(http.MethodDelete, "/api/v2/companies/"+id, "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestAPIVersionsActors(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(api_http.NewRouter(ds, api_http.RouterOptions{}))
+	defer srv.Close()
+	defer ds.DropDatabase(ctx)
+
+	id, err := ds.CreateCompany(ctx, model.Company{Name: "audited", Code: "CY", Country: "Cyprus",
+		CreatedBy: "jwt:alice", UpdatedBy: "jwt:alice"})
+	assert.NoError(t, err)
+
+	get := func(path string) string {
+		res, err := http.Get(srv.URL + path)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		b, _ := ioutil.ReadAll(res.Body)
+		return string(b)
+	}
+
+	// v1 keeps its format, the actors are v2 only
+	body := get("/api/v1/companies/" + id)
+	assert.NotContains(t, body, "created_by")
+	assert.NotContains(t, body, "tenant_id")
+	assert.Contains(t, get("/api/v2/companies/"+id), `"created_by":"jwt:alice"`)
+}
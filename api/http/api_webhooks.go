@@ -0,0 +1,211 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/utils"
+	"github.com/arpsch/xm/webhook"
+)
+
+const (
+	queryParamStatus = "status"
+)
+
+type WebhookHandler struct {
+	Webhooks store.WebhookStore
+
+	// InsecureHosts are the hosts the webhooks may reach over plain http
+	InsecureHosts []string
+}
+
+func NewWebhookHandler(hooks store.WebhookStore, insecureHosts []string) *WebhookHandler {
+	return &WebhookHandler{
+		Webhooks:      hooks,
+		InsecureHosts: insecureHosts,
+	}
+}
+
+// webhookCreated is the response to a webhook creation, the only time the
+// secret is shown
+type webhookCreated struct {
+	model.Webhook
+	Secret string `json:"secret"`
+}
+
+// storeError answers the errors of the webhook store
+func storeError(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, store.ErrWebhookNotFound) || errors.Is(err, store.ErrDeliveryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, msg+": "+err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "internal server error in encoding the response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// CreateWebhookHandler subscribes a URL to the company events of the
+// tenant and returns the webhook with its secret
+func (wh *WebhookHandler) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wc := model.WebhookCreate{}
+	if err := json.NewDecoder(r.Body).Decode(&wc); err != nil {
+		http.Error(w, "failed to decode request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wc.InsecureHosts = wh.InsecureHosts
+	if err := wc.Validate(); err != nil {
+		http.Error(w, "failed to parse the payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wc.Secret == "" {
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		wc.Secret = secret
+	}
+
+	hook := model.Webhook{
+		URL:        wc.URL,
+		EventTypes: wc.EventTypes,
+		Secret:     wc.Secret,
+	}
+	id, err := wh.Webhooks.CreateWebhook(r.Context(), hook)
+	if err != nil {
+		storeError(w, "failed to create the webhook", err)
+		return
+	}
+
+	created, err := wh.Webhooks.GetWebhook(r.Context(), id)
+	if err != nil {
+		storeError(w, "failed to fetch the created webhook", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &webhookCreated{Webhook: *created, Secret: created.Secret})
+}
+
+// ListWebhooksHandler lists the webhooks of the tenant, without secrets
+func (wh *WebhookHandler) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := wh.Webhooks.ListWebhooks(r.Context())
+	if err != nil {
+		storeError(w, "failed to list the webhooks", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &hooks)
+}
+
+// GetWebhookHandler fetches a webhook by its id
+func (wh *WebhookHandler) GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	hook, err := wh.Webhooks.GetWebhook(r.Context(), id)
+	if err != nil {
+		storeError(w, "failed to fetch the webhook", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// UpdateWebhookHandler replaces the URL and event types of a webhook and,
+// if given, its secret
+func (wh *WebhookHandler) UpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	wu := model.WebhookUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&wu); err != nil {
+		http.Error(w, "failed to decode request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wu.InsecureHosts = wh.InsecureHosts
+	if err := wu.Validate(); err != nil {
+		http.Error(w, "failed to parse the payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := wh.Webhooks.UpdateWebhook(r.Context(), id, wu); err != nil {
+		storeError(w, "failed to update the webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteWebhookHandler deletes a webhook along with its deliveries
+func (wh *WebhookHandler) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	if err := wh.Webhooks.DeleteWebhook(r.Context(), id); err != nil {
+		storeError(w, "failed to delete the webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveriesHandler is the delivery log of a webhook, latest first;
+// ?status=dead lists its dead letters
+func (wh *WebhookHandler) ListDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := httprouter.ParamsFromContext(ctx).ByName("id")
+
+	page, perPage, err := utils.ParsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get(queryParamStatus)
+	switch status {
+	case "", model.DeliveryPending, model.DeliveryDelivered, model.DeliveryDead:
+	default:
+		http.Error(w, "invalid status "+status, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := wh.Webhooks.GetWebhook(ctx, id); err != nil {
+		storeError(w, "failed to fetch the webhook", err)
+		return
+	}
+
+	// one more, to tell whether there's a next page
+	deliveries, err := wh.Webhooks.ListDeliveries(ctx, id, status,
+		int((page-1)*perPage), int(perPage)+1)
+	if err != nil {
+		storeError(w, "failed to list the deliveries", err)
+		return
+	}
+
+	hasNext := len(deliveries) > int(perPage)
+	if hasNext {
+		deliveries = deliveries[:perPage]
+	}
+	for _, l := range utils.MakePageLinkHdrs(r, page, perPage, hasNext) {
+		w.Header().Add("Link", l)
+	}
+	writeJSON(w, http.StatusOK, &deliveries)
+}
+
+// RetryDeliveryHandler queues a dead letter for delivery again
+func (wh *WebhookHandler) RetryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	err := wh.Webhooks.RetryDelivery(r.Context(), params.ByName("id"), params.ByName("delivery_id"))
+	if err != nil {
+		storeError(w, "failed to retry the delivery", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,458 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/utils"
+)
+
+// WebSocket request types
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsGet         = "get"
+	wsList        = "list"
+)
+
+// WebSocket message types sent to the clients
+const (
+	wsResult = "result"
+	wsError  = "error"
+	wsEvent  = "event"
+)
+
+const (
+	wsMaxMessageLen    = 64 << 10
+	wsMaxSubscriptions = 100
+	wsWriteTimeout     = 10 * time.Second
+
+	// close code of the clients which fell behind
+	wsCloseSlowConsumer = 4000
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsRequest is a request of a client; ID is echoed in the answer
+type wsRequest struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+
+	// CompanyID is the company to get, or to subscribe to
+	CompanyID string `json:"company_id,omitempty"`
+	// Filters narrow a list or a subscription, as the query parameters of
+	// the list endpoint, e.g. {"code": "eq:CY"}
+	Filters map[string]string `json:"filters,omitempty"`
+
+	Page    uint64 `json:"page,omitempty"`
+	PerPage uint64 `json:"per_page,omitempty"`
+
+	// Subscription is the subscription to cancel
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// wsMessage is an answer to a request, or an event of a subscription
+type wsMessage struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+
+	Subscription string       `json:"subscription,omitempty"`
+	Result       interface{}  `json:"result,omitempty"`
+	Total        *int         `json:"total,omitempty"`
+	Event        *model.Event `json:"event,omitempty"`
+
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// wsSubscription selects the events of a company, or of the companies
+// matching filters
+type wsSubscription struct {
+	companyID string
+	filters   []store.Filter
+}
+
+func (s wsSubscription) matches(e model.Event) bool {
+	if s.companyID != "" {
+		return e.CompanyID == s.companyID
+	}
+	return store.Matches(s.filters, e.Company())
+}
+
+type WSHandler struct {
+	App        comp.CompanyApp
+	Broker     *stream.Broker
+	Policies   *policy.Engine
+	RateLimits *ratelimit.Engine
+}
+
+// NewWSHandler returns the WebSocket API handler; the gets and lists are
+// throttled and guarded as the requests to their v1 routes, nil engines
+// applying none
+func NewWSHandler(app comp.CompanyApp, broker *stream.Broker, policies *policy.Engine, limits *ratelimit.Engine) *WSHandler {
+	return &WSHandler{
+		App:        app,
+		Broker:     broker,
+		Policies:   policies,
+		RateLimits: limits,
+	}
+}
+
+// wsRoutes are the HTTP routes of the requests, whose rate limits and
+// geo-access policies apply to them
+var wsRoutes = map[string]struct{ method, path string }{
+	wsGet:  {http.MethodGet, "/api/v1/companies/:id"},
+	wsList: {http.MethodGet, "/api/v1/companies"},
+}
+
+// wsSession is the state of a WebSocket connection
+type wsSession struct {
+	app  comp.CompanyApp
+	conn *websocket.Conn
+	v    *stream.Visibility
+	l    *logging.Logger
+
+	// r is the upgrade request, the requests are checked as
+	r          *http.Request
+	policies   *policy.Engine
+	rateLimits *ratelimit.Engine
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// out queues the messages to the writer; a client which doesn't read
+	// them fast enough is disconnected
+	out chan wsMessage
+
+	mu   sync.Mutex
+	seq  int
+	subs map[string]wsSubscription
+	// closeCode and closeText are sent when the session ends
+	closeCode int
+	closeText string
+}
+
+// SessionHandler serves the WebSocket API: the caller, authenticated by
+// the upgrade request, subscribes to companies or filters to get their
+// changes, and gets or lists companies, over JSON messages. Requests carry
+// an id echoed in their answer. A client falling behind the events is
+// disconnected.
+func (wh *WSHandler) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	// the request context isn't canceled once the connection is hijacked
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	v, err := stream.NewVisibility(ctx, wh.App, nil)
+	if err != nil {
+		if isForbidden(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the upgrader answers the failures
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s := &wsSession{
+		app:  wh.App,
+		conn: conn,
+		v:    v,
+		l:    logging.FromContext(ctx),
+
+		r:          r.WithContext(ctx),
+		policies:   wh.Policies,
+		rateLimits: wh.RateLimits,
+
+		ctx:    ctx,
+		cancel: cancel,
+		out:    make(chan wsMessage, stream.DefaultBufferSize),
+		subs:   map[string]wsSubscription{},
+	}
+	s.run(wh.Broker)
+}
+
+func (s *wsSession) run(broker *stream.Broker) {
+	sub, _, _ := broker.Subscribe("")
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.write(broker.Heartbeat())
+	}()
+	go func() {
+		defer wg.Done()
+		s.pump(sub)
+	}()
+
+	s.read(broker.Heartbeat())
+	s.cancel()
+	wg.Wait()
+	s.conn.Close()
+}
+
+// end ends the session with the close code
+func (s *wsSession) end(code int, text string) {
+	s.mu.Lock()
+	if s.closeCode == 0 {
+		s.closeCode, s.closeText = code, text
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// send queues a message, waiting for room unless it's an event
+func (s *wsSession) send(m wsMessage) {
+	if m.Type == wsEvent {
+		select {
+		case s.out <- m:
+		default:
+			s.l.Info("websocket: dropped a slow client")
+			s.end(wsCloseSlowConsumer, "too slow, resubscribe")
+		}
+		return
+	}
+
+	select {
+	case s.out <- m:
+	case <-s.ctx.Done():
+	}
+}
+
+// write writes the queued messages and pings the client
+func (s *wsSession) write(heartbeat time.Duration) {
+	ping := time.NewTicker(heartbeat)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			code, text := s.closeCode, s.closeText
+			s.mu.Unlock()
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text),
+				time.Now().Add(wsWriteTimeout))
+			return
+
+		case m := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.conn.WriteJSON(m); err != nil {
+				s.cancel()
+				return
+			}
+
+		case <-ping.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				s.cancel()
+				return
+			}
+		}
+	}
+}
+
+// pump sends the events visible to the client to its subscriptions
+func (s *wsSession) pump(sub *stream.Subscription) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case m, ok := <-sub.C():
+			if !ok {
+				if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+					s.end(wsCloseSlowConsumer, "too slow, resubscribe")
+				} else {
+					s.end(websocket.CloseGoingAway, "server shutting down")
+				}
+				return
+			}
+			if !s.v.Visible(m.Event) {
+				continue
+			}
+
+			s.mu.Lock()
+			var ids []string
+			for id, ws := range s.subs {
+				if ws.matches(m.Event) {
+					ids = append(ids, id)
+				}
+			}
+			s.mu.Unlock()
+
+			for _, id := range ids {
+				e := m.Event
+				s.send(wsMessage{Type: wsEvent, Subscription: id, Event: &e})
+			}
+		}
+	}
+}
+
+// read serves the requests of the client until it leaves
+func (s *wsSession) read(heartbeat time.Duration) {
+	s.conn.SetReadLimit(wsMaxMessageLen)
+	// the client answers the pings
+	deadline := func() time.Time { return time.Now().Add(2 * heartbeat) }
+	s.conn.SetReadDeadline(deadline())
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(deadline())
+	})
+
+	reqs := make(chan wsRequest)
+	go func() {
+		defer close(reqs)
+		for {
+			var req wsRequest
+			if err := s.conn.ReadJSON(&req); err != nil {
+				// the message was read, the connection is fine
+				var syntaxErr *json.SyntaxError
+				var typeErr *json.UnmarshalTypeError
+				if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+					return
+				}
+				s.send(wsMessage{Type: wsError, Error: "invalid message: " + err.Error(),
+					Status: http.StatusBadRequest})
+				continue
+			}
+			s.conn.SetReadDeadline(deadline())
+			select {
+			case reqs <- req:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case req, ok := <-reqs:
+			if !ok {
+				s.cancel()
+				return
+			}
+			s.send(s.serve(req))
+		}
+	}
+}
+
+// serve answers a request
+func (s *wsSession) serve(req wsRequest) wsMessage {
+	fail := func(status int, err error) wsMessage {
+		return wsMessage{ID: req.ID, Type: wsError, Error: err.Error(), Status: status}
+	}
+
+	if rt, ok := wsRoutes[req.Type]; ok {
+		if err := s.rateLimits.Check(s.r, rt.method, rt.path); err != nil {
+			if errors.Is(err, ratelimit.ErrLimited) {
+				return fail(http.StatusTooManyRequests, err)
+			}
+			return fail(http.StatusForbidden, err)
+		}
+		if err := s.policies.Check(s.r, rt.method, rt.path); err != nil {
+			return fail(http.StatusForbidden, err)
+		}
+	}
+
+	filters := []store.Filter{}
+	for name, value := range req.Filters {
+		f, err := parseFilter(name, value)
+		if err != nil {
+			return fail(http.StatusBadRequest, err)
+		}
+		filters = append(filters, f)
+	}
+
+	switch req.Type {
+	case wsSubscribe:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.subs) >= wsMaxSubscriptions {
+			return fail(http.StatusTooManyRequests, errors.New("too many subscriptions"))
+		}
+		s.seq++
+		id := "s" + strconv.Itoa(s.seq)
+		s.subs[id] = wsSubscription{companyID: req.CompanyID, filters: filters}
+		return wsMessage{ID: req.ID, Type: wsResult, Subscription: id}
+
+	case wsUnsubscribe:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[req.Subscription]; !ok {
+			return fail(http.StatusNotFound, errors.New("unknown subscription "+req.Subscription))
+		}
+		delete(s.subs, req.Subscription)
+		return wsMessage{ID: req.ID, Type: wsResult, Subscription: req.Subscription}
+
+	case wsGet:
+		if req.CompanyID == "" {
+			return fail(http.StatusBadRequest, errors.New("company_id is empty"))
+		}
+		c, err := s.app.GetCompany(s.ctx, req.CompanyID)
+		if err != nil {
+			return fail(appErrorStatus(err), err)
+		}
+		return wsMessage{ID: req.ID, Type: wsResult, Result: c}
+
+	case wsList:
+		page, perPage := req.Page, req.PerPage
+		if page < utils.PageMin {
+			page = utils.PageDefault
+		}
+		if perPage < utils.PerPageMin {
+			perPage = utils.PerPageDefault
+		}
+		if perPage > utils.PerPageMax {
+			return fail(http.StatusBadRequest, errors.New("per_page too large"))
+		}
+		companies, total, err := s.app.ListCompanies(s.ctx, store.ListQuery{
+			Skip:    int((page - 1) * perPage),
+			Limit:   int(perPage),
+			Filters: filters,
+		})
+		if err != nil {
+			return fail(appErrorStatus(err), err)
+		}
+		return wsMessage{ID: req.ID, Type: wsResult, Result: companies, Total: &total}
+	}
+
+	return fail(http.StatusBadRequest, errors.New("unknown request type "+req.Type))
+}
+
+// appErrorStatus is the HTTP status matching an error of the app
+func appErrorStatus(err error) int {
+	switch {
+	case isForbidden(err):
+		return http.StatusForbidden
+	case errors.Is(err, store.ErrCompanyNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
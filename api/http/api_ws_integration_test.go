@@ -0,0 +1,157 @@
+package http_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	api_http "github.com/arpsch/xm/api/http"
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/utils"
+)
+
+// wsMessage is a message of the WebSocket API
+type wsMessage struct {
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	Subscription string       `json:"subscription"`
+	Result       interface{}  `json:"result"`
+	Total        *int         `json:"total"`
+	Event        *model.Event `json:"event"`
+	Error        string       `json:"error"`
+	Status       int          `json:"status"`
+}
+
+func TestWebSocket(t *testing.T) {
+	ctx := context.Background()
+
+	id, err := ds.CreateCompany(ctx, model.Company{Name: "ws", Code: "CY", Country: "Cyprus"})
+	assert.NoError(t, err)
+
+	broker := stream.NewBroker(stream.Config{})
+	srv := httptest.NewServer(api_http.NewRouter(ds, api_http.RouterOptions{Stream: broker}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	call := func(req map[string]interface{}) wsMessage {
+		assert.NoError(t, conn.WriteJSON(req))
+		var m wsMessage
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(t, conn.ReadJSON(&m))
+		assert.Equal(t, req["id"], m.ID)
+		return m
+	}
+	publish := func(eventID, companyID, code string) {
+		broker.Handle(ctx, model.Event{ID: eventID, Type: model.EventCompanyCreated, CompanyID: companyID,
+			Created: &model.CompanyCreated{Company: model.Company{ID: companyID, Code: code}}})
+	}
+
+	m := call(map[string]interface{}{"id": "1", "type": "get", "company_id": id})
+	assert.Equal(t, "result", m.Type)
+	assert.Equal(t, "ws", m.Result.(map[string]interface{})["name"])
+
+	m = call(map[string]interface{}{"id": "2", "type": "get", "company_id": "missing"})
+	assert.Equal(t, "error", m.Type)
+	assert.Equal(t, 404, m.Status)
+
+	m = call(map[string]interface{}{"id": "3", "type": "list", "filters": map[string]string{"name": "ws"}})
+	assert.Equal(t, "result", m.Type)
+	assert.Equal(t, 1, *m.Total)
+
+	byID := call(map[string]interface{}{"id": "4", "type": "subscribe", "company_id": "c1"}).Subscription
+	byCode := call(map[string]interface{}{"id": "5", "type": "subscribe", "filters": map[string]string{"code": "eq:CY"}}).Subscription
+	assert.NotEqual(t, byID, byCode)
+
+	publish("e1", "c1", "GR")
+	publish("e2", "c2", "CY")
+	for _, want := range []struct{ sub, event string }{{byID, "e1"}, {byCode, "e2"}} {
+		var m wsMessage
+		assert.NoError(t, conn.ReadJSON(&m))
+		assert.Equal(t, "event", m.Type)
+		assert.Equal(t, want.sub, m.Subscription)
+		assert.Equal(t, want.event, m.Event.ID)
+	}
+
+	m = call(map[string]interface{}{"id": "6", "type": "unsubscribe", "subscription": byID})
+	assert.Equal(t, "result", m.Type)
+	m = call(map[string]interface{}{"id": "7", "type": "unsubscribe", "subscription": byID})
+	assert.Equal(t, 404, m.Status)
+	m = call(map[string]interface{}{"id": "8", "type": "unknown"})
+	assert.Equal(t, 400, m.Status)
+
+	// going away on shutdown
+	broker.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestWebSocketGuards(t *testing.T) {
+	ctx := context.Background()
+
+	id, err := ds.CreateCompany(ctx, model.Company{Name: "ws-guards", Code: "CY", Country: "Cyprus"})
+	assert.NoError(t, err)
+	defer ds.DropDatabase(ctx)
+
+	geo, err := client.NewGeoLocator(client.GeoLocatorConfig{
+		Provider: client.ProviderIPAPI,
+		IPAPIURL: ipapiSrv.URL(),
+	})
+	assert.NoError(t, err)
+	// the test client isn't in Cyprus
+	policies, err := policy.NewEngine([]policy.Config{
+		{Name: "cyprus-only-lists", Methods: []string{http.MethodGet}, Paths: []string{"/api/v1/companies"},
+			AllowCountries: []string{"CY"}},
+	}, geo, nil)
+	assert.NoError(t, err)
+	limits, err := ratelimit.NewEngine([]ratelimit.Config{
+		{Name: "gets", Methods: []string{http.MethodGet}, Paths: []string{"/api/v1/companies/:id"},
+			Requests: 1, Period: utils.Duration(time.Minute)},
+	}, ratelimit.NewMemoryLimiter(), nil)
+	assert.NoError(t, err)
+
+	broker := stream.NewBroker(stream.Config{})
+	defer broker.Close()
+	srv := httptest.NewServer(api_http.NewRouter(ds, api_http.RouterOptions{
+		Stream:     broker,
+		Policies:   policies,
+		RateLimits: limits,
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	call := func(req map[string]interface{}) wsMessage {
+		assert.NoError(t, conn.WriteJSON(req))
+		var m wsMessage
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(t, conn.ReadJSON(&m))
+		return m
+	}
+
+	m := call(map[string]interface{}{"id": "1", "type": "get", "company_id": id})
+	assert.Equal(t, "result", m.Type)
+	m = call(map[string]interface{}{"id": "2", "type": "get", "company_id": id})
+	assert.Equal(t, http.StatusTooManyRequests, m.Status)
+
+	m = call(map[string]interface{}{"id": "3", "type": "list"})
+	assert.Equal(t, http.StatusForbidden, m.Status)
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/metrics"
+	"github.com/arpsch/xm/tracing"
+)
+
+var httpRequestDuration = metrics.NewHistogramVec(
+	"xm_http_request_duration_seconds",
+	"Latency of the API requests by method, route and status.",
+	nil,
+	"method", "route", "status")
+
+func init() {
+	metrics.MustRegister(httpRequestDuration)
+}
+
+// instrument traces the requests to the route registered for method and
+// path, and records their latency; the route, not the URL, keeps the label
+// values bounded. The logs of a traced request carry its trace id.
+func instrument(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		r, span := tracing.StartServer(r, path)
+		if id, ok := tracing.TraceID(r.Context()); ok {
+			ctx := r.Context()
+			r = r.WithContext(logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", id)))
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+
+		tracing.EndServer(span, sw.code())
+		httpRequestDuration.
+			WithLabelValues(method, path, strconv.Itoa(sw.code())).
+			ObserveSince(start)
+	}
+}
+
+// statusWriter captures the status of the response. It passes flushes
+// and hijacks through, for streaming responses.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
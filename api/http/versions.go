@@ -0,0 +1,181 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/utils"
+)
+
+const (
+	// URLPrefixV2 is the prefix of the v2 company routes
+	URLPrefixV2 = "/api/v2/companies/"
+
+	HdrDeprecation = "Deprecation"
+	HdrSunset      = "Sunset"
+)
+
+// DefaultV1Deprecation is the date v1 was deprecated, superseded by v2
+var DefaultV1Deprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// apiVersion maps the companies between the model and the wire format of
+// a version of the API, the handlers being shared
+type apiVersion struct {
+	// prefix is the prefix of the company routes, before the id
+	prefix string
+
+	decodeCompany func(io.Reader) (model.Company, error)
+	decodeUpdate  func(io.Reader) (model.CompanyUpdate, error)
+
+	// company and list are the representations of the companies answered
+	company func(c *model.Company) interface{}
+	list    func(cs []model.Company, total int, page, perPage uint64) interface{}
+
+	// attribute is the stored name of a filtered attribute
+	attribute func(name string) string
+
+	// the statuses of the answers
+	created, notFound, exists int
+
+	// stored answers the creates and updates with the company as stored,
+	// rather than the one sent or 202 without
+	stored bool
+}
+
+// v1 keeps the wire format of the model, typos included: the country is
+// "Country" and the creation time "crated_ts"
+var v1 = apiVersion{
+	prefix: utils.URLPrefix,
+	decodeCompany: func(r io.Reader) (model.Company, error) {
+		var c model.Company
+		err := json.NewDecoder(r).Decode(&c)
+		return c, err
+	},
+	decodeUpdate: func(r io.Reader) (model.CompanyUpdate, error) {
+		var cu model.CompanyUpdate
+		err := json.NewDecoder(r).Decode(&cu)
+		return cu, err
+	},
+	company: func(c *model.Company) interface{} { return c },
+	list: func(cs []model.Company, total int, page, perPage uint64) interface{} {
+		return cs
+	},
+	attribute: func(name string) string { return name },
+	created:   http.StatusOK,
+	notFound:  http.StatusBadRequest,
+	exists:    http.StatusBadRequest,
+}
+
+// companyInputV2 is the company created in v2, the server managing the
+// other fields
+type companyInputV2 struct {
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Country string `json:"country"`
+	Website string `json:"website"`
+	Phone   string `json:"phone"`
+}
+
+// companyUpdateV2 is the update of a company in v2
+type companyUpdateV2 struct {
+	Website string `json:"website"`
+	Phone   string `json:"phone"`
+}
+
+// companyListV2 is a page of the companies in v2
+type companyListV2 struct {
+	Companies []model.CompanyV2 `json:"companies"`
+	Total     int               `json:"total"`
+	Page      uint64            `json:"page"`
+	PerPage   uint64            `json:"per_page"`
+}
+
+// decodeStrict decodes a v2 body, rejecting the unknown fields
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// v2Attributes are the stored names of the v2 attributes named otherwise
+var v2Attributes = map[string]string{
+	"id":         "_id",
+	"created_at": "created_ts",
+	"updated_at": "updated_ts",
+}
+
+// v2 fixes the field names, answers with the created and updated
+// companies and pages of companies, and with 404 and 409 for the missing
+// and duplicate ones
+var v2 = apiVersion{
+	prefix: URLPrefixV2,
+	decodeCompany: func(r io.Reader) (model.Company, error) {
+		var in companyInputV2
+		if err := decodeStrict(r, &in); err != nil {
+			return model.Company{}, err
+		}
+		return model.Company{
+			Name:    in.Name,
+			Code:    in.Code,
+			Country: in.Country,
+			Website: in.Website,
+			Phone:   in.Phone,
+		}, nil
+	},
+	decodeUpdate: func(r io.Reader) (model.CompanyUpdate, error) {
+		var in companyUpdateV2
+		if err := decodeStrict(r, &in); err != nil {
+			return model.CompanyUpdate{}, err
+		}
+		return model.CompanyUpdate{Website: in.Website, Phone: in.Phone}, nil
+	},
+	company: func(c *model.Company) interface{} { return c.V2() },
+	list: func(cs []model.Company, total int, page, perPage uint64) interface{} {
+		l := companyListV2{
+			Companies: make([]model.CompanyV2, len(cs)),
+			Total:     total,
+			Page:      page,
+			PerPage:   perPage,
+		}
+		for i := range cs {
+			l.Companies[i] = cs[i].V2()
+		}
+		return l
+	},
+	attribute: func(name string) string {
+		if stored, ok := v2Attributes[name]; ok {
+			return stored
+		}
+		return name
+	},
+	created:  http.StatusCreated,
+	notFound: http.StatusNotFound,
+	exists:   http.StatusConflict,
+	stored:   true,
+}
+
+// deprecated announces the deprecation of v1 on its responses, at
+// DefaultV1Deprecation when the date is zero, with the date it's retired
+// when set, and links the v2 route superseding it
+func deprecated(deprecation, sunset time.Time, next http.HandlerFunc) http.HandlerFunc {
+	if deprecation.IsZero() {
+		deprecation = DefaultV1Deprecation
+	}
+	since := fmt.Sprintf("@%d", deprecation.Unix())
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set(HdrDeprecation, since)
+		if !sunset.IsZero() {
+			hdr.Set(HdrSunset, sunset.UTC().Format(http.TimeFormat))
+		}
+		successor := strings.Replace(r.URL.Path, "/api/v1/", "/api/v2/", 1)
+		hdr.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
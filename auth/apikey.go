@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+const (
+	// HdrAPIKey carries the API key, alternatively to
+	// "Authorization: ApiKey <key>"
+	HdrAPIKey = "X-API-Key"
+
+	schemeAPIKey = "ApiKey"
+
+	apiKeyPrefix    = "xm_"
+	apiKeyBytes     = 32
+	apiKeyPrefixLen = len(apiKeyPrefix) + 6
+)
+
+// GenerateAPIKey returns a new random key, its display prefix and hash
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", errors.Wrap(err, "failed to generate api key")
+	}
+
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:apiKeyPrefixLen], HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hash under which a key is stored. The keys are
+// random, so a plain SHA-256 is enough to make the stored value useless
+// to an attacker.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey validates the request and stores a new key. The returned
+// plain key is not stored anywhere and can't be shown again.
+func CreateAPIKey(ctx context.Context, keys store.APIKeyStore, kc model.APIKeyCreate) (string, *model.APIKey, error) {
+	if err := kc.Validate(Scopes); err != nil {
+		return "", nil, err
+	}
+
+	key, prefix, hash, err := GenerateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	k := model.APIKey{
+		Name:      kc.Name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    kc.Scopes,
+		TenantID:  kc.TenantID,
+		ExpiresTs: kc.ExpiresTs,
+	}
+
+	id, err := keys.CreateAPIKey(ctx, k)
+	if err != nil {
+		return "", nil, err
+	}
+	k.ID = id
+
+	return key, &k, nil
+}
+
+// APIKeyAuthenticator authenticates requests by API key
+type APIKeyAuthenticator struct {
+	keys store.APIKeyStore
+	now  func() time.Time
+}
+
+func NewAPIKeyAuthenticator(keys store.APIKeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		keys: keys,
+		now:  time.Now,
+	}
+}
+
+func (a *APIKeyAuthenticator) Challenge() string {
+	return schemeAPIKey + ` realm="xm"`
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(HdrAPIKey)
+	if key == "" {
+		key = credential(r, schemeAPIKey)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrInvalidCredentials
+	}
+
+	k, err := a.keys.GetAPIKeyByHash(r.Context(), HashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, store.ErrAPIKeyNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	if !k.Active(a.now()) {
+		return nil, ErrInvalidCredentials
+	}
+
+	p := &Principal{
+		ID:     k.ID,
+		Name:   k.Name,
+		Kind:   KindAPIKey,
+		Scopes: k.Scopes,
+	}
+	if k.TenantID != "" {
+		p.Attributes = map[string]string{AttributeTenant: k.TenantID}
+	}
+	return p, nil
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+// memKeyStore is an in-memory store.APIKeyStore
+type memKeyStore struct {
+	keys map[string]model.APIKey
+}
+
+func newMemKeyStore() *memKeyStore {
+	return &memKeyStore{keys: map[string]model.APIKey{}}
+}
+
+func (s *memKeyStore) CreateAPIKey(ctx context.Context, k model.APIKey) (string, error) {
+	k.ID = k.Prefix
+	s.keys[k.ID] = k
+	return k.ID, nil
+}
+
+func (s *memKeyStore) GetAPIKeyByHash(ctx context.Context, hash string) (*model.APIKey, error) {
+	for _, k := range s.keys {
+		if k.Hash == hash {
+			return &k, nil
+		}
+	}
+	return nil, store.ErrAPIKeyNotFound
+}
+
+func (s *memKeyStore) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *memKeyStore) RevokeAPIKey(ctx context.Context, id string) error {
+	k, ok := s.keys[id]
+	if !ok {
+		return store.ErrAPIKeyNotFound
+	}
+	now := time.Now()
+	k.RevokedTs = &now
+	s.keys[id] = k
+	return nil
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, hash, err := GenerateAPIKey()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	assert.True(t, strings.HasPrefix(key, prefix))
+	assert.Equal(t, HashAPIKey(key), hash)
+	assert.NotContains(t, hash, key)
+
+	other, _, _, err := GenerateAPIKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	ctx := context.Background()
+	keys := newMemKeyStore()
+
+	_, _, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{Name: "ci", Scopes: []string{"companies:nuke"}})
+	assert.Error(t, err)
+
+	_, _, err = CreateAPIKey(ctx, keys, model.APIKeyCreate{Scopes: []string{ScopeCompaniesRead}})
+	assert.Error(t, err)
+
+	past := time.Now().Add(-time.Minute)
+	_, _, err = CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:      "ci",
+		Scopes:    []string{ScopeCompaniesRead},
+		ExpiresTs: &past,
+	})
+	assert.Error(t, err)
+
+	assert.Empty(t, keys.keys)
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	ctx := context.Background()
+	keys := newMemKeyStore()
+
+	reader, _, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:   "reader",
+		Scopes: []string{ScopeCompaniesRead},
+	})
+	assert.NoError(t, err)
+
+	soon := time.Now().Add(time.Hour)
+	expired, k, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:      "expired",
+		Scopes:    []string{ScopeCompaniesRead},
+		ExpiresTs: &soon,
+	})
+	assert.NoError(t, err)
+	past := time.Now().Add(-time.Hour)
+	k.ExpiresTs = &past
+	keys.keys[k.ID] = *k
+
+	revoked, k, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:   "revoked",
+		Scopes: []string{ScopeCompaniesRead},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, keys.RevokeAPIKey(ctx, k.ID))
+
+	var principal *Principal
+	next := func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}
+
+	authn := NewAPIKeyAuthenticator(keys)
+
+	tt := []struct {
+		name       string
+		scope      string
+		headers    map[string]string
+		statusCode int
+	}{
+		{
+			name:       "no key",
+			scope:      ScopeCompaniesRead,
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown key",
+			scope:      ScopeCompaniesRead,
+			headers:    map[string]string{HdrAPIKey: "xm_nope"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "X-API-Key header",
+			scope:      ScopeCompaniesRead,
+			headers:    map[string]string{HdrAPIKey: reader},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Authorization header",
+			scope:      ScopeCompaniesRead,
+			headers:    map[string]string{"Authorization": "ApiKey " + reader},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "missing scope",
+			scope:      ScopeCompaniesDelete,
+			headers:    map[string]string{HdrAPIKey: reader},
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "expired key",
+			scope:      ScopeCompaniesRead,
+			headers:    map[string]string{HdrAPIKey: expired},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "revoked key",
+			scope:      ScopeCompaniesRead,
+			headers:    map[string]string{HdrAPIKey: revoked},
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			principal = nil
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/companies", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			Middleware(authn, tc.scope, next)(rec, req)
+
+			assert.Equal(t, tc.statusCode, rec.Code)
+			if tc.statusCode == http.StatusOK {
+				assert.NotNil(t, principal)
+				assert.Equal(t, "reader", principal.Name)
+				assert.Equal(t, KindAPIKey, principal.Kind)
+			}
+		})
+	}
+}
+
+func TestAPIKeyTenant(t *testing.T) {
+	ctx := context.Background()
+	keys := newMemKeyStore()
+
+	_, _, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:     "bad",
+		Scopes:   []string{ScopeCompaniesRead},
+		TenantID: "no/slashes",
+	})
+	assert.Error(t, err)
+
+	key, _, err := CreateAPIKey(ctx, keys, model.APIKeyCreate{
+		Name:     "acme",
+		Scopes:   []string{ScopeCompaniesRead},
+		TenantID: "acme",
+	})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/v1/companies", nil)
+	req.Header.Set(HdrAPIKey, key)
+
+	p, err := NewAPIKeyAuthenticator(keys).Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", p.Attributes[AttributeTenant])
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+)
+
+// scopes
+const (
+	ScopeCompaniesRead   = "companies:read"
+	ScopeCompaniesWrite  = "companies:write"
+	ScopeCompaniesDelete = "companies:delete"
+	ScopeAPIKeysAdmin    = "apikeys:admin"
+	ScopeWebhooks        = "webhooks:manage"
+	// ScopeTenantsAll lets callers bound to no tenant name any
+	ScopeTenantsAll = "tenants:all"
+)
+
+// Scopes lists the known scopes
+var Scopes = []string{
+	ScopeCompaniesRead,
+	ScopeCompaniesWrite,
+	ScopeCompaniesDelete,
+	ScopeAPIKeysAdmin,
+	ScopeWebhooks,
+	ScopeTenantsAll,
+}
+
+var (
+	ErrNoCredentials      = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// principal kinds
+const (
+	KindAPIKey = "api_key"
+	KindJWT    = "jwt"
+)
+
+// AttributeTenant is the principal attribute holding its tenant
+const AttributeTenant = "tenant"
+
+// Principal is the authenticated caller
+type Principal struct {
+	// ID identifies the caller, e.g. the API key id or the token subject
+	ID   string
+	Name string
+	Kind string
+
+	Scopes []string
+	Roles  []string
+
+	// Attributes are facts about the principal authorization rules may
+	// check, e.g. its country
+	Attributes map[string]string
+}
+
+// Actor identifies the principal in records of who did what, e.g.
+// "jwt:alice"
+func (p *Principal) Actor() string {
+	return p.Kind + ":" + p.ID
+}
+
+// HasRole tells whether the principal was given the role
+func (p *Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+// HasScope tells whether the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal of the request, if any
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials when the request carries none of its credentials.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Challenger is implemented by Authenticators which tell unauthenticated
+// clients how to authenticate, in the WWW-Authenticate header
+type Challenger interface {
+	Challenge() string
+}
+
+// Chain tries the authenticators in order until one finds its credentials
+// in the request
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+func (c Chain) Challenge() string {
+	var challenges []string
+	for _, a := range c {
+		if ch, ok := a.(Challenger); ok {
+			challenges = append(challenges, ch.Challenge())
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// Middleware authenticates the request and checks the principal has the
+// scope before calling next. Unauthenticated requests get 401, requests
+// lacking the scope 403. A nil Authenticator disables authentication.
+func Middleware(a Authenticator, scope string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			if errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrInvalidCredentials) {
+				if ch, ok := a.(Challenger); ok {
+					w.Header().Set("WWW-Authenticate", ch.Challenge())
+				}
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "failed to authenticate the request: "+err.Error(),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if scope != "" && !p.HasScope(scope) {
+			http.Error(w, "forbidden: missing scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		ctx := WithPrincipal(r.Context(), p)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("actor", p.Actor()))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// credential returns the credential sent with the given Authorization
+// scheme, e.g. "Authorization: ApiKey <key>"
+func credential(r *http.Request, scheme string) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > len(scheme)+1 && strings.EqualFold(h[:len(scheme)], scheme) && h[len(scheme)] == ' ' {
+		return strings.TrimSpace(h[len(scheme)+1:])
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// KindCert identifies the callers authenticated by a client certificate
+const KindCert = "cert"
+
+// CertConfig turns the verified client certificates of mutual TLS into
+// principals, for service-to-service calls
+type CertConfig struct {
+	// Subjects are the common names accepted, empty accepts every
+	// certificate the client CAs issued
+	Subjects []string `json:"subjects"`
+
+	// Scopes are granted to the services, default the company scopes
+	Scopes []string `json:"scopes"`
+
+	// Roles are given to the services, authorizing them by role rather
+	// than by scope
+	Roles []string `json:"roles"`
+}
+
+// CertAuthenticator authenticates the callers by the client certificate
+// the TLS handshake verified
+type CertAuthenticator struct {
+	subjects []string
+	scopes   []string
+	roles    []string
+}
+
+func NewCertAuthenticator(conf CertConfig) *CertAuthenticator {
+	scopes := conf.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeCompaniesRead, ScopeCompaniesWrite, ScopeCompaniesDelete}
+	}
+	return &CertAuthenticator{
+		subjects: conf.Subjects,
+		scopes:   scopes,
+		roles:    conf.Roles,
+	}
+}
+
+// Authenticate returns the principal of the certificate subject. Requests
+// without a verified certificate carry no credentials for it.
+func (a *CertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	cn := cert.Subject.CommonName
+	if cn == "" {
+		return nil, errors.Wrap(ErrInvalidCredentials, "client certificate without common name")
+	}
+	if len(a.subjects) > 0 && !contains(a.subjects, cn) {
+		return nil, errors.Wrapf(ErrInvalidCredentials, "client certificate subject %q not allowed", cn)
+	}
+
+	return &Principal{
+		ID:     cn,
+		Name:   cert.Subject.String(),
+		Kind:   KindCert,
+		Scopes: a.scopes,
+		Roles:  a.roles,
+	}, nil
+}
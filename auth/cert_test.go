@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertAuthenticator(t *testing.T) {
+	verified := func(cn string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"xm"}}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	testCases := map[string]struct {
+		conf CertConfig
+		tls  *tls.ConnectionState
+
+		principal *Principal
+		err       error
+	}{
+		"plain http": {
+			err: ErrNoCredentials,
+		},
+		"no client certificate": {
+			tls: &tls.ConnectionState{},
+			err: ErrNoCredentials,
+		},
+		"default scopes": {
+			tls: verified("billing"),
+			principal: &Principal{
+				ID:     "billing",
+				Name:   "CN=billing,O=xm",
+				Kind:   KindCert,
+				Scopes: []string{ScopeCompaniesRead, ScopeCompaniesWrite, ScopeCompaniesDelete},
+			},
+		},
+		"allowed subject": {
+			conf: CertConfig{Subjects: []string{"billing"}, Scopes: []string{ScopeCompaniesRead}, Roles: []string{RoleViewer}},
+			tls:  verified("billing"),
+			principal: &Principal{
+				ID:     "billing",
+				Name:   "CN=billing,O=xm",
+				Kind:   KindCert,
+				Scopes: []string{ScopeCompaniesRead},
+				Roles:  []string{RoleViewer},
+			},
+		},
+		"subject not allowed": {
+			conf: CertConfig{Subjects: []string{"billing"}},
+			tls:  verified("reporting"),
+			err:  ErrInvalidCredentials,
+		},
+		"no common name": {
+			tls: verified(""),
+			err: ErrInvalidCredentials,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/api/v1/companies", nil)
+			req.TLS = tc.tls
+
+			p, err := NewCertAuthenticator(tc.conf).Authenticate(req)
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.principal, p)
+			assert.Equal(t, "cert:billing", p.Actor())
+		})
+	}
+}
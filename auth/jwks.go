@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// refresh at most this often when a token names an unknown key, or
+	// after a failed refresh
+	minJWKSRefresh = 30 * time.Second
+
+	// minRSABits is the size of the smallest RSA key accepted
+	minRSABits = 2048
+
+	jwksReqTimeout = 10 * time.Second
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwk is a JSON Web Key (RFC 7517) as found in a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKey is a parsed JWK
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// JWKS holds the verification keys loaded from a file or a URL. The keys
+// are reloaded every refresh interval and when a token names a key id we
+// don't know, so rotated keys are picked up. The reloads are serialized,
+// and retried no sooner than minJWKSRefresh after a failure.
+type JWKS struct {
+	file     string
+	url      string
+	client   *http.Client
+	interval time.Duration
+
+	// loadMu serializes the loads
+	loadMu sync.Mutex
+
+	mu       sync.Mutex
+	keys     map[string]publicKey
+	loadedAt time.Time
+	modTime  time.Time
+
+	// attemptedAt is the time of the last load, failed tells whether it
+	// failed
+	attemptedAt time.Time
+	failed      bool
+
+	now func() time.Time
+}
+
+// NewJWKS loads the key set from a file or a URL
+func NewJWKS(ctx context.Context, file, url string, interval time.Duration) (*JWKS, error) {
+	if (file == "") == (url == "") {
+		return nil, errors.New("jwks: exactly one of file or url must be set")
+	}
+
+	s := &JWKS{
+		file:     file,
+		url:      url,
+		client:   &http.Client{},
+		interval: interval,
+		now:      time.Now,
+	}
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Key returns the key with the given id
+func (s *JWKS) Key(ctx context.Context, kid string) (publicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	refresh, attempted := s.needsRefresh(ok), s.attemptedAt
+	s.mu.Unlock()
+
+	if !refresh {
+		if ok {
+			return key, nil
+		}
+		return publicKey{}, ErrUnknownKey
+	}
+
+	s.loadMu.Lock()
+	s.mu.Lock()
+	// loaded while we waited
+	done := !s.attemptedAt.Equal(attempted)
+	s.mu.Unlock()
+	var err error
+	if !done {
+		err = s.load(ctx)
+	}
+	s.loadMu.Unlock()
+
+	if err != nil {
+		// keep serving the keys we have
+		if ok {
+			return key, nil
+		}
+		return publicKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, found := s.keys[kid]; found {
+		return k, nil
+	}
+	return publicKey{}, ErrUnknownKey
+}
+
+// needsRefresh tells whether to reload the keys, stale or missing the key
+// looked up; called with mu held
+func (s *JWKS) needsRefresh(known bool) bool {
+	now := s.now()
+	retry := now.Sub(s.attemptedAt) >= minJWKSRefresh
+	if s.failed || !known {
+		return retry
+	}
+	return s.interval > 0 && now.Sub(s.loadedAt) >= s.interval
+}
+
+func (s *JWKS) load(ctx context.Context) error {
+	var (
+		data    []byte
+		modTime time.Time
+		err     error
+	)
+
+	if s.file != "" {
+		data, modTime, err = s.readFile()
+	} else {
+		data, err = s.fetch(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attemptedAt = s.now()
+	s.failed = true
+	if err != nil {
+		return err
+	}
+
+	// the file didn't change since the last load
+	if data == nil {
+		s.loadedAt = s.attemptedAt
+		s.failed = false
+		return nil
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.loadedAt = s.attemptedAt
+	s.modTime = modTime
+	s.failed = false
+	return nil
+}
+
+// readFile returns nil data when the file wasn't modified since the last
+// load
+func (s *JWKS) readFile() ([]byte, time.Time, error) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "jwks: failed to stat file")
+	}
+
+	s.mu.Lock()
+	unchanged := s.keys != nil && fi.ModTime().Equal(s.modTime)
+	s.mu.Unlock()
+	if unchanged {
+		return nil, fi.ModTime(), nil
+	}
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "jwks: failed to read file")
+	}
+	return data, fi.ModTime(), nil
+}
+
+func (s *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksReqTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "jwks: failed to create request")
+	}
+
+	rsp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "jwks: request failed")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("jwks: request failed with status %d", rsp.StatusCode)
+	}
+
+	return ioutil.ReadAll(rsp.Body)
+}
+
+func parseJWKS(data []byte) (map[string]publicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "jwks: failed to parse key set")
+	}
+
+	keys := map[string]publicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := parseJWK(k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "jwks: key %q", k.Kid)
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+func parseJWK(k jwk) (publicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if n.BitLen() < minRSABits {
+			return publicKey{}, errors.Errorf("RSA key of %d bits, at least %d required", n.BitLen(), minRSABits)
+		}
+		return checkAlg(k, AlgRS256, &rsa.PublicKey{N: n, E: int(e.Int64())})
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return publicKey{}, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pub.Curve.IsOnCurve(x, y) {
+			return publicKey{}, errors.New("point is not on the curve")
+		}
+		return checkAlg(k, AlgES256, pub)
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return publicKey{}, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("invalid Ed25519 key")
+		}
+		return checkAlg(k, AlgEdDSA, ed25519.PublicKey(x))
+	}
+
+	return publicKey{}, errors.Errorf("unsupported key type %q", k.Kty)
+}
+
+// checkAlg makes sure the key is only used with the algorithm of its type
+func checkAlg(k jwk, alg string, key crypto.PublicKey) (publicKey, error) {
+	if k.Alg != "" && k.Alg != alg {
+		return publicKey{}, errors.Errorf("unsupported algorithm %q for key type %s", k.Alg, k.Kty)
+	}
+	return publicKey{alg: alg, key: key}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
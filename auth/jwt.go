@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// signing algorithms
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// roles
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+const (
+	schemeBearer = "Bearer"
+
+	defaultRolesClaim   = "roles"
+	defaultJWKSInterval = time.Hour
+)
+
+// DefaultRoleScopes are the scopes granted to each role
+var DefaultRoleScopes = map[string][]string{
+	RoleViewer: {ScopeCompaniesRead},
+	RoleEditor: {ScopeCompaniesRead, ScopeCompaniesWrite},
+	RoleAdmin:  Scopes,
+}
+
+// JWTConfig configures the bearer token validation
+type JWTConfig struct {
+	// JWKSFile or JWKSURL is where the verification keys are loaded from
+	JWKSFile string `json:"jwks_file"`
+	JWKSURL  string `json:"jwks_url"`
+
+	// JWKSRefresh is how often the keys are reloaded, default 1h. They are
+	// also reloaded when a token is signed with an unknown key.
+	JWKSRefresh utils.Duration `json:"jwks_refresh"`
+
+	// Issuer and Audience are required to match the iss and aud claims
+	// when set
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway utils.Duration `json:"leeway"`
+
+	// RolesClaim is the claim holding the roles, default "roles". Nested
+	// claims are addressed with dots, e.g. "realm_access.roles".
+	RolesClaim string `json:"roles_claim"`
+
+	// RoleMapping maps claim values to roles; values without a mapping
+	// are taken as they are
+	RoleMapping map[string]string `json:"role_mapping"`
+
+	// RoleScopes grants scopes to roles, default DefaultRoleScopes
+	RoleScopes map[string][]string `json:"role_scopes"`
+
+	// AttributeClaims maps principal attributes to the string claims
+	// holding them, e.g. {"country": "country"}
+	AttributeClaims map[string]string `json:"attribute_claims"`
+}
+
+var (
+	ErrTokenExpired  = errors.New("token expired")
+	ErrTokenNotValid = errors.New("token not valid yet")
+)
+
+// Claims are the registered claims of a token plus all the others
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt *time.Time
+	NotBefore *time.Time
+
+	raw map[string]interface{}
+}
+
+// JWTAuthenticator authenticates requests by bearer JWT
+type JWTAuthenticator struct {
+	conf JWTConfig
+	keys *JWKS
+	now  func() time.Time
+}
+
+// NewJWTAuthenticator loads the JWKS and returns the authenticator
+func NewJWTAuthenticator(ctx context.Context, conf JWTConfig) (*JWTAuthenticator, error) {
+	interval := conf.JWKSRefresh.Duration()
+	if interval == 0 {
+		interval = defaultJWKSInterval
+	}
+
+	keys, err := NewJWKS(ctx, conf.JWKSFile, conf.JWKSURL, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.RolesClaim == "" {
+		conf.RolesClaim = defaultRolesClaim
+	}
+	if conf.RoleScopes == nil {
+		conf.RoleScopes = DefaultRoleScopes
+	}
+
+	return &JWTAuthenticator{
+		conf: conf,
+		keys: keys,
+		now:  time.Now,
+	}, nil
+}
+
+func (a *JWTAuthenticator) Challenge() string {
+	return schemeBearer + ` realm="xm"`
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := credential(r, schemeBearer)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := a.Verify(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return nil, err
+		}
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+
+	roles := a.roles(claims)
+	p := &Principal{
+		ID:    claims.Subject,
+		Name:  claims.Subject,
+		Kind:  KindJWT,
+		Roles: roles,
+	}
+	if name, ok := claims.raw["name"].(string); ok && name != "" {
+		p.Name = name
+	}
+	for attr, claim := range a.conf.AttributeClaims {
+		if v, ok := claimValue(claims.raw, claim).(string); ok && v != "" {
+			if p.Attributes == nil {
+				p.Attributes = map[string]string{}
+			}
+			p.Attributes[attr] = v
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, role := range roles {
+		for _, s := range a.conf.RoleScopes[role] {
+			if !seen[s] {
+				seen[s] = true
+				p.Scopes = append(p.Scopes, s)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Verify checks the signature and the registered claims of the token
+func (a *JWTAuthenticator) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidCredentials, "malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "malformed token header")
+	}
+
+	key, err := a.keys.Key(ctx, header.Kid)
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+		}
+		return nil, err
+	}
+
+	// the algorithm is dictated by the key, never by the token alone
+	if header.Alg != key.alg {
+		return nil, errors.Wrapf(ErrInvalidCredentials, "unexpected algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "malformed token signature")
+	}
+	if !verifySignature(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid signature")
+	}
+
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "malformed token claims")
+	}
+
+	claims, err := parseClaims(raw)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+
+	if err := a.validate(claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) validate(c *Claims) error {
+	now := a.now()
+	leeway := a.conf.Leeway.Duration()
+
+	if c.ExpiresAt == nil {
+		return errors.New("missing exp claim")
+	}
+	if !now.Before(c.ExpiresAt.Add(leeway)) {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(*c.NotBefore) {
+		return ErrTokenNotValid
+	}
+
+	if a.conf.Issuer != "" && c.Issuer != a.conf.Issuer {
+		return errors.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if a.conf.Audience != "" && !contains(c.Audience, a.conf.Audience) {
+		return errors.New("token not intended for this audience")
+	}
+	if c.Subject == "" {
+		return errors.New("missing sub claim")
+	}
+	return nil
+}
+
+// roles returns the mapped roles found in the roles claim
+func (a *JWTAuthenticator) roles(c *Claims) []string {
+	var values []string
+	switch v := claimValue(c.raw, a.conf.RolesClaim).(type) {
+	case string:
+		// space separated, like the scope claim
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	roles := make([]string, 0, len(values))
+	for _, s := range values {
+		if role, ok := a.conf.RoleMapping[s]; ok {
+			s = role
+		}
+		if s != "" && !contains(roles, s) {
+			roles = append(roles, s)
+		}
+	}
+	return roles
+}
+
+// claimValue returns the claim at the dotted path, e.g. "realm_access.roles"
+func claimValue(raw map[string]interface{}, path string) interface{} {
+	var v interface{} = raw
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+func parseClaims(raw map[string]interface{}) (*Claims, error) {
+	c := &Claims{raw: raw}
+
+	var ok bool
+	if v, set := raw["iss"]; set {
+		if c.Issuer, ok = v.(string); !ok {
+			return nil, errors.New("invalid iss claim")
+		}
+	}
+	if v, set := raw["sub"]; set {
+		if c.Subject, ok = v.(string); !ok {
+			return nil, errors.New("invalid sub claim")
+		}
+	}
+
+	switch v := raw["aud"].(type) {
+	case nil:
+	case string:
+		c.Audience = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, errors.New("invalid aud claim")
+			}
+			c.Audience = append(c.Audience, s)
+		}
+	default:
+		return nil, errors.New("invalid aud claim")
+	}
+
+	var err error
+	if c.ExpiresAt, err = numericDate(raw, "exp"); err != nil {
+		return nil, err
+	}
+	if c.NotBefore, err = numericDate(raw, "nbf"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func numericDate(raw map[string]interface{}, name string) (*time.Time, error) {
+	v, set := raw[name]
+	if !set {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.Errorf("invalid %s claim", name)
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	t := time.Unix(sec, int64(frac*1e9))
+	return &t, nil
+}
+
+func verifySignature(key publicKey, input, sig []byte) bool {
+	switch key.alg {
+	case AlgRS256:
+		pub, ok := key.key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+
+	case AlgES256:
+		pub, ok := key.key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+
+	case AlgEdDSA:
+		pub, ok := key.key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, input, sig)
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+)
+
+// testKey is a signing key with its public JWK
+type testKey struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newTestKey(t *testing.T, kid, alg string) testKey {
+	var (
+		priv crypto.Signer
+		err  error
+	)
+	switch alg {
+	case AlgRS256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	assert.NoError(t, err)
+	return testKey{kid: kid, alg: alg, priv: priv}
+}
+
+func (k testKey) jwk() jwk {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	switch pub := k.priv.Public().(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: k.kid, N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return jwk{Kty: "EC", Kid: k.kid, Crv: "P-256", X: b64(pub.X.Bytes()), Y: b64(pub.Y.Bytes())}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: k.kid, Crv: "Ed25519", X: b64(pub)}
+	}
+	return jwk{}
+}
+
+func (k testKey) sign(t *testing.T, claims map[string]interface{}) string {
+	seg := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	input := seg(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"}) + "." + seg(claims)
+	sum := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch priv := k.priv.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+		assert.NoError(t, err)
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, sum[:])
+		assert.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(input))
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...testKey) {
+	set := jwks{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	b, err := json.Marshal(set)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey := newTestKey(t, "rsa", AlgRS256)
+	ecKey := newTestKey(t, "ec", AlgES256)
+	edKey := newTestKey(t, "ed", AlgEdDSA)
+	unknown := newTestKey(t, "unknown", AlgRS256)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaKey, ecKey, edKey)
+
+	authn, err := NewJWTAuthenticator(context.Background(), JWTConfig{
+		JWKSFile:        path,
+		Issuer:          "https://idp.example.com",
+		Audience:        "xm",
+		RolesClaim:      "realm_access.roles",
+		RoleMapping:     map[string]string{"xm-editors": RoleEditor},
+		AttributeClaims: map[string]string{"country": "country"},
+	})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	claims := func(mod func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":          "https://idp.example.com",
+			"aud":          []string{"other", "xm"},
+			"sub":          "alice",
+			"name":         "Alice",
+			"country":      "CY",
+			"exp":          now.Add(time.Hour).Unix(),
+			"nbf":          now.Add(-time.Minute).Unix(),
+			"realm_access": map[string]interface{}{"roles": []string{"xm-editors", "offline"}},
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	// an ES256 header with the RSA key id must not verify
+	confused := rsaKey
+	confused.alg = AlgES256
+	confused.priv = ecKey.priv
+
+	tt := []struct {
+		name  string
+		token string
+		err   bool
+	}{
+		{name: "RS256", token: rsaKey.sign(t, claims(nil))},
+		{name: "ES256", token: ecKey.sign(t, claims(nil))},
+		{name: "EdDSA", token: edKey.sign(t, claims(nil))},
+		{
+			name:  "unknown key",
+			token: unknown.sign(t, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "algorithm confusion",
+			token: confused.sign(t, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "tampered",
+			token: rsaKey.sign(t, claims(nil))[:20] + "x" + rsaKey.sign(t, claims(nil))[21:],
+			err:   true,
+		},
+		{
+			name:  "expired",
+			token: rsaKey.sign(t, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Second).Unix() })),
+			err:   true,
+		},
+		{
+			name:  "no exp",
+			token: rsaKey.sign(t, claims(func(c map[string]interface{}) { delete(c, "exp") })),
+			err:   true,
+		},
+		{
+			name:  "not yet valid",
+			token: rsaKey.sign(t, claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })),
+			err:   true,
+		},
+		{
+			name:  "wrong issuer",
+			token: rsaKey.sign(t, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })),
+			err:   true,
+		},
+		{
+			name:  "wrong audience",
+			token: rsaKey.sign(t, claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+			err:   true,
+		},
+		{
+			name:  "malformed",
+			token: "not.a-token",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/companies", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			p, err := authn.Authenticate(req)
+			if tc.err {
+				assert.True(t, errors.Is(err, ErrInvalidCredentials))
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", p.ID)
+			assert.Equal(t, "Alice", p.Name)
+			assert.Equal(t, KindJWT, p.Kind)
+			assert.Equal(t, "jwt:alice", p.Actor())
+			assert.Equal(t, []string{RoleEditor, "offline"}, p.Roles)
+			assert.Equal(t, map[string]string{"country": "CY"}, p.Attributes)
+			assert.True(t, p.HasScope(ScopeCompaniesWrite))
+			assert.False(t, p.HasScope(ScopeCompaniesDelete))
+		})
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey := newTestKey(t, "2021-01", AlgES256)
+	newKey := newTestKey(t, "2021-02", AlgEdDSA)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, oldKey)
+
+	authn, err := NewJWTAuthenticator(context.Background(), JWTConfig{JWKSFile: path})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	authn.keys.now = func() time.Time { return now }
+
+	claims := map[string]interface{}{"sub": "bob", "exp": now.Add(time.Hour).Unix(), "roles": "viewer"}
+	verify := func(k testKey) error {
+		_, err := authn.Verify(context.Background(), k.sign(t, claims))
+		return err
+	}
+
+	assert.NoError(t, verify(oldKey))
+	assert.True(t, errors.Is(verify(newKey), ErrInvalidCredentials))
+
+	// rotate, the unknown key id triggers a reload once the minimum
+	// refresh interval passed
+	writeJWKS(t, path, newKey)
+	later := now.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, later, later))
+
+	assert.True(t, errors.Is(verify(newKey), ErrInvalidCredentials))
+	now = now.Add(minJWKSRefresh)
+	assert.NoError(t, verify(newKey))
+	assert.True(t, errors.Is(verify(oldKey), ErrInvalidCredentials))
+}
+
+func TestJWKSURL(t *testing.T) {
+	key := newTestKey(t, "k1", AlgRS256)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{key.jwk()}})
+	}))
+	defer srv.Close()
+
+	authn, err := NewJWTAuthenticator(context.Background(), JWTConfig{JWKSURL: srv.URL})
+	assert.NoError(t, err)
+
+	_, err = authn.Verify(context.Background(), key.sign(t, map[string]interface{}{
+		"sub": "carol",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	assert.NoError(t, err)
+}
+
+func TestJWKSFailedRefresh(t *testing.T) {
+	key := newTestKey(t, "k1", AlgES256)
+
+	var mu sync.Mutex
+	fetches, down := 0, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if down {
+			time.Sleep(10 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{key.jwk()}})
+	}))
+	defer srv.Close()
+
+	keys, err := NewJWKS(context.Background(), "", srv.URL, 0)
+	assert.NoError(t, err)
+	now := time.Now().Add(minJWKSRefresh)
+	keys.now = func() time.Time { return now }
+
+	mu.Lock()
+	down = true
+	mu.Unlock()
+
+	// the lookups of an unknown key share a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(context.Background(), "k2")
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// the failure holds the next fetch off
+	_, err = keys.Key(context.Background(), "k2")
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+	_, err = keys.Key(context.Background(), "k1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	now = now.Add(minJWKSRefresh)
+	keys.Key(context.Background(), "k2")
+	assert.Equal(t, 3, fetches)
+}
+
+func TestJWKSWeakRSAKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	_, err = parseJWK(testKey{kid: "weak", alg: AlgRS256, priv: priv}.jwk())
+	assert.Error(t, err)
+
+	_, err = parseJWK(newTestKey(t, "strong", AlgRS256).jwk())
+	assert.NoError(t, err)
+}
+
+func TestChainMiddleware(t *testing.T) {
+	key := newTestKey(t, "k1", AlgEdDSA)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, key)
+
+	jwt, err := NewJWTAuthenticator(context.Background(), JWTConfig{JWKSFile: path})
+	assert.NoError(t, err)
+
+	keys := newMemKeyStore()
+	apiKey, _, err := CreateAPIKey(context.Background(), keys, model.APIKeyCreate{
+		Name:   "ci",
+		Scopes: []string{ScopeCompaniesRead},
+	})
+	assert.NoError(t, err)
+
+	authn := Chain{jwt, NewAPIKeyAuthenticator(keys)}
+
+	var principal *Principal
+	next := func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFromContext(r.Context())
+	}
+
+	tt := []struct {
+		name       string
+		headers    map[string]string
+		statusCode int
+		kind       string
+	}{
+		{
+			name:       "bearer",
+			headers:    map[string]string{"Authorization": "Bearer " + key.sign(t, map[string]interface{}{"sub": "dave", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{RoleViewer}})},
+			statusCode: http.StatusOK,
+			kind:       KindJWT,
+		},
+		{
+			name:       "api key",
+			headers:    map[string]string{HdrAPIKey: apiKey},
+			statusCode: http.StatusOK,
+			kind:       KindAPIKey,
+		},
+		{
+			name:       "bad bearer",
+			headers:    map[string]string{"Authorization": "Bearer nope"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "nothing",
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			principal = nil
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/companies", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			Middleware(authn, ScopeCompaniesRead, next)(rec, req)
+
+			assert.Equal(t, tc.statusCode, rec.Code)
+			if tc.statusCode == http.StatusOK {
+				assert.Equal(t, tc.kind, principal.Kind)
+			} else {
+				assert.Equal(t, `Bearer realm="xm", ApiKey realm="xm"`, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
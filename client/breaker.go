@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+var ErrCircuitOpen = errors.New("geolocation provider unavailable, circuit open")
+
+// CircuitBreakerConfig configures the circuit breaker, zero Failures
+// disables it
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failures which trips the breaker
+	Failures int `json:"failures"`
+
+	// Cooldown is how long the breaker stays open before a trial request
+	Cooldown utils.Duration `json:"cooldown"`
+}
+
+// breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calling a failing GeoLocator. After Failures
+// consecutive failures it fails fast with ErrCircuitOpen for Cooldown,
+// then lets a single trial request through: success closes the breaker,
+// failure opens it again. A request the caller cancels, or one running out
+// of time before the time a chain allots the provider, tells nothing of the
+// provider; such a trial lets another one through.
+type CircuitBreaker struct {
+	next     GeoLocator
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	state       int
+	consecutive int
+	openedAt    time.Time
+
+	now func() time.Time
+}
+
+// NewCircuitBreaker wraps next with a circuit breaker
+func NewCircuitBreaker(next GeoLocator, config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		next:     next,
+		failures: config.Failures,
+		cooldown: config.Cooldown.Duration(),
+		now:      time.Now,
+	}
+}
+
+func (b *CircuitBreaker) CountryByIP(ctx context.Context, ip string) (string, error) {
+	if !b.allow() {
+		return "", ErrCircuitOpen
+	}
+
+	start := b.now()
+	country, err := b.next.CountryByIP(ctx, ip)
+	b.record(ctx, err, b.now().Sub(start))
+
+	return country, err
+}
+
+// Open reports whether the breaker currently rejects requests
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && b.now().Sub(b.openedAt) < b.cooldown
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// a trial request is already in flight
+		return false
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(ctx context.Context, err error, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if inconclusive(ctx, err, elapsed) {
+		if b.state == breakerHalfOpen {
+			// still open past the cooldown: the next request is a trial
+			b.state = breakerOpen
+		}
+		return
+	}
+
+	if !isProviderFailure(ctx, err) {
+		b.state = breakerClosed
+		b.consecutive = 0
+		return
+	}
+
+	b.consecutive++
+	if b.state == breakerHalfOpen || b.consecutive >= b.failures {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+		geoBreakerTrips.WithLabelValues().Inc()
+	}
+}
+
+// inconclusive tells whether the provider wasn't given the chance to
+// answer: the caller gave up, or the time ran out before the provider's
+// allotment
+func inconclusive(ctx context.Context, err error, elapsed time.Duration) bool {
+	if ctx.Err() == context.Canceled {
+		return true
+	}
+	timedOut := errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded
+	allotted, ok := allotmentFrom(ctx)
+	return timedOut && ok && elapsed < allotted
+}
+
+// isProviderFailure tells whether err means the provider misbehaved, as
+// opposed to a bad input, an unknown IP or the caller giving up. Running
+// out of time counts as a failure.
+func isProviderFailure(ctx context.Context, err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrMissingIP),
+		errors.Is(err, ErrInvalidIP),
+		errors.Is(err, ErrCountryNotFound):
+		return false
+	case ctx.Err() == context.Canceled:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/utils"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	next := &countingLocator{
+		table: map[string]string{"1.1.1.1": "CY"},
+		err:   errors.New("503 from provider"),
+	}
+
+	b := NewCircuitBreaker(next, CircuitBreakerConfig{
+		Failures: 3,
+		Cooldown: utils.Duration(10 * time.Second),
+	})
+	b.now = clock.now
+
+	for i := 0; i < 3; i++ {
+		_, err := b.CountryByIP(ctx, "1.1.1.1")
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	assert.True(t, b.Open())
+
+	// open: fail fast without calling the provider
+	_, err := b.CountryByIP(ctx, "1.1.1.1")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 3, next.calls)
+
+	// half-open trial fails: open again
+	clock.t = clock.t.Add(11 * time.Second)
+	_, err = b.CountryByIP(ctx, "1.1.1.1")
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 4, next.calls)
+	assert.True(t, b.Open())
+
+	// half-open trial succeeds: closed
+	next.err = nil
+	clock.t = clock.t.Add(11 * time.Second)
+	country, err := b.CountryByIP(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CY", country)
+	assert.False(t, b.Open())
+}
+
+func TestCircuitBreakerCancelledTrial(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	next := &countingLocator{
+		table: map[string]string{"1.1.1.1": "CY"},
+		err:   errors.New("503 from provider"),
+	}
+
+	b := NewCircuitBreaker(next, CircuitBreakerConfig{
+		Failures: 1,
+		Cooldown: utils.Duration(10 * time.Second),
+	})
+	b.now = clock.now
+
+	_, err := b.CountryByIP(context.Background(), "1.1.1.1")
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.True(t, b.Open())
+
+	// the trial is cancelled by the caller: inconclusive
+	clock.t = clock.t.Add(11 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.CountryByIP(ctx, "1.1.1.1")
+	assert.Equal(t, 2, next.calls)
+	assert.Equal(t, breakerOpen, b.state)
+
+	// another trial is let through, and fails
+	_, err = b.CountryByIP(context.Background(), "1.1.1.1")
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 3, next.calls)
+	assert.True(t, b.Open())
+}
+
+func TestCircuitBreakerIgnoresUnknownIPs(t *testing.T) {
+	ctx := context.Background()
+	next := &countingLocator{table: map[string]string{}}
+
+	b := NewCircuitBreaker(next, CircuitBreakerConfig{
+		Failures: 1,
+		Cooldown: utils.Duration(time.Minute),
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := b.CountryByIP(ctx, "1.1.1.1")
+		assert.True(t, errors.Is(err, ErrCountryNotFound))
+	}
+	assert.False(t, b.Open())
+}
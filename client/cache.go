@@ -0,0 +1,142 @@
+package client
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// GeoCacheConfig configures the lookup cache, a zero Size disables it
+type GeoCacheConfig struct {
+	// Size is the maximum number of cached IPs
+	Size int `json:"size"`
+
+	// TTL is how long a resolved country is kept
+	TTL utils.Duration `json:"ttl"`
+
+	// NegativeTTL is how long an IP without a country is kept
+	NegativeTTL utils.Duration `json:"negative_ttl"`
+}
+
+type cacheEntry struct {
+	ip      string
+	result  Result
+	expires time.Time
+}
+
+// CachedLocator is an LRU cache with TTL in front of another GeoLocator.
+// IPs the provider has no country for are cached as well (negative
+// caching); transient errors are not.
+type CachedLocator struct {
+	next        GeoLocator
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+
+	now func() time.Time
+}
+
+// NewCachedLocator wraps next with a cache
+func NewCachedLocator(next GeoLocator, config GeoCacheConfig) *CachedLocator {
+	return &CachedLocator{
+		next:        next,
+		size:        config.Size,
+		ttl:         config.TTL.Duration(),
+		negativeTTL: config.NegativeTTL.Duration(),
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+		now:         time.Now,
+	}
+}
+
+func (c *CachedLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	res, err := c.Locate(ctx, ip)
+	return res.Country, err
+}
+
+func (c *CachedLocator) Locate(ctx context.Context, ip string) (Result, error) {
+	if res, ok := c.get(ip); ok {
+		geoCacheLookups.WithLabelValues(cacheHit).Inc()
+		if res.Country == "" {
+			return Result{}, ErrCountryNotFound
+		}
+		return res, nil
+	}
+	geoCacheLookups.WithLabelValues(cacheMiss).Inc()
+
+	res, err := Locate(ctx, c.next, ip)
+	switch {
+	case err == nil:
+		c.add(ip, res, c.ttl)
+	case errors.Is(err, ErrCountryNotFound):
+		c.add(ip, Result{}, c.negativeTTL)
+	}
+
+	return res, err
+}
+
+// Len returns the number of cached entries, including expired ones
+func (c *CachedLocator) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CachedLocator) get(ip string) (Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[ip]
+	if !ok {
+		return Result{}, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, ip)
+		return Result{}, false
+	}
+
+	c.lru.MoveToFront(el)
+	return e.result, true
+}
+
+func (c *CachedLocator) add(ip string, res Result, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(ttl)
+	if el, ok := c.entries[ip]; ok {
+		e := el.Value.(*cacheEntry)
+		e.result = res
+		e.expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[ip] = c.lru.PushFront(&cacheEntry{
+		ip:      ip,
+		result:  res,
+		expires: expires,
+	})
+
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).ip)
+	}
+}
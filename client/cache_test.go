@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// countingLocator answers from a table and counts the calls
+type countingLocator struct {
+	table map[string]string
+	err   error
+	calls int
+}
+
+func (l *countingLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	l.calls++
+	if l.err != nil {
+		return "", l.err
+	}
+	if c, ok := l.table[ip]; ok {
+		return c, nil
+	}
+	return "", ErrCountryNotFound
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestCachedLocator(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	next := &countingLocator{table: map[string]string{
+		"1.1.1.1": "CY",
+		"2.2.2.2": "FR",
+		"3.3.3.3": "DE",
+	}}
+
+	c := NewCachedLocator(next, GeoCacheConfig{
+		Size:        2,
+		TTL:         utils.Duration(time.Minute),
+		NegativeTTL: utils.Duration(time.Second),
+	})
+	c.now = clock.now
+
+	// miss then hit
+	for i := 0; i < 2; i++ {
+		country, err := c.CountryByIP(ctx, "1.1.1.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "CY", country)
+	}
+	assert.Equal(t, 1, next.calls)
+
+	// negative caching
+	for i := 0; i < 2; i++ {
+		_, err := c.CountryByIP(ctx, "9.9.9.9")
+		assert.True(t, errors.Is(err, ErrCountryNotFound))
+	}
+	assert.Equal(t, 2, next.calls)
+
+	// negative entries expire with the negative TTL
+	clock.t = clock.t.Add(2 * time.Second)
+	c.CountryByIP(ctx, "9.9.9.9")
+	assert.Equal(t, 3, next.calls)
+
+	// LRU eviction: 1.1.1.1 is the least recently used one
+	c.CountryByIP(ctx, "2.2.2.2")
+	assert.Equal(t, 2, c.Len())
+	c.CountryByIP(ctx, "1.1.1.1")
+	assert.Equal(t, 5, next.calls)
+
+	// positive entries expire with the TTL
+	clock.t = clock.t.Add(2 * time.Minute)
+	c.CountryByIP(ctx, "1.1.1.1")
+	assert.Equal(t, 6, next.calls)
+}
+
+func TestCachedLocatorTransientError(t *testing.T) {
+	ctx := context.Background()
+	next := &countingLocator{err: errors.New("connection refused")}
+
+	c := NewCachedLocator(next, GeoCacheConfig{
+		Size:        10,
+		TTL:         utils.Duration(time.Minute),
+		NegativeTTL: utils.Duration(time.Minute),
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := c.CountryByIP(ctx, "1.1.1.1")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, next.calls)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	next := &countingLocator{table: map[string]string{"8.8.8.8": "US"}}
+	cached := NewCachedLocator(next, GeoCacheConfig{Size: 10, TTL: utils.Duration(time.Hour)})
+
+	// the cache is bypassed
+	assert.NoError(t, Check(ctx, cached, ""))
+	assert.NoError(t, Check(ctx, cached, ""))
+	assert.Equal(t, 2, next.calls)
+
+	// no country is an answer
+	assert.NoError(t, Check(ctx, cached, "10.0.0.1"))
+
+	next.err = errors.New("connection refused")
+	assert.Error(t, Check(ctx, cached, ""))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		name  string
+		input string
+		want  time.Duration
+	}{
+		{
+			name:  "missing header",
+			input: "",
+			want:  defaultRetryAfter,
+		},
+		{
+			name:  "delay seconds",
+			input: "120",
+			want:  2 * time.Minute,
+		},
+		{
+			name:  "HTTP date",
+			input: now.Add(30 * time.Second).Format(http.TimeFormat),
+			want:  30 * time.Second,
+		},
+		{
+			name:  "HTTP date in the past",
+			input: now.Add(-30 * time.Second).Format(http.TimeFormat),
+			want:  0,
+		},
+		{
+			name:  "garbage",
+			input: "soon",
+			want:  defaultRetryAfter,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseRetryAfter(tc.input, now))
+		})
+	}
+}
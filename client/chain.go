@@ -0,0 +1,280 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// chain modes
+const (
+	// ModeFallback asks the providers in order, the first answer wins
+	ModeFallback = "fallback"
+
+	// ModeConsensus asks all providers, a majority of them must agree
+	ModeConsensus = "consensus"
+)
+
+var ErrNoConsensus = errors.New("geolocation providers did not reach a consensus")
+
+// Result is a country lookup result
+type Result struct {
+	Country string
+
+	// Provider names the provider(s) which answered
+	Provider string
+
+	// Confidence is between 0 and 1
+	Confidence float64
+}
+
+// ResultLocator is a GeoLocator which can tell where its answer came from
+type ResultLocator interface {
+	GeoLocator
+	Locate(ctx context.Context, ip string) (Result, error)
+}
+
+// Locate returns the full result when geo is a ResultLocator, otherwise
+// the country with full confidence
+func Locate(ctx context.Context, geo GeoLocator, ip string) (Result, error) {
+	if rl, ok := geo.(ResultLocator); ok {
+		return rl.Locate(ctx, ip)
+	}
+
+	country, err := geo.CountryByIP(ctx, ip)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Country: country, Confidence: 1}, nil
+}
+
+// chainProvider is a provider with its chain settings
+type chainProvider struct {
+	name       string
+	geo        GeoLocator
+	timeout    time.Duration
+	confidence float64
+}
+
+// ChainLocator asks an ordered list of providers, either until one answers
+// (fallback) or all of them to take a majority vote (consensus). All
+// lookups share the defaultReqTimeout budget, each provider being allotted
+// its own part of it.
+type ChainLocator struct {
+	mode      string
+	providers []chainProvider
+	budget    time.Duration
+}
+
+func (c *ChainLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	res, err := c.Locate(ctx, ip)
+	return res.Country, err
+}
+
+func (c *ChainLocator) Locate(ctx context.Context, ip string) (Result, error) {
+	if ip == "" {
+		return Result{}, ErrMissingIP
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.budget)
+	defer cancel()
+
+	if c.mode == ModeConsensus {
+		return c.consensus(ctx, ip)
+	}
+	return c.fallback(ctx, ip)
+}
+
+// allotments returns the time each provider is given. Asked in turn, a
+// provider gets its timeout or an even share of what the timeouts leave of
+// the budget, so that a slow one can't use up the time of the next. Asked
+// together, they get their timeout or the whole budget.
+func (c *ChainLocator) allotments() []time.Duration {
+	allotted := make([]time.Duration, len(c.providers))
+	share := c.budget
+	if c.mode != ModeConsensus {
+		left, implicit := c.budget, 0
+		for _, p := range c.providers {
+			if p.timeout > 0 {
+				left -= p.timeout
+			} else {
+				implicit++
+			}
+		}
+		if implicit > 0 && left > 0 {
+			share = left / time.Duration(implicit)
+		} else {
+			share = 0
+		}
+	}
+	for i, p := range c.providers {
+		allotted[i] = share
+		if p.timeout > 0 {
+			allotted[i] = p.timeout
+		}
+		if allotted[i] > c.budget {
+			allotted[i] = c.budget
+		}
+	}
+	return allotted
+}
+
+func (c *ChainLocator) fallback(ctx context.Context, ip string) (Result, error) {
+	var errs []string
+	notFound := false
+
+	allotted := c.allotments()
+	for i, p := range c.providers {
+		// the time the next providers are owed is kept for them; what
+		// the previous ones left unused is lent to this one
+		owed := time.Duration(0)
+		for _, d := range allotted[i+1:] {
+			owed += d
+		}
+		timeout := allotted[i]
+		if deadline, ok := ctx.Deadline(); ok {
+			if spare := time.Until(deadline) - owed; spare > timeout {
+				timeout = spare
+			}
+		}
+
+		country, err := c.ask(ctx, p, timeout, allotted[i], ip)
+		if err == nil {
+			return Result{
+				Country:    country,
+				Provider:   p.name,
+				Confidence: p.confidence,
+			}, nil
+		}
+
+		if errors.Is(err, ErrMissingIP) || errors.Is(err, ErrInvalidIP) {
+			return Result{}, err
+		}
+		if errors.Is(err, ErrCountryNotFound) {
+			notFound = true
+		}
+		errs = append(errs, p.name+": "+err.Error())
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if notFound {
+		return Result{}, ErrCountryNotFound
+	}
+	return Result{}, errors.Errorf("all geolocation providers failed: %s", strings.Join(errs, "; "))
+}
+
+type vote struct {
+	provider chainProvider
+	country  string
+	err      error
+}
+
+func (c *ChainLocator) consensus(ctx context.Context, ip string) (Result, error) {
+	votes := make([]vote, len(c.providers))
+
+	allotted := c.allotments()
+	var wg sync.WaitGroup
+	for i, p := range c.providers {
+		wg.Add(1)
+		go func(i int, p chainProvider) {
+			defer wg.Done()
+			country, err := c.ask(ctx, p, allotted[i], allotted[i], ip)
+			votes[i] = vote{provider: p, country: country, err: err}
+		}(i, p)
+	}
+	wg.Wait()
+
+	// an unknown IP is a vote for "no country"
+	counts := map[string]int{}
+	weights := map[string]float64{}
+	names := map[string][]string{}
+	total := 0.0
+	var errs []string
+	for _, v := range votes {
+		switch {
+		case v.err == nil:
+		case errors.Is(v.err, ErrMissingIP), errors.Is(v.err, ErrInvalidIP):
+			return Result{}, v.err
+		case errors.Is(v.err, ErrCountryNotFound):
+			v.country = ""
+		default:
+			errs = append(errs, v.provider.name+": "+v.err.Error())
+			continue
+		}
+		counts[v.country]++
+		weights[v.country] += v.provider.confidence
+		names[v.country] = append(names[v.country], v.provider.name)
+		total += v.provider.confidence
+	}
+
+	// deterministic winner: most votes, then most weight, then name
+	candidates := make([]string, 0, len(counts))
+	for country := range counts {
+		candidates = append(candidates, country)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		if weights[a] != weights[b] {
+			return weights[a] > weights[b]
+		}
+		return a < b
+	})
+
+	if len(candidates) == 0 || counts[candidates[0]]*2 <= len(c.providers) {
+		if len(errs) > 0 {
+			return Result{}, errors.Wrap(ErrNoConsensus, strings.Join(errs, "; "))
+		}
+		return Result{}, ErrNoConsensus
+	}
+
+	winner := candidates[0]
+	if winner == "" {
+		return Result{}, ErrCountryNotFound
+	}
+
+	return Result{
+		Country:    winner,
+		Provider:   strings.Join(names[winner], ","),
+		Confidence: weights[winner] / total,
+	}, nil
+}
+
+// allotmentKey is the context key of the time a provider is allotted
+type allotmentKey struct{}
+
+// withAllotment tells the provider asked with ctx how long it is allotted
+func withAllotment(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, allotmentKey{}, d)
+}
+
+// allotmentFrom returns the time allotted to the provider asked with ctx
+func allotmentFrom(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(allotmentKey{}).(time.Duration)
+	return d, ok
+}
+
+// ask queries a provider within timeout, telling it the time it's
+// allotted: running out of time before, the budget or the caller's
+// deadline reached, isn't its failure
+func (c *ChainLocator) ask(ctx context.Context, p chainProvider, timeout, allotted time.Duration, ip string) (string, error) {
+	ctx = withAllotment(ctx, allotted)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	country, err := p.geo.CountryByIP(ctx, ip)
+	geoLookups.WithLabelValues(p.name, lookupOutcome(ctx, err)).Inc()
+	return country, err
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// slowLocator answers after a delay unless the context is done first
+type slowLocator struct {
+	delay   time.Duration
+	country string
+}
+
+func (l *slowLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	select {
+	case <-time.After(l.delay):
+		return l.country, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func newChain(mode string, providers ...chainProvider) *ChainLocator {
+	return &ChainLocator{
+		mode:      mode,
+		providers: providers,
+		budget:    defaultReqTimeout,
+	}
+}
+
+func fixed(name, country string, confidence float64) chainProvider {
+	return chainProvider{
+		name:       name,
+		geo:        &countingLocator{table: map[string]string{"1.1.1.1": country}},
+		confidence: confidence,
+	}
+}
+
+func failing(name string) chainProvider {
+	return chainProvider{
+		name:       name,
+		geo:        &countingLocator{err: errors.New("boom")},
+		confidence: 1,
+	}
+}
+
+func TestChainFallback(t *testing.T) {
+	ctx := context.Background()
+
+	c := newChain(ModeFallback, failing("ipapi"), fixed("mmdb", "CY", 0.8))
+	res, err := c.Locate(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Country: "CY", Provider: "mmdb", Confidence: 0.8}, res)
+
+	c = newChain(ModeFallback, failing("ipapi"), failing("mmdb"))
+	_, err = c.Locate(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ipapi: boom")
+	assert.Contains(t, err.Error(), "mmdb: boom")
+
+	// an unknown IP is asked further down the chain, then reported as such
+	c = newChain(ModeFallback, fixed("static", "CY", 1), failing("mmdb"))
+	_, err = c.Locate(ctx, "2.2.2.2")
+	assert.True(t, errors.Is(err, ErrCountryNotFound))
+}
+
+func TestChainFallbackTimeoutBudget(t *testing.T) {
+	c := newChain(ModeFallback,
+		chainProvider{name: "slow", geo: &slowLocator{delay: time.Second, country: "FR"}, confidence: 1},
+		fixed("fast", "CY", 1),
+	)
+	c.budget = 100 * time.Millisecond
+
+	start := time.Now()
+	res, err := c.Locate(context.Background(), "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", res.Provider)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestChainBreakers(t *testing.T) {
+	breaker := func(geo GeoLocator) *CircuitBreaker {
+		return NewCircuitBreaker(geo, CircuitBreakerConfig{Failures: 1, Cooldown: utils.Duration(time.Minute)})
+	}
+	slow := breaker(&slowLocator{delay: time.Second, country: "FR"})
+	fast := breaker(&countingLocator{table: map[string]string{"1.1.1.1": "CY"}})
+	c := newChain(ModeFallback,
+		chainProvider{name: "slow", geo: slow, timeout: 40 * time.Millisecond, confidence: 1},
+		chainProvider{name: "fast", geo: fast, confidence: 1},
+	)
+	c.budget = 100 * time.Millisecond
+
+	// the caller's deadline cuts the slow provider short: not its failure
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Locate(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	assert.False(t, slow.Open())
+	assert.False(t, fast.Open())
+
+	// given its time, the slow provider fails, the next one has its own
+	res, err := c.Locate(context.Background(), "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", res.Provider)
+	assert.True(t, slow.Open())
+}
+
+func TestChainLookupMetrics(t *testing.T) {
+	c := newChain(ModeFallback,
+		chainProvider{name: "m-slow", geo: &slowLocator{delay: time.Second}, confidence: 1},
+		failing("m-failing"),
+		fixed("m-static", "CY", 1),
+	)
+	c.budget = 30 * time.Millisecond
+
+	c.Locate(context.Background(), "1.1.1.1")
+	c.Locate(context.Background(), "2.2.2.2")
+
+	for _, tc := range []struct {
+		provider, outcome string
+		count             float64
+	}{
+		{"m-slow", outcomeTimeout, 2},
+		{"m-failing", outcomeError, 2},
+		{"m-static", outcomeSuccess, 1},
+		{"m-static", outcomeNotFound, 1},
+	} {
+		assert.Equal(t, tc.count, geoLookups.WithLabelValues(tc.provider, tc.outcome).Value(),
+			tc.provider+" "+tc.outcome)
+	}
+}
+
+func TestChainConsensus(t *testing.T) {
+	ctx := context.Background()
+
+	c := newChain(ModeConsensus,
+		fixed("ipapi", "CY", 1),
+		fixed("ip-api", "GR", 0.5),
+		fixed("mmdb", "CY", 1),
+	)
+	res, err := c.Locate(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CY", res.Country)
+	assert.Equal(t, "ipapi,mmdb", res.Provider)
+	assert.InDelta(t, 0.8, res.Confidence, 0.0001)
+
+	// 1 out of 3 is not a majority
+	c = newChain(ModeConsensus,
+		fixed("ipapi", "CY", 1),
+		failing("ip-api"),
+		failing("mmdb"),
+	)
+	_, err = c.Locate(ctx, "1.1.1.1")
+	assert.True(t, errors.Is(err, ErrNoConsensus))
+
+	// a majority may agree the IP is unknown
+	c = newChain(ModeConsensus,
+		fixed("ipapi", "CY", 1),
+		fixed("ip-api", "CY", 1),
+		fixed("mmdb", "DE", 1),
+	)
+	_, err = c.Locate(ctx, "2.2.2.2")
+	assert.True(t, errors.Is(err, ErrCountryNotFound))
+}
+
+func TestIPAPIComLocator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/1.1.1.1":
+			json.NewEncoder(w).Encode(ipapiComResponse{Status: "success", CountryCode: "CY"})
+		default:
+			json.NewEncoder(w).Encode(ipapiComResponse{Status: "fail", Message: "reserved range"})
+		}
+	}))
+	defer srv.Close()
+
+	l := NewIPAPIComLocator(srv.URL)
+
+	country, err := l.CountryByIP(context.Background(), "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CY", country)
+
+	_, err = l.CountryByIP(context.Background(), "127.0.0.1")
+	assert.True(t, errors.Is(err, ErrCountryNotFound))
+}
+
+func TestNewGeoLocatorChain(t *testing.T) {
+	geo, err := NewGeoLocator(GeoLocatorConfig{
+		Mode: ModeConsensus,
+		Providers: []ProviderConfig{
+			{Name: "a", Provider: ProviderStatic, StaticTable: map[string]string{"1.1.1.1": "CY"}},
+			{Name: "b", Provider: ProviderStatic, StaticTable: map[string]string{"1.1.1.1": "CY"}, Confidence: 0.5},
+		},
+	})
+	assert.NoError(t, err)
+
+	res, err := Locate(context.Background(), geo, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Country: "CY", Provider: "a,b", Confidence: 1}, res)
+
+	_, err = NewGeoLocator(GeoLocatorConfig{Mode: "vote"})
+	assert.Error(t, err)
+
+	// asked in turn, the providers can't be given more than the budget
+	_, err = NewGeoLocator(GeoLocatorConfig{
+		Providers: []ProviderConfig{
+			{Provider: ProviderStatic, Timeout: utils.Duration(6 * time.Second)},
+			{Provider: ProviderStatic, Timeout: utils.Duration(6 * time.Second)},
+		},
+	})
+	assert.Error(t, err)
+}
@@ -2,35 +2,104 @@ package client
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/tracing"
 )
 
 const (
-	// IPAPIURL https://ipapi.co/api/#complete-location
-	IPAPIURL = "https://ipapi.co/:ip/country/"
+	// IPAPIBaseURL is the ipapi.co service, https://ipapi.co/api/#complete-location
+	IPAPIBaseURL = "https://ipapi.co"
+
+	// IPAPIURL is the country lookup endpoint
+	IPAPIURL = IPAPIBaseURL + ipapiCountryPath
+
+	ipapiCountryPath = "/:ip/country/"
 
 	// default request timeout, 10s
 	defaultReqTimeout = time.Duration(10) * time.Second
+
+	// default back-off on a 429 without a usable Retry-After header
+	defaultRetryAfter = time.Duration(60) * time.Second
+
+	// ipapiUndefined is returned by ipapi.co for reserved/unknown IPs
+	ipapiUndefined = "Undefined"
+
+	// maxResponseLen caps the lookup responses read, a country code or a
+	// small JSON document
+	maxResponseLen = 4 << 10
+)
+
+var (
+	ErrMissingIP       = errors.New("missing IP")
+	ErrInvalidIP       = errors.New("Invalid IP")
+	ErrCountryNotFound = errors.New("country not found")
 )
 
+// RateLimitError is returned when the provider throttles us; no request is
+// sent to the provider before RetryAfter has passed
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "geolocation provider rate limit exceeded, retry after " + e.RetryAfter.String()
+}
+
+// defaultIPAPI backs IPAPI_GetCountryNameByIP
+var defaultIPAPI = NewIPAPILocator("")
+
 func IPAPI_GetCountryNameByIP(ctx context.Context, ip string) (string, error) {
+	return defaultIPAPI.CountryByIP(ctx, ip)
+}
+
+// IPAPILocator resolves countries through the ipapi.co web service.
+// It honors the Retry-After header of 429 responses.
+type IPAPILocator struct {
+	client  *http.Client
+	baseURL string
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// NewIPAPILocator returns a GeoLocator backed by the ipapi.co compatible
+// service at baseURL, an empty baseURL means IPAPIBaseURL
+func NewIPAPILocator(baseURL string) *IPAPILocator {
+	if baseURL == "" {
+		baseURL = IPAPIBaseURL
+	}
+	return &IPAPILocator{
+		client:  &http.Client{Transport: tracing.Transport(nil)},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (l *IPAPILocator) CountryByIP(ctx context.Context, ip string) (string, error) {
 
 	if ip == "" {
-		return "", errors.New("missing IP")
+		return "", ErrMissingIP
 	}
 
 	if r := net.ParseIP(ip); r == nil {
-		return "", errors.New("Invalid IP")
+		return "", ErrInvalidIP
+	}
+
+	if wait := l.retryAfter(); wait > 0 {
+		return "", &RateLimitError{RetryAfter: wait}
 	}
 
 	repl := strings.NewReplacer(":ip", ip)
-	uri := repl.Replace(IPAPIURL)
+	uri := l.baseURL + repl.Replace(ipapiCountryPath)
 
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 	if err != nil {
@@ -40,21 +109,64 @@ func IPAPI_GetCountryNameByIP(ctx context.Context, ip string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, defaultReqTimeout)
 	defer cancel()
 
-	client := http.Client{}
-	rsp, err := client.Do(req.WithContext(ctx))
+	rsp, err := l.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", errors.Wrap(err, "GET /:ip/country/ request failed")
 	}
 	defer rsp.Body.Close()
 
+	if rsp.StatusCode == http.StatusTooManyRequests {
+		wait := parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())
+		l.blockFor(wait)
+		return "", &RateLimitError{RetryAfter: wait}
+	}
+
 	if rsp.StatusCode != http.StatusOK {
-		return "", errors.Wrap(err, "GET  /:ip/country/  request failed")
+		return "", errors.Errorf("GET /:ip/country/ request failed with status %d", rsp.StatusCode)
 	}
 
-	country, err := ioutil.ReadAll(rsp.Body)
+	country, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxResponseLen))
 	if err != nil {
 		return "", err
 	}
 
-	return string(country), nil
+	cc := strings.TrimSpace(string(country))
+	if cc == "" || cc == ipapiUndefined {
+		return "", ErrCountryNotFound
+	}
+
+	return cc, nil
+}
+
+// retryAfter returns how long requests are still blocked after a 429
+func (l *IPAPILocator) retryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.blockedUntil)
+}
+
+func (l *IPAPILocator) blockFor(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blockedUntil = time.Now().Add(d)
+}
+
+// parseRetryAfter handles both the delay-seconds and HTTP-date forms
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return defaultRetryAfter
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+
+	return defaultRetryAfter
 }
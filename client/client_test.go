@@ -2,14 +2,22 @@ package client_test
 
 import (
 	"context"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/client/ipapitest"
 	"github.com/pkg/errors"
 )
 
 func TestIPAPI_GetCountryNameByIP(t *testing.T) {
 
+	srv := ipapitest.NewServer(map[string]string{
+		"20.188.40.63": "FR",
+	})
+	defer srv.Close()
+
 	tt := []struct {
 		name   string
 		input  string
@@ -28,14 +36,30 @@ func TestIPAPI_GetCountryNameByIP(t *testing.T) {
 			want:   "",
 			expErr: errors.New("Invalid IP"),
 		},
+		{
+			name:   "missing IP",
+			input:  "",
+			want:   "",
+			expErr: client.ErrMissingIP,
+		},
+		{
+			name:   "reserved IP",
+			input:  "127.0.0.1",
+			want:   "",
+			expErr: client.ErrCountryNotFound,
+		},
 	}
 	ctx := context.Background()
+	geo := client.NewIPAPILocator(srv.URL())
 
 	for _, tc := range tt {
 
 		t.Run(tc.name, func(t *testing.T) {
-			country, err := client.IPAPI_GetCountryNameByIP(ctx, tc.input)
-			if err != nil && tc.expErr != nil && tc.expErr.Error() != err.Error() {
+			country, err := geo.CountryByIP(ctx, tc.input)
+			if (err != nil) != (tc.expErr != nil) {
+				t.Fatalf("expected error %v, actual error %v", tc.expErr, err)
+			}
+			if err != nil && tc.expErr.Error() != err.Error() {
 				t.Errorf("expected error %v, actual error %v", tc.expErr, err)
 			}
 
@@ -45,3 +69,59 @@ func TestIPAPI_GetCountryNameByIP(t *testing.T) {
 		})
 	}
 }
+
+func TestIPAPIServerError(t *testing.T) {
+	srv := ipapitest.NewServer(map[string]string{"20.188.40.63": "FR"})
+	defer srv.Close()
+
+	geo := client.NewIPAPILocator(srv.URL())
+	srv.FailNext(1, http.StatusBadGateway)
+
+	_, err := geo.CountryByIP(context.Background(), "20.188.40.63")
+	if err == nil {
+		t.Fatalf("expected an error on 502")
+	}
+
+	country, err := geo.CountryByIP(context.Background(), "20.188.40.63")
+	if err != nil || country != "FR" {
+		t.Errorf("expected FR once the server recovered, received %v, %v", country, err)
+	}
+}
+
+func TestIPAPIRateLimit(t *testing.T) {
+	srv := ipapitest.NewServer(map[string]string{"20.188.40.63": "FR"})
+	defer srv.Close()
+
+	geo := client.NewIPAPILocator(srv.URL())
+	srv.RateLimitNext(1, "3600")
+
+	_, err := geo.CountryByIP(context.Background(), "20.188.40.63")
+	var rlErr *client.RateLimitError
+	if !errors.As(err, &rlErr) || rlErr.RetryAfter != time.Hour {
+		t.Fatalf("expected a rate limit error with a 1h retry after, actual error %v", err)
+	}
+
+	// no request goes out before Retry-After has passed
+	_, err = geo.CountryByIP(context.Background(), "20.188.40.63")
+	if !errors.As(err, &rlErr) {
+		t.Errorf("expected a rate limit error, actual error %v", err)
+	}
+	if srv.Requests() != 1 {
+		t.Errorf("expected 1 request, received %d", srv.Requests())
+	}
+}
+
+func TestIPAPILatency(t *testing.T) {
+	srv := ipapitest.NewServer(map[string]string{"20.188.40.63": "FR"})
+	defer srv.Close()
+
+	geo := client.NewIPAPILocator(srv.URL())
+	srv.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := geo.CountryByIP(ctx, "20.188.40.63"); err == nil {
+		t.Errorf("expected a timeout error")
+	}
+}
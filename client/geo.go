@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// supported geolocation providers
+const (
+	ProviderIPAPI    = "ipapi"
+	ProviderIPAPICom = "ip-api"
+	ProviderMMDB     = "mmdb"
+	ProviderStatic   = "static"
+)
+
+// GeoLocator resolves the 2-letter country code of a client IP address
+type GeoLocator interface {
+	CountryByIP(ctx context.Context, ip string) (string, error)
+}
+
+// ProviderConfig configures one provider of a chain
+type ProviderConfig struct {
+	// Name identifies the provider in results and metrics, defaults to
+	// Provider
+	Name string `json:"name"`
+
+	// Provider is one of ipapi, ip-api, mmdb or static
+	Provider string `json:"provider"`
+
+	// URL is the base URL of the ipapi or ip-api provider
+	URL string `json:"url"`
+
+	// MMDBPath is the path to a MaxMind GeoLite2/GeoIP2 country or city
+	// .mmdb file, used by the mmdb provider
+	MMDBPath string `json:"mmdb_path"`
+
+	// StaticTable maps CIDRs (or single IPs) to country codes, used by the
+	// static provider
+	StaticTable map[string]string `json:"static_table"`
+
+	// Timeout bounds a lookup, by default a provider gets an even share of
+	// the remaining request budget
+	Timeout utils.Duration `json:"timeout"`
+
+	// Confidence is how much the provider is trusted, between 0 and 1,
+	// defaults to 1
+	Confidence float64 `json:"confidence"`
+}
+
+// GeoLocatorConfig selects and configures the geolocation provider(s)
+type GeoLocatorConfig struct {
+	// Provider is one of ipapi, ip-api, mmdb or static, defaults to ipapi.
+	// Ignored when Providers is set.
+	Provider string `json:"provider"`
+
+	// IPAPIURL is the base URL of the ipapi provider, defaults to
+	// IPAPIBaseURL
+	IPAPIURL string `json:"ipapi_url"`
+
+	// MMDBPath is the .mmdb file of the mmdb provider
+	MMDBPath string `json:"mmdb_path"`
+
+	// StaticTable is the CIDR to country table of the static provider
+	StaticTable map[string]string `json:"static_table"`
+
+	// Providers is an ordered chain of providers
+	Providers []ProviderConfig `json:"providers"`
+
+	// Mode is fallback (default) or consensus
+	Mode string `json:"mode"`
+
+	Cache GeoCacheConfig `json:"cache"`
+
+	// CircuitBreaker applies to each provider
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+}
+
+// NewGeoLocator returns the GeoLocator selected by the config: a chain of
+// providers, each behind the configured circuit breaker, with the cache in
+// front of the chain
+func NewGeoLocator(config GeoLocatorConfig) (GeoLocator, error) {
+	mode := config.Mode
+	switch mode {
+	case "":
+		mode = ModeFallback
+	case ModeFallback, ModeConsensus:
+	default:
+		return nil, errors.Errorf("unknown geolocation mode %q", config.Mode)
+	}
+
+	providers := config.Providers
+	if len(providers) == 0 {
+		providers = []ProviderConfig{{
+			Provider:    config.Provider,
+			URL:         config.IPAPIURL,
+			MMDBPath:    config.MMDBPath,
+			StaticTable: config.StaticTable,
+		}}
+	}
+
+	chain := &ChainLocator{
+		mode:   mode,
+		budget: defaultReqTimeout,
+	}
+	for _, pc := range providers {
+		provider, err := newProvider(pc)
+		if err != nil {
+			return nil, err
+		}
+
+		name := pc.Name
+		if name == "" {
+			name = pc.Provider
+		}
+		if name == "" {
+			name = ProviderIPAPI
+		}
+
+		confidence := pc.Confidence
+		if confidence <= 0 || confidence > 1 {
+			confidence = 1
+		}
+
+		var geo GeoLocator = &timedLocator{next: provider, provider: name}
+		if config.CircuitBreaker.Failures > 0 {
+			geo = NewCircuitBreaker(geo, config.CircuitBreaker)
+		}
+
+		chain.providers = append(chain.providers, chainProvider{
+			name:       name,
+			geo:        geo,
+			timeout:    pc.Timeout.Duration(),
+			confidence: confidence,
+		})
+	}
+
+	if mode == ModeFallback {
+		total := time.Duration(0)
+		for _, p := range chain.providers {
+			total += p.timeout
+		}
+		if total > chain.budget {
+			return nil, errors.Errorf("the provider timeouts add up to more than the %s budget", chain.budget)
+		}
+	}
+
+	if config.Cache.Size > 0 {
+		return NewCachedLocator(chain, config.Cache), nil
+	}
+	return chain, nil
+}
+
+func newProvider(config ProviderConfig) (GeoLocator, error) {
+	switch config.Provider {
+	case "", ProviderIPAPI:
+		return NewIPAPILocator(config.URL), nil
+	case ProviderIPAPICom:
+		return NewIPAPIComLocator(config.URL), nil
+	case ProviderMMDB:
+		return NewMMDBLocator(config.MMDBPath)
+	case ProviderStatic:
+		return NewStaticLocator(config.StaticTable)
+	}
+	return nil, errors.Errorf("unknown geolocation provider %q", config.Provider)
+}
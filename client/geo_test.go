@@ -0,0 +1,152 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arpsch/xm/client"
+)
+
+func TestStaticLocator(t *testing.T) {
+
+	table := map[string]string{
+		"185.193.148.0/22": "cy",
+		"185.193.151.0/24": "GR",
+		"20.188.40.63":     "FR",
+		"2a02:1388::/32":   "CY",
+	}
+
+	l, err := client.NewStaticLocator(table)
+	if err != nil {
+		t.Fatalf("failed to build static locator: %v", err)
+	}
+
+	tt := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "IPv4 network",
+			input: "185.193.149.1",
+			want:  "CY",
+		},
+		{
+			name:  "most specific network wins",
+			input: "185.193.151.255",
+			want:  "GR",
+		},
+		{
+			name:  "single IP entry",
+			input: "20.188.40.63",
+			want:  "FR",
+		},
+		{
+			name:  "IPv6 network",
+			input: "2a02:1388:1::1",
+			want:  "CY",
+		},
+		{
+			name:    "unknown IP",
+			input:   "127.0.0.1",
+			wantErr: true,
+		},
+		{
+			name:    "invalid IP",
+			input:   "20.188.40.63.0",
+			wantErr: true,
+		},
+	}
+
+	ctx := context.Background()
+
+	for _, tc := range tt {
+
+		t.Run(tc.name, func(t *testing.T) {
+			country, err := l.CountryByIP(ctx, tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, actual error %v", tc.wantErr, err)
+			}
+
+			if country != tc.want {
+				t.Errorf("expected country %v, received country %v", tc.want, country)
+			}
+		})
+	}
+}
+
+func TestStaticLocatorSameNetwork(t *testing.T) {
+	// the same network, written twice
+	_, err := client.NewStaticLocator(map[string]string{
+		"10.0.0.0/8": "CY",
+		"10.1.2.3/8": "GR",
+	})
+	if err == nil {
+		t.Fatal("expected an error for a network mapped to two countries")
+	}
+
+	l, err := client.NewStaticLocator(map[string]string{
+		"10.0.0.0/8": "CY",
+		"10.1.2.3/8": "cy",
+	})
+	if err != nil {
+		t.Fatalf("failed to build static locator: %v", err)
+	}
+	country, err := l.CountryByIP(context.Background(), "10.2.0.1")
+	if err != nil || country != "CY" {
+		t.Errorf("expected country CY, received country %v, error %v", country, err)
+	}
+}
+
+func TestNewGeoLocator(t *testing.T) {
+
+	tt := []struct {
+		name    string
+		config  client.GeoLocatorConfig
+		wantErr bool
+	}{
+		{
+			name:   "default provider",
+			config: client.GeoLocatorConfig{},
+		},
+		{
+			name: "static provider",
+			config: client.GeoLocatorConfig{
+				Provider:    client.ProviderStatic,
+				StaticTable: map[string]string{"10.0.0.0/8": "CY"},
+			},
+		},
+		{
+			name: "static provider with invalid CIDR",
+			config: client.GeoLocatorConfig{
+				Provider:    client.ProviderStatic,
+				StaticTable: map[string]string{"10.0.0.0/33": "CY"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "mmdb provider without a file",
+			config: client.GeoLocatorConfig{
+				Provider: client.ProviderMMDB,
+				MMDBPath: "/nonexistent/GeoLite2-Country.mmdb",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown provider",
+			config:  client.GeoLocatorConfig{Provider: "carrier-pigeon"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.NewGeoLocator(tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, actual error %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultProbeIP is looked up to check the geolocation providers
+const DefaultProbeIP = "8.8.8.8"
+
+// Check tells whether the providers behind geo answer a lookup of ip. The
+// cache is bypassed; an IP without a country still proves the providers
+// are up.
+func Check(ctx context.Context, geo GeoLocator, ip string) error {
+	if c, ok := geo.(*CachedLocator); ok {
+		geo = c.next
+	}
+	if ip == "" {
+		ip = DefaultProbeIP
+	}
+
+	_, err := geo.CountryByIP(ctx, ip)
+	if errors.Is(err, ErrCountryNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/tracing"
+)
+
+const (
+	// IPAPIComBaseURL is the ip-api.com service, https://ip-api.com/docs/api:json
+	IPAPIComBaseURL = "http://ip-api.com"
+
+	ipapiComJSONPath = "/json/:ip?fields=status,message,countryCode"
+
+	ipapiComSuccess = "success"
+)
+
+// IPAPIComLocator resolves countries through an ip-api.com compatible
+// JSON service
+type IPAPIComLocator struct {
+	client  *http.Client
+	baseURL string
+}
+
+type ipapiComResponse struct {
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	CountryCode string `json:"countryCode"`
+}
+
+// NewIPAPIComLocator returns a GeoLocator backed by the ip-api.com
+// compatible service at baseURL, an empty baseURL means IPAPIComBaseURL
+func NewIPAPIComLocator(baseURL string) *IPAPIComLocator {
+	if baseURL == "" {
+		baseURL = IPAPIComBaseURL
+	}
+	return &IPAPIComLocator{
+		client:  &http.Client{Transport: tracing.Transport(nil)},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (l *IPAPIComLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	if ip == "" {
+		return "", ErrMissingIP
+	}
+
+	if r := net.ParseIP(ip); r == nil {
+		return "", ErrInvalidIP
+	}
+
+	repl := strings.NewReplacer(":ip", ip)
+	uri := l.baseURL + repl.Replace(ipapiComJSONPath)
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request for GET /json/:ip")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultReqTimeout)
+	defer cancel()
+
+	rsp, err := l.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "GET /json/:ip request failed")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusTooManyRequests {
+		return "", &RateLimitError{RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())}
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("GET /json/:ip request failed with status %d", rsp.StatusCode)
+	}
+
+	var body ipapiComResponse
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, maxResponseLen)).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "failed to decode GET /json/:ip response")
+	}
+
+	if body.Status != ipapiComSuccess || body.CountryCode == "" {
+		return "", ErrCountryNotFound
+	}
+
+	return body.CountryCode, nil
+}
@@ -0,0 +1,143 @@
+// Package ipapitest provides a local stand-in for the ipapi.co
+// GET /:ip/country/ endpoint, for hermetic tests
+package ipapitest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Undefined is what ipapi.co answers for reserved or unknown IPs
+const Undefined = "Undefined"
+
+// Server serves countries from a fixture table. Latency and failures can
+// be injected while the server is running.
+type Server struct {
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	fixtures   map[string]string
+	latency    time.Duration
+	failures   []int
+	retryAfter string
+	requests   int
+}
+
+// NewServer starts a server answering from the IP to country fixtures.
+// Close it when done.
+func NewServer(fixtures map[string]string) *Server {
+	s := &Server{
+		fixtures: map[string]string{},
+	}
+	for ip, c := range fixtures {
+		s.fixtures[ip] = c
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL is the base URL to configure the ipapi client with
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetCountry adds or replaces a fixture
+func (s *Server) SetCountry(ip, country string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures[ip] = country
+}
+
+// SetLatency delays every response by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// FailNext answers the next n requests with the given status code
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// RateLimitNext answers the next n requests with 429 and the given
+// Retry-After header value (omitted when empty)
+func (s *Server) RateLimitNext(n int, retryAfter string) {
+	s.mu.Lock()
+	s.retryAfter = retryAfter
+	s.mu.Unlock()
+	s.FailNext(n, http.StatusTooManyRequests)
+}
+
+// Requests returns the number of requests served so far
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	latency := s.latency
+	status := 0
+	if len(s.failures) > 0 {
+		status = s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	retryAfter := s.retryAfter
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if status != 0 {
+		if status == http.StatusTooManyRequests && retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		http.Error(w, strconv.Itoa(status)+" injected failure", status)
+		return
+	}
+
+	// /:ip/country/
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) != 2 || parts[1] != "country" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ip := parts[0]
+	if net.ParseIP(ip) == nil {
+		http.Error(w, `{"error": true, "reason": "Invalid IP Address"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	country, ok := s.fixtures[ip]
+	s.mu.Unlock()
+	if !ok {
+		country = Undefined
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(country))
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/metrics"
+)
+
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+// lookup outcomes
+const (
+	outcomeSuccess     = "success"
+	outcomeNotFound    = "not_found"
+	outcomeInvalidIP   = "invalid_ip"
+	outcomeCircuitOpen = "circuit_open"
+	outcomeTimeout     = "timeout"
+	outcomeCanceled    = "canceled"
+	outcomeError       = "error"
+)
+
+var (
+	geoCacheLookups = metrics.NewCounterVec(
+		"xm_geo_cache_lookups_total",
+		"Geolocation cache lookups by result (hit or miss).",
+		"result")
+
+	geoCacheHitRatio = metrics.NewGaugeFunc(
+		"xm_geo_cache_hit_ratio",
+		"Ratio of geolocation lookups served from the cache.",
+		func() float64 {
+			hits := geoCacheLookups.WithLabelValues(cacheHit).Value()
+			misses := geoCacheLookups.WithLabelValues(cacheMiss).Value()
+			if hits+misses == 0 {
+				return 0
+			}
+			return hits / (hits + misses)
+		})
+
+	geoProviderLatency = metrics.NewHistogramVec(
+		"xm_geo_provider_request_duration_seconds",
+		"Latency of geolocation provider lookups.",
+		nil,
+		"provider")
+
+	geoLookups = metrics.NewCounterVec(
+		"xm_geo_lookups_total",
+		"Geolocation provider lookups by provider and outcome.",
+		"provider", "outcome")
+
+	geoBreakerTrips = metrics.NewCounterVec(
+		"xm_geo_circuit_breaker_trips_total",
+		"Number of times the geolocation circuit breaker opened.")
+)
+
+func init() {
+	metrics.MustRegister(
+		geoCacheLookups,
+		geoCacheHitRatio,
+		geoProviderLatency,
+		geoLookups,
+		geoBreakerTrips,
+	)
+}
+
+// timedLocator records the latency of every provider lookup and logs the
+// failures with the request
+type timedLocator struct {
+	next     GeoLocator
+	provider string
+}
+
+func (l *timedLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	start := time.Now()
+	defer geoProviderLatency.WithLabelValues(l.provider).ObserveSince(start)
+
+	country, err := l.next.CountryByIP(ctx, ip)
+	if isProviderFailure(ctx, err) {
+		logging.FromContext(ctx).Warn("geoip lookup failed",
+			"provider", l.provider, "ip", ip, "latency", time.Since(start), "error", err)
+	}
+	return country, err
+}
+
+// lookupOutcome classifies the result of a provider lookup
+func lookupOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case errors.Is(err, ErrCountryNotFound):
+		return outcomeNotFound
+	case errors.Is(err, ErrMissingIP), errors.Is(err, ErrInvalidIP):
+		return outcomeInvalidIP
+	case errors.Is(err, ErrCircuitOpen):
+		return outcomeCircuitOpen
+	case errors.Is(err, context.DeadlineExceeded), ctx.Err() == context.DeadlineExceeded:
+		return outcomeTimeout
+	case ctx.Err() == context.Canceled:
+		return outcomeCanceled
+	}
+	return outcomeError
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+// MMDBLocator resolves countries offline from a MaxMind .mmdb file
+type MMDBLocator struct {
+	reader *maxminddb.Reader
+}
+
+// mmdbRecord is the subset of the GeoLite2 record we are interested in
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewMMDBLocator opens the .mmdb file at the given path
+func NewMMDBLocator(path string) (*MMDBLocator, error) {
+	if path == "" {
+		return nil, errors.New("missing mmdb path")
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mmdb file")
+	}
+
+	return &MMDBLocator{
+		reader: reader,
+	}, nil
+}
+
+func (l *MMDBLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	if ip == "" {
+		return "", ErrMissingIP
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", ErrInvalidIP
+	}
+
+	var rec mmdbRecord
+	if err := l.reader.Lookup(addr, &rec); err != nil {
+		return "", errors.Wrap(err, "mmdb lookup failed")
+	}
+
+	if rec.Country.ISOCode == "" {
+		return "", ErrCountryNotFound
+	}
+
+	return rec.Country.ISOCode, nil
+}
+
+// Close releases the underlying mmdb file
+func (l *MMDBLocator) Close() error {
+	return l.reader.Close()
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+type staticEntry struct {
+	network *net.IPNet
+	country string
+}
+
+func (e staticEntry) prefixLen() int {
+	ones, _ := e.network.Mask.Size()
+	return ones
+}
+
+// StaticLocator resolves countries from a fixed CIDR to country table.
+// When several networks contain the IP, the most specific one wins.
+type StaticLocator struct {
+	// entries are sorted from the most specific network
+	entries []staticEntry
+}
+
+// NewStaticLocator builds a StaticLocator from a CIDR (or single IP) to
+// country code table. A network listed twice, e.g. as "10.0.0.0/8" and
+// "10.1.0.0/8", must map to the same country.
+func NewStaticLocator(table map[string]string) (*StaticLocator, error) {
+	l := &StaticLocator{}
+
+	countries := map[string]string{}
+	for cidr, country := range table {
+		network, err := utils.ParseNetwork(cidr)
+		if err != nil {
+			return nil, err
+		}
+		country = strings.ToUpper(country)
+		if other, ok := countries[network.String()]; ok {
+			if other != country {
+				return nil, errors.Errorf("network %s is mapped to both %s and %s", network, other, country)
+			}
+			continue
+		}
+		countries[network.String()] = country
+		l.entries = append(l.entries, staticEntry{
+			network: network,
+			country: country,
+		})
+	}
+
+	sort.Slice(l.entries, func(i, j int) bool {
+		a, b := l.entries[i], l.entries[j]
+		if a.prefixLen() != b.prefixLen() {
+			return a.prefixLen() > b.prefixLen()
+		}
+		return a.network.String() < b.network.String()
+	})
+
+	return l, nil
+}
+
+func (l *StaticLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	if ip == "" {
+		return "", ErrMissingIP
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", ErrInvalidIP
+	}
+
+	for _, e := range l.entries {
+		if e.network.Contains(addr) {
+			return e.country, nil
+		}
+	}
+
+	return "", ErrCountryNotFound
+}
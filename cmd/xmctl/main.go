@@ -0,0 +1,169 @@
+// xmctl administers the xm service directly against its data store
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/config"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store/mongo"
+)
+
+const usage = `usage: xmctl [-config config.json] <command> [args]
+
+commands:
+  apikey create -name <name> -scopes <scope,...> [-tenant <id>] [-ttl <duration>]
+  apikey list
+  apikey revoke <id>
+`
+
+func main() {
+	if err := doMain(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func doMain(args []string) error {
+	fs := flag.NewFlagSet("xmctl", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configPath := fs.String("config", "", "path to the JSON config file")
+	fs.Parse(args)
+
+	args = fs.Args()
+	if len(args) < 2 || args[0] != "apikey" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ds, err := openStore(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer ds.Close(ctx)
+
+	switch args[1] {
+	case "create":
+		return createAPIKey(ctx, ds, args[2:])
+	case "list":
+		return listAPIKeys(ctx, ds)
+	case "revoke":
+		if len(args) != 3 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		return revokeAPIKey(ctx, ds, args[2])
+	}
+
+	fs.Usage()
+	os.Exit(2)
+	return nil
+}
+
+func openStore(ctx context.Context, conf *config.Config) (*mongo.MongoStore, error) {
+	mgoUrl, err := url.Parse(conf.Mongo.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return mongo.NewMongoStore(ctx, mongo.MongoStoreConfig{
+		MongoURL: mgoUrl,
+		DbName:   conf.Mongo.DbName,
+		Tenancy:  conf.Tenancy.Mode,
+	})
+}
+
+func createAPIKey(ctx context.Context, ds *mongo.MongoStore, args []string) error {
+	fs := flag.NewFlagSet("apikey create", flag.ExitOnError)
+	name := fs.String("name", "", "name of the key")
+	scopes := fs.String("scopes", "", "comma separated scopes: "+strings.Join(auth.Scopes, ", "))
+	tenantID := fs.String("tenant", "", "tenant the key is bound to; none lets callers name it")
+	ttl := fs.Duration("ttl", 0, "lifetime of the key, e.g. 720h; 0 never expires")
+	fs.Parse(args)
+
+	kc := model.APIKeyCreate{
+		Name:     *name,
+		Scopes:   strings.Split(*scopes, ","),
+		TenantID: *tenantID,
+	}
+	if *scopes == "" {
+		kc.Scopes = nil
+	}
+	if *ttl > 0 {
+		expires := time.Now().Add(*ttl)
+		kc.ExpiresTs = &expires
+	}
+
+	key, k, err := auth.CreateAPIKey(ctx, ds, kc)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the api key")
+	}
+
+	fmt.Printf("id:     %s\nname:   %s\nscopes: %s\n", k.ID, k.Name, strings.Join(k.Scopes, ","))
+	if k.TenantID != "" {
+		fmt.Printf("tenant: %s\n", k.TenantID)
+	}
+	if k.ExpiresTs != nil {
+		fmt.Printf("expires: %s\n", k.ExpiresTs.Format(time.RFC3339))
+	}
+	fmt.Printf("key:    %s\n\nthe key is shown only once, store it safely\n", key)
+	return nil
+}
+
+func listAPIKeys(ctx context.Context, ds *mongo.MongoStore) error {
+	keys, err := ds.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tTENANT\tEXPIRES\tSTATUS")
+	for _, k := range keys {
+		expires := "never"
+		if k.ExpiresTs != nil {
+			expires = k.ExpiresTs.Format(time.RFC3339)
+		}
+
+		status := "active"
+		switch {
+		case k.RevokedTs != nil:
+			status = "revoked"
+		case !k.Active(now):
+			status = "expired"
+		}
+
+		tenantID := k.TenantID
+		if tenantID == "" {
+			tenantID = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","), tenantID, expires, status)
+	}
+	return tw.Flush()
+}
+
+func revokeAPIKey(ctx context.Context, ds *mongo.MongoStore, id string) error {
+	if err := ds.RevokeAPIKey(ctx, id); err != nil {
+		return errors.Wrapf(err, "failed to revoke api key %s", id)
+	}
+	fmt.Printf("api key %s revoked\n", id)
+	return nil
+}
@@ -0,0 +1,337 @@
+package comp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+// Action is what a principal does to a company
+type Action string
+
+// actions
+const (
+	ActionRead   Action = "read"
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// actions in the order roles list them
+var actions = []Action{ActionRead, ActionCreate, ActionUpdate, ActionDelete}
+
+// DefaultRoles is the role→permission matrix used when none is configured,
+// following the scopes of auth.DefaultRoleScopes
+var DefaultRoles = RolesFromScopes(auth.DefaultRoleScopes)
+
+// actionScopes authorizes principals without roles, like API keys, by the
+// scopes they were granted
+var actionScopes = map[Action]string{
+	ActionRead:   auth.ScopeCompaniesRead,
+	ActionCreate: auth.ScopeCompaniesWrite,
+	ActionUpdate: auth.ScopeCompaniesWrite,
+	ActionDelete: auth.ScopeCompaniesDelete,
+}
+
+// RolesFromScopes grants each role the actions its scopes allow
+func RolesFromScopes(roleScopes map[string][]string) map[string][]Action {
+	roles := make(map[string][]Action, len(roleScopes))
+	for role, scopes := range roleScopes {
+		granted := []Action{}
+		for _, a := range actions {
+			for _, s := range scopes {
+				if s == actionScopes[a] {
+					granted = append(granted, a)
+					break
+				}
+			}
+		}
+		roles[role] = granted
+	}
+	return roles
+}
+
+// ErrForbidden is matched by every authorization denial
+var ErrForbidden = errors.New("forbidden")
+
+// ForbiddenError tells why the principal may not perform the action
+type ForbiddenError struct {
+	Actor  string
+	Action Action
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	if e.Actor == "" {
+		return fmt.Sprintf("forbidden: %s companies: %s", e.Action, e.Reason)
+	}
+	return fmt.Sprintf("forbidden: %s may not %s companies: %s", e.Actor, e.Action, e.Reason)
+}
+
+func (e *ForbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// RowRule restricts a role to the companies whose Field equals the
+// principal's Attribute, e.g. editors may only modify companies in their
+// own country:
+//
+//	{"role": "editor", "actions": ["create", "update"], "field": "country", "attribute": "country"}
+type RowRule struct {
+	Role      string   `json:"role"`
+	Actions   []Action `json:"actions"`
+	Field     string   `json:"field"`
+	Attribute string   `json:"attribute"`
+}
+
+// AuthzConfig configures the authorization of the company operations
+type AuthzConfig struct {
+	// Roles grants actions to roles, default DefaultRoles. The server
+	// derives them from the jwt role scopes when those are configured.
+	Roles map[string][]Action `json:"roles"`
+
+	Rules []RowRule `json:"rules"`
+}
+
+// companyFields are the fields row rules can check, by their store name
+var companyFields = map[string]func(c *model.Company) string{
+	"country": func(c *model.Company) string { return c.Country },
+	"code":    func(c *model.Company) string { return c.Code },
+}
+
+// authorizer is a CompanyApp checking the principal of the context may
+// perform each operation before passing it on
+type authorizer struct {
+	app   CompanyApp
+	roles map[string][]Action
+	rules []RowRule
+}
+
+// NewAuthorizer wraps the app with the authorization checks
+func NewAuthorizer(app CompanyApp, conf AuthzConfig) (CompanyApp, error) {
+	roles := conf.Roles
+	if roles == nil {
+		roles = DefaultRoles
+	}
+
+	for _, actions := range roles {
+		for _, a := range actions {
+			if _, ok := actionScopes[a]; !ok {
+				return nil, errors.Errorf("authz: unknown action %q", a)
+			}
+		}
+	}
+	for _, r := range conf.Rules {
+		if _, ok := companyFields[r.Field]; !ok {
+			return nil, errors.Errorf("authz: rule for role %q: unknown field %q", r.Role, r.Field)
+		}
+		if r.Attribute == "" {
+			return nil, errors.Errorf("authz: rule for role %q: missing attribute", r.Role)
+		}
+	}
+
+	return &authorizer{
+		app:   app,
+		roles: roles,
+		rules: conf.Rules,
+	}, nil
+}
+
+// grants returns the rules restricting each of the principal's roles which
+// allow the action. A role without rules is unrestricted.
+func (a *authorizer) grants(p *auth.Principal, action Action) map[string][]RowRule {
+	grants := map[string][]RowRule{}
+	for _, role := range p.Roles {
+		if !containsAction(a.roles[role], action) {
+			continue
+		}
+		rules := []RowRule{}
+		for _, r := range a.rules {
+			if r.Role == role && containsAction(r.Actions, action) {
+				rules = append(rules, r)
+			}
+		}
+		grants[role] = rules
+	}
+	return grants
+}
+
+// authorize checks the principal may perform the action, on the company
+// when it's given
+func (a *authorizer) authorize(ctx context.Context, action Action, c *model.Company) error {
+	p, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return &ForbiddenError{Action: action, Reason: "unauthenticated"}
+	}
+
+	if len(p.Roles) == 0 {
+		if p.HasScope(actionScopes[action]) {
+			return nil
+		}
+		return &ForbiddenError{Actor: p.Actor(), Action: action, Reason: "missing scope " + actionScopes[action]}
+	}
+
+	grants := a.grants(p, action)
+	if len(grants) == 0 {
+		return &ForbiddenError{Actor: p.Actor(), Action: action, Reason: "no role grants it"}
+	}
+	if c == nil {
+		return nil
+	}
+
+	var reason string
+	for _, rules := range grants {
+		failed := failedRule(p, rules, c)
+		if failed == nil {
+			return nil
+		}
+		reason = fmt.Sprintf("%s must match the %s of the %s", failed.Field, failed.Attribute, failed.Role)
+	}
+	return &ForbiddenError{Actor: p.Actor(), Action: action, Reason: reason}
+}
+
+// failedRule returns the first rule the company doesn't satisfy
+func failedRule(p *auth.Principal, rules []RowRule, c *model.Company) *RowRule {
+	for i, r := range rules {
+		attr := p.Attributes[r.Attribute]
+		if attr == "" || companyFields[r.Field](c) != attr {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// ReadAuthorizer is implemented by the apps checking who may read the
+// companies, for the companies handed out other than by the app, like
+// those of events
+type ReadAuthorizer interface {
+	// AuthorizeRead checks the principal of the context may read the
+	// company, or any company when nil
+	AuthorizeRead(ctx context.Context, c *model.Company) error
+}
+
+func (a *authorizer) AuthorizeRead(ctx context.Context, c *model.Company) error {
+	return a.authorize(ctx, ActionRead, c)
+}
+
+func (a *authorizer) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	if err := a.authorize(ctx, ActionCreate, &c); err != nil {
+		return "", err
+	}
+	return a.app.CreateCompany(ctx, c)
+}
+
+// ListCompanies narrows the query down to the companies the principal may
+// read: those any of its roles allows, a role restricted by rules allowing
+// the companies satisfying all of them
+func (a *authorizer) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
+	if err := a.authorize(ctx, ActionRead, nil); err != nil {
+		return nil, 0, err
+	}
+
+	p, _ := auth.PrincipalFromContext(ctx)
+	grants := a.grants(p, ActionRead)
+
+	var anyOf [][]store.Filter
+	for _, rules := range grants {
+		if len(rules) == 0 {
+			// unrestricted
+			return a.app.ListCompanies(ctx, q)
+		}
+
+		group := []store.Filter{}
+		for _, r := range rules {
+			attr := p.Attributes[r.Attribute]
+			if attr == "" {
+				// the role allows none
+				group = nil
+				break
+			}
+			group = append(group, store.Filter{AttrName: r.Field, Value: attr, Operator: store.Eq})
+		}
+		if group != nil {
+			anyOf = append(anyOf, group)
+		}
+	}
+
+	switch len(anyOf) {
+	case 0:
+		return []model.Company{}, 0, nil
+	case 1:
+		q.Filters = append(q.Filters, anyOf[0]...)
+	default:
+		// in a fixed order, grants being a map
+		sort.Slice(anyOf, func(i, j int) bool {
+			return fmt.Sprint(anyOf[i]) < fmt.Sprint(anyOf[j])
+		})
+		q.AnyOf = append(q.AnyOf, anyOf...)
+	}
+	return a.app.ListCompanies(ctx, q)
+}
+
+func (a *authorizer) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	if err := a.authorize(ctx, ActionRead, nil); err != nil {
+		return nil, err
+	}
+
+	c, err := a.app.GetCompany(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the companies hidden by row rules don't exist for the principal
+	if err := a.authorize(ctx, ActionRead, c); err != nil {
+		return nil, store.ErrCompanyNotFound
+	}
+	return c, nil
+}
+
+func (a *authorizer) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	if err := a.authorizeExisting(ctx, ActionUpdate, id); err != nil {
+		return err
+	}
+	return a.app.UpdateCompany(ctx, id, cu)
+}
+
+func (a *authorizer) DeleteCompany(ctx context.Context, id string) error {
+	if err := a.authorizeExisting(ctx, ActionDelete, id); err != nil {
+		return err
+	}
+	return a.app.DeleteCompany(ctx, id)
+}
+
+// authorizeExisting checks the action on a stored company, fetching it
+// only if row rules need to look at it. A company the principal may not
+// read is not found, like a missing one.
+func (a *authorizer) authorizeExisting(ctx context.Context, action Action, id string) error {
+	if err := a.authorize(ctx, action, nil); err != nil {
+		return err
+	}
+	if len(a.rules) == 0 {
+		return nil
+	}
+
+	c, err := a.app.GetCompany(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := a.authorize(ctx, ActionRead, c); err != nil {
+		return store.ErrCompanyNotFound
+	}
+	return a.authorize(ctx, action, c)
+}
+
+func containsAction(actions []Action, action Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
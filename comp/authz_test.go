@@ -0,0 +1,329 @@
+package comp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+// memApp is an in-memory CompanyApp
+type memApp struct {
+	companies map[string]model.Company
+	lastQuery store.ListQuery
+}
+
+func newMemApp(companies ...model.Company) *memApp {
+	app := &memApp{companies: map[string]model.Company{}}
+	for _, c := range companies {
+		app.companies[c.ID] = c
+	}
+	return app
+}
+
+func (m *memApp) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	c.ID = c.Name
+	m.companies[c.ID] = c
+	return c.ID, nil
+}
+
+func (m *memApp) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
+	m.lastQuery = q
+	return nil, 0, nil
+}
+
+func (m *memApp) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	c, ok := m.companies[id]
+	if !ok {
+		return nil, store.ErrCompanyNotFound
+	}
+	return &c, nil
+}
+
+func (m *memApp) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	if _, ok := m.companies[id]; !ok {
+		return store.ErrCompanyNotFound
+	}
+	return nil
+}
+
+func (m *memApp) DeleteCompany(ctx context.Context, id string) error {
+	delete(m.companies, id)
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	cy := model.Company{ID: "cy", Name: "cy", Country: "CY", Code: "CY"}
+	gr := model.Company{ID: "gr", Name: "gr", Country: "GR", Code: "GR"}
+
+	conf := AuthzConfig{
+		Rules: []RowRule{
+			{Role: auth.RoleEditor, Actions: []Action{ActionCreate, ActionUpdate}, Field: "country", Attribute: "country"},
+			{Role: "auditor", Actions: []Action{ActionRead}, Field: "country", Attribute: "country"},
+		},
+		Roles: map[string][]Action{
+			auth.RoleViewer: {ActionRead},
+			auth.RoleEditor: {ActionRead, ActionCreate, ActionUpdate},
+			auth.RoleAdmin:  {ActionRead, ActionCreate, ActionUpdate, ActionDelete},
+			"auditor":       {ActionRead},
+		},
+	}
+
+	viewer := &auth.Principal{ID: "v", Kind: auth.KindJWT, Roles: []string{auth.RoleViewer}}
+	editor := &auth.Principal{ID: "e", Kind: auth.KindJWT, Roles: []string{auth.RoleEditor},
+		Attributes: map[string]string{"country": "CY"}}
+	admin := &auth.Principal{ID: "a", Kind: auth.KindJWT, Roles: []string{auth.RoleAdmin}}
+	apiKey := &auth.Principal{ID: "k", Kind: auth.KindAPIKey, Scopes: []string{auth.ScopeCompaniesRead}}
+	auditor := &auth.Principal{ID: "au", Kind: auth.KindJWT, Roles: []string{"auditor"},
+		Attributes: map[string]string{"country": "CY"}}
+
+	tt := []struct {
+		name      string
+		principal *auth.Principal
+		op        func(ctx context.Context, app CompanyApp) error
+		forbidden bool
+		notFound  bool
+	}{
+		{
+			name: "unauthenticated",
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "cy")
+				return err
+			},
+			forbidden: true,
+		},
+		{
+			name:      "viewer reads",
+			principal: viewer,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "gr")
+				return err
+			},
+		},
+		{
+			name:      "viewer can't update",
+			principal: viewer,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.UpdateCompany(ctx, "cy", model.CompanyUpdate{})
+			},
+			forbidden: true,
+		},
+		{
+			name:      "editor updates own country",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.UpdateCompany(ctx, "cy", model.CompanyUpdate{})
+			},
+		},
+		{
+			name:      "editor can't update other country",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.UpdateCompany(ctx, "gr", model.CompanyUpdate{})
+			},
+			forbidden: true,
+		},
+		{
+			name:      "editor can't create in other country",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.CreateCompany(ctx, model.Company{Name: "new", Country: "GR"})
+				return err
+			},
+			forbidden: true,
+		},
+		{
+			name:      "editor reads other country",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "gr")
+				return err
+			},
+		},
+		{
+			name:      "editor can't delete",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.DeleteCompany(ctx, "cy")
+			},
+			forbidden: true,
+		},
+		{
+			name:      "admin deletes",
+			principal: admin,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.DeleteCompany(ctx, "gr")
+			},
+		},
+		{
+			name:      "api key by scope",
+			principal: apiKey,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, _, err := app.ListCompanies(ctx, store.ListQuery{})
+				return err
+			},
+		},
+		{
+			name:      "api key missing scope",
+			principal: apiKey,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.DeleteCompany(ctx, "gr")
+			},
+			forbidden: true,
+		},
+		{
+			name:      "not found",
+			principal: editor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.UpdateCompany(ctx, "nope", model.CompanyUpdate{})
+			},
+			notFound: true,
+		},
+		{
+			name: "unauthenticated missing",
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "nope")
+				return err
+			},
+			forbidden: true,
+		},
+		{
+			name:      "viewer can't update missing",
+			principal: viewer,
+			op: func(ctx context.Context, app CompanyApp) error {
+				return app.UpdateCompany(ctx, "nope", model.CompanyUpdate{})
+			},
+			forbidden: true,
+		},
+		{
+			name:      "auditor can't see other country",
+			principal: auditor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "gr")
+				return err
+			},
+			notFound: true,
+		},
+		{
+			name:      "auditor missing",
+			principal: auditor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "nope")
+				return err
+			},
+			notFound: true,
+		},
+		{
+			name:      "auditor reads own country",
+			principal: auditor,
+			op: func(ctx context.Context, app CompanyApp) error {
+				_, err := app.GetCompany(ctx, "cy")
+				return err
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			app, err := NewAuthorizer(newMemApp(cy, gr), conf)
+			assert.NoError(t, err)
+
+			ctx := context.Background()
+			if tc.principal != nil {
+				ctx = auth.WithPrincipal(ctx, tc.principal)
+			}
+
+			err = tc.op(ctx, app)
+			if tc.forbidden {
+				assert.True(t, errors.Is(err, ErrForbidden), "got %v", err)
+				var fe *ForbiddenError
+				assert.True(t, errors.As(err, &fe))
+			} else {
+				assert.False(t, errors.Is(err, ErrForbidden), "got %v", err)
+			}
+			assert.Equal(t, tc.notFound, errors.Is(err, store.ErrCompanyNotFound), "got %v", err)
+		})
+	}
+}
+
+func TestAuthorizerListRowRules(t *testing.T) {
+	mem := newMemApp()
+	app, err := NewAuthorizer(mem, AuthzConfig{
+		Rules: []RowRule{
+			{Role: auth.RoleViewer, Actions: []Action{ActionRead}, Field: "country", Attribute: "country"},
+		},
+	})
+	assert.NoError(t, err)
+
+	restricted := &auth.Principal{ID: "v", Roles: []string{auth.RoleViewer}, Attributes: map[string]string{"country": "CY"}}
+	_, _, err = app.ListCompanies(auth.WithPrincipal(context.Background(), restricted), store.ListQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Filter{{AttrName: "country", Value: "CY", Operator: store.Eq}}, mem.lastQuery.Filters)
+
+	// another role lifts the restriction
+	restricted.Roles = append(restricted.Roles, auth.RoleEditor)
+	_, _, err = app.ListCompanies(auth.WithPrincipal(context.Background(), restricted), store.ListQuery{})
+	assert.NoError(t, err)
+	assert.Empty(t, mem.lastQuery.Filters)
+	assert.Empty(t, mem.lastQuery.AnyOf)
+}
+
+func TestAuthorizerListRowRulesRoles(t *testing.T) {
+	mem := newMemApp()
+	app, err := NewAuthorizer(mem, AuthzConfig{
+		Roles: map[string][]Action{auth.RoleViewer: {ActionRead}, "auditor": {ActionRead}},
+		Rules: []RowRule{
+			{Role: auth.RoleViewer, Actions: []Action{ActionRead}, Field: "country", Attribute: "country"},
+			{Role: "auditor", Actions: []Action{ActionRead}, Field: "code", Attribute: "code"},
+		},
+	})
+	assert.NoError(t, err)
+
+	want := [][]store.Filter{
+		{{AttrName: "code", Value: "XM", Operator: store.Eq}},
+		{{AttrName: "country", Value: "CY", Operator: store.Eq}},
+	}
+	for _, roles := range [][]string{{auth.RoleViewer, "auditor"}, {"auditor", auth.RoleViewer}} {
+		p := &auth.Principal{ID: "v", Roles: roles, Attributes: map[string]string{"country": "CY", "code": "XM"}}
+		_, _, err = app.ListCompanies(auth.WithPrincipal(context.Background(), p), store.ListQuery{})
+		assert.NoError(t, err)
+		assert.Empty(t, mem.lastQuery.Filters)
+		assert.Equal(t, want, mem.lastQuery.AnyOf, "roles %v", roles)
+	}
+
+	// a role missing its attribute allows none
+	p := &auth.Principal{ID: "v", Roles: []string{auth.RoleViewer, "auditor"}, Attributes: map[string]string{"country": "CY"}}
+	_, _, err = app.ListCompanies(auth.WithPrincipal(context.Background(), p), store.ListQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Filter{{AttrName: "country", Value: "CY", Operator: store.Eq}}, mem.lastQuery.Filters)
+	assert.Empty(t, mem.lastQuery.AnyOf)
+}
+
+func TestRolesFromScopes(t *testing.T) {
+	assert.Equal(t, map[string][]Action{
+		auth.RoleViewer: {ActionRead},
+		auth.RoleEditor: {ActionRead, ActionCreate, ActionUpdate},
+		auth.RoleAdmin:  {ActionRead, ActionCreate, ActionUpdate, ActionDelete},
+	}, DefaultRoles)
+
+	assert.Equal(t, map[string][]Action{
+		"janitor": {ActionDelete},
+		"nobody":  {},
+	}, RolesFromScopes(map[string][]string{
+		"janitor": {auth.ScopeCompaniesDelete},
+		"nobody":  {"unknown:scope"},
+	}))
+}
+
+func TestNewAuthorizerValidation(t *testing.T) {
+	_, err := NewAuthorizer(newMemApp(), AuthzConfig{Roles: map[string][]Action{"viewer": {"nuke"}}})
+	assert.Error(t, err)
+
+	_, err = NewAuthorizer(newMemApp(), AuthzConfig{Rules: []RowRule{{Role: "editor", Field: "website", Attribute: "x"}}})
+	assert.Error(t, err)
+}
@@ -2,9 +2,14 @@ package comp
 
 import (
 	"context"
+	"errors"
 
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/events"
+	"github.com/arpsch/xm/logging"
 	"github.com/arpsch/xm/model"
 	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tracing"
 )
 
 // CompanyApp represents the behavour on compay object
@@ -19,35 +24,79 @@ type CompanyApp interface {
 // app is an app object
 type companyApp struct {
 	store store.DataStore
+	bus   events.EventBus
 }
 
-// NewApp initialize a new company App
-func NewApp(ds store.DataStore) (*companyApp, error) {
+// NewApp initialize a new company App; the changes are published on bus,
+// if not nil, once stored
+func NewApp(ds store.DataStore, bus events.EventBus) (*companyApp, error) {
 
 	app := &companyApp{
 		store: ds,
+		bus:   bus,
 	}
 
 	return app, nil
 }
 
+// actor returns who is making the request, empty when unauthenticated
+func actor(ctx context.Context) string {
+	if p, ok := auth.PrincipalFromContext(ctx); ok {
+		return p.Actor()
+	}
+	return ""
+}
+
+// logStoreError logs the store failures, not the expected outcomes like
+// a missing company, with the request
+func logStoreError(ctx context.Context, op string, err error) {
+	if err == nil ||
+		errors.Is(err, store.ErrCompanyNotFound) ||
+		errors.Is(err, store.ErrCompanyExists) {
+		return
+	}
+	logging.FromContext(ctx).Error("store: "+op+" failed", "error", err)
+}
+
 func (ca *companyApp) CreateCompany(ctx context.Context, c model.Company) (string, error) {
-	return ca.store.CreateCompany(ctx, c)
+	ctx, span := tracing.Start(ctx, "comp.CreateCompany")
+	c.CreatedBy = actor(ctx)
+	c.UpdatedBy = c.CreatedBy
+	id, err := ca.createCompany(ctx, c)
+	logStoreError(ctx, "create company", err)
+	tracing.End(span, err)
+	return id, err
 }
 
 func (ca *companyApp) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
-	return ca.store.ListCompanies(ctx, q)
-
+	ctx, span := tracing.Start(ctx, "comp.ListCompanies")
+	companies, count, err := ca.store.ListCompanies(ctx, q)
+	logStoreError(ctx, "list companies", err)
+	tracing.End(span, err)
+	return companies, count, err
 }
 
 func (ca *companyApp) GetCompany(ctx context.Context, id string) (*model.Company, error) {
-	return ca.store.GetCompany(ctx, id)
+	ctx, span := tracing.Start(ctx, "comp.GetCompany")
+	c, err := ca.store.GetCompany(ctx, id)
+	logStoreError(ctx, "get company", err)
+	tracing.End(span, err)
+	return c, err
 }
 
 func (ca *companyApp) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
-	return ca.store.UpdateCompany(ctx, id, cu)
+	ctx, span := tracing.Start(ctx, "comp.UpdateCompany")
+	cu.UpdatedBy = actor(ctx)
+	err := ca.updateCompany(ctx, id, cu)
+	logStoreError(ctx, "update company", err)
+	tracing.End(span, err)
+	return err
 }
 
 func (ca *companyApp) DeleteCompany(ctx context.Context, id string) error {
-	return ca.store.DeleteCompany(ctx, id)
+	ctx, span := tracing.Start(ctx, "comp.DeleteCompany")
+	err := ca.deleteCompany(ctx, id)
+	logStoreError(ctx, "delete company", err)
+	tracing.End(span, err)
+	return err
 }
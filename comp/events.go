@@ -0,0 +1,158 @@
+package comp
+
+import (
+	"context"
+	"time"
+
+	"github.com/arpsch/xm/events"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+)
+
+// eventFunc returns the maker of the event of a change of the caller;
+// cu is the update of an updated event
+func eventFunc(ctx context.Context, typ string, cu model.CompanyUpdate) store.EventFunc {
+	t, _ := tenant.FromContext(ctx)
+	by := actor(ctx)
+
+	return func(before, after *model.Company) *model.Event {
+		e := &model.Event{
+			ID:       events.NewID(),
+			Type:     typ,
+			Time:     time.Now().UTC(),
+			TenantID: t,
+			Actor:    by,
+		}
+
+		c := before
+		switch typ {
+		case model.EventCompanyCreated:
+			c = after
+			e.Created = &model.CompanyCreated{Company: *after}
+		case model.EventCompanyUpdated:
+			changes := diff(before, cu)
+			if len(changes) == 0 {
+				return nil
+			}
+			updated := *before
+			for _, ch := range changes {
+				switch ch.Field {
+				case "website":
+					updated.Website = ch.New
+				case "phone":
+					updated.Phone = ch.New
+				}
+			}
+			updated.UpdatedBy = cu.UpdatedBy
+			updated.UpdatedTs = e.Time
+			e.Updated = &model.CompanyUpdated{Changes: changes, Company: updated}
+		case model.EventCompanyDeleted:
+			e.Deleted = &model.CompanyDeleted{Company: *before}
+		}
+
+		e.CompanyID = c.ID
+		if c.TenantID != "" {
+			e.TenantID = c.TenantID
+		}
+		return e
+	}
+}
+
+// diff returns the fields the update changes
+func diff(c *model.Company, cu model.CompanyUpdate) []model.FieldChange {
+	var changes []model.FieldChange
+	add := func(field, old, new string) {
+		// empty fields aren't updated
+		if new != "" && new != old {
+			changes = append(changes, model.FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	add("website", c.Website, cu.Website)
+	add("phone", c.Phone, cu.Phone)
+	return changes
+}
+
+// The writes below store the change along with its event when the store
+// keeps an outbox, the relay delivers the event then. Otherwise the event
+// is published once the change is stored, and lost if the process stops
+// in between.
+
+func (ca *companyApp) createCompany(ctx context.Context, c model.Company) (string, error) {
+	if ca.bus == nil {
+		return ca.store.CreateCompany(ctx, c)
+	}
+
+	ev := eventFunc(ctx, model.EventCompanyCreated, model.CompanyUpdate{})
+	if ob, ok := ca.store.(store.OutboxStore); ok {
+		return ob.CreateCompanyWithEvent(ctx, c, ev)
+	}
+
+	id, err := ca.store.CreateCompany(ctx, c)
+	if err != nil {
+		return "", err
+	}
+	// the store completes the company, e.g. with its timestamps
+	created, err := ca.store.GetCompany(ctx, id)
+	if err != nil {
+		c.ID = id
+		created = &c
+	}
+	ca.publish(ctx, ev(nil, created))
+	return id, nil
+}
+
+func (ca *companyApp) updateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	if ca.bus == nil {
+		return ca.store.UpdateCompany(ctx, id, cu)
+	}
+
+	ev := eventFunc(ctx, model.EventCompanyUpdated, cu)
+	if ob, ok := ca.store.(store.OutboxStore); ok {
+		return ob.UpdateCompanyWithEvent(ctx, id, cu, ev)
+	}
+
+	before, err := ca.store.GetCompany(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := ca.store.UpdateCompany(ctx, id, cu); err != nil {
+		return err
+	}
+	ca.publish(ctx, ev(before, nil))
+	return nil
+}
+
+func (ca *companyApp) deleteCompany(ctx context.Context, id string) error {
+	if ca.bus == nil {
+		return ca.store.DeleteCompany(ctx, id)
+	}
+
+	ev := eventFunc(ctx, model.EventCompanyDeleted, model.CompanyUpdate{})
+	if ob, ok := ca.store.(store.OutboxStore); ok {
+		return ob.DeleteCompanyWithEvent(ctx, id, ev)
+	}
+
+	before, err := ca.store.GetCompany(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := ca.store.DeleteCompany(ctx, id); err != nil {
+		return err
+	}
+	ca.publish(ctx, ev(before, nil))
+	return nil
+}
+
+// publish publishes the event, if any, of a stored change. The change is
+// done, a failure is logged rather than returned.
+func (ca *companyApp) publish(ctx context.Context, e *model.Event) {
+	if e == nil {
+		return
+	}
+	if err := ca.bus.Publish(ctx, *e); err != nil {
+		logging.FromContext(ctx).Error("failed to publish the event",
+			"event", e.ID, "type", e.Type, "company", e.CompanyID, "error", err)
+	}
+}
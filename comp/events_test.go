@@ -0,0 +1,155 @@
+package comp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/events"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+)
+
+func TestEvents(t *testing.T) {
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{ID: "alice", Kind: auth.KindJWT})
+	ctx = tenant.WithID(ctx, "acme")
+
+	bus := events.NewMemoryBus()
+	var got []model.Event
+	bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		got = append(got, e)
+		return nil
+	})
+
+	app, _ := NewApp(newMemApp(), bus)
+
+	id, err := app.CreateCompany(ctx, model.Company{Name: "xm", Country: "CY", Code: "CY", Phone: "+35722000000"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, app.UpdateCompany(ctx, id, model.CompanyUpdate{Phone: "+35722000001", Website: ""}))
+	// nothing changes, nothing's published
+	assert.NoError(t, app.UpdateCompany(ctx, id, model.CompanyUpdate{}))
+
+	assert.NoError(t, app.DeleteCompany(ctx, id))
+
+	// failed writes aren't published
+	assert.Equal(t, store.ErrCompanyNotFound, app.UpdateCompany(ctx, "missing", model.CompanyUpdate{Phone: "+35722000001"}))
+	assert.Equal(t, store.ErrCompanyNotFound, app.DeleteCompany(ctx, "missing"))
+
+	if !assert.Len(t, got, 3) {
+		return
+	}
+	for _, e := range got {
+		assert.NotEmpty(t, e.ID)
+		assert.Equal(t, "acme", e.TenantID)
+		assert.Equal(t, "jwt:alice", e.Actor)
+		assert.Equal(t, id, e.CompanyID)
+	}
+
+	assert.Equal(t, model.EventCompanyCreated, got[0].Type)
+	assert.Equal(t, "xm", got[0].Created.Company.Name)
+	assert.Equal(t, "jwt:alice", got[0].Created.Company.CreatedBy)
+
+	assert.Equal(t, model.EventCompanyUpdated, got[1].Type)
+	assert.Equal(t, []model.FieldChange{{Field: "phone", Old: "+35722000000", New: "+35722000001"}},
+		got[1].Updated.Changes)
+	assert.Equal(t, "+35722000001", got[1].Updated.Company.Phone)
+	assert.Equal(t, "jwt:alice", got[1].Updated.Company.UpdatedBy)
+
+	assert.Equal(t, model.EventCompanyDeleted, got[2].Type)
+	assert.Equal(t, "xm", got[2].Deleted.Company.Name)
+}
+
+// memOutbox is an in-memory store keeping the events in an outbox
+type memOutbox struct {
+	*memApp
+	outbox []model.Event
+}
+
+func (m *memOutbox) keep(e *model.Event) {
+	if e != nil {
+		e.Seq = int64(len(m.outbox) + 1)
+		m.outbox = append(m.outbox, *e)
+	}
+}
+
+func (m *memOutbox) CreateCompanyWithEvent(ctx context.Context, c model.Company, ev store.EventFunc) (string, error) {
+	id, _ := m.CreateCompany(ctx, c)
+	after, _ := m.GetCompany(ctx, id)
+	m.keep(ev(nil, after))
+	return id, nil
+}
+
+func (m *memOutbox) UpdateCompanyWithEvent(ctx context.Context, id string, cu model.CompanyUpdate, ev store.EventFunc) error {
+	before, err := m.GetCompany(ctx, id)
+	if err != nil {
+		return err
+	}
+	m.keep(ev(before, nil))
+	return m.UpdateCompany(ctx, id, cu)
+}
+
+func (m *memOutbox) DeleteCompanyWithEvent(ctx context.Context, id string, ev store.EventFunc) error {
+	before, err := m.GetCompany(ctx, id)
+	if err != nil {
+		return err
+	}
+	m.keep(ev(before, nil))
+	return m.DeleteCompany(ctx, id)
+}
+
+func (m *memOutbox) PendingEvents(ctx context.Context, limit int, skip []string) ([]model.Event, error) {
+	return append([]model.Event(nil), m.outbox...), nil
+}
+
+func (m *memOutbox) MarkEventDelivered(ctx context.Context, e model.Event) error {
+	m.outbox = m.outbox[1:]
+	return nil
+}
+
+func TestOutboxEvents(t *testing.T) {
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{ID: "alice", Kind: auth.KindJWT})
+	ctx = tenant.WithID(ctx, "acme")
+
+	bus := events.NewMemoryBus()
+	var got []model.Event
+	bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		got = append(got, e)
+		return nil
+	})
+
+	ob := &memOutbox{memApp: newMemApp()}
+	app, _ := NewApp(ob, bus)
+
+	id, err := app.CreateCompany(ctx, model.Company{Name: "xm", Country: "CY", Code: "CY", Phone: "+35722000000"})
+	assert.NoError(t, err)
+	assert.NoError(t, app.UpdateCompany(ctx, id, model.CompanyUpdate{Phone: "+35722000001"}))
+	assert.NoError(t, app.UpdateCompany(ctx, id, model.CompanyUpdate{}))
+	assert.NoError(t, app.DeleteCompany(ctx, id))
+
+	// the relay publishes the events, not the app
+	assert.Empty(t, got)
+	if !assert.Len(t, ob.outbox, 3) {
+		return
+	}
+
+	n, err := events.NewRelay(ob, bus, events.Config{}).Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Empty(t, ob.outbox)
+
+	if !assert.Len(t, got, 3) {
+		return
+	}
+	assert.Equal(t, model.EventCompanyCreated, got[0].Type)
+	assert.Equal(t, model.EventCompanyUpdated, got[1].Type)
+	assert.Equal(t, model.EventCompanyDeleted, got[2].Type)
+	for _, e := range got {
+		assert.Equal(t, "acme", e.TenantID)
+		assert.Equal(t, "jwt:alice", e.Actor)
+		assert.Equal(t, id, e.CompanyID)
+	}
+}
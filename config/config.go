@@ -0,0 +1,244 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/api/graphql"
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/events"
+	"github.com/arpsch/xm/health"
+	"github.com/arpsch/xm/idempotency"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/tlsconfig"
+	"github.com/arpsch/xm/tracing"
+	"github.com/arpsch/xm/utils"
+	"github.com/arpsch/xm/webhook"
+)
+
+const (
+	DefaultListen   = ":8080"
+	DefaultMongoURL = "mongodb://127.0.0.1:27017"
+	DefaultDbName   = "xm"
+
+	// CyprusCC is the 2-letter Cyprus country code
+	CyprusCC = "CY"
+)
+
+// MongoConfig holds the MongoDB connection settings
+type MongoConfig struct {
+	URL    string `json:"url"`
+	DbName string `json:"db_name"`
+}
+
+// AuthConfig enables authentication
+type AuthConfig struct {
+	// APIKeys requires an API key with the route's scope on every API
+	// call and enables the API key admin endpoints
+	APIKeys bool `json:"api_keys"`
+
+	// JWT accepts bearer tokens signed by the keys of a JWKS
+	JWT *auth.JWTConfig `json:"jwt"`
+
+	// ClientCert accepts the client certificates verified by mutual TLS,
+	// see TLS.ClientAuth
+	ClientCert *auth.CertConfig `json:"client_cert"`
+
+	// RBAC authorizes the company operations of authenticated callers
+	RBAC comp.AuthzConfig `json:"rbac"`
+}
+
+// APIConfig sets the lifecycle of the API versions
+type APIConfig struct {
+	// V1Deprecation is the date the v1 company routes were deprecated,
+	// announced in their Deprecation header; by default the date v2 was
+	// released
+	V1Deprecation *time.Time `json:"v1_deprecation"`
+
+	// V1Sunset is the date the v1 company routes are retired, announced
+	// in their Sunset header
+	V1Sunset *time.Time `json:"v1_sunset"`
+}
+
+// Config represents the service configuration
+type Config struct {
+	// Listen is the address the HTTP server listens on
+	Listen string `json:"listen"`
+
+	// TLS serves HTTPS, nil serves plain HTTP
+	TLS *tlsconfig.Config `json:"tls"`
+
+	// GRPCListen is the address the gRPC server listens on, with the TLS
+	// of the HTTP server; empty disables it
+	GRPCListen string `json:"grpc_listen"`
+
+	Mongo MongoConfig `json:"mongo"`
+
+	API APIConfig `json:"api"`
+
+	// GeoIP selects the geolocation provider used for geo-fencing
+	GeoIP client.GeoLocatorConfig `json:"geoip"`
+
+	// TrustedProxies lists the CIDRs of the load balancers/proxies whose
+	// Forwarded, X-Forwarded-For and X-Real-IP headers are honored
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Policies are the geo-access policies attached to the API routes
+	Policies []policy.Config `json:"policies"`
+
+	// RateLimits throttle each client of the API routes
+	RateLimits []ratelimit.Config `json:"rate_limits"`
+
+	Auth AuthConfig `json:"auth"`
+
+	// Tenancy isolates the companies of the tenants sharing the deployment
+	Tenancy tenant.Config `json:"tenancy"`
+
+	Idempotency idempotency.Config `json:"idempotency"`
+
+	Log logging.Config `json:"log"`
+
+	// Tracing exports the spans of the requests
+	Tracing tracing.Config `json:"tracing"`
+
+	// Health configures the readiness checks and the shutdown drain
+	Health health.Config `json:"health"`
+
+	// Events configures the subscribers of the company events
+	Events events.Config `json:"events"`
+
+	// Webhooks configures the deliveries to the webhooks
+	Webhooks webhook.Config `json:"webhooks"`
+
+	// Stream configures the live streams of the company changes
+	Stream stream.Config `json:"stream"`
+
+	// GraphQL limits the complexity of the GraphQL operations
+	GraphQL graphql.Config `json:"graphql"`
+}
+
+// Default returns the configuration used when no config file is given
+func Default() *Config {
+	return &Config{
+		Listen: DefaultListen,
+		Mongo: MongoConfig{
+			URL:    DefaultMongoURL,
+			DbName: DefaultDbName,
+		},
+		GeoIP: client.GeoLocatorConfig{
+			Provider: client.ProviderIPAPI,
+			Cache: client.GeoCacheConfig{
+				Size:        10000,
+				TTL:         utils.Duration(time.Hour),
+				NegativeTTL: utils.Duration(5 * time.Minute),
+			},
+			CircuitBreaker: client.CircuitBreakerConfig{
+				Failures: 5,
+				Cooldown: utils.Duration(30 * time.Second),
+			},
+		},
+		Policies: []policy.Config{
+			{
+				Name:           "cyprus-only-writes",
+				Methods:        []string{"POST", "DELETE"},
+				Paths:          []string{"/api/v1/companies", "/api/v1/companies/:id"},
+				AllowCountries: []string{CyprusCC},
+			},
+		},
+		RateLimits: []ratelimit.Config{
+			{
+				// ahead of the authentication, throttling the failed ones
+				Name:     "ips",
+				Key:      ratelimit.KeyIP,
+				Paths:    []string{"/api/*", "/graphql"},
+				Requests: 1200,
+				Period:   utils.Duration(time.Minute),
+			},
+			{
+				Name:     "reads",
+				Methods:  []string{"GET"},
+				Paths:    []string{"/api/v1/companies*"},
+				Requests: 600,
+				Period:   utils.Duration(time.Minute),
+			},
+			{
+				// every create and delete costs a geolocation lookup
+				Name:     "writes",
+				Methods:  []string{"POST", "PUT", "DELETE"},
+				Paths:    []string{"/api/v1/companies*"},
+				Requests: 60,
+				Period:   utils.Duration(time.Minute),
+				Burst:    10,
+			},
+			{
+				// an operation may combine several lookups
+				Name:     "graphql",
+				Methods:  []string{"GET", "POST"},
+				Paths:    []string{"/graphql"},
+				Requests: 300,
+				Period:   utils.Duration(time.Minute),
+			},
+		},
+		Idempotency: idempotency.Config{
+			TTL: utils.Duration(idempotency.DefaultTTL),
+		},
+		Log: logging.Config{
+			Level: "info",
+		},
+		Health: health.Config{
+			Timeout:       utils.Duration(health.DefaultTimeout),
+			GeoIPInterval: utils.Duration(time.Minute),
+			DrainDelay:    utils.Duration(health.DefaultDrainDelay),
+		},
+	}
+}
+
+// Load reads a JSON config file on top of the defaults.
+// An empty path returns the defaults.
+func Load(path string) (*Config, error) {
+	conf := Default()
+	if path == "" {
+		return conf, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open config file")
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config file")
+	}
+
+	if err := conf.Tenancy.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := logging.ParseLevel(conf.Log.Level); err != nil {
+		return nil, err
+	}
+	if err := conf.Tracing.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.TLS != nil {
+		if err := conf.TLS.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Auth.ClientCert != nil && (conf.TLS == nil || conf.TLS.ClientAuth == tlsconfig.ClientAuthNone) {
+		return nil, errors.New("auth.client_cert needs tls.client_auth")
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/client"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "xm-config")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadDefault(t *testing.T) {
+	conf, err := Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), conf)
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": ":9090",
+		"api": {"v1_deprecation": "2026-11-01T00:00:00Z", "v1_sunset": "2027-06-30T00:00:00Z"},
+		"geoip": {
+			"provider": "static",
+			"static_table": {"10.0.0.0/8": "CY"}
+		}
+	}`)
+
+	conf, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ":9090", conf.Listen)
+	assert.Equal(t, DefaultMongoURL, conf.Mongo.URL)
+	assert.Equal(t, client.ProviderStatic, conf.GeoIP.Provider)
+	assert.Equal(t, map[string]string{"10.0.0.0/8": "CY"}, conf.GeoIP.StaticTable)
+	assert.Equal(t, time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC), *conf.API.V1Deprecation)
+	assert.Equal(t, time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC), *conf.API.V1Sunset)
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := writeConfig(t, `{"lisen": ":9090"}`)
+
+	_, err := Load(path)
+	assert.Error(t, err)
+}
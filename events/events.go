@@ -0,0 +1,52 @@
+// Package events delivers the domain events of the companies to the
+// subsystems interested in them
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/utils"
+)
+
+// Handler handles an event; the events of a company may be delivered more
+// than once, handlers should be idempotent
+type Handler func(ctx context.Context, e model.Event) error
+
+// Publisher publishes events
+type Publisher interface {
+	Publish(ctx context.Context, e model.Event) error
+}
+
+// EventBus delivers the published events to its subscribers
+type EventBus interface {
+	Publisher
+
+	// Subscribe registers h for the events of the types, all events
+	// without types. The returned function unsubscribes h.
+	Subscribe(h Handler, types ...string) func()
+}
+
+// Config configures the event subscribers of the deployment
+type Config struct {
+	// File appends every event as a JSON line to the file, if set
+	File string `json:"file"`
+
+	// RelayInterval is how often the outbox is checked for events to
+	// deliver, default 1s
+	RelayInterval utils.Duration `json:"relay_interval"`
+
+	// RelayBatch is the number of events delivered at once, default 100
+	RelayBatch int `json:"relay_batch"`
+}
+
+// NewID returns a random event id
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("events: failed to generate an id: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,83 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+)
+
+func TestMemoryBus(t *testing.T) {
+	ctx := context.Background()
+	bus := NewMemoryBus()
+
+	var all, deleted []string
+	unsubscribe := bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		all = append(all, e.ID)
+		return nil
+	})
+	bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		deleted = append(deleted, e.ID)
+		return errors.New("downstream is down")
+	}, model.EventCompanyDeleted)
+
+	assert.NoError(t, bus.Publish(ctx, model.Event{ID: "1", Type: model.EventCompanyCreated}))
+
+	// every subscriber gets the event, the failure is returned
+	err := bus.Publish(ctx, model.Event{ID: "2", Type: model.EventCompanyDeleted})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "downstream is down")
+
+	unsubscribe()
+	bus.Publish(ctx, model.Event{ID: "3", Type: model.EventCompanyCreated})
+
+	assert.Equal(t, []string{"1", "2"}, all)
+	assert.Equal(t, []string{"2"}, deleted)
+}
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	sink, err := NewFileSink(path)
+	assert.NoError(t, err)
+
+	bus := NewMemoryBus()
+	bus.Subscribe(sink.Handle)
+	bus.Publish(ctx, model.Event{ID: "1", Type: model.EventCompanyCreated, CompanyID: "c1",
+		Created: &model.CompanyCreated{Company: model.Company{ID: "c1", Name: "xm", Country: "Cyprus",
+			CreatedTs: time.Date(2026, time.October, 19, 10, 0, 0, 0, time.UTC)}}})
+	bus.Publish(ctx, model.Event{ID: "2", Type: model.EventCompanyUpdated, CompanyID: "c1",
+		Updated: &model.CompanyUpdated{Changes: []model.FieldChange{{Field: "phone", New: "+35722000000"}}}})
+	assert.NoError(t, sink.Close())
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var got []model.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(got) == 0 {
+			// the company in its v2 representation
+			assert.Contains(t, scanner.Text(), `"country":"Cyprus"`)
+			assert.Contains(t, scanner.Text(), `"created_at":"2026-10-19T10:00:00Z"`)
+		}
+		var e model.Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		got = append(got, e)
+	}
+	assert.Len(t, got, 2)
+	assert.Equal(t, "xm", got[0].Created.Company.Name)
+	assert.Equal(t, "Cyprus", got[0].Created.Company.Country)
+	assert.Nil(t, got[0].Updated)
+	assert.Equal(t, "phone", got[1].Updated.Changes[0].Field)
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+)
+
+type subscription struct {
+	id      int
+	handler Handler
+	types   []string
+}
+
+func (s *subscription) wants(typ string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryBus delivers the events in process, synchronously, in the order
+// of the subscriptions
+type MemoryBus struct {
+	mu     sync.RWMutex
+	subs   []*subscription
+	nextID int
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Subscribe(h Handler, types ...string) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := b.nextID
+	b.subs = append(b.subs, &subscription{id: id, handler: h, types: types})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, s := range b.subs {
+			if s.id == id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish hands e to every subscriber of its type. All of them get it, the
+// first failure is returned.
+func (b *MemoryBus) Publish(ctx context.Context, e model.Event) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	var first error
+	for _, s := range subs {
+		if !s.wants(e.Type) {
+			continue
+		}
+		if err := s.handler(ctx, e); err != nil {
+			logging.FromContext(ctx).Error("events: subscriber failed",
+				"event", e.ID, "type", e.Type, "error", err)
+			if first == nil {
+				first = errors.Wrapf(err, "events: subscriber failed on %s", e.ID)
+			}
+		}
+	}
+	return first
+}
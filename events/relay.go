@@ -0,0 +1,117 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/store"
+)
+
+const (
+	DefaultRelayInterval = time.Second
+	DefaultRelayBatch    = 100
+)
+
+// Relay delivers the events waiting in the outbox of the store to the
+// publisher, at least once and in order per company
+type Relay struct {
+	store    store.OutboxStore
+	pub      Publisher
+	interval time.Duration
+	batch    int
+}
+
+func NewRelay(s store.OutboxStore, pub Publisher, conf Config) *Relay {
+	r := &Relay{
+		store:    s,
+		pub:      pub,
+		interval: conf.RelayInterval.Duration(),
+		batch:    conf.RelayBatch,
+	}
+	if r.interval <= 0 {
+		r.interval = DefaultRelayInterval
+	}
+	if r.batch <= 0 {
+		r.batch = DefaultRelayBatch
+	}
+	return r
+}
+
+// Run delivers the pending events until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		// drain the backlog before waiting
+		for {
+			n, err := r.Flush(ctx)
+			if err != nil || n < r.batch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Flush delivers a batch of pending events and returns how many were
+// delivered. Once an event of a company fails, its next events wait for
+// the next flush, not to overtake it; the batch is refilled with the events
+// of the other companies, so a failing one doesn't hold them up.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	l := logging.FromContext(ctx)
+
+	delivered := 0
+	blocked := map[string]bool{}
+	for {
+		evs, err := r.store.PendingEvents(ctx, r.batch, blockedIDs(blocked))
+		if err != nil {
+			l.Error("events: failed to fetch the outbox", "error", err)
+			return delivered, err
+		}
+
+		blocks := len(blocked)
+		for _, e := range evs {
+			if blocked[e.CompanyID] {
+				continue
+			}
+
+			if err := r.pub.Publish(ctx, e); err != nil {
+				l.Error("events: failed to deliver the event",
+					"event", e.ID, "type", e.Type, "company", e.CompanyID, "error", err)
+				blocked[e.CompanyID] = true
+				continue
+			}
+			if err := r.store.MarkEventDelivered(ctx, e); err != nil {
+				// delivered again on the next flush
+				l.Error("events: failed to mark the event delivered",
+					"event", e.ID, "error", err)
+				blocked[e.CompanyID] = true
+				continue
+			}
+			delivered++
+		}
+
+		// the outbox is drained, or the batch was delivered but for
+		// the events of companies blocked before
+		if len(evs) < r.batch || len(blocked) == blocks {
+			return delivered, nil
+		}
+	}
+}
+
+func blockedIDs(blocked map[string]bool) []string {
+	ids := make([]string, 0, len(blocked))
+	for id := range blocked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
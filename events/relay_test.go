@@ -0,0 +1,111 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/utils"
+)
+
+// memOutbox is an in-memory outbox of pending events
+type memOutbox struct {
+	store.OutboxStore
+	pending []model.Event
+}
+
+func (m *memOutbox) PendingEvents(ctx context.Context, limit int, skip []string) ([]model.Event, error) {
+	evs := []model.Event{}
+	for _, e := range m.pending {
+		if len(evs) == limit {
+			break
+		}
+		if !utils.ContainsString(e.CompanyID, skip) {
+			evs = append(evs, e)
+		}
+	}
+	return evs, nil
+}
+
+func (m *memOutbox) MarkEventDelivered(ctx context.Context, e model.Event) error {
+	for i, p := range m.pending {
+		if p.ID == e.ID {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestRelayFlush(t *testing.T) {
+	ctx := context.Background()
+	ob := &memOutbox{pending: []model.Event{
+		{ID: "a1", CompanyID: "a", Seq: 1},
+		{ID: "b1", CompanyID: "b", Seq: 1},
+		{ID: "a2", CompanyID: "a", Seq: 2},
+		{ID: "b2", CompanyID: "b", Seq: 2},
+	}}
+
+	var got []string
+	failing := map[string]bool{"b1": true}
+	bus := NewMemoryBus()
+	bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		if failing[e.ID] {
+			return errors.New("downstream is down")
+		}
+		got = append(got, e.ID)
+		return nil
+	})
+
+	r := NewRelay(ob, bus, Config{RelayBatch: 3})
+
+	// b2 doesn't overtake the failed b1
+	n, err := r.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"a1", "a2"}, got)
+	assert.Len(t, ob.pending, 2)
+
+	failing["b1"] = false
+	n, err = r.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"a1", "a2", "b1", "b2"}, got)
+	assert.Empty(t, ob.pending)
+}
+
+func TestRelayFlushBlockedCompany(t *testing.T) {
+	ctx := context.Background()
+
+	// the events of the failing company fill the batches
+	ob := &memOutbox{}
+	for i := 1; i <= 5; i++ {
+		ob.pending = append(ob.pending, model.Event{ID: fmt.Sprintf("a%d", i), CompanyID: "a", Seq: int64(i)})
+	}
+	ob.pending = append(ob.pending,
+		model.Event{ID: "b1", CompanyID: "b", Seq: 1},
+		model.Event{ID: "c1", CompanyID: "c", Seq: 1},
+	)
+
+	var got []string
+	bus := NewMemoryBus()
+	bus.Subscribe(func(ctx context.Context, e model.Event) error {
+		if e.CompanyID == "a" {
+			return errors.New("downstream is down")
+		}
+		got = append(got, e.ID)
+		return nil
+	})
+
+	r := NewRelay(ob, bus, Config{RelayBatch: 2})
+	n, err := r.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"b1", "c1"}, got)
+	assert.Len(t, ob.pending, 5)
+}
@@ -0,0 +1,191 @@
+// Package health answers the liveness and readiness probes of the
+// orchestrator
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// statuses
+const (
+	StatusOK           = "ok"
+	StatusFailing      = "failing"
+	StatusShuttingDown = "shutting_down"
+)
+
+const (
+	DefaultTimeout    = 2 * time.Second
+	DefaultDrainDelay = 5 * time.Second
+)
+
+// Config configures the readiness checks
+type Config struct {
+	// Timeout bounds each check, default 2s
+	Timeout utils.Duration `json:"timeout"`
+
+	// GeoIP adds the geolocation providers to the readiness checks
+	GeoIP bool `json:"geoip"`
+
+	// GeoIPProbeIP is the IP looked up to check the providers
+	GeoIPProbeIP string `json:"geoip_probe_ip"`
+
+	// GeoIPInterval is how long the result of the providers check is
+	// reused, to spare the providers' quota, default 1m
+	GeoIPInterval utils.Duration `json:"geoip_interval"`
+
+	// DrainDelay is how long the server keeps serving with the readiness
+	// failing before it shuts down, default 5s
+	DrainDelay utils.Duration `json:"drain_delay"`
+}
+
+// CheckFunc checks a dependency, nil means it's usable
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs the readiness checks of the dependencies
+type Checker struct {
+	timeout  time.Duration
+	checks   []check
+	stopping int32
+}
+
+// NewChecker returns a checker bounding every check with timeout, 0 is
+// DefaultTimeout
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{timeout: timeout}
+}
+
+// Add adds the check of a dependency
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Shutdown fails the readiness from now on, for the traffic to drain
+func (c *Checker) Shutdown() {
+	atomic.StoreInt32(&c.stopping, 1)
+}
+
+func (c *Checker) shuttingDown() bool {
+	return atomic.LoadInt32(&c.stopping) == 1
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of the checks
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// Check runs the checks concurrently, the report is ok if all of them pass
+func (c *Checker) Check(ctx context.Context) Report {
+	rep := Report{
+		Status: StatusOK,
+		Checks: make(map[string]Result, len(c.checks)),
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func(chk check) {
+			defer wg.Done()
+			res := c.run(ctx, chk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			rep.Checks[chk.name] = res
+			if res.Status != StatusOK {
+				rep.Status = StatusFailing
+			}
+		}(chk)
+	}
+	wg.Wait()
+
+	if c.shuttingDown() {
+		rep.Status = StatusShuttingDown
+	}
+	return rep
+}
+
+func (c *Checker) run(ctx context.Context, chk check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := chk.fn(ctx)
+	res := Result{
+		Status:    StatusOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = StatusFailing
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Every reuses the result of fn for d
+func Every(d time.Duration, fn CheckFunc) CheckFunc {
+	var (
+		mu      sync.Mutex
+		last    error
+		checked time.Time
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < d {
+			return last
+		}
+		last = fn(ctx)
+		checked = time.Now()
+		return last
+	}
+}
+
+// LivenessHandler answers ok while the process serves requests; the
+// dependencies aren't checked, restarting wouldn't bring them back
+func (c *Checker) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, Report{Status: StatusOK})
+}
+
+// ReadinessHandler answers 200 with the checks' breakdown when the
+// dependencies are usable, 503 when one of them isn't or the server is
+// shutting down
+func (c *Checker) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	rep := c.Check(r.Context())
+	code := http.StatusOK
+	if rep.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeReport(w, code, rep)
+}
+
+func writeReport(w http.ResponseWriter, code int, rep Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
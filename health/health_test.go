@@ -0,0 +1,122 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func readyz(c *Checker) (int, Report) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	c.ReadinessHandler(rec, req)
+
+	var rep Report
+	json.Unmarshal(rec.Body.Bytes(), &rep)
+	return rec.Code, rep
+}
+
+func TestReadiness(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	testCases := map[string]struct {
+		checks   map[string]CheckFunc
+		shutdown bool
+
+		code    int
+		status  string
+		results map[string]string
+	}{
+		"no checks": {
+			code:    http.StatusOK,
+			status:  StatusOK,
+			results: map[string]string{},
+		},
+		"ok": {
+			checks:  map[string]CheckFunc{"mongo": ok, "geoip": ok},
+			code:    http.StatusOK,
+			status:  StatusOK,
+			results: map[string]string{"mongo": StatusOK, "geoip": StatusOK},
+		},
+		"down": {
+			checks:  map[string]CheckFunc{"mongo": down, "geoip": ok},
+			code:    http.StatusServiceUnavailable,
+			status:  StatusFailing,
+			results: map[string]string{"mongo": StatusFailing, "geoip": StatusOK},
+		},
+		"timeout": {
+			checks:  map[string]CheckFunc{"mongo": hang},
+			code:    http.StatusServiceUnavailable,
+			status:  StatusFailing,
+			results: map[string]string{"mongo": StatusFailing},
+		},
+		"shutting down": {
+			checks:   map[string]CheckFunc{"mongo": ok},
+			shutdown: true,
+			code:     http.StatusServiceUnavailable,
+			status:   StatusShuttingDown,
+			results:  map[string]string{"mongo": StatusOK},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := NewChecker(20 * time.Millisecond)
+			for n, fn := range tc.checks {
+				c.Add(n, fn)
+			}
+			if tc.shutdown {
+				c.Shutdown()
+			}
+
+			code, rep := readyz(c)
+			assert.Equal(t, tc.code, code)
+			assert.Equal(t, tc.status, rep.Status)
+
+			results := map[string]string{}
+			for n, res := range rep.Checks {
+				results[n] = res.Status
+				if res.Status == StatusFailing {
+					assert.NotEmpty(t, res.Error)
+				}
+			}
+			assert.Equal(t, tc.results, results)
+		})
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	c := NewChecker(0)
+	c.Add("mongo", func(ctx context.Context) error { return errors.New("down") })
+	c.Shutdown()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	c.LivenessHandler(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestEvery(t *testing.T) {
+	calls := 0
+	fn := Every(time.Hour, func(ctx context.Context) error {
+		calls++
+		return errors.New("down")
+	})
+
+	assert.Error(t, fn(context.Background()))
+	assert.Error(t, fn(context.Background()))
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,246 @@
+// Package idempotency replays the response to a request retried with the
+// same Idempotency-Key
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/utils"
+)
+
+const (
+	HdrIdempotencyKey = "Idempotency-Key"
+
+	// HdrIdempotentReplayed marks replayed responses
+	HdrIdempotentReplayed = "Idempotent-Replayed"
+
+	DefaultTTL = 24 * time.Hour
+
+	maxKeyLen  = 255
+	maxBodyLen = 1 << 20
+)
+
+// recorded response headers, the others belong to the request at hand
+var replayHeaders = []string{"Content-Type", "Location"}
+
+// Config configures the idempotency keys
+type Config struct {
+	// TTL is how long responses are kept for replay, default 24h
+	TTL utils.Duration `json:"ttl"`
+}
+
+// Engine records and replays the responses of idempotent requests
+type Engine struct {
+	store    store.IdempotencyStore
+	ttl      time.Duration
+	clientIP *utils.ClientIPResolver
+	now      func() time.Time
+}
+
+// NewEngine returns the engine; clientIP may be nil, then the peer address
+// is the client IP
+func NewEngine(conf Config, s store.IdempotencyStore, clientIP *utils.ClientIPResolver) *Engine {
+	ttl := conf.TTL.Duration()
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Engine{
+		store:    s,
+		ttl:      ttl,
+		clientIP: clientIP,
+		now:      time.Now,
+	}
+}
+
+// scopedKey keeps the keys of different callers, tenants and routes apart;
+// the unauthenticated callers are told apart by client IP
+func (e *Engine) scopedKey(r *http.Request, key string) (string, error) {
+	var caller string
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+		caller = p.Actor()
+	} else {
+		ip, err := e.clientIP.ClientIP(r)
+		if err != nil {
+			return "", err
+		}
+		caller = "ip:" + ip
+	}
+	t, _ := tenant.FromContext(r.Context())
+
+	return strings.Join([]string{t, caller, r.Method, r.URL.Path, key}, "|"), nil
+}
+
+// fingerprint identifies the request payload
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Middleware makes next idempotent for requests sent with an
+// Idempotency-Key: the first response is recorded and replayed to retries
+// with the same key and payload. A retry with another payload gets 422,
+// one while the first is in progress 409. Server errors aren't recorded,
+// so the request can be retried. Requests without a key pass through.
+// It's meant for the creates of a single company, there are no batch
+// endpoints to cover.
+func (e *Engine) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if e == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HdrIdempotencyKey)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLen {
+			http.Error(w, "idempotency key too long", http.StatusBadRequest)
+			return
+		}
+		scoped, err := e.scopedKey(r, key)
+		if err != nil {
+			http.Error(w, "failed to retrieve client IP: "+err.Error(), http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyLen))
+		if err != nil {
+			http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		now := e.now()
+		rec := model.IdempotencyRecord{
+			Key:         scoped,
+			Fingerprint: fingerprint(r, body),
+			CreatedTs:   now,
+			ExpiresTs:   now.Add(e.ttl),
+		}
+
+		err = e.store.ReserveIdempotencyKey(ctx, rec)
+		if errors.Is(err, store.ErrIdempotencyKeyExists) {
+			e.replay(w, r, rec)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to store the idempotency key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the client may be gone, the outcome must be recorded anyway
+		l := logging.FromContext(ctx)
+		ctx = logging.NewContext(context.Background(), l)
+
+		rw := &recorder{ResponseWriter: w}
+		done := false
+		defer func() {
+			if done {
+				return
+			}
+			// the handler panicked, the key is released for the retries
+			if err := e.store.DeleteIdempotencyKey(ctx, rec.Key); err != nil {
+				l.Error("idempotency: failed to release the key", "key", key, "error", err)
+			}
+		}()
+		next(rw, r)
+		done = true
+
+		if rw.status() >= http.StatusInternalServerError {
+			err = e.store.DeleteIdempotencyKey(ctx, rec.Key)
+		} else {
+			rec.Status = rw.status()
+			rec.Body = rw.body.Bytes()
+			for _, h := range replayHeaders {
+				if v := w.Header().Get(h); v != "" {
+					if rec.Header == nil {
+						rec.Header = map[string]string{}
+					}
+					rec.Header[h] = v
+				}
+			}
+			err = e.store.CompleteIdempotencyKey(ctx, rec)
+		}
+		if err != nil {
+			l.Error("idempotency: failed to record the response", "key", key, "error", err)
+		}
+	}
+}
+
+// replay answers a retry with the recorded response
+func (e *Engine) replay(w http.ResponseWriter, r *http.Request, req model.IdempotencyRecord) {
+	rec, err := e.store.GetIdempotencyKey(r.Context(), req.Key)
+	if errors.Is(err, store.ErrIdempotencyKeyNotFound) {
+		// expired or released in between
+		http.Error(w, "a request with this idempotency key just completed, retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to fetch the idempotency key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if rec.Fingerprint != req.Fingerprint {
+		http.Error(w, "idempotency key reused with a different payload", http.StatusUnprocessableEntity)
+		return
+	}
+	if !rec.Done() {
+		http.Error(w, "a request with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+
+	for h, v := range rec.Header {
+		w.Header().Set(h, v)
+	}
+	w.Header().Set(HdrIdempotentReplayed, "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// recorder captures the response while writing it through
+type recorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
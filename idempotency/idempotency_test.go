@@ -0,0 +1,158 @@
+package idempotency
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/utils"
+)
+
+func TestMiddleware(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	mem := NewMemoryStore()
+	mem.now = func() time.Time { return now }
+
+	e := NewEngine(Config{TTL: utils.Duration(time.Hour)}, mem, nil)
+	e.now = mem.now
+
+	calls := 0
+	fail := false
+	h := e.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			http.Error(w, "mongo is down", http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Other", "not replayed")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":"%d","req":%s}`, calls, body)
+	})
+
+	remoteAddr := "10.0.0.1:1234"
+	do := func(key, body string, p *auth.Principal) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/companies", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set(HdrIdempotencyKey, key)
+		}
+		if p != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), p))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	first := do("k1", `{"name":"a"}`, nil)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, `{"id":"1","req":{"name":"a"}}`, first.Body.String())
+
+	// retry
+	rec := do("k1", `{"name":"a"}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, first.Body.String(), rec.Body.String())
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "", rec.Header().Get("X-Other"))
+	assert.Equal(t, "true", rec.Header().Get(HdrIdempotentReplayed))
+	assert.Equal(t, 1, calls)
+
+	// same key, another payload
+	rec = do("k1", `{"name":"b"}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, 1, calls)
+
+	// the key of another caller
+	p := &auth.Principal{ID: "k", Kind: auth.KindAPIKey}
+	rec = do("k1", `{"name":"b"}`, p)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 2, calls)
+
+	// the key of an unauthenticated caller from another IP
+	remoteAddr = "10.0.0.2:1234"
+	rec = do("k1", `{"name":"b"}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 3, calls)
+	remoteAddr = "10.0.0.1:1234"
+
+	// no key
+	do("", `{"name":"a"}`, nil)
+	do("", `{"name":"a"}`, nil)
+	assert.Equal(t, 5, calls)
+
+	// server errors aren't recorded
+	fail = true
+	rec = do("k2", `{"name":"c"}`, nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	fail = false
+	rec = do("k2", `{"name":"c"}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 7, calls)
+
+	// expired
+	now = now.Add(time.Hour)
+	rec = do("k1", `{"name":"b"}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 8, calls)
+
+	rec = do(strings.Repeat("k", 256), `{}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMiddlewareInProgress(t *testing.T) {
+	e := NewEngine(Config{}, NewMemoryStore(), nil)
+
+	var inner *httptest.ResponseRecorder
+	var h http.HandlerFunc
+	h = e.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		// the retry arrives while the first request is handled
+		req, _ := http.NewRequest("POST", "/api/v1/companies", strings.NewReader("{}"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(HdrIdempotencyKey, "k")
+		inner = httptest.NewRecorder()
+		h(inner, req)
+	})
+
+	req, _ := http.NewRequest("POST", "/api/v1/companies", strings.NewReader("{}"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(HdrIdempotencyKey, "k")
+	h(httptest.NewRecorder(), req)
+
+	assert.Equal(t, http.StatusConflict, inner.Code)
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	e := NewEngine(Config{}, NewMemoryStore(), nil)
+
+	panics := true
+	h := e.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	do := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/companies", strings.NewReader("{}"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(HdrIdempotencyKey, "k")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	assert.Panics(t, func() { do() })
+
+	// the key was released, the retry runs
+	panics = false
+	assert.Equal(t, http.StatusCreated, do().Code)
+}
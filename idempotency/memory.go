@@ -0,0 +1,90 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+// drop expired records at most this often
+const sweepInterval = time.Minute
+
+// MemoryStore is an in-process store.IdempotencyStore, for data stores
+// which don't keep idempotency keys
+type MemoryStore struct {
+	mu        sync.Mutex
+	records   map[string]model.IdempotencyRecord
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: map[string]model.IdempotencyRecord{},
+		now:     time.Now,
+	}
+}
+
+// get returns the unexpired record, dropping an expired one
+func (s *MemoryStore) get(key string) (model.IdempotencyRecord, bool) {
+	rec, ok := s.records[key]
+	if ok && !s.now().Before(rec.ExpiresTs) {
+		delete(s.records, key)
+		return rec, false
+	}
+	return rec, ok
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(rec.Key); ok {
+		return store.ErrIdempotencyKeyExists
+	}
+	s.records[rec.Key] = rec
+
+	if now := s.now(); now.Sub(s.lastSweep) >= sweepInterval {
+		for key, rec := range s.records {
+			if !now.Before(rec.ExpiresTs) {
+				delete(s.records, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetIdempotencyKey(ctx context.Context, key string) (*model.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.get(key)
+	if !ok {
+		return nil, store.ErrIdempotencyKeyNotFound
+	}
+	return &rec, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[rec.Key]; !ok {
+		return store.ErrIdempotencyKeyNotFound
+	}
+	s.records[rec.Key] = rec
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
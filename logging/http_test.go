@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	testCases := map[string]struct {
+		reqID  string
+		status int
+
+		sameID bool
+		level  string
+	}{
+		"caller id": {
+			reqID:  "abc-123",
+			status: http.StatusOK,
+			sameID: true,
+			level:  "info",
+		},
+		"no id": {
+			status: http.StatusNotFound,
+			level:  "info",
+		},
+		"id too long": {
+			reqID:  strings.Repeat("a", 129),
+			status: http.StatusOK,
+			level:  "info",
+		},
+		"id not printable": {
+			reqID:  "a b",
+			status: http.StatusOK,
+			level:  "info",
+		},
+		"server error": {
+			reqID:  "abc-123",
+			status: http.StatusInternalServerError,
+			sameID: true,
+			level:  "error",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := New(&buf, LevelInfo)
+
+			var ctxID string
+			h := Middleware(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxID, _ = RequestIDFromContext(r.Context())
+				FromContext(r.Context()).Info("handling")
+				w.WriteHeader(tc.status)
+				w.Write([]byte("body"))
+			}))
+
+			req, _ := http.NewRequest("GET", "/api/v1/companies", nil)
+			if tc.reqID != "" {
+				req.Header.Set(HdrRequestID, tc.reqID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(HdrRequestID)
+			assert.NotEmpty(t, id)
+			assert.Equal(t, id, ctxID)
+			if tc.sameID {
+				assert.Equal(t, tc.reqID, id)
+			} else {
+				assert.NotEqual(t, tc.reqID, id)
+			}
+
+			es := entries(t, &buf)
+			assert.Len(t, es, 2)
+			assert.Equal(t, "handling", es[0]["msg"])
+			assert.Equal(t, id, es[0]["request_id"])
+
+			assert.Equal(t, "access", es[1]["msg"])
+			assert.Equal(t, tc.level, es[1]["level"])
+			assert.Equal(t, id, es[1]["request_id"])
+			assert.Equal(t, float64(tc.status), es[1]["status"])
+			assert.Equal(t, float64(4), es[1]["bytes"])
+			assert.Equal(t, "/api/v1/companies", es[1]["path"])
+		})
+	}
+}
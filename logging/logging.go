@@ -0,0 +1,208 @@
+// Package logging writes leveled, structured JSON logs
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, empty is info
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", s)
+}
+
+// Config configures the logger
+type Config struct {
+	// Level is the minimum level logged: debug, info, warn or error
+	Level string `json:"level"`
+}
+
+// output serializes the writes of a logger and its children
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Logger writes one JSON object per entry, with the entry's key/value
+// pairs added to the logger's own
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+
+	now func() time.Time
+}
+
+// New returns a logger writing entries at level and above to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		out:   &output{w: w},
+		level: level,
+		now:   time.Now,
+	}
+}
+
+// NewFromConfig returns a logger writing to stderr
+func NewFromConfig(conf Config) (*Logger, error) {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return nil, err
+	}
+	return New(os.Stderr, level), nil
+}
+
+// With returns a logger adding the key/value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &child
+}
+
+// Enabled tells whether entries of the level are logged
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"ts":    l.now().UTC().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	addFields(entry, l.fields)
+	addFields(entry, kv)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"ts":    entry["ts"],
+			"level": entry["level"],
+			"msg":   msg,
+			"error": "failed to encode log entry: " + err.Error(),
+		})
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(append(b, '\n'))
+}
+
+// addFields adds the key/value pairs to the entry. Errors are logged by
+// their message, a key without value gets "!MISSING".
+func addFields(entry map[string]interface{}, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+
+		var v interface{} = "!MISSING"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		switch val := v.(type) {
+		case error:
+			v = val.Error()
+		case time.Duration:
+			v = val.String()
+		case fmt.Stringer:
+			v = val.String()
+		}
+		entry[key] = v
+	}
+}
+
+// Writer returns a writer logging every line written to it at the level,
+// to route the standard library logger through l
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.log(level, strings.TrimRight(string(p), "\n"), nil)
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(os.Stderr, LevelInfo)
+)
+
+// Default returns the logger of contexts without one
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger of the context, the default logger if it
+// has none
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok && l != nil {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		res = append(res, e)
+	}
+	return res
+}
+
+func TestParseLevel(t *testing.T) {
+	testCases := map[string]struct {
+		in    string
+		level Level
+		err   bool
+	}{
+		"empty":   {in: "", level: LevelInfo},
+		"debug":   {in: "debug", level: LevelDebug},
+		"case":    {in: "WARN", level: LevelWarn},
+		"error":   {in: "error", level: LevelError},
+		"unknown": {in: "verbose", err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			level, err := ParseLevel(tc.in)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.level, level)
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelInfo)
+	l.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	l.Debug("dropped")
+	l.With("request_id", "r1").Info("hello", "n", 1, "err", errors.New("boom"), "d", time.Second, "odd")
+	l.Error("failed")
+
+	es := entries(t, &buf)
+	assert.Len(t, es, 2)
+	assert.Equal(t, map[string]interface{}{
+		"ts":         "2020-09-13T12:26:40Z",
+		"level":      "info",
+		"msg":        "hello",
+		"request_id": "r1",
+		"n":          float64(1),
+		"err":        "boom",
+		"d":          "1s",
+		"odd":        "!MISSING",
+	}, es[0])
+	assert.Equal(t, "error", es[1]["level"])
+	assert.NotContains(t, es[1], "request_id")
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelInfo)
+
+	l.Writer(LevelWarn).Write([]byte("from the std logger\n"))
+
+	es := entries(t, &buf)
+	assert.Len(t, es, 1)
+	assert.Equal(t, "warn", es[0]["level"])
+	assert.Equal(t, "from the std logger", es[0]["msg"])
+}
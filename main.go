@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
 	"net/url"
 
+	"github.com/arpsch/xm/config"
+	"github.com/arpsch/xm/logging"
 	"github.com/arpsch/xm/server"
 	"github.com/arpsch/xm/store/mongo"
+	"github.com/arpsch/xm/tracing"
 )
 
 func main() {
@@ -21,21 +24,48 @@ func doMain() error {
 
 	ctx := context.Background()
 
-	mgoUrl, err := url.Parse("mongodb://127.0.0.1:27017")
+	configPath := flag.String("config", "", "path to the JSON config file")
+	flag.Parse()
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger, err := logging.NewFromConfig(conf.Log)
 	if err != nil {
 		log.Fatal(err)
 	}
+	logging.SetDefault(logger)
+	// route the logs of the libraries through the structured logger
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+
+	shutdownTracing, err := tracing.Setup(ctx, conf.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("failed to flush the spans", "error", err)
+		}
+	}()
+
+	mgoUrl, err := url.Parse(conf.Mongo.URL)
+	if err != nil {
+		return err
+	}
 
 	storeConfig := mongo.MongoStoreConfig{
 		MongoURL: mgoUrl,
-		DbName:   "xm",
+		DbName:   conf.Mongo.DbName,
+		Tenancy:  conf.Tenancy.Mode,
 	}
 	ds, err := mongo.NewMongoStore(context.Background(), storeConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	defer ds.Close(ctx)
-	fmt.Printf("Starting the server...")
-	return server.InitAndRun(ds)
+	return server.InitAndRun(conf, ds)
 }
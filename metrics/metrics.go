@@ -0,0 +1,327 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector is a metric family which can be written in the Prometheus
+// text exposition format
+type Collector interface {
+	Name() string
+	Write(w io.Writer) error
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders {name="value",...}, extra pairs are appended as is
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return err
+}
+
+// vec holds the children of a labeled metric family
+type vec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu       sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newVec(name, help string, labelNames []string) vec {
+	return vec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		children:   map[string]interface{}{},
+		values:     map[string][]string{},
+	}
+}
+
+func (v *vec) Name() string {
+	return v.name
+}
+
+func (v *vec) child(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			v.name, len(v.labelNames), len(values)))
+	}
+
+	key := labelKey(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.children[key]
+	if !ok {
+		c = create()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// sortedKeys returns the children keys in a stable order
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	mu  sync.Mutex
+	val float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.val += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.val
+}
+
+// CounterVec is a counter family partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labelNames)}
+}
+
+func (cv *CounterVec) WithLabelValues(values ...string) *Counter {
+	return cv.child(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (cv *CounterVec) Write(w io.Writer) error {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	if err := writeHeader(w, cv.name, cv.help, "counter"); err != nil {
+		return err
+	}
+	for _, k := range cv.sortedKeys() {
+		c := cv.children[k].(*Counter)
+		_, err := fmt.Fprintf(w, "%s%s %s\n", cv.name,
+			formatLabels(cv.labelNames, cv.values[k]), formatFloat(c.Value()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	mu  sync.Mutex
+	val float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.val = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.val += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.val
+}
+
+// GaugeVec is a gauge family partitioned by labels
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec(name, help, labelNames)}
+}
+
+func (gv *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return gv.child(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (gv *GaugeVec) Write(w io.Writer) error {
+	gv.mu.Lock()
+	defer gv.mu.Unlock()
+
+	if err := writeHeader(w, gv.name, gv.help, "gauge"); err != nil {
+		return err
+	}
+	for _, k := range gv.sortedKeys() {
+		g := gv.children[k].(*Gauge)
+		_, err := fmt.Fprintf(w, "%s%s %s\n", gv.name,
+			formatLabels(gv.labelNames, gv.values[k]), formatFloat(g.Value()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is an unlabeled gauge whose value is computed at scrape time
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, fn: fn}
+}
+
+func (gf *GaugeFunc) Name() string {
+	return gf.name
+}
+
+func (gf *GaugeFunc) Write(w io.Writer) error {
+	if err := writeHeader(w, gf.name, gf.help, "gauge"); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", gf.name, formatFloat(gf.fn()))
+	return err
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// HistogramVec is a histogram family partitioned by labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{vec: newVec(name, help, labelNames), buckets: b}
+}
+
+func (hv *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return hv.child(values, func() interface{} {
+		return &Histogram{
+			buckets: hv.buckets,
+			counts:  make([]uint64, len(hv.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (hv *HistogramVec) Write(w io.Writer) error {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	if err := writeHeader(w, hv.name, hv.help, "histogram"); err != nil {
+		return err
+	}
+	for _, k := range hv.sortedKeys() {
+		h := hv.children[k].(*Histogram)
+		values := hv.values[k]
+
+		h.mu.Lock()
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name,
+				formatLabels(hv.labelNames, values, "le", formatFloat(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name,
+			formatLabels(hv.labelNames, values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name,
+			formatLabels(hv.labelNames, values), formatFloat(h.sum))
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", hv.name,
+			formatLabels(hv.labelNames, values), h.count)
+		h.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+
+	requests := NewCounterVec("test_requests_total", "Requests served.", "code")
+	requests.WithLabelValues("200").Inc()
+	requests.WithLabelValues("200").Add(2)
+	requests.WithLabelValues("500").Inc()
+
+	latency := NewHistogramVec("test_latency_seconds", "Request latency.",
+		[]float64{0.1, 1}, "route")
+	latency.WithLabelValues("/a").Observe(0.05)
+	latency.WithLabelValues("/a").Observe(0.5)
+
+	up := NewGaugeFunc("test_up", "Whether the test is up.", func() float64 { return 1 })
+
+	reg.Register(requests)
+	reg.Register(latency)
+	reg.Register(up)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	reg.ServeHTTP(rec, req)
+
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="/a",le="0.1"} 1
+test_latency_seconds_bucket{route="/a",le="1"} 2
+test_latency_seconds_bucket{route="/a",le="+Inf"} 2
+test_latency_seconds_sum{route="/a"} 0.55
+test_latency_seconds_count{route="/a"} 2
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="500"} 1
+# HELP test_up Whether the test is up.
+# TYPE test_up gauge
+test_up 1
+`, string(body))
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register(NewCounterVec("dup_total", "dup"))
+
+	assert.Panics(t, func() {
+		reg.Register(NewCounterVec("dup_total", "dup"))
+	})
+}
+
+func TestLabelCardinality(t *testing.T) {
+	cv := NewCounterVec("card_total", "card", "a", "b")
+
+	assert.Panics(t, func() {
+		cv.WithLabelValues("only-one")
+	})
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds the collectors exposed on /metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]Collector
+}
+
+// DefaultRegistry is the registry the package level helpers use
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: map[string]Collector{},
+	}
+}
+
+// Register adds a collector, panics if its name is already taken
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collectors[c.Name()]; ok {
+		panic(fmt.Sprintf("metrics: duplicate collector %s", c.Name()))
+	}
+	r.collectors[c.Name()] = c
+}
+
+// Unregister removes the collector with the given name
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.collectors, name)
+	r.mu.Unlock()
+}
+
+// ServeHTTP writes all collectors in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for n := range r.collectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	collectors := make([]Collector, 0, len(names))
+	for _, n := range names {
+		collectors = append(collectors, r.collectors[n])
+	}
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		if err := c.Write(&buf); err != nil {
+			http.Error(w, "failed to write metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+// MustRegister adds the collectors to the DefaultRegistry
+func MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		DefaultRegistry.Register(c)
+	}
+}
+
+// Handler serves the DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// APIKey represents an API key; only the hash of the key is stored
+type APIKey struct {
+	ID string `json:"id" bson:"_id,omitempty"`
+
+	Name string `json:"name" bson:"name,omitempty"`
+
+	// Prefix is the beginning of the key, to tell keys apart
+	Prefix string `json:"prefix" bson:"prefix,omitempty"`
+	Hash   string `json:"-" bson:"hash,omitempty"`
+
+	Scopes []string `json:"scopes" bson:"scopes,omitempty"`
+
+	// TenantID binds the key to a tenant, keys without one name the
+	// tenant of each request
+	TenantID string `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+
+	CreatedTs time.Time  `json:"created_ts" bson:"created_ts,omitempty"`
+	ExpiresTs *time.Time `json:"expires_ts,omitempty" bson:"expires_ts,omitempty"`
+	RevokedTs *time.Time `json:"revoked_ts,omitempty" bson:"revoked_ts,omitempty"`
+}
+
+// Active tells whether the key is neither revoked nor expired
+func (k APIKey) Active(now time.Time) bool {
+	if k.RevokedTs != nil {
+		return false
+	}
+	if k.ExpiresTs != nil && !now.Before(*k.ExpiresTs) {
+		return false
+	}
+	return true
+}
+
+// APIKeyCreate is the request to create an API key
+type APIKeyCreate struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// ExpiresTs is optional and in the future, keys without it don't
+	// expire
+	ExpiresTs *time.Time `json:"expires_ts,omitempty"`
+}
+
+func (kc APIKeyCreate) Validate(knownScopes []string) error {
+	scopes := make([]interface{}, 0, len(knownScopes))
+	for _, s := range knownScopes {
+		scopes = append(scopes, s)
+	}
+	return validation.ValidateStruct(&kc,
+		validation.Field(&kc.Name, validation.Required),
+		validation.Field(&kc.Scopes, validation.Required,
+			validation.Each(validation.In(scopes...))),
+		validation.Field(&kc.TenantID, validation.By(func(v interface{}) error {
+			if id := v.(string); id != "" {
+				return ValidateTenantID(id)
+			}
+			return nil
+		})),
+		validation.Field(&kc.ExpiresTs, validation.By(func(v interface{}) error {
+			if ts := v.(*time.Time); ts != nil && !ts.After(time.Now()) {
+				return errors.New("must be in the future")
+			}
+			return nil
+		})),
+	)
+}
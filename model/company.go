@@ -11,6 +11,10 @@ import (
 type Company struct {
 	ID string `json:"id" bson:"_id,omitempty"`
 
+	// TenantID is set by the store from the request context. It and the
+	// actors are left out of the v1 wire format, see CompanyV2.
+	TenantID string `json:"-" bson:"tenant_id,omitempty"`
+
 	Name    string `json:"name" bson:"name,omitempty"`
 	Code    string `json:"code" bson:"code,omitempty"`
 	Country string `jsoon:"country" bson:"country,omitempty"`
@@ -19,6 +23,62 @@ type Company struct {
 
 	CreatedTs time.Time `json:"crated_ts" bson:"created_ts,omitempty"`
 	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+
+	// CreatedBy and UpdatedBy record the actor of the last change
+	CreatedBy string `json:"-" bson:"created_by,omitempty"`
+	UpdatedBy string `json:"-" bson:"updated_by,omitempty"`
+}
+
+// CompanyV2 is the v2 representation of a company, that of the v2 API and
+// of the event payloads; v1 keeps the wire format of Company
+type CompanyV2 struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id,omitempty"`
+
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Country string `json:"country"`
+	Website string `json:"website,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// V2 returns the v2 representation of the company
+func (comp *Company) V2() CompanyV2 {
+	return CompanyV2{
+		ID:        comp.ID,
+		TenantID:  comp.TenantID,
+		Name:      comp.Name,
+		Code:      comp.Code,
+		Country:   comp.Country,
+		Website:   comp.Website,
+		Phone:     comp.Phone,
+		CreatedAt: comp.CreatedTs,
+		UpdatedAt: comp.UpdatedTs,
+		CreatedBy: comp.CreatedBy,
+		UpdatedBy: comp.UpdatedBy,
+	}
+}
+
+// Company returns the company of the v2 representation
+func (c CompanyV2) Company() Company {
+	return Company{
+		ID:        c.ID,
+		TenantID:  c.TenantID,
+		Name:      c.Name,
+		Code:      c.Code,
+		Country:   c.Country,
+		Website:   c.Website,
+		Phone:     c.Phone,
+		CreatedTs: c.CreatedAt,
+		UpdatedTs: c.UpdatedAt,
+		CreatedBy: c.CreatedBy,
+		UpdatedBy: c.UpdatedBy,
+	}
 }
 
 func (comp Company) Validate() error {
@@ -38,9 +98,10 @@ func (comp Company) Validate() error {
 // CompanyUpdate allows updating the company information
 type CompanyUpdate struct {
 	Website string `json:"website" bson:"website,omitempty"`
-	Phone   string `json:"phone" bson:"phone,omitmepty"`
+	Phone   string `json:"phone" bson:"phone,omitempty"`
 
 	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+	UpdatedBy string    `json:"-" bson:"updated_by,omitempty"`
 }
 
 func (compUp CompanyUpdate) Validate() error {
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// event types
+const (
+	EventCompanyCreated = "company.created"
+	EventCompanyUpdated = "company.updated"
+	EventCompanyDeleted = "company.deleted"
+)
+
+// Event is a stored change of a company. The payload matching the Type is
+// set. In JSON the payloads carry the companies in their v2 representation.
+type Event struct {
+	ID   string    `json:"id" bson:"_id"`
+	Type string    `json:"type" bson:"type"`
+	Time time.Time `json:"time" bson:"time"`
+
+	TenantID  string `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+	CompanyID string `json:"company_id" bson:"company_id"`
+
+	// Seq orders the events of a company, set by stores keeping an outbox
+	Seq int64 `json:"seq,omitempty" bson:"seq,omitempty"`
+
+	// Actor made the change, see auth.Principal.Actor
+	Actor string `json:"actor,omitempty" bson:"actor,omitempty"`
+
+	Created *CompanyCreated `json:"created,omitempty" bson:"created,omitempty"`
+	Updated *CompanyUpdated `json:"updated,omitempty" bson:"updated,omitempty"`
+	Deleted *CompanyDeleted `json:"deleted,omitempty" bson:"deleted,omitempty"`
+}
+
+// CompanyCreated carries the new company
+type CompanyCreated struct {
+	Company Company `json:"company" bson:"company"`
+}
+
+// CompanyUpdated carries the fields which changed and the company after
+// the update
+type CompanyUpdated struct {
+	Changes []FieldChange `json:"changes" bson:"changes"`
+	Company Company       `json:"company" bson:"company"`
+}
+
+// FieldChange is the old and new value of a field
+type FieldChange struct {
+	Field string `json:"field" bson:"field"`
+	Old   string `json:"old" bson:"old"`
+	New   string `json:"new" bson:"new"`
+}
+
+// CompanyDeleted carries the company as it was before its deletion
+type CompanyDeleted struct {
+	Company Company `json:"company" bson:"company"`
+}
+
+// companyPayload and updatePayload are the JSON of the payloads, with the
+// company in its v2 representation
+type companyPayload struct {
+	Company CompanyV2 `json:"company"`
+}
+
+type updatePayload struct {
+	Changes []FieldChange `json:"changes"`
+	Company CompanyV2     `json:"company"`
+}
+
+func (p CompanyCreated) MarshalJSON() ([]byte, error) {
+	return json.Marshal(companyPayload{Company: p.Company.V2()})
+}
+
+func (p *CompanyCreated) UnmarshalJSON(b []byte) error {
+	var v companyPayload
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	p.Company = v.Company.Company()
+	return nil
+}
+
+func (p CompanyUpdated) MarshalJSON() ([]byte, error) {
+	return json.Marshal(updatePayload{Changes: p.Changes, Company: p.Company.V2()})
+}
+
+func (p *CompanyUpdated) UnmarshalJSON(b []byte) error {
+	var v updatePayload
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	p.Changes = v.Changes
+	p.Company = v.Company.Company()
+	return nil
+}
+
+func (p CompanyDeleted) MarshalJSON() ([]byte, error) {
+	return json.Marshal(companyPayload{Company: p.Company.V2()})
+}
+
+func (p *CompanyDeleted) UnmarshalJSON(b []byte) error {
+	var v companyPayload
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	p.Company = v.Company.Company()
+	return nil
+}
+
+// Company returns the company as of the event
+func (e Event) Company() *Company {
+	switch {
+	case e.Created != nil:
+		return &e.Created.Company
+	case e.Updated != nil:
+		return &e.Updated.Company
+	case e.Deleted != nil:
+		return &e.Deleted.Company
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// IdempotencyRecord keeps the response to a request sent with an
+// Idempotency-Key, to replay it when the request is retried
+type IdempotencyRecord struct {
+	// Key is the client's key, scoped to the caller and route
+	Key string `json:"key" bson:"_id"`
+
+	// Fingerprint identifies the request payload
+	Fingerprint string `json:"fingerprint" bson:"fingerprint"`
+
+	// Status is 0 while the request is in progress
+	Status int               `json:"status" bson:"status"`
+	Header map[string]string `json:"header,omitempty" bson:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty" bson:"body,omitempty"`
+
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
+	ExpiresTs time.Time `json:"expires_ts" bson:"expires_ts"`
+}
+
+// Done tells whether the response was recorded
+func (r IdempotencyRecord) Done() bool {
+	return r.Status != 0
+}
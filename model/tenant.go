@@ -0,0 +1,19 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+)
+
+var ErrInvalidTenantID = errors.New("invalid tenant id")
+
+// tenant ids end up in database names, keep them short and plain
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidateTenantID checks the id is usable as a tenant id
+func ValidateTenantID(id string) error {
+	if !tenantIDPattern.MatchString(id) {
+		return ErrInvalidTenantID
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/go-ozzo/ozzo-validation/is"
+)
+
+// delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead marks the deliveries which ran out of retries, the dead
+	// letters
+	DeliveryDead = "dead"
+)
+
+// EventTypes lists the types of the company events
+var EventTypes = []string{
+	EventCompanyCreated,
+	EventCompanyUpdated,
+	EventCompanyDeleted,
+}
+
+// Webhook is a subscription to the company events of a tenant, pushed to
+// URL
+type Webhook struct {
+	ID string `json:"id" bson:"_id,omitempty"`
+
+	TenantID string `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+
+	URL string `json:"url" bson:"url,omitempty"`
+
+	// EventTypes filters the events, empty subscribes to all of them
+	EventTypes []string `json:"event_types,omitempty" bson:"event_types,omitempty"`
+
+	// Secret signs the deliveries, shown only at creation
+	Secret string `json:"-" bson:"secret,omitempty"`
+
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts,omitempty"`
+	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+}
+
+// Wants tells whether the webhook subscribes to the events of the type
+func (w Webhook) Wants(typ string) bool {
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range w.EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckWebhookURL checks a webhook URL is https, or plain http to one of
+// the insecure hosts
+func CheckWebhookURL(raw string, insecureHosts []string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if u.Scheme == "http" {
+		for _, h := range insecureHosts {
+			if strings.EqualFold(h, u.Hostname()) {
+				return nil
+			}
+		}
+	}
+	return errors.New("must be an https URL")
+}
+
+func webhookURLRule(insecureHosts []string) validation.Rule {
+	return validation.By(func(value interface{}) error {
+		s, _ := value.(string)
+		if s == "" {
+			return nil
+		}
+		return CheckWebhookURL(s, insecureHosts)
+	})
+}
+
+func eventTypeRule() validation.Rule {
+	types := make([]interface{}, 0, len(EventTypes))
+	for _, t := range EventTypes {
+		types = append(types, t)
+	}
+	return validation.Each(validation.In(types...))
+}
+
+// WebhookCreate is the request to create a webhook; a secret is generated
+// when none is given
+type WebhookCreate struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+
+	// InsecureHosts are the hosts the URL may name over plain http, it
+	// must be https otherwise
+	InsecureHosts []string `json:"-"`
+}
+
+func (wc WebhookCreate) Validate() error {
+	return validation.ValidateStruct(&wc,
+		validation.Field(&wc.URL, validation.Required, is.URL, webhookURLRule(wc.InsecureHosts)),
+		validation.Field(&wc.EventTypes, eventTypeRule()),
+		validation.Field(&wc.Secret, validation.Length(16, 256)),
+	)
+}
+
+// WebhookUpdate replaces the URL and event types of a webhook and, if
+// given, its secret
+type WebhookUpdate struct {
+	URL        string   `json:"url" bson:"url,omitempty"`
+	EventTypes []string `json:"event_types" bson:"event_types"`
+	Secret     string   `json:"secret" bson:"secret,omitempty"`
+
+	UpdatedTs time.Time `json:"-" bson:"updated_ts,omitempty"`
+
+	// InsecureHosts are the hosts the URL may name over plain http, it
+	// must be https otherwise
+	InsecureHosts []string `json:"-" bson:"-"`
+}
+
+func (wu WebhookUpdate) Validate() error {
+	return validation.ValidateStruct(&wu,
+		validation.Field(&wu.URL, validation.Required, is.URL, webhookURLRule(wu.InsecureHosts)),
+		validation.Field(&wu.EventTypes, eventTypeRule()),
+		validation.Field(&wu.Secret, validation.Length(16, 256)),
+	)
+}
+
+// Delivery is the push of an event to a webhook, along with its attempts
+type Delivery struct {
+	ID        string `json:"id" bson:"_id,omitempty"`
+	WebhookID string `json:"webhook_id" bson:"webhook_id,omitempty"`
+	TenantID  string `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+
+	EventID   string `json:"event_id" bson:"event_id,omitempty"`
+	EventType string `json:"event_type" bson:"event_type,omitempty"`
+
+	// Payload is the body posted, the event
+	Payload json.RawMessage `json:"payload" bson:"payload,omitempty"`
+
+	Status string `json:"status" bson:"status,omitempty"`
+	// NextAttemptTs is when a pending delivery is attempted next
+	NextAttemptTs time.Time         `json:"next_attempt_ts,omitempty" bson:"next_attempt_ts,omitempty"`
+	Attempts      []DeliveryAttempt `json:"attempts" bson:"attempts"`
+
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts,omitempty"`
+	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+}
+
+// DeliveryAttempt is the outcome of an attempt: the response status or,
+// without a response, the error
+type DeliveryAttempt struct {
+	Ts         time.Time `json:"ts" bson:"ts"`
+	StatusCode int       `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	LatencyMs  float64   `json:"latency_ms" bson:"latency_ms"`
+}
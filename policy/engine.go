@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/utils"
+)
+
+// ErrDenied is matched by the denials of the policies
+var ErrDenied = errors.New("you're not authorized")
+
+// Engine attaches geo-access policies to routes
+type Engine struct {
+	policies []*Policy
+	geo      client.GeoLocator
+	clientIP *utils.ClientIPResolver
+}
+
+// NewEngine compiles the policy configs; clientIP may be nil, then the
+// peer address is the client IP
+func NewEngine(configs []Config, geo client.GeoLocator, clientIP *utils.ClientIPResolver) (*Engine, error) {
+	e := &Engine{
+		geo:      geo,
+		clientIP: clientIP,
+	}
+
+	for _, c := range configs {
+		p, err := New(c)
+		if err != nil {
+			return nil, err
+		}
+		e.policies = append(e.policies, p)
+	}
+
+	return e, nil
+}
+
+// Middleware wraps the handler registered for method and path with the
+// policies matching that route. Every matching policy must allow the
+// request; the first denial answers 403.
+func (e *Engine) Middleware(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	if e == nil {
+		return next
+	}
+
+	policies := e.matching(method, path)
+	if len(policies) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := e.check(r, policies); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Check checks the request against the policies of the route given by
+// method and path, for the requests acting on routes they aren't sent to,
+// e.g. the GraphQL operations. It returns ErrDenied on the first denial.
+func (e *Engine) Check(r *http.Request, method, path string) error {
+	if e == nil {
+		return nil
+	}
+	return e.check(r, e.matching(method, path))
+}
+
+func (e *Engine) matching(method, path string) []*Policy {
+	var policies []*Policy
+	for _, p := range e.policies {
+		if p.Matches(method, path) {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+func (e *Engine) check(r *http.Request, policies []*Policy) error {
+	if len(policies) == 0 {
+		return nil
+	}
+
+	ip, err := e.clientIP.ClientIP(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("geo-access denied: failed to resolve client IP",
+			"method", r.Method, "path", r.URL.Path, "error", err)
+		return errors.Wrap(ErrDenied, "failed to retrieve client IP: "+err.Error())
+	}
+
+	for _, p := range policies {
+		d := p.Evaluate(r.Context(), e.geo, ip)
+		logDecision(r, ip, d)
+
+		if d.Allowed {
+			continue
+		}
+		if d.Err != nil {
+			return errors.Wrap(ErrDenied, "failed to retrieve client country: "+d.Err.Error())
+		}
+		return ErrDenied
+	}
+	return nil
+}
+
+func logDecision(r *http.Request, ip string, d Decision) {
+	l := logging.FromContext(r.Context())
+	kv := []interface{}{
+		"policy", d.Policy,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"client_ip", ip,
+		"country", d.Country,
+		"provider", d.Provider,
+		"confidence", d.Confidence,
+		"reason", d.Reason,
+	}
+	if d.Err != nil {
+		kv = append(kv, "error", d.Err)
+	}
+
+	if d.Allowed {
+		l.Info("geo-access allowed", kv...)
+	} else {
+		l.Warn("geo-access denied", kv...)
+	}
+}
@@ -0,0 +1,186 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/client"
+	"github.com/arpsch/xm/utils"
+)
+
+// Config describes a geo-access policy and the routes it applies to
+type Config struct {
+	Name string `json:"name"`
+
+	// Methods the policy applies to, empty means all methods
+	Methods []string `json:"methods"`
+
+	// Paths are route patterns as registered on the router, e.g.
+	// /api/v1/companies/:id; a trailing * matches a prefix and an empty
+	// list means all routes
+	Paths []string `json:"paths"`
+
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+
+	AllowCIDRs []string `json:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs"`
+
+	// FailOpen lets requests through when the country lookup fails,
+	// by default they are rejected
+	FailOpen bool `json:"fail_open"`
+}
+
+// Decision is the outcome of evaluating a policy
+type Decision struct {
+	Allowed bool
+	Policy  string
+	Reason  string
+	Country string
+
+	// Provider and Confidence tell where the country came from
+	Provider   string
+	Confidence float64
+
+	// Err is the lookup error which led to the decision, if any
+	Err error
+}
+
+// Policy is a compiled Config
+type Policy struct {
+	name    string
+	methods []string
+	paths   []string
+
+	allowCountries []string
+	denyCountries  []string
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	failOpen bool
+}
+
+// New validates and compiles a policy config
+func New(config Config) (*Policy, error) {
+	allowNets, err := parseNetworks(config.AllowCIDRs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "policy %s", config.Name)
+	}
+	denyNets, err := parseNetworks(config.DenyCIDRs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "policy %s", config.Name)
+	}
+
+	p := &Policy{
+		name:      config.Name,
+		paths:     config.Paths,
+		allowNets: allowNets,
+		denyNets:  denyNets,
+		failOpen:  config.FailOpen,
+	}
+	for _, m := range config.Methods {
+		p.methods = append(p.methods, strings.ToUpper(m))
+	}
+	for _, c := range config.AllowCountries {
+		p.allowCountries = append(p.allowCountries, strings.ToUpper(c))
+	}
+	for _, c := range config.DenyCountries {
+		p.denyCountries = append(p.denyCountries, strings.ToUpper(c))
+	}
+
+	return p, nil
+}
+
+// Name returns the policy name
+func (p *Policy) Name() string {
+	return p.name
+}
+
+// Matches tells whether the policy applies to the route
+func (p *Policy) Matches(method, path string) bool {
+	return utils.MatchRoute(p.methods, p.paths, method, path)
+}
+
+// Evaluate decides whether the client IP may access a route covered by
+// the policy. IP rules are checked before country rules; deny rules win
+// over allow rules.
+func (p *Policy) Evaluate(ctx context.Context, geo client.GeoLocator, ip string) Decision {
+	d := Decision{Policy: p.name}
+
+	addr := net.ParseIP(ip)
+	if containsIP(p.denyNets, addr) {
+		return d.deny("client IP is in the deny list")
+	}
+	if containsIP(p.allowNets, addr) {
+		return d.allow("client IP is in the allow list")
+	}
+
+	if len(p.allowCountries) == 0 && len(p.denyCountries) == 0 {
+		if len(p.allowNets) > 0 {
+			return d.deny("client IP is not in the allow list")
+		}
+		return d.allow("no country restriction")
+	}
+
+	res, err := client.Locate(ctx, geo, ip)
+	if err != nil {
+		d.Err = err
+		if p.failOpen {
+			return d.allow("country lookup failed, failing open: " + err.Error())
+		}
+		return d.deny("country lookup failed, failing closed: " + err.Error())
+	}
+	country := res.Country
+	d.Country = country
+	d.Provider = res.Provider
+	d.Confidence = res.Confidence
+
+	if utils.ContainsString(country, p.denyCountries) {
+		return d.deny("country " + country + " is in the deny list")
+	}
+	if len(p.allowCountries) > 0 && !utils.ContainsString(country, p.allowCountries) {
+		return d.deny("country " + country + " is not in the allow list")
+	}
+
+	return d.allow("country " + country + " is allowed")
+}
+
+func (d Decision) allow(reason string) Decision {
+	d.Allowed = true
+	d.Reason = reason
+	return d
+}
+
+func (d Decision) deny(reason string) Decision {
+	d.Allowed = false
+	d.Reason = reason
+	return d
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		n, err := utils.ParseNetwork(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package policy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/client"
+)
+
+type failingLocator struct{}
+
+func (failingLocator) CountryByIP(ctx context.Context, ip string) (string, error) {
+	return "", errors.New("provider down")
+}
+
+func testGeo(t *testing.T) client.GeoLocator {
+	geo, err := client.NewStaticLocator(map[string]string{
+		"185.193.148.0/22": "CY",
+		"20.188.40.0/24":   "FR",
+		"5.62.56.0/24":     "RU",
+	})
+	if err != nil {
+		t.Fatalf("failed to build static locator: %v", err)
+	}
+	return geo
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	tt := []struct {
+		name    string
+		config  Config
+		geo     client.GeoLocator
+		ip      string
+		allowed bool
+	}{
+		{
+			name:    "allowed country",
+			config:  Config{AllowCountries: []string{"cy"}},
+			ip:      "185.193.151.255",
+			allowed: true,
+		},
+		{
+			name:    "country not in the allow list",
+			config:  Config{AllowCountries: []string{"CY"}},
+			ip:      "20.188.40.63",
+			allowed: false,
+		},
+		{
+			name:    "denied country",
+			config:  Config{DenyCountries: []string{"RU"}},
+			ip:      "5.62.56.1",
+			allowed: false,
+		},
+		{
+			name:    "not a denied country",
+			config:  Config{DenyCountries: []string{"RU"}},
+			ip:      "20.188.40.63",
+			allowed: true,
+		},
+		{
+			name: "allowed IP skips the country check",
+			config: Config{
+				AllowCountries: []string{"CY"},
+				AllowCIDRs:     []string{"10.0.0.0/8"},
+			},
+			ip:      "10.1.2.3",
+			allowed: true,
+		},
+		{
+			name: "denied IP wins over an allowed country",
+			config: Config{
+				AllowCountries: []string{"CY"},
+				DenyCIDRs:      []string{"185.193.151.0/24"},
+			},
+			ip:      "185.193.151.255",
+			allowed: false,
+		},
+		{
+			name:    "IP allow list only",
+			config:  Config{AllowCIDRs: []string{"10.0.0.0/8"}},
+			ip:      "185.193.151.255",
+			allowed: false,
+		},
+		{
+			name:    "lookup failure fails closed by default",
+			config:  Config{AllowCountries: []string{"CY"}},
+			geo:     failingLocator{},
+			ip:      "185.193.151.255",
+			allowed: false,
+		},
+		{
+			name:    "lookup failure fails open",
+			config:  Config{AllowCountries: []string{"CY"}, FailOpen: true},
+			geo:     failingLocator{},
+			ip:      "185.193.151.255",
+			allowed: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := New(tc.config)
+			assert.NoError(t, err)
+
+			geo := tc.geo
+			if geo == nil {
+				geo = testGeo(t)
+			}
+
+			d := p.Evaluate(context.Background(), geo, tc.ip)
+			assert.Equal(t, tc.allowed, d.Allowed, d.Reason)
+			assert.NotEmpty(t, d.Reason)
+		})
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	p, err := New(Config{
+		Methods: []string{"post", "DELETE"},
+		Paths:   []string{"/api/v1/companies", "/api/v2/*"},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, p.Matches("POST", "/api/v1/companies"))
+	assert.True(t, p.Matches("DELETE", "/api/v2/companies/:id"))
+	assert.False(t, p.Matches("GET", "/api/v1/companies"))
+	assert.False(t, p.Matches("POST", "/api/v1/companies/:id"))
+
+	all, err := New(Config{})
+	assert.NoError(t, err)
+	assert.True(t, all.Matches("GET", "/anything"))
+}
+
+func TestNewInvalidCIDR(t *testing.T) {
+	_, err := New(Config{Name: "bad", DenyCIDRs: []string{"300.0.0.0/8"}})
+	assert.Error(t, err)
+}
+
+func TestEngineMiddleware(t *testing.T) {
+	e, err := NewEngine([]Config{
+		{
+			Name:           "cyprus-only-writes",
+			Methods:        []string{http.MethodPost},
+			Paths:          []string{"/api/v1/companies"},
+			AllowCountries: []string{"CY"},
+		},
+	}, testGeo(t), nil)
+	assert.NoError(t, err)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		statusCode int
+	}{
+		{
+			name:       "allowed",
+			method:     http.MethodPost,
+			path:       "/api/v1/companies",
+			remoteAddr: "185.193.151.255:8080",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "denied",
+			method:     http.MethodPost,
+			path:       "/api/v1/companies",
+			remoteAddr: "20.188.40.63:8080",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "unknown country fails closed",
+			method:     http.MethodPost,
+			path:       "/api/v1/companies",
+			remoteAddr: "127.0.0.1:8080",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "route without policy",
+			method:     http.MethodGet,
+			path:       "/api/v1/companies",
+			remoteAddr: "20.188.40.63:8080",
+			statusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			h := e.Middleware(tc.method, tc.path, ok)
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, nil)
+			req.RemoteAddr = tc.remoteAddr
+			h(rec, req)
+
+			assert.Equal(t, tc.statusCode, rec.Code)
+		})
+	}
+}
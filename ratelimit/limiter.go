@@ -0,0 +1,153 @@
+// Package ratelimit throttles clients with token buckets
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweep idle buckets at most this often
+const sweepInterval = time.Minute
+
+// Rule is a token bucket: Requests tokens are added per Period, up to
+// Burst
+type Rule struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+func (r Rule) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Requests)
+}
+
+// rate is the number of tokens added per second
+func (r Rule) rate() float64 {
+	return float64(r.Requests) / r.Period.Seconds()
+}
+
+// Result is the state of a bucket after taking a token
+type Result struct {
+	Allowed bool
+
+	// Limit is the bucket capacity, Remaining the tokens left
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+
+	// RetryAfter is the time until the next token, when not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter keeps the buckets. MemoryLimiter keeps them in-process; a
+// shared implementation lets several instances enforce common limits.
+type Limiter interface {
+	// Take takes a token from the bucket of key
+	Take(ctx context.Context, key string, rule Rule) (Result, error)
+
+	// Put puts back a token taken from the bucket of key
+	Put(ctx context.Context, key string, rule Rule) error
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	// full is when the bucket will have refilled
+	full time.Time
+}
+
+// MemoryLimiter is an in-process Limiter
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+func (l *MemoryLimiter) Take(ctx context.Context, key string, rule Rule) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	capacity, rate := rule.capacity(), rule.rate()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+
+	res := Result{Limit: int(capacity)}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((capacity - b.tokens) / rate)
+	b.full = now.Add(res.Reset)
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+	return res, nil
+}
+
+func (l *MemoryLimiter) Put(ctx context.Context, key string, rule Rule) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		// refilled and swept already
+		return nil
+	}
+
+	now := l.now()
+	capacity, rate := rule.capacity(), rule.rate()
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate+1)
+	b.last = now
+	b.full = now.Add(seconds((capacity - b.tokens) / rate))
+	return nil
+}
+
+// sweep drops the buckets which refilled, they're as good as new
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of buckets kept
+func (l *MemoryLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
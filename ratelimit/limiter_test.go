@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1600000000, 0)
+
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+
+	// 1 token per second, bursting to 3
+	rule := Rule{Requests: 60, Period: time.Minute, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, err := l.Take(ctx, "a", rule)
+		assert.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 3, res.Limit)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res, _ := l.Take(ctx, "a", rule)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+
+	// other keys have their own bucket
+	res, _ = l.Take(ctx, "b", rule)
+	assert.True(t, res.Allowed)
+
+	now = now.Add(1500 * time.Millisecond)
+	res, _ = l.Take(ctx, "a", rule)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, _ = l.Take(ctx, "a", rule)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	// refilled buckets are swept, the bucket of c was just used
+	now = now.Add(time.Hour)
+	l.Take(ctx, "c", rule)
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestMemoryLimiterSweepKeepsSlowBuckets(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1600000000, 0)
+
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+
+	slow := Rule{Requests: 1, Period: time.Hour}
+	fast := Rule{Requests: 60, Period: time.Minute}
+
+	res, _ := l.Take(ctx, "slow", slow)
+	assert.True(t, res.Allowed)
+
+	now = now.Add(2 * sweepInterval)
+	l.Take(ctx, "fast", fast)
+
+	res, _ = l.Take(ctx, "slow", slow)
+	assert.False(t, res.Allowed)
+}
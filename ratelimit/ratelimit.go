@@ -0,0 +1,270 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/utils"
+)
+
+// response headers, after the IETF RateLimit header fields draft
+const (
+	HdrRateLimitLimit     = "RateLimit-Limit"
+	HdrRateLimitRemaining = "RateLimit-Remaining"
+	HdrRateLimitReset     = "RateLimit-Reset"
+	HdrRateLimitPolicy    = "RateLimit-Policy"
+	HdrRetryAfter         = "Retry-After"
+)
+
+// limit keys
+const (
+	// KeyClient tells the clients apart by their principal, else their IP
+	KeyClient = ""
+	// KeyIP tells the clients apart by their IP, before authenticating
+	// them, so failed authentications are throttled too
+	KeyIP = "ip"
+)
+
+// Config is a limit on the routes matching Methods and Paths, as with the
+// geo-access policies. Every client, as told apart by Key, gets Requests
+// per Period, bursting up to Burst, default Requests.
+type Config struct {
+	Name     string         `json:"name"`
+	Key      string         `json:"key"`
+	Methods  []string       `json:"methods"`
+	Paths    []string       `json:"paths"`
+	Requests int            `json:"requests"`
+	Period   utils.Duration `json:"period"`
+	Burst    int            `json:"burst"`
+}
+
+type limit struct {
+	name    string
+	byIP    bool
+	methods []string
+	paths   []string
+	rule    Rule
+}
+
+// Engine attaches rate limits to routes
+type Engine struct {
+	limits   []limit
+	limiter  Limiter
+	clientIP *utils.ClientIPResolver
+}
+
+// NewEngine compiles the configs; clientIP may be nil, then the peer
+// address is the client IP
+func NewEngine(configs []Config, limiter Limiter, clientIP *utils.ClientIPResolver) (*Engine, error) {
+	e := &Engine{
+		limiter:  limiter,
+		clientIP: clientIP,
+	}
+
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, errors.New("ratelimit: missing name")
+		}
+		if c.Requests <= 0 || c.Period <= 0 || c.Burst < 0 {
+			return nil, errors.Errorf("ratelimit %s: requests and period must be positive", c.Name)
+		}
+		if c.Key != KeyClient && c.Key != KeyIP {
+			return nil, errors.Errorf("ratelimit %s: unknown key %q", c.Name, c.Key)
+		}
+
+		methods := make([]string, len(c.Methods))
+		for i, m := range c.Methods {
+			methods[i] = strings.ToUpper(m)
+		}
+		e.limits = append(e.limits, limit{
+			name:    c.Name,
+			byIP:    c.Key == KeyIP,
+			methods: methods,
+			paths:   c.Paths,
+			rule: Rule{
+				Requests: c.Requests,
+				Period:   c.Period.Duration(),
+				Burst:    c.Burst,
+			},
+		})
+	}
+
+	return e, nil
+}
+
+// clientKey identifies the client of the limit: the authenticated
+// principal, else the client IP
+func (e *Engine) clientKey(r *http.Request, l *limit) (string, error) {
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && !l.byIP {
+		return p.Actor(), nil
+	}
+
+	ip, err := e.clientIP.ClientIP(r)
+	if err != nil {
+		return "", err
+	}
+	return "ip:" + ip, nil
+}
+
+// ErrLimited is matched by the errors of the throttled requests
+var ErrLimited = errors.New("too many requests")
+
+// Middleware wraps the handler registered for method and path with the
+// limits matching that route, but the KeyIP ones. A token is taken from the
+// client's bucket of every matching limit; an empty bucket answers 429, the
+// tokens taken from the other buckets being put back. The headers describe
+// the limit closest to exhaustion.
+func (e *Engine) Middleware(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	if e == nil {
+		return next
+	}
+	return e.middleware(e.matching(method, path, false), next)
+}
+
+// IPMiddleware wraps the handler with the KeyIP limits matching the route,
+// as Middleware does; it goes ahead of the authentication.
+func (e *Engine) IPMiddleware(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	if e == nil {
+		return next
+	}
+	return e.middleware(e.matching(method, path, true), next)
+}
+
+func (e *Engine) middleware(limits []limit, next http.HandlerFunc) http.HandlerFunc {
+	if len(limits) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, l, allowed, err := e.take(r, limits)
+		if err != nil {
+			http.Error(w, "failed to retrieve client IP: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if !allowed {
+			setHeaders(w, *l, res)
+			w.Header().Set(HdrRetryAfter, ceilSeconds(res.RetryAfter))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		if l != nil {
+			setHeaders(w, *l, res)
+		}
+		next(w, r)
+	}
+}
+
+// Check takes the tokens of the request from the client's buckets of the
+// limits of the route given by method and path, as Middleware and
+// IPMiddleware do, for the requests acting on routes they aren't sent to,
+// e.g. the gRPC calls. It returns ErrLimited when a limit throttles the
+// request.
+func (e *Engine) Check(r *http.Request, method, path string) error {
+	if e == nil {
+		return nil
+	}
+
+	limits := append(e.matching(method, path, true), e.matching(method, path, false)...)
+	if len(limits) == 0 {
+		return nil
+	}
+
+	res, l, allowed, err := e.take(r, limits)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve client IP")
+	}
+	if !allowed {
+		return errors.Wrapf(ErrLimited, "limit %s, retry after %ss", l.name, ceilSeconds(res.RetryAfter))
+	}
+	return nil
+}
+
+func (e *Engine) matching(method, path string, byIP bool) []limit {
+	var limits []limit
+	for _, l := range e.limits {
+		if l.byIP == byIP && utils.MatchRoute(l.methods, l.paths, method, path) {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// taken is a token taken from the bucket of a limit
+type taken struct {
+	limit limit
+	key   string
+}
+
+// take takes a token from the client's bucket of every limit. It returns
+// whether the request is allowed and the limit throttling it or, when
+// allowed, the one closest to exhaustion, with the state of its bucket;
+// the limit is nil when none could be checked. It fails when the client
+// can't be identified.
+func (e *Engine) take(r *http.Request, limits []limit) (Result, *limit, bool, error) {
+	var (
+		closest Result
+		policy  *limit
+		tokens  []taken
+	)
+	for i := range limits {
+		l := &limits[i]
+		key, err := e.clientKey(r, l)
+		if err != nil {
+			e.putBack(r, tokens)
+			return Result{}, nil, false, err
+		}
+
+		res, err := e.limiter.Take(r.Context(), l.name+"|"+key, l.rule)
+		if err != nil {
+			// fail open, an outage of a shared limiter mustn't take
+			// the API down
+			logging.FromContext(r.Context()).Error("rate limit: failed to take a token",
+				"limit", l.name, "client", key, "error", err)
+			continue
+		}
+
+		if !res.Allowed {
+			logging.FromContext(r.Context()).Info("rate limit: throttled",
+				"limit", l.name, "client", key, "retry_after", res.RetryAfter)
+			e.putBack(r, tokens)
+			return res, l, false, nil
+		}
+		tokens = append(tokens, taken{limit: *l, key: key})
+
+		if policy == nil || res.Remaining < closest.Remaining {
+			closest, policy = res, l
+		}
+	}
+	return closest, policy, true, nil
+}
+
+// putBack puts back the tokens taken from the client's buckets, the
+// request being throttled by another limit
+func (e *Engine) putBack(r *http.Request, tokens []taken) {
+	for _, t := range tokens {
+		if err := e.limiter.Put(r.Context(), t.limit.name+"|"+t.key, t.limit.rule); err != nil {
+			logging.FromContext(r.Context()).Error("rate limit: failed to put back a token",
+				"limit", t.limit.name, "client", t.key, "error", err)
+		}
+	}
+}
+
+func setHeaders(w http.ResponseWriter, l limit, res Result) {
+	h := w.Header()
+	h.Set(HdrRateLimitLimit, strconv.Itoa(res.Limit))
+	h.Set(HdrRateLimitRemaining, strconv.Itoa(res.Remaining))
+	h.Set(HdrRateLimitReset, ceilSeconds(res.Reset))
+	h.Set(HdrRateLimitPolicy, strconv.Itoa(l.rule.Requests)+";w="+ceilSeconds(l.rule.Period))
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,242 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/utils"
+)
+
+type failingLimiter struct{}
+
+func (failingLimiter) Take(ctx context.Context, key string, rule Rule) (Result, error) {
+	return Result{}, errors.New("redis: connection refused")
+}
+
+func (failingLimiter) Put(ctx context.Context, key string, rule Rule) error {
+	return errors.New("redis: connection refused")
+}
+
+func TestMiddleware(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	now := time.Unix(1600000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	engine, err := NewEngine([]Config{
+		{
+			Name:     "writes",
+			Methods:  []string{"POST"},
+			Paths:    []string{"/api/v1/companies"},
+			Requests: 2,
+			Period:   utils.Duration(time.Minute),
+		},
+		{
+			Name:     "all",
+			Requests: 100,
+			Period:   utils.Duration(time.Minute),
+		},
+	}, limiter, nil)
+	assert.NoError(t, err)
+
+	next := func(w http.ResponseWriter, r *http.Request) {}
+	post := engine.Middleware("POST", "/api/v1/companies", next)
+
+	do := func(h http.HandlerFunc, remoteAddr string, p *auth.Principal) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/companies", nil)
+		req.RemoteAddr = remoteAddr
+		if p != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), p))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	rec := do(post, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get(HdrRateLimitLimit))
+	assert.Equal(t, "1", rec.Header().Get(HdrRateLimitRemaining))
+	assert.Equal(t, "30", rec.Header().Get(HdrRateLimitReset))
+	assert.Equal(t, "2;w=60", rec.Header().Get(HdrRateLimitPolicy))
+
+	assert.Equal(t, http.StatusOK, do(post, "10.0.0.1:1234", nil).Code)
+
+	rec = do(post, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get(HdrRetryAfter))
+	assert.Equal(t, "0", rec.Header().Get(HdrRateLimitRemaining))
+
+	// another client IP, and a principal behind the same IP, aren't
+	// throttled
+	assert.Equal(t, http.StatusOK, do(post, "10.0.0.2:1234", nil).Code)
+	p := &auth.Principal{ID: "k1", Kind: auth.KindAPIKey}
+	assert.Equal(t, http.StatusOK, do(post, "10.0.0.1:1234", p).Code)
+
+	// GET only matches the "all" limit
+	get := engine.Middleware("GET", "/api/v1/companies", next)
+	rec = do(get, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "100", rec.Header().Get(HdrRateLimitLimit))
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, http.StatusOK, do(post, "10.0.0.1:1234", nil).Code)
+}
+
+func TestMiddlewareOverlappingLimits(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	now := time.Unix(1600000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	engine, err := NewEngine([]Config{
+		{
+			Name:     "all",
+			Requests: 3,
+			Period:   utils.Duration(time.Minute),
+		},
+		{
+			Name:     "writes",
+			Methods:  []string{"POST"},
+			Paths:    []string{"/api/v1/companies"},
+			Requests: 1,
+			Period:   utils.Duration(time.Minute),
+		},
+	}, limiter, nil)
+	assert.NoError(t, err)
+
+	next := func(w http.ResponseWriter, r *http.Request) {}
+	post := engine.Middleware("POST", "/api/v1/companies", next)
+	get := engine.Middleware("GET", "/api/v1/companies", next)
+
+	do := func(h http.HandlerFunc) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/companies", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, do(post).Code)
+
+	// throttled by "writes", without spending the "all" tokens
+	for i := 0; i < 3; i++ {
+		rec := do(post)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get(HdrRateLimitLimit))
+	}
+
+	rec := do(get)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "3", rec.Header().Get(HdrRateLimitLimit))
+	assert.Equal(t, "1", rec.Header().Get(HdrRateLimitRemaining))
+	assert.Equal(t, http.StatusOK, do(get).Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(get).Code)
+}
+
+func TestCheck(t *testing.T) {
+	engine, err := NewEngine([]Config{
+		{Name: "writes", Methods: []string{"POST"}, Paths: []string{"/api/v1/companies"},
+			Requests: 1, Period: utils.Duration(time.Minute)},
+	}, NewMemoryLimiter(), nil)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "/xm.company.v1.CompanyService/CreateCompany", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.NoError(t, engine.Check(req, "POST", "/api/v1/companies"))
+	err = engine.Check(req, "POST", "/api/v1/companies")
+	assert.True(t, errors.Is(err, ErrLimited), "got %v", err)
+	assert.NoError(t, engine.Check(req, "GET", "/api/v1/companies"))
+
+	req.RemoteAddr = "bufconn"
+	err = engine.Check(req, "POST", "/api/v1/companies")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrLimited))
+
+	var nilEngine *Engine
+	assert.NoError(t, nilEngine.Check(req, "POST", "/api/v1/companies"))
+}
+
+func TestIPMiddleware(t *testing.T) {
+	engine, err := NewEngine([]Config{
+		{Name: "ips", Key: KeyIP, Methods: []string{"get"}, Requests: 1, Period: utils.Duration(time.Minute)},
+		{Name: "clients", Requests: 1, Period: utils.Duration(time.Minute)},
+	}, NewMemoryLimiter(), nil)
+	assert.NoError(t, err)
+
+	next := func(w http.ResponseWriter, r *http.Request) {}
+	byIP := engine.IPMiddleware("GET", "/api/v1/companies", next)
+	byClient := engine.Middleware("GET", "/api/v1/companies", next)
+
+	do := func(h http.HandlerFunc, p *auth.Principal) int {
+		req, _ := http.NewRequest("GET", "/api/v1/companies", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if p != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), p))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	// the methods match whatever their case, the principals behind an IP
+	// share its bucket
+	assert.Equal(t, http.StatusOK, do(byIP, nil))
+	assert.Equal(t, http.StatusTooManyRequests, do(byIP, &auth.Principal{ID: "k1", Kind: auth.KindAPIKey}))
+
+	// the other limits are left to Middleware
+	p := &auth.Principal{ID: "k1", Kind: auth.KindAPIKey}
+	assert.Equal(t, http.StatusOK, do(byClient, p))
+	assert.Equal(t, http.StatusTooManyRequests, do(byClient, p))
+	assert.Equal(t, http.StatusOK, do(byClient, &auth.Principal{ID: "k2", Kind: auth.KindAPIKey}))
+
+	// Check takes from both
+	req, _ := http.NewRequest("GET", "/xm.company.v1.CompanyService/ListCompanies", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{ID: "k3", Kind: auth.KindAPIKey}))
+	assert.NoError(t, engine.Check(req, "GET", "/api/v1/companies"))
+	err = engine.Check(req, "GET", "/api/v1/companies")
+	assert.True(t, errors.Is(err, ErrLimited), "got %v", err)
+}
+
+func TestMiddlewareFailsOpen(t *testing.T) {
+	engine, err := NewEngine([]Config{
+		{Name: "all", Requests: 1, Period: utils.Duration(time.Minute)},
+	}, failingLimiter{}, nil)
+	assert.NoError(t, err)
+
+	called := false
+	h := engine.Middleware("GET", "/api/v1/companies", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	req, _ := http.NewRequest("GET", "/api/v1/companies", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	h(rec, req)
+
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestNewEngineValidation(t *testing.T) {
+	_, err := NewEngine([]Config{{Requests: 1, Period: utils.Duration(time.Second)}}, NewMemoryLimiter(), nil)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Config{{Name: "x", Period: utils.Duration(time.Second)}}, NewMemoryLimiter(), nil)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Config{{Name: "x", Key: "tenant", Requests: 1, Period: utils.Duration(time.Second)}},
+		NewMemoryLimiter(), nil)
+	assert.Error(t, err)
+
+	var e *Engine
+	called := false
+	e.Middleware("GET", "/", func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), &http.Request{})
+	assert.True(t, called)
+}
@@ -2,58 +2,308 @@ package server
 
 import (
 	"context"
-	"log"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
 	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	graphqlapi "github.com/arpsch/xm/api/graphql"
+	grpcapi "github.com/arpsch/xm/api/grpc"
 	api "github.com/arpsch/xm/api/http"
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/client"
 	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/config"
+	"github.com/arpsch/xm/events"
+	"github.com/arpsch/xm/health"
+	"github.com/arpsch/xm/idempotency"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/policy"
+	"github.com/arpsch/xm/ratelimit"
 	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/stream"
+	"github.com/arpsch/xm/tlsconfig"
+	"github.com/arpsch/xm/utils"
+	"github.com/arpsch/xm/webhook"
 )
 
+// pinger is a data store which can check its connection
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
 // InitAndRun initializes the server and runs it
-func InitAndRun(dataStore store.DataStore) error {
+func InitAndRun(conf *config.Config, dataStore store.DataStore) error {
 	ctx := context.Background()
+	logger := logging.Default()
+
+	var appl comp.CompanyApp
+	bus := events.NewMemoryBus()
+	if conf.Events.File != "" {
+		sink, err := events.NewFileSink(conf.Events.File)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+		defer sink.Close()
+		bus.Subscribe(sink.Handle)
+	}
 
+	broker := stream.NewBroker(conf.Stream)
+	bus.Subscribe(broker.Handle)
+
+	hooks, ok := dataStore.(store.WebhookStore)
+	if ok {
+		dispatcher, err := webhook.NewDispatcher(hooks, conf.Webhooks)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+		bus.Subscribe(dispatcher.Handle)
+
+		dispatchCtx, stopDispatch := context.WithCancel(logging.NewContext(ctx, logger))
+		dispatchDone := make(chan struct{})
+		go func() {
+			defer close(dispatchDone)
+			dispatcher.Run(dispatchCtx)
+		}()
+		defer func() {
+			stopDispatch()
+			<-dispatchDone
+		}()
+	}
+
+	ds := store.WithMetrics(dataStore)
 	appl, err := comp.NewApp(
-		dataStore,
+		ds,
+		bus,
 	)
 
 	if err != nil {
-		log.Fatalf("server setup encounterd a fatal error, stopping :%v", err)
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
+		return err
+	}
+
+	// the changes are written with their events to the outbox of the
+	// store, the relay publishes them
+	if ob, ok := ds.(store.OutboxStore); ok {
+		relayCtx, stopRelay := context.WithCancel(logging.NewContext(ctx, logger))
+		relayDone := make(chan struct{})
+		go func() {
+			defer close(relayDone)
+			events.NewRelay(ob, bus, conf.Events).Run(relayCtx)
+		}()
+		// before the subscribers close
+		defer func() {
+			stopRelay()
+			<-relayDone
+		}()
+	}
+
+	geo, err := client.NewGeoLocator(conf.GeoIP)
+	if err != nil {
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
+		return err
+	}
+
+	clientIP, err := utils.NewClientIPResolver(conf.TrustedProxies)
+	if err != nil {
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
+		return err
+	}
+
+	policies, err := policy.NewEngine(conf.Policies, geo, clientIP)
+	if err != nil {
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
+		return err
+	}
+
+	rateLimits, err := ratelimit.NewEngine(conf.RateLimits, ratelimit.NewMemoryLimiter(), clientIP)
+	if err != nil {
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
+		return err
+	}
+
+	idemKeys, ok := dataStore.(store.IdempotencyStore)
+	if !ok {
+		logger.Warn("the data store doesn't keep idempotency keys, keeping them in memory")
+		idemKeys = idempotency.NewMemoryStore()
+	}
+
+	checker := health.NewChecker(conf.Health.Timeout.Duration())
+	if db, ok := dataStore.(pinger); ok {
+		checker.Add("mongo", db.Ping)
+	}
+	if conf.Health.GeoIP {
+		checker.Add("geoip", health.Every(conf.Health.GeoIPInterval.Duration(),
+			func(ctx context.Context) error {
+				return client.Check(ctx, geo, conf.Health.GeoIPProbeIP)
+			}))
+	}
+
+	opts := api.RouterOptions{
+		Policies:    policies,
+		RateLimits:  rateLimits,
+		Tenancy:     conf.Tenancy,
+		Idempotency: idempotency.NewEngine(conf.Idempotency, idemKeys, clientIP),
+		Health:      checker,
+		Webhooks:    hooks,
+		Stream:      broker,
+
+		WebhookInsecureHosts: conf.Webhooks.InsecureHosts,
+	}
+	if conf.API.V1Deprecation != nil {
+		opts.V1Deprecation = *conf.API.V1Deprecation
+	}
+	if conf.API.V1Sunset != nil {
+		opts.V1Sunset = *conf.API.V1Sunset
+	}
+	var authn auth.Chain
+	if conf.Auth.JWT != nil {
+		jwt, err := auth.NewJWTAuthenticator(ctx, *conf.Auth.JWT)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+		authn = append(authn, jwt)
+	}
+	if conf.Auth.APIKeys {
+		keys, ok := dataStore.(store.APIKeyStore)
+		if !ok {
+			err := errors.New("the data store doesn't support api keys")
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+		authn = append(authn, auth.NewAPIKeyAuthenticator(keys))
+		opts.APIKeys = keys
+	}
+	if conf.Auth.ClientCert != nil {
+		authn = append(authn, auth.NewCertAuthenticator(*conf.Auth.ClientCert))
+	}
+	if len(authn) > 0 {
+		opts.Authenticator = authn
+
+		rbac := conf.Auth.RBAC
+		if rbac.Roles == nil && conf.Auth.JWT != nil && conf.Auth.JWT.RoleScopes != nil {
+			rbac.Roles = comp.RolesFromScopes(conf.Auth.JWT.RoleScopes)
+		}
+		appl, err = comp.NewAuthorizer(appl, rbac)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+	}
+
+	opts.GraphQL, err = graphqlapi.NewHandler(appl, broker, policies, rateLimits, conf.GraphQL)
+	if err != nil {
+		logger.Error("server setup encountered a fatal error, stopping", "error", err)
 		return err
 	}
 
-	router := api.NewRouter(appl)
+	router := api.NewRouter(appl, opts)
 
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:    conf.Listen,
+		Handler: logging.Middleware(logger, router),
+	}
+	// Shutdown waits for the connections to go idle, which the streams
+	// never do; they end with the broker
+	srv.RegisterOnShutdown(broker.Close)
+
+	listenErr := make(chan error, 2)
+	if conf.TLS != nil {
+		srv.TLSConfig, err = tlsconfig.New(*conf.TLS)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+	}
+
+	var grpcSrv *grpc.Server
+	if conf.GRPCListen != "" {
+		grpcOpts := grpcapi.Options{
+			Authenticator: opts.Authenticator,
+			Tenancy:       conf.Tenancy,
+			Policies:      policies,
+			RateLimits:    rateLimits,
+			Stream:        broker,
+			Logger:        logger,
+		}
+		var serverOpts []grpc.ServerOption
+		if srv.TLSConfig != nil {
+			serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(srv.TLSConfig.Clone())))
+		}
+		grpcSrv = grpcapi.NewServer(appl, grpcOpts, serverOpts...)
+		defer grpcSrv.Stop()
+
+		lis, err := net.Listen("tcp", conf.GRPCListen)
+		if err != nil {
+			logger.Error("server setup encountered a fatal error, stopping", "error", err)
+			return err
+		}
+		go func() {
+			logger.Info("starting the gRPC server", "listen", conf.GRPCListen, "tls", srv.TLSConfig != nil)
+			if err := grpcSrv.Serve(lis); err != nil {
+				listenErr <- err
+			}
+		}()
 	}
 
 	go func() {
-		log.Printf("starting the server, Listening on :8080\n")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		logger.Info("starting the server", "listen", conf.Listen, "tls", srv.TLSConfig != nil)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			listenErr <- err
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, unix.SIGINT, unix.SIGTERM)
-	<-quit
+	select {
+	case <-quit:
+	case err := <-listenErr:
+		logger.Error("listen failed", "error", err)
+		return err
+	}
 
-	log.Print("Server shutting down")
+	// fail the readiness first, for the load balancers to stop sending
+	// requests before the listener closes
+	checker.Shutdown()
+	logger.Info("server shutting down, draining", "drain_delay", conf.Health.DrainDelay.Duration())
+	time.Sleep(conf.Health.DrainDelay.Duration())
 
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctxWithTimeout); err != nil {
-		log.Fatal("error when shutting down the server ", err)
+		logger.Error("error when shutting down the server", "error", err)
+		return err
+	}
+	if grpcSrv != nil {
+		// the watches ended with the broker
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctxWithTimeout.Done():
+			logger.Error("error when shutting down the gRPC server", "error", ctxWithTimeout.Err())
+			return ctxWithTimeout.Err()
+		}
 	}
 
-	log.Print("Server exited")
+	logger.Info("server exited")
 	return nil
 }
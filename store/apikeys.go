@@ -0,0 +1,20 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arpsch/xm/model"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// APIKeyStore represents behavour on the API key storage
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, k model.APIKey) (string, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (*model.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+}
@@ -0,0 +1,25 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arpsch/xm/model"
+)
+
+var (
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrIdempotencyKeyExists   = errors.New("idempotency key exists")
+)
+
+// IdempotencyStore represents behavour on the idempotency key storage.
+// Expired records are as good as absent.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey stores the in-progress record, failing with
+	// ErrIdempotencyKeyExists if its key is taken
+	ReserveIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error
+	GetIdempotencyKey(ctx context.Context, key string) (*model.IdempotencyRecord, error)
+	// CompleteIdempotencyKey records the response of a reserved key
+	CompleteIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, key string) error
+}
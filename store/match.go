@@ -0,0 +1,43 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/arpsch/xm/model"
+)
+
+// companyFields indexes the fields of a company by their stored name, the
+// name filters use
+var companyFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(model.Company{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]
+		if name != "" && t.Field(i).Type.Kind() == reflect.String {
+			fields[name] = i
+		}
+	}
+	return fields
+}()
+
+// Matches tells whether the company satisfies all the filters, as a query
+// of the store would; for the companies at hand, like those of events
+func Matches(filters []Filter, c *model.Company) bool {
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range filters {
+		i, ok := companyFields[f.AttrName]
+		if !ok {
+			return false
+		}
+		switch f.Operator {
+		case Eq:
+			if v.Field(i).String() != f.Value {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
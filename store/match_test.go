@@ -0,0 +1,37 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+)
+
+func TestMatches(t *testing.T) {
+	c := &model.Company{ID: "1", Name: "xm", Code: "CY", Country: "Cyprus"}
+
+	tt := []struct {
+		name    string
+		filters []Filter
+		match   bool
+	}{
+		{name: "no filters", match: true},
+		{name: "equal", filters: []Filter{{AttrName: "code", Value: "CY", Operator: Eq}}, match: true},
+		{name: "id", filters: []Filter{{AttrName: "_id", Value: "1", Operator: Eq}}, match: true},
+		{
+			name: "all of them",
+			filters: []Filter{
+				{AttrName: "code", Value: "CY", Operator: Eq},
+				{AttrName: "name", Value: "other", Operator: Eq},
+			},
+		},
+		{name: "unknown field", filters: []Filter{{AttrName: "employees", Value: "10", Operator: Eq}}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.match, Matches(tc.filters, c))
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/arpsch/xm/metrics"
+	"github.com/arpsch/xm/model"
+)
+
+// store operations, one per DataStore method
+const (
+	OpCreateCompany = "create_company"
+	OpListCompanies = "list_companies"
+	OpGetCompany    = "get_company"
+	OpUpdateCompany = "update_company"
+	OpDeleteCompany = "delete_company"
+
+	OpPendingEvents      = "pending_events"
+	OpMarkEventDelivered = "mark_event_delivered"
+)
+
+var (
+	opDuration = metrics.NewHistogramVec(
+		"xm_store_operation_duration_seconds",
+		"Latency of the data store operations.",
+		nil,
+		"operation")
+
+	opErrors = metrics.NewCounterVec(
+		"xm_store_operation_errors_total",
+		"Failed data store operations by error (not_found, exists or internal).",
+		"operation", "error")
+)
+
+func init() {
+	metrics.MustRegister(opDuration, opErrors)
+}
+
+// errorLabel classifies a store error
+func errorLabel(err error) string {
+	switch {
+	case errors.Is(err, ErrCompanyNotFound):
+		return "not_found"
+	case errors.Is(err, ErrCompanyExists):
+		return "exists"
+	}
+	return "internal"
+}
+
+func observe(op string, start time.Time, err error) {
+	opDuration.WithLabelValues(op).ObserveSince(start)
+	if err != nil {
+		opErrors.WithLabelValues(op, errorLabel(err)).Inc()
+	}
+}
+
+// instrumented records the latency and errors of the operations of a
+// DataStore
+type instrumented struct {
+	next DataStore
+}
+
+// instrumentedOutbox is an instrumented OutboxStore
+type instrumentedOutbox struct {
+	instrumented
+	outbox OutboxStore
+}
+
+// WithMetrics returns ds recording the latency and errors of its
+// operations. The result is an OutboxStore if ds is one.
+func WithMetrics(ds DataStore) DataStore {
+	if ob, ok := ds.(OutboxStore); ok {
+		return &instrumentedOutbox{instrumented: instrumented{next: ds}, outbox: ob}
+	}
+	return &instrumented{next: ds}
+}
+
+func (s *instrumented) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	start := time.Now()
+	id, err := s.next.CreateCompany(ctx, c)
+	observe(OpCreateCompany, start, err)
+	return id, err
+}
+
+func (s *instrumented) ListCompanies(ctx context.Context, q ListQuery) ([]model.Company, int, error) {
+	start := time.Now()
+	companies, count, err := s.next.ListCompanies(ctx, q)
+	observe(OpListCompanies, start, err)
+	return companies, count, err
+}
+
+func (s *instrumented) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	start := time.Now()
+	c, err := s.next.GetCompany(ctx, id)
+	observe(OpGetCompany, start, err)
+	return c, err
+}
+
+func (s *instrumented) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	start := time.Now()
+	err := s.next.UpdateCompany(ctx, id, cu)
+	observe(OpUpdateCompany, start, err)
+	return err
+}
+
+func (s *instrumented) DeleteCompany(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.next.DeleteCompany(ctx, id)
+	observe(OpDeleteCompany, start, err)
+	return err
+}
+
+func (s *instrumentedOutbox) CreateCompanyWithEvent(ctx context.Context, c model.Company, ev EventFunc) (string, error) {
+	start := time.Now()
+	id, err := s.outbox.CreateCompanyWithEvent(ctx, c, ev)
+	observe(OpCreateCompany, start, err)
+	return id, err
+}
+
+func (s *instrumentedOutbox) UpdateCompanyWithEvent(ctx context.Context, id string, cu model.CompanyUpdate, ev EventFunc) error {
+	start := time.Now()
+	err := s.outbox.UpdateCompanyWithEvent(ctx, id, cu, ev)
+	observe(OpUpdateCompany, start, err)
+	return err
+}
+
+func (s *instrumentedOutbox) DeleteCompanyWithEvent(ctx context.Context, id string, ev EventFunc) error {
+	start := time.Now()
+	err := s.outbox.DeleteCompanyWithEvent(ctx, id, ev)
+	observe(OpDeleteCompany, start, err)
+	return err
+}
+
+func (s *instrumentedOutbox) PendingEvents(ctx context.Context, limit int, skip []string) ([]model.Event, error) {
+	start := time.Now()
+	evs, err := s.outbox.PendingEvents(ctx, limit, skip)
+	observe(OpPendingEvents, start, err)
+	return evs, err
+}
+
+func (s *instrumentedOutbox) MarkEventDelivered(ctx context.Context, e model.Event) error {
+	start := time.Now()
+	err := s.outbox.MarkEventDelivered(ctx, e)
+	observe(OpMarkEventDelivered, start, err)
+	return err
+}
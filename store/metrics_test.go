@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+)
+
+// errStore fails every operation with err
+type errStore struct {
+	err error
+}
+
+func (s errStore) CreateCompany(ctx context.Context, c model.Company) (string, error) {
+	return "", s.err
+}
+
+func (s errStore) ListCompanies(ctx context.Context, q ListQuery) ([]model.Company, int, error) {
+	return nil, 0, s.err
+}
+
+func (s errStore) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+	return nil, s.err
+}
+
+func (s errStore) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
+	return s.err
+}
+
+func (s errStore) DeleteCompany(ctx context.Context, id string) error {
+	return s.err
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	errs := func(op, label string) float64 {
+		return opErrors.WithLabelValues(op, label).Value()
+	}
+
+	ok := WithMetrics(errStore{})
+	ok.CreateCompany(ctx, model.Company{})
+	ok.ListCompanies(ctx, ListQuery{})
+	assert.Equal(t, float64(0), errs(OpCreateCompany, "internal"))
+	assert.Equal(t, float64(0), errs(OpListCompanies, "internal"))
+
+	WithMetrics(errStore{err: ErrCompanyNotFound}).GetCompany(ctx, "id")
+	assert.Equal(t, float64(1), errs(OpGetCompany, "not_found"))
+
+	WithMetrics(errStore{err: ErrCompanyExists}).UpdateCompany(ctx, "id", model.CompanyUpdate{})
+	assert.Equal(t, float64(1), errs(OpUpdateCompany, "exists"))
+
+	WithMetrics(errStore{err: errors.New("connection reset")}).DeleteCompany(ctx, "id")
+	assert.Equal(t, float64(1), errs(OpDeleteCompany, "internal"))
+}
@@ -0,0 +1,95 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+const (
+	DbAPIKeysColl = "api_keys"
+
+	//fields
+	Hash      = "hash"
+	RevokedTs = "revoked_ts"
+)
+
+// createAPIKeyIndex makes the key hashes unique
+func (db *MongoStore) createAPIKeyIndex(ctx context.Context) error {
+	c := db.Database(ctx).Collection(DbAPIKeysColl)
+
+	mod := mongo.IndexModel{
+		Keys:    bson.M{Hash: 1},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := c.Indexes().CreateOne(ctx, mod)
+	return err
+}
+
+func (db *MongoStore) CreateAPIKey(ctx context.Context, k model.APIKey) (string, error) {
+	c := db.Database(ctx).Collection(DbAPIKeysColl)
+
+	if k.ID == "" {
+		k.ID = primitive.NewObjectID().Hex()
+	}
+	k.CreatedTs = time.Now()
+
+	if _, err := c.InsertOne(ctx, k); err != nil {
+		return "", errors.Wrap(err, "failed to create api key")
+	}
+
+	return k.ID, nil
+}
+
+func (db *MongoStore) GetAPIKeyByHash(ctx context.Context, hash string) (*model.APIKey, error) {
+	c := db.Database(ctx).Collection(DbAPIKeysColl)
+	res := model.APIKey{}
+
+	err := c.FindOne(ctx, bson.M{Hash: hash}).Decode(&res)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, store.ErrAPIKeyNotFound
+		}
+		return nil, errors.Wrap(err, "failed to fetch api key")
+	}
+	return &res, nil
+}
+
+func (db *MongoStore) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	c := db.Database(ctx).Collection(DbAPIKeysColl)
+
+	cursor, err := c.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_ts": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list api keys")
+	}
+
+	keys := []model.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, errors.Wrap(err, "failed to list api keys")
+	}
+	return keys, nil
+}
+
+func (db *MongoStore) RevokeAPIKey(ctx context.Context, id string) error {
+	c := db.Database(ctx).Collection(DbAPIKeysColl)
+
+	update := bson.M{
+		"$set": bson.M{RevokedTs: time.Now()},
+	}
+	res, err := c.UpdateOne(ctx, bson.M{"_id": id, RevokedTs: bson.M{"$exists": false}}, update)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke api key")
+	} else if res.MatchedCount < 1 {
+		return store.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+func TestMongoAPIKeys(t *testing.T) {
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	id, err := ds.CreateAPIKey(ctx, model.APIKey{
+		Name:      "ci",
+		Prefix:    "xm_abcdef",
+		Hash:      "0123456789abcdef",
+		Scopes:    []string{"companies:read"},
+		ExpiresTs: &expires,
+	})
+	assert.NoError(t, err, "failed to create api key")
+
+	k, err := ds.GetAPIKeyByHash(ctx, "0123456789abcdef")
+	assert.NoError(t, err, "failed to get api key")
+	assert.Equal(t, id, k.ID)
+	assert.Equal(t, []string{"companies:read"}, k.Scopes)
+	assert.True(t, expires.Equal(*k.ExpiresTs))
+	assert.Nil(t, k.RevokedTs)
+
+	_, err = ds.GetAPIKeyByHash(ctx, "fedcba9876543210")
+	assert.Equal(t, store.ErrAPIKeyNotFound, err)
+
+	keys, err := ds.ListAPIKeys(ctx)
+	assert.NoError(t, err, "failed to list api keys")
+	assert.Len(t, keys, 1)
+
+	assert.NoError(t, ds.RevokeAPIKey(ctx, id))
+	assert.Equal(t, store.ErrAPIKeyNotFound, ds.RevokeAPIKey(ctx, id))
+
+	k, err = ds.GetAPIKeyByHash(ctx, "0123456789abcdef")
+	assert.NoError(t, err, "failed to get api key")
+	assert.NotNil(t, k.RevokedTs)
+
+	err = ds.DropDatabase(ctx)
+	assert.NoError(t, err, "failed to clean api keys db")
+}
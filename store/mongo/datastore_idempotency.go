@@ -0,0 +1,85 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+const (
+	DbIdempotencyColl = "idempotency_keys"
+
+	//fields
+	ExpiresTs = "expires_ts"
+)
+
+// createIdempotencyIndex makes the records expire; the TTL index removes
+// them eventually, until then they are replaced
+func (db *MongoStore) createIdempotencyIndex(ctx context.Context) error {
+	c := db.Database(ctx).Collection(DbIdempotencyColl)
+
+	mod := mongo.IndexModel{
+		Keys:    bson.M{ExpiresTs: 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := c.Indexes().CreateOne(ctx, mod)
+	return err
+}
+
+func (db *MongoStore) ReserveIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error {
+	c := db.Database(ctx).Collection(DbIdempotencyColl)
+
+	// an existing, unexpired key doesn't match the filter, so the upsert
+	// fails on the duplicate _id
+	filter := bson.M{"_id": rec.Key, ExpiresTs: bson.M{"$lte": time.Now()}}
+	_, err := c.ReplaceOne(ctx, filter, rec, options.Replace().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return store.ErrIdempotencyKeyExists
+		}
+		return errors.Wrap(err, "failed to reserve idempotency key")
+	}
+	return nil
+}
+
+func (db *MongoStore) GetIdempotencyKey(ctx context.Context, key string) (*model.IdempotencyRecord, error) {
+	c := db.Database(ctx).Collection(DbIdempotencyColl)
+	res := model.IdempotencyRecord{}
+
+	err := c.FindOne(ctx, bson.M{"_id": key, ExpiresTs: bson.M{"$gt": time.Now()}}).Decode(&res)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, store.ErrIdempotencyKeyNotFound
+		}
+		return nil, errors.Wrap(err, "failed to fetch idempotency key")
+	}
+	return &res, nil
+}
+
+func (db *MongoStore) CompleteIdempotencyKey(ctx context.Context, rec model.IdempotencyRecord) error {
+	c := db.Database(ctx).Collection(DbIdempotencyColl)
+
+	res, err := c.ReplaceOne(ctx, bson.M{"_id": rec.Key}, rec)
+	if err != nil {
+		return errors.Wrap(err, "failed to complete idempotency key")
+	} else if res.MatchedCount < 1 {
+		return store.ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+func (db *MongoStore) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	c := db.Database(ctx).Collection(DbIdempotencyColl)
+
+	if _, err := c.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return errors.Wrap(err, "failed to delete idempotency key")
+	}
+	return nil
+}
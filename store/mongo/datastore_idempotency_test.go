@@ -0,0 +1,54 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+func TestMongoIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	rec := model.IdempotencyRecord{
+		Key:         "|anonymous|POST|/api/v1/companies|k1",
+		Fingerprint: "abc",
+		CreatedTs:   now,
+		ExpiresTs:   now.Add(time.Hour),
+	}
+	assert.NoError(t, ds.ReserveIdempotencyKey(ctx, rec))
+	assert.Equal(t, store.ErrIdempotencyKeyExists, ds.ReserveIdempotencyKey(ctx, rec))
+
+	got, err := ds.GetIdempotencyKey(ctx, rec.Key)
+	assert.NoError(t, err)
+	assert.False(t, got.Done())
+
+	rec.Status = 201
+	rec.Body = []byte(`{"id":"1"}`)
+	rec.Header = map[string]string{"Content-Type": "application/json"}
+	assert.NoError(t, ds.CompleteIdempotencyKey(ctx, rec))
+
+	got, err = ds.GetIdempotencyKey(ctx, rec.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, rec, *got)
+
+	// expired records are replaced
+	expired := model.IdempotencyRecord{Key: "k2", CreatedTs: now.Add(-time.Hour), ExpiresTs: now.Add(-time.Second)}
+	assert.NoError(t, ds.ReserveIdempotencyKey(ctx, expired))
+	_, err = ds.GetIdempotencyKey(ctx, "k2")
+	assert.Equal(t, store.ErrIdempotencyKeyNotFound, err)
+	expired.ExpiresTs = now.Add(time.Hour)
+	assert.NoError(t, ds.ReserveIdempotencyKey(ctx, expired))
+
+	assert.NoError(t, ds.DeleteIdempotencyKey(ctx, rec.Key))
+	_, err = ds.GetIdempotencyKey(ctx, rec.Key)
+	assert.Equal(t, store.ErrIdempotencyKeyNotFound, err)
+
+	err = ds.DropDatabase(ctx)
+	assert.NoError(t, err, "failed to clean idempotency keys db")
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/arpsch/xm/model"
 	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/tracing"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,6 +17,7 @@ import (
 
 	"go.mongodb.org/mongo-driver/mongo/options"
 	mopts "go.mongodb.org/mongo-driver/mongo/options"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
 const (
@@ -31,6 +34,9 @@ type MongoStoreConfig struct {
 
 	// DbName contains the name of the deviceconfig database.
 	DbName string
+
+	// Tenancy is the multi-tenancy mode, see the tenant package
+	Tenancy string
 }
 
 // newClient returns a mongo client
@@ -41,6 +47,7 @@ func newClient(ctx context.Context, config MongoStoreConfig) (*mongo.Client, err
 		return nil, errors.New("mongo: missing URL")
 	}
 	clientOptions.ApplyURI(config.MongoURL.String())
+	clientOptions.SetPoolMonitor(poolMonitor())
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -62,18 +69,37 @@ type MongoStore struct {
 	client *mongo.Client
 
 	config MongoStoreConfig
+
+	// txn tells whether the deployment supports multi-document
+	// transactions, else the outbox is embedded in the companies
+	txn bool
 }
 
 // SetupDataStore returns the mongo data store and optionally runs migrations
 func NewMongoStore(ctx context.Context, config MongoStoreConfig) (*MongoStore, error) {
+	if err := (tenant.Config{Mode: config.Tenancy}).Validate(); err != nil {
+		return nil, err
+	}
+
 	dbClient, err := newClient(ctx, config)
 	if err != nil {
 		return nil, err
 	}
-	return &MongoStore{
+	db := &MongoStore{
 		client: dbClient,
 		config: config,
-	}, nil
+		txn:    supportsTransactions(ctx, dbClient),
+	}
+	if err := db.createAPIKeyIndex(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to create the api key index")
+	}
+	if err := db.createIdempotencyIndex(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to create the idempotency key index")
+	}
+	if err := db.dropLegacyCompanyIndexes(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to drop the legacy company indexes")
+	}
+	return db, nil
 }
 
 func (db *MongoStore) Database(ctx context.Context, opt ...*mopts.DatabaseOptions) *mongo.Database {
@@ -100,6 +126,20 @@ func (db *MongoStore) DropDatabase(ctx context.Context) error {
 		Drop(ctx)
 	return err
 }
+
+// filterQuery returns the query of a filter, matching the numbers stored
+// as such too
+func filterQuery(filter store.Filter) bson.M {
+	op := mongoOperator(filter.Operator)
+	if filter.ValueFloat != nil {
+		return bson.M{"$or": []bson.M{
+			{filter.AttrName: bson.M{op: filter.Value}},
+			{filter.AttrName: bson.M{op: filter.ValueFloat}},
+		}}
+	}
+	return bson.M{filter.AttrName: bson.M{op: filter.Value}}
+}
+
 func mongoOperator(co store.ComparisonOperator) string {
 	switch co {
 	case store.Eq:
@@ -125,12 +165,8 @@ func (db *MongoStore) CreateIndex(ctx context.Context, collectionName string, fi
 	return nil
 }
 
-func (db *MongoStore) CreateCompany(ctx context.Context, comp model.Company) (string, error) {
-
-	if err := db.CreateIndex(ctx, DbCompaniesColl, Name, true); err != nil {
-		return "", err
-	}
-
+// newCompany completes a company about to be inserted in the scope
+func newCompany(comp model.Company, scope bson.M) model.Company {
 	if comp.ID == "" {
 		comp.ID = primitive.NewObjectID().Hex()
 	}
@@ -140,8 +176,27 @@ func (db *MongoStore) CreateCompany(ctx context.Context, comp model.Company) (st
 	comp.CreatedTs = now
 	comp.UpdatedTs = now
 
-	c := db.Database(ctx).Collection(DbCompaniesColl)
-	_, err := c.InsertOne(ctx, comp)
+	comp.TenantID, _ = scope[TenantID].(string)
+	return comp
+}
+
+func (db *MongoStore) CreateCompany(ctx context.Context, comp model.Company) (_ string, err error) {
+	ctx, span := startSpan(ctx, "CreateCompany", "insert")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return "", err
+	}
+	setCollection(span, c)
+
+	if err := db.createCompanyIndex(ctx, c); err != nil {
+		return "", err
+	}
+
+	comp = newCompany(comp, scope)
+
+	_, err = c.InsertOne(ctx, comp)
 	if err != nil {
 		if strings.Contains(err.Error(), "duplicate key error") {
 			return "", store.ErrCompanyExists
@@ -153,25 +208,38 @@ func (db *MongoStore) CreateCompany(ctx context.Context, comp model.Company) (st
 	return comp.ID, nil
 }
 
-func (db *MongoStore) ListCompanies(ctx context.Context, q store.ListQuery) ([]model.Company, int, error) {
+func (db *MongoStore) ListCompanies(ctx context.Context, q store.ListQuery) (_ []model.Company, _ int, err error) {
 	type CompanyResult struct {
 		Company []model.Company `json:"results" bson:"results"`
 		Count   int             `json:"totalCount" bson:"totalCount"`
 	}
 
-	c := db.Database(ctx).Collection(DbCompaniesColl)
+	ctx, span := startSpan(ctx, "ListCompanies", "aggregate")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return []model.Company{}, 0, err
+	}
+	setCollection(span, c)
 
 	queryFilters := make([]bson.M, 0)
+	if len(scope) > 0 {
+		queryFilters = append(queryFilters, scope)
+	}
 	for _, filter := range q.Filters {
-		op := mongoOperator(filter.Operator)
-		if filter.ValueFloat != nil {
-			queryFilters = append(queryFilters, bson.M{"$or": []bson.M{
-				{filter.AttrName: bson.M{op: filter.Value}},
-				{filter.AttrName: bson.M{op: filter.ValueFloat}},
-			}})
-		} else {
-			queryFilters = append(queryFilters, bson.M{filter.AttrName: bson.M{op: filter.Value}})
+		queryFilters = append(queryFilters, filterQuery(filter))
+	}
+	if len(q.AnyOf) > 0 {
+		groups := make([]bson.M, 0, len(q.AnyOf))
+		for _, group := range q.AnyOf {
+			all := []bson.M{}
+			for _, filter := range group {
+				all = append(all, filterQuery(filter))
+			}
+			groups = append(groups, bson.M{"$and": all})
 		}
+		queryFilters = append(queryFilters, bson.M{"$or": groups})
 	}
 
 	findQuery := bson.M{}
@@ -231,6 +299,7 @@ func (db *MongoStore) ListCompanies(ctx context.Context, q store.ListQuery) ([]m
 
 	queryPipeline := []bson.M{filter}
 	queryPipeline = append(queryPipeline, combinedQuery, resultMap)
+	span.SetAttributes(semconv.DBStatementKey.String(pipelineJSON(queryPipeline)))
 
 	cursor, err := c.Aggregate(ctx, queryPipeline, nil)
 	if err != nil {
@@ -249,12 +318,18 @@ func (db *MongoStore) ListCompanies(ctx context.Context, q store.ListQuery) ([]m
 	return companies[0].Company, companies[0].Count, nil
 }
 
-func (db *MongoStore) GetCompany(ctx context.Context, id string) (*model.Company, error) {
+func (db *MongoStore) GetCompany(ctx context.Context, id string) (_ *model.Company, err error) {
+	ctx, span := startSpan(ctx, "GetCompany", "find")
+	defer func() { tracing.End(span, err) }()
 
-	c := db.Database(ctx).Collection(DbCompaniesColl)
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	setCollection(span, c)
 	res := model.Company{}
 
-	err := c.FindOne(ctx, bson.M{"_id": id}).Decode(&res)
+	err = c.FindOne(ctx, scoped(scope, bson.M{"_id": id})).Decode(&res)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, store.ErrCompanyNotFound
@@ -265,14 +340,21 @@ func (db *MongoStore) GetCompany(ctx context.Context, id string) (*model.Company
 	return &res, nil
 }
 
-func (db *MongoStore) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) error {
-	c := db.Database(ctx).Collection(DbCompaniesColl)
+func (db *MongoStore) UpdateCompany(ctx context.Context, id string, cu model.CompanyUpdate) (err error) {
+	ctx, span := startSpan(ctx, "UpdateCompany", "update")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return err
+	}
+	setCollection(span, c)
 	cu.UpdatedTs = time.Now()
 
 	update := bson.M{
 		"$set": cu,
 	}
-	res, err := c.UpdateOne(ctx, bson.M{"_id": id}, update)
+	res, err := c.UpdateOne(ctx, scoped(scope, bson.M{"_id": id}), update)
 	if err != nil {
 		return errors.Wrap(err, "failed to update company")
 	} else if res.MatchedCount < 1 {
@@ -282,10 +364,17 @@ func (db *MongoStore) UpdateCompany(ctx context.Context, id string, cu model.Com
 	return nil
 }
 
-func (db *MongoStore) DeleteCompany(ctx context.Context, id string) error {
-	c := db.Database(ctx).Collection(DbCompaniesColl)
+func (db *MongoStore) DeleteCompany(ctx context.Context, id string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteCompany", "delete")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return err
+	}
+	setCollection(span, c)
 
-	filter := bson.M{"_id": id}
+	filter := scoped(scope, bson.M{"_id": id})
 	result, err := c.DeleteOne(ctx, filter)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove company")
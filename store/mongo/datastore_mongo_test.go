@@ -269,6 +269,24 @@ func TestMongoUpdateCompany(t *testing.T) {
 			filters:   nil,
 			sort:      nil,
 		},
+		"update the website only, keeping the phone": {
+			input: model.CompanyUpdate{
+				Website: "jio.in",
+			},
+			expected: model.Company{
+				ID:      "12345689",
+				Name:    "jio",
+				Country: "India",
+				Code:    "IN",
+				Website: "jio.in",
+				Phone:   "+35722111111",
+			},
+			compTotal: len(inputCompanies),
+			skip:      0,
+			limit:     20,
+			filters:   nil,
+			sort:      nil,
+		},
 	}
 
 	for name, tc := range testCases {
@@ -0,0 +1,442 @@
+package mongo
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/tracing"
+)
+
+const (
+	DbOutboxColl = "outbox"
+
+	//fields
+	Version     = "version"
+	Deleted     = "deleted"
+	DeletedName = "deleted_name"
+	Outbox      = "outbox"
+	CompanyID   = "company_id"
+	Seq         = "seq"
+
+	// maxWriteAttempts bounds the retries of a write racing another on
+	// the same company in the embedded outbox mode
+	maxWriteAttempts = 5
+)
+
+var errWriteConflict = errors.New("the company changed concurrently")
+
+// companyDoc is the stored company. Version counts its changes and orders
+// its events. Without transactions, its events wait in Outbox and a
+// deleted company is kept, Deleted, until they're delivered; its name
+// moves to DeletedName, free for another company.
+type companyDoc struct {
+	model.Company `bson:",inline"`
+
+	Version     int64         `bson:"version,omitempty"`
+	Deleted     bool          `bson:"deleted,omitempty"`
+	DeletedName string        `bson:"deleted_name,omitempty"`
+	Outbox      []model.Event `bson:"outbox,omitempty"`
+}
+
+// outboxRecord is an event waiting in the outbox collection
+type outboxRecord struct {
+	ID        string      `bson:"_id"`
+	CompanyID string      `bson:"company_id"`
+	Seq       int64       `bson:"seq"`
+	Event     model.Event `bson:"event"`
+}
+
+// supportsTransactions tells whether the deployment is a replica set or a
+// sharded cluster, where multi-document transactions are available
+func supportsTransactions(ctx context.Context, client *mongo.Client) bool {
+	var res bson.M
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	if err != nil {
+		return false
+	}
+	if _, ok := res["setName"]; ok {
+		return true
+	}
+	return res["msg"] == "isdbgrid"
+}
+
+// versioned matches the company at the version
+func versioned(filter bson.M, version int64) bson.M {
+	if version == 0 {
+		// stored before the companies were versioned
+		filter[Version] = bson.M{"$exists": false}
+	} else {
+		filter[Version] = version
+	}
+	return filter
+}
+
+// applyUpdate returns the company after the update, empty fields aren't
+// updated
+func applyUpdate(c model.Company, cu model.CompanyUpdate) model.Company {
+	if cu.Website != "" {
+		c.Website = cu.Website
+	}
+	if cu.Phone != "" {
+		c.Phone = cu.Phone
+	}
+	c.UpdatedTs = cu.UpdatedTs
+	if cu.UpdatedBy != "" {
+		c.UpdatedBy = cu.UpdatedBy
+	}
+	return c
+}
+
+// numbered returns the event of the change, numbered after the company
+// version it leads to
+func numbered(ev store.EventFunc, before, after *model.Company, version int64) *model.Event {
+	e := ev(before, after)
+	if e != nil {
+		e.Seq = version
+	}
+	return e
+}
+
+// withTransaction runs fn in a transaction, retried on transient errors
+func (db *MongoStore) withTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	sess, err := db.client.StartSession()
+	if err != nil {
+		return errors.Wrap(err, "failed to start a session")
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// outbox returns the outbox collection, the events of all tenants wait in
+// the base database
+func (db *MongoStore) outbox(ctx context.Context) (*mongo.Collection, error) {
+	c := db.Database(ctx).Collection(DbOutboxColl)
+	_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: CompanyID, Value: 1}, {Key: Seq, Value: 1}},
+	})
+	return c, err
+}
+
+func insertOutbox(ctx context.Context, c *mongo.Collection, e *model.Event) error {
+	if e == nil {
+		return nil
+	}
+	_, err := c.InsertOne(ctx, outboxRecord{ID: e.ID, CompanyID: e.CompanyID, Seq: e.Seq, Event: *e})
+	return errors.Wrap(err, "failed to write the outbox")
+}
+
+// getCompanyDoc fetches the company, with its version
+func getCompanyDoc(ctx context.Context, c *mongo.Collection, scope bson.M, id string) (*companyDoc, error) {
+	var doc companyDoc
+	err := c.FindOne(ctx, scoped(scope, bson.M{"_id": id})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, store.ErrCompanyNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch company")
+	}
+	return &doc, nil
+}
+
+func (db *MongoStore) CreateCompanyWithEvent(ctx context.Context, comp model.Company, ev store.EventFunc) (_ string, err error) {
+	ctx, span := startSpan(ctx, "CreateCompanyWithEvent", "insert")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return "", err
+	}
+	setCollection(span, c)
+
+	if err := db.createCompanyIndex(ctx, c); err != nil {
+		return "", err
+	}
+
+	comp = newCompany(comp, scope)
+	doc := companyDoc{Company: comp, Version: 1}
+	e := numbered(ev, nil, &comp, doc.Version)
+
+	if db.txn {
+		ob, err := db.outbox(ctx)
+		if err != nil {
+			return "", err
+		}
+		err = db.withTransaction(ctx, func(sc mongo.SessionContext) error {
+			if _, err := c.InsertOne(sc, doc); err != nil {
+				return err
+			}
+			return insertOutbox(sc, ob, e)
+		})
+	} else {
+		if e != nil {
+			doc.Outbox = []model.Event{*e}
+		}
+		_, err = c.InsertOne(ctx, doc)
+	}
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) || strings.Contains(err.Error(), "duplicate key error") {
+			return "", store.ErrCompanyExists
+		}
+		return "", err
+	}
+
+	return comp.ID, nil
+}
+
+func (db *MongoStore) UpdateCompanyWithEvent(ctx context.Context, id string, cu model.CompanyUpdate, ev store.EventFunc) (err error) {
+	ctx, span := startSpan(ctx, "UpdateCompanyWithEvent", "update")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return err
+	}
+	setCollection(span, c)
+	cu.UpdatedTs = time.Now()
+
+	write := func(ctx context.Context, withOutbox bool) (*model.Event, error) {
+		before, err := getCompanyDoc(ctx, c, scope, id)
+		if err != nil {
+			return nil, err
+		}
+		after := applyUpdate(before.Company, cu)
+		e := numbered(ev, &before.Company, &after, before.Version+1)
+
+		update := bson.M{
+			"$set": cu,
+			"$inc": bson.M{Version: 1},
+		}
+		if withOutbox && e != nil {
+			update["$push"] = bson.M{Outbox: e}
+		}
+		res, err := c.UpdateOne(ctx, versioned(scoped(scope, bson.M{"_id": id}), before.Version), update)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to update company")
+		}
+		if res.MatchedCount < 1 {
+			return nil, errWriteConflict
+		}
+		return e, nil
+	}
+
+	if db.txn {
+		ob, err := db.outbox(ctx)
+		if err != nil {
+			return err
+		}
+		return retryConflicts(func() error {
+			return db.withTransaction(ctx, func(sc mongo.SessionContext) error {
+				e, err := write(sc, false)
+				if err != nil {
+					return err
+				}
+				return insertOutbox(sc, ob, e)
+			})
+		})
+	}
+	return retryConflicts(func() error {
+		_, err := write(ctx, true)
+		return err
+	})
+}
+
+func (db *MongoStore) DeleteCompanyWithEvent(ctx context.Context, id string, ev store.EventFunc) (err error) {
+	ctx, span := startSpan(ctx, "DeleteCompanyWithEvent", "delete")
+	defer func() { tracing.End(span, err) }()
+
+	c, scope, err := db.companies(ctx)
+	if err != nil {
+		return err
+	}
+	setCollection(span, c)
+
+	if db.txn {
+		ob, err := db.outbox(ctx)
+		if err != nil {
+			return err
+		}
+		return db.withTransaction(ctx, func(sc mongo.SessionContext) error {
+			before, err := getCompanyDoc(sc, c, scope, id)
+			if err != nil {
+				return err
+			}
+			if _, err := c.DeleteOne(sc, scoped(scope, bson.M{"_id": id})); err != nil {
+				return errors.Wrap(err, "failed to remove company")
+			}
+			return insertOutbox(sc, ob, numbered(ev, &before.Company, nil, before.Version+1))
+		})
+	}
+
+	// the company is kept, deleted, until its events are delivered
+	return retryConflicts(func() error {
+		before, err := getCompanyDoc(ctx, c, scope, id)
+		if err != nil {
+			return err
+		}
+		filter := versioned(scoped(scope, bson.M{"_id": id}), before.Version)
+
+		e := numbered(ev, &before.Company, nil, before.Version+1)
+		if e == nil && len(before.Outbox) == 0 {
+			res, err := c.DeleteOne(ctx, filter)
+			if err != nil {
+				return errors.Wrap(err, "failed to remove company")
+			}
+			if res.DeletedCount < 1 {
+				return errWriteConflict
+			}
+			return nil
+		}
+
+		update := bson.M{
+			"$set":    bson.M{Deleted: true},
+			"$rename": bson.M{Name: DeletedName},
+			"$inc":    bson.M{Version: 1},
+		}
+		if e != nil {
+			update["$push"] = bson.M{Outbox: e}
+		}
+		res, err := c.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove company")
+		}
+		if res.MatchedCount < 1 {
+			return errWriteConflict
+		}
+		return nil
+	})
+}
+
+// retryConflicts retries write while it races another write
+func retryConflicts(write func() error) error {
+	var err error
+	for i := 0; i < maxWriteAttempts; i++ {
+		if err = write(); !errors.Is(err, errWriteConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *MongoStore) PendingEvents(ctx context.Context, limit int, skip []string) ([]model.Event, error) {
+	if db.txn {
+		ob, err := db.outbox(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filter := bson.M{}
+		if len(skip) > 0 {
+			filter[CompanyID] = bson.M{"$nin": skip}
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: CompanyID, Value: 1}, {Key: Seq, Value: 1}}).
+			SetLimit(int64(limit))
+		cursor, err := ob.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to fetch the outbox")
+		}
+		var recs []outboxRecord
+		if err := cursor.All(ctx, &recs); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch the outbox")
+		}
+		evs := make([]model.Event, 0, len(recs))
+		for _, r := range recs {
+			evs = append(evs, r.Event)
+		}
+		return evs, nil
+	}
+
+	colls, err := db.allCompanies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	match := bson.M{Outbox + ".0": bson.M{"$exists": true}}
+	if len(skip) > 0 {
+		match["_id"] = bson.M{"$nin": skip}
+	}
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$unwind": "$" + Outbox},
+		{"$replaceRoot": bson.M{"newRoot": "$" + Outbox}},
+		{"$sort": bson.D{{Key: CompanyID, Value: 1}, {Key: Seq, Value: 1}}},
+		{"$limit": limit},
+	}
+	evs := []model.Event{}
+	for _, c := range colls {
+		cursor, err := c.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to fetch the outbox")
+		}
+		var page []model.Event
+		if err := cursor.All(ctx, &page); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch the outbox")
+		}
+		evs = append(evs, page...)
+		if len(evs) >= limit {
+			return evs[:limit], nil
+		}
+	}
+	return evs, nil
+}
+
+// allCompanies returns the companies collections of all tenants
+func (db *MongoStore) allCompanies(ctx context.Context) ([]*mongo.Collection, error) {
+	if db.config.Tenancy != tenant.ModeDatabase {
+		return []*mongo.Collection{db.companiesOf("")}, nil
+	}
+
+	prefix := TenantDbName(db.config.DbName, "")
+	names, err := db.client.ListDatabaseNames(ctx, bson.M{
+		"name": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the tenant databases")
+	}
+
+	colls := make([]*mongo.Collection, 0, len(names))
+	for _, n := range names {
+		colls = append(colls, db.client.Database(n).Collection(DbCompaniesColl))
+	}
+	return colls, nil
+}
+
+func (db *MongoStore) MarkEventDelivered(ctx context.Context, e model.Event) error {
+	if db.txn {
+		ob, err := db.outbox(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = ob.DeleteOne(ctx, bson.M{"_id": e.ID})
+		return errors.Wrap(err, "failed to update the outbox")
+	}
+
+	c := db.companiesOf(e.TenantID)
+	_, err := c.UpdateOne(ctx,
+		bson.M{"_id": e.CompanyID},
+		bson.M{"$pull": bson.M{Outbox: bson.M{"_id": e.ID}}})
+	if err != nil {
+		return errors.Wrap(err, "failed to update the outbox")
+	}
+
+	// a deleted company goes with its last event
+	_, err = c.DeleteOne(ctx, bson.M{
+		"_id":   e.CompanyID,
+		Deleted: true,
+		Outbox:  bson.M{"$size": 0},
+	})
+	return errors.Wrap(err, "failed to remove company")
+}
@@ -0,0 +1,66 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+func TestMongoOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	event := func(typ string) store.EventFunc {
+		return func(before, after *model.Company) *model.Event {
+			c := after
+			if c == nil {
+				c = before
+			}
+			return &model.Event{ID: typ + ":" + c.ID, Type: typ, CompanyID: c.ID}
+		}
+	}
+
+	id, err := ds.CreateCompanyWithEvent(ctx, model.Company{Name: "Outbox", Code: "CY", Country: "Cyprus"},
+		event(model.EventCompanyCreated))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.UpdateCompanyWithEvent(ctx, id, model.CompanyUpdate{Website: "outbox.cy"},
+		event(model.EventCompanyUpdated)))
+	assert.Equal(t, store.ErrCompanyNotFound, ds.UpdateCompanyWithEvent(ctx, "missing", model.CompanyUpdate{Website: "x.cy"},
+		event(model.EventCompanyUpdated)))
+	assert.NoError(t, ds.DeleteCompanyWithEvent(ctx, id, event(model.EventCompanyDeleted)))
+
+	// the deleted company is gone, its events aren't
+	_, err = ds.GetCompany(ctx, id)
+	assert.Equal(t, store.ErrCompanyNotFound, err)
+
+	// its name is free right away
+	none := func(before, after *model.Company) *model.Event { return nil }
+	_, err = ds.CreateCompanyWithEvent(ctx, model.Company{Name: "Outbox", Code: "CY", Country: "Cyprus"}, none)
+	assert.NoError(t, err)
+	_, err = ds.CreateCompanyWithEvent(ctx, model.Company{Name: "Outbox", Code: "CY", Country: "Cyprus"}, none)
+	assert.Equal(t, store.ErrCompanyExists, err)
+
+	evs, err := ds.PendingEvents(ctx, 10, nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, evs, 3) {
+		return
+	}
+	assert.Equal(t, model.EventCompanyCreated, evs[0].Type)
+	assert.Equal(t, model.EventCompanyUpdated, evs[1].Type)
+	assert.Equal(t, model.EventCompanyDeleted, evs[2].Type)
+	assert.True(t, evs[0].Seq < evs[1].Seq && evs[1].Seq < evs[2].Seq)
+
+	skipped, err := ds.PendingEvents(ctx, 10, []string{id})
+	assert.NoError(t, err)
+	assert.Empty(t, skipped)
+
+	for _, e := range evs {
+		assert.NoError(t, ds.MarkEventDelivered(ctx, e))
+	}
+	evs, err = ds.PendingEvents(ctx, 10, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, evs)
+}
@@ -0,0 +1,110 @@
+package mongo_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	. "github.com/arpsch/xm/store/mongo"
+	"github.com/arpsch/xm/tenant"
+)
+
+func TestMongoTenantIsolation(t *testing.T) {
+	mgoUrl, err := url.Parse("mongodb://localhost:27017")
+	assert.NoError(t, err)
+
+	for _, mode := range []string{tenant.ModeShared, tenant.ModeDatabase} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+
+			tds, err := NewMongoStore(ctx, MongoStoreConfig{
+				MongoURL: mgoUrl,
+				DbName:   "xm-tenancy",
+				Tenancy:  mode,
+			})
+			assert.NoError(t, err)
+			defer tds.Close(ctx)
+
+			acme := tenant.WithID(ctx, "acme")
+			globex := tenant.WithID(ctx, "globex")
+
+			_, err = tds.CreateCompany(ctx, model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+			assert.Equal(t, tenant.ErrNoTenant, err)
+
+			// names are unique per tenant
+			id, err := tds.CreateCompany(acme, model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+			assert.NoError(t, err)
+			_, err = tds.CreateCompany(globex, model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+			assert.NoError(t, err)
+			_, err = tds.CreateCompany(acme, model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+			assert.Equal(t, store.ErrCompanyExists, err)
+
+			c, err := tds.GetCompany(acme, id)
+			assert.NoError(t, err)
+			assert.Equal(t, "acme", c.TenantID)
+
+			_, err = tds.GetCompany(globex, id)
+			assert.Equal(t, store.ErrCompanyNotFound, err)
+			assert.Equal(t, store.ErrCompanyNotFound, tds.UpdateCompany(globex, id, model.CompanyUpdate{Website: "x.cy"}))
+			assert.Equal(t, store.ErrCompanyNotFound, tds.DeleteCompany(globex, id))
+
+			companies, count, err := tds.ListCompanies(globex, store.ListQuery{})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			assert.NotEqual(t, id, companies[0].ID)
+
+			for _, name := range []string{"xm-tenancy", TenantDbName("xm-tenancy", "acme"), TenantDbName("xm-tenancy", "globex")} {
+				assert.NoError(t, tds.Database(ctx).Client().Database(name).Drop(ctx))
+			}
+		})
+	}
+}
+
+func TestMongoTenantLegacyIndex(t *testing.T) {
+	mgoUrl, err := url.Parse("mongodb://localhost:27017")
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// a database from before the multi-tenancy, with the former index
+	legacy, err := NewMongoStore(ctx, MongoStoreConfig{MongoURL: mgoUrl, DbName: "xm-legacy"})
+	assert.NoError(t, err)
+	defer legacy.Close(ctx)
+	defer legacy.DropDatabase(ctx)
+
+	_, err = legacy.Database(ctx).Collection(DbCompaniesColl).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: Name, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.NoError(t, err)
+	_, err = legacy.CreateCompany(ctx, model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+	assert.NoError(t, err)
+
+	tds, err := NewMongoStore(ctx, MongoStoreConfig{
+		MongoURL: mgoUrl,
+		DbName:   "xm-legacy",
+		Tenancy:  tenant.ModeShared,
+	})
+	assert.NoError(t, err)
+	defer tds.Close(ctx)
+
+	_, err = tds.CreateCompany(tenant.WithID(ctx, "acme"), model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+	assert.NoError(t, err)
+	_, err = tds.CreateCompany(tenant.WithID(ctx, "globex"), model.Company{Name: "Airtel", Code: "CY", Country: "Cyprus"})
+	assert.NoError(t, err)
+
+	// once dropped, it stays so
+	tds, err = NewMongoStore(ctx, MongoStoreConfig{
+		MongoURL: mgoUrl,
+		DbName:   "xm-legacy",
+		Tenancy:  tenant.ModeShared,
+	})
+	assert.NoError(t, err)
+	defer tds.Close(ctx)
+}
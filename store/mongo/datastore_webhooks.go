@@ -0,0 +1,308 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+)
+
+const (
+	DbWebhooksColl   = "webhooks"
+	DbDeliveriesColl = "webhook_deliveries"
+
+	//fields
+	EventTypes    = "event_types"
+	WebhookID     = "webhook_id"
+	Status        = "status"
+	NextAttemptTs = "next_attempt_ts"
+	Attempts      = "attempts"
+	CreatedTs     = "created_ts"
+	UpdatedTs     = "updated_ts"
+)
+
+// tenantScope returns the filter keeping the webhooks and deliveries to
+// the tenant in the context. Unlike the companies, they are kept in the
+// main database in every tenancy mode, for the dispatcher to find them.
+func (db *MongoStore) tenantScope(ctx context.Context) (string, bson.M, error) {
+	if db.config.Tenancy == tenant.ModeNone {
+		return "", bson.M{}, nil
+	}
+
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return "", nil, tenant.ErrNoTenant
+	}
+	if err := model.ValidateTenantID(id); err != nil {
+		return "", nil, err
+	}
+	return id, bson.M{TenantID: id}, nil
+}
+
+func (db *MongoStore) CreateWebhook(ctx context.Context, w model.Webhook) (string, error) {
+	t, _, err := db.tenantScope(ctx)
+	if err != nil {
+		return "", err
+	}
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	mod := mongo.IndexModel{
+		Keys: bson.D{{Key: TenantID, Value: 1}, {Key: EventTypes, Value: 1}},
+	}
+	if _, err := c.Indexes().CreateOne(ctx, mod); err != nil {
+		return "", err
+	}
+
+	if w.ID == "" {
+		w.ID = primitive.NewObjectID().Hex()
+	}
+	w.TenantID = t
+	w.CreatedTs = time.Now()
+	w.UpdatedTs = w.CreatedTs
+
+	if _, err := c.InsertOne(ctx, w); err != nil {
+		return "", errors.Wrap(err, "failed to create webhook")
+	}
+	return w.ID, nil
+}
+
+func (db *MongoStore) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	cursor, err := c.Find(ctx, scope, options.Find().SetSort(bson.M{CreatedTs: 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list webhooks")
+	}
+
+	hooks := []model.Webhook{}
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, errors.Wrap(err, "failed to list webhooks")
+	}
+	return hooks, nil
+}
+
+func (db *MongoStore) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	res := model.Webhook{}
+	err = c.FindOne(ctx, scoped(scope, bson.M{"_id": id})).Decode(&res)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, store.ErrWebhookNotFound
+		}
+		return nil, errors.Wrap(err, "failed to fetch webhook")
+	}
+	return &res, nil
+}
+
+func (db *MongoStore) UpdateWebhook(ctx context.Context, id string, wu model.WebhookUpdate) error {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return err
+	}
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	wu.UpdatedTs = time.Now()
+	res, err := c.UpdateOne(ctx, scoped(scope, bson.M{"_id": id}), bson.M{"$set": wu})
+	if err != nil {
+		return errors.Wrap(err, "failed to update webhook")
+	} else if res.MatchedCount < 1 {
+		return store.ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (db *MongoStore) DeleteWebhook(ctx context.Context, id string) error {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return err
+	}
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	res, err := c.DeleteOne(ctx, scoped(scope, bson.M{"_id": id}))
+	if err != nil {
+		return errors.Wrap(err, "failed to delete webhook")
+	} else if res.DeletedCount < 1 {
+		return store.ErrWebhookNotFound
+	}
+
+	_, err = db.Database(ctx).Collection(DbDeliveriesColl).
+		DeleteMany(ctx, scoped(scope, bson.M{WebhookID: id}))
+	if err != nil {
+		return errors.Wrap(err, "failed to delete the webhook deliveries")
+	}
+	return nil
+}
+
+func (db *MongoStore) ListDeliveries(ctx context.Context, webhookID, status string, skip, limit int) ([]model.Delivery, error) {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := db.Database(ctx).Collection(DbDeliveriesColl)
+
+	filter := bson.M{WebhookID: webhookID}
+	if status != "" {
+		filter[Status] = status
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: CreatedTs, Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit))
+
+	cursor, err := c.Find(ctx, scoped(scope, filter), opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list deliveries")
+	}
+
+	deliveries := []model.Delivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, errors.Wrap(err, "failed to list deliveries")
+	}
+	return deliveries, nil
+}
+
+func (db *MongoStore) RetryDelivery(ctx context.Context, webhookID, id string) error {
+	_, scope, err := db.tenantScope(ctx)
+	if err != nil {
+		return err
+	}
+	c := db.Database(ctx).Collection(DbDeliveriesColl)
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			Status:        model.DeliveryPending,
+			NextAttemptTs: now,
+			Attempts:      []model.DeliveryAttempt{},
+			UpdatedTs:     now,
+		},
+	}
+	filter := bson.M{"_id": id, WebhookID: webhookID, Status: model.DeliveryDead}
+	res, err := c.UpdateOne(ctx, scoped(scope, filter), update)
+	if err != nil {
+		return errors.Wrap(err, "failed to retry delivery")
+	} else if res.MatchedCount < 1 {
+		return store.ErrDeliveryNotFound
+	}
+	return nil
+}
+
+func (db *MongoStore) WebhooksFor(ctx context.Context, tenantID, eventType string) ([]model.Webhook, error) {
+	c := db.Database(ctx).Collection(DbWebhooksColl)
+
+	// without event types, a webhook gets them all
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{EventTypes: eventType},
+			bson.M{EventTypes: nil},
+			bson.M{EventTypes: bson.M{"$size": 0}},
+		},
+	}
+	if db.config.Tenancy != tenant.ModeNone {
+		filter[TenantID] = tenantID
+	}
+
+	cursor, err := c.Find(ctx, filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find webhooks")
+	}
+
+	hooks := []model.Webhook{}
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, errors.Wrap(err, "failed to find webhooks")
+	}
+	return hooks, nil
+}
+
+func (db *MongoStore) CreateDelivery(ctx context.Context, d model.Delivery) error {
+	c := db.Database(ctx).Collection(DbDeliveriesColl)
+
+	mods := []mongo.IndexModel{
+		{Keys: bson.D{{Key: Status, Value: 1}, {Key: NextAttemptTs, Value: 1}}},
+		{Keys: bson.D{{Key: WebhookID, Value: 1}, {Key: CreatedTs, Value: -1}}},
+	}
+	if _, err := c.Indexes().CreateMany(ctx, mods); err != nil {
+		return err
+	}
+
+	if d.Attempts == nil {
+		d.Attempts = []model.DeliveryAttempt{}
+	}
+	d.CreatedTs = time.Now()
+	d.UpdatedTs = d.CreatedTs
+
+	if _, err := c.InsertOne(ctx, d); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to create delivery")
+	}
+	return nil
+}
+
+func (db *MongoStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Delivery, error) {
+	c := db.Database(ctx).Collection(DbDeliveriesColl)
+
+	filter := bson.M{
+		Status:        model.DeliveryPending,
+		NextAttemptTs: bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.M{NextAttemptTs: now.Add(lease)},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{NextAttemptTs: 1}).
+		SetReturnDocument(options.After)
+
+	// one by one, so each is claimed by a single dispatcher
+	deliveries := []model.Delivery{}
+	for len(deliveries) < limit {
+		d := model.Delivery{}
+		err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&d)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return deliveries, errors.Wrap(err, "failed to claim deliveries")
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (db *MongoStore) SaveDeliveryAttempt(ctx context.Context, d model.Delivery, a model.DeliveryAttempt) error {
+	c := db.Database(ctx).Collection(DbDeliveriesColl)
+
+	update := bson.M{
+		"$set": bson.M{
+			Status:        d.Status,
+			NextAttemptTs: d.NextAttemptTs,
+			UpdatedTs:     time.Now(),
+		},
+		"$push": bson.M{Attempts: a},
+	}
+	res, err := c.UpdateOne(ctx, bson.M{"_id": d.ID}, update)
+	if err != nil {
+		return errors.Wrap(err, "failed to save delivery attempt")
+	} else if res.MatchedCount < 1 {
+		return store.ErrDeliveryNotFound
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+)
+
+func TestMongoWebhooks(t *testing.T) {
+	ctx := context.Background()
+
+	all, err := ds.CreateWebhook(ctx, model.Webhook{URL: "http://localhost/all", Secret: "secret"})
+	assert.NoError(t, err)
+	deleted, err := ds.CreateWebhook(ctx, model.Webhook{URL: "http://localhost/deleted", Secret: "secret",
+		EventTypes: []string{model.EventCompanyDeleted}})
+	assert.NoError(t, err)
+
+	hooks, err := ds.WebhooksFor(ctx, "", model.EventCompanyCreated)
+	assert.NoError(t, err)
+	if assert.Len(t, hooks, 1) {
+		assert.Equal(t, all, hooks[0].ID)
+		assert.Equal(t, "secret", hooks[0].Secret)
+	}
+	hooks, err = ds.WebhooksFor(ctx, "", model.EventCompanyDeleted)
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 2)
+
+	assert.NoError(t, ds.UpdateWebhook(ctx, deleted, model.WebhookUpdate{URL: "http://localhost/any"}))
+	hooks, err = ds.WebhooksFor(ctx, "", model.EventCompanyCreated)
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 2)
+	assert.Equal(t, store.ErrWebhookNotFound, ds.UpdateWebhook(ctx, "missing", model.WebhookUpdate{URL: "http://localhost"}))
+
+	now := time.Now()
+	d := model.Delivery{ID: "e1-" + all, WebhookID: all, EventID: "e1", EventType: model.EventCompanyCreated,
+		Payload: []byte(`{"id":"e1"}`), Status: model.DeliveryPending, NextAttemptTs: now}
+	assert.NoError(t, ds.CreateDelivery(ctx, d))
+	assert.NoError(t, ds.CreateDelivery(ctx, d))
+
+	claimed, err := ds.ClaimDeliveries(ctx, now, time.Minute, 10)
+	assert.NoError(t, err)
+	if !assert.Len(t, claimed, 1) {
+		return
+	}
+	assert.JSONEq(t, `{"id":"e1"}`, string(claimed[0].Payload))
+
+	// leased
+	claimed, err = ds.ClaimDeliveries(ctx, now, time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	d.Status = model.DeliveryDead
+	assert.NoError(t, ds.SaveDeliveryAttempt(ctx, d, model.DeliveryAttempt{Ts: now, StatusCode: 500}))
+
+	dead, err := ds.ListDeliveries(ctx, all, model.DeliveryDead, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Len(t, dead[0].Attempts, 1)
+	}
+
+	assert.NoError(t, ds.RetryDelivery(ctx, all, d.ID))
+	assert.Equal(t, store.ErrDeliveryNotFound, ds.RetryDelivery(ctx, all, d.ID))
+	claimed, err = ds.ClaimDeliveries(ctx, time.Now(), time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Len(t, claimed, 1)
+
+	assert.NoError(t, ds.DeleteWebhook(ctx, all))
+	assert.Equal(t, store.ErrWebhookNotFound, ds.DeleteWebhook(ctx, all))
+	deliveries, err := ds.ListDeliveries(ctx, all, "", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
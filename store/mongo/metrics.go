@@ -0,0 +1,51 @@
+package mongo
+
+import (
+	"go.mongodb.org/mongo-driver/event"
+
+	"github.com/arpsch/xm/metrics"
+)
+
+var (
+	poolConnections = metrics.NewGaugeVec(
+		"xm_mongo_pool_connections",
+		"Connections of the Mongo connection pool, open or in_use, by server.",
+		"address", "state")
+
+	poolCheckouts = metrics.NewCounterVec(
+		"xm_mongo_pool_checkouts_total",
+		"Connection checkouts from the Mongo connection pool by result (success or failure).",
+		"address", "result")
+
+	poolClears = metrics.NewCounterVec(
+		"xm_mongo_pool_cleared_total",
+		"Number of times the Mongo connection pool of a server was cleared.",
+		"address")
+)
+
+func init() {
+	metrics.MustRegister(poolConnections, poolCheckouts, poolClears)
+}
+
+// poolMonitor keeps the connection pool metrics up to date
+func poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				poolConnections.WithLabelValues(e.Address, "open").Add(1)
+			case event.ConnectionClosed:
+				poolConnections.WithLabelValues(e.Address, "open").Add(-1)
+			case event.GetSucceeded:
+				poolConnections.WithLabelValues(e.Address, "in_use").Add(1)
+				poolCheckouts.WithLabelValues(e.Address, "success").Inc()
+			case event.GetFailed:
+				poolCheckouts.WithLabelValues(e.Address, "failure").Inc()
+			case event.ConnectionReturned:
+				poolConnections.WithLabelValues(e.Address, "in_use").Add(-1)
+			case event.PoolCleared:
+				poolClears.WithLabelValues(e.Address).Inc()
+			}
+		},
+	}
+}
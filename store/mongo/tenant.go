@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/tenant"
+)
+
+const (
+	//fields
+	TenantID = "tenant_id"
+
+	// the unique name indexes of the live companies, global and per
+	// tenant
+	companyIndex       = "live_name"
+	tenantCompanyIndex = "live_tenant_id_name"
+
+	// legacyCompanyIndex is the unique name index of all the companies,
+	// deleted ones included, from before companyIndex
+	legacyCompanyIndex = "name_1"
+
+	// the codes of the missing collection and index errors
+	errNamespaceNotFound = 26
+	errIndexNotFound     = 27
+)
+
+// TenantDbName returns the database of the tenant in the database per
+// tenant mode
+func TenantDbName(dbName, tenantID string) string {
+	return dbName + "-" + tenantID
+}
+
+// companies returns the companies collection of the tenant in the context
+// and the filter every query on it must include. All the company
+// operations go through it, so none can reach another tenant's companies.
+// The companies deleted but whose events are still in their embedded
+// outbox are filtered out as well.
+func (db *MongoStore) companies(ctx context.Context) (*mongo.Collection, bson.M, error) {
+	if db.config.Tenancy == tenant.ModeNone {
+		return db.companiesOf(""), bson.M{Deleted: bson.M{"$ne": true}}, nil
+	}
+
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return nil, nil, tenant.ErrNoTenant
+	}
+	if err := model.ValidateTenantID(id); err != nil {
+		return nil, nil, err
+	}
+
+	return db.companiesOf(id), bson.M{TenantID: id, Deleted: bson.M{"$ne": true}}, nil
+}
+
+// companiesOf returns the companies collection of the tenant, without
+// checking the caller may access it
+func (db *MongoStore) companiesOf(tenantID string) *mongo.Collection {
+	dbName := db.config.DbName
+	if db.config.Tenancy == tenant.ModeDatabase {
+		dbName = TenantDbName(dbName, tenantID)
+	}
+	return db.client.Database(dbName).Collection(DbCompaniesColl)
+}
+
+// scoped adds the tenant scope to the filter
+func scoped(scope, filter bson.M) bson.M {
+	res := bson.M{}
+	for k, v := range filter {
+		res[k] = v
+	}
+	for k, v := range scope {
+		res[k] = v
+	}
+	return res
+}
+
+// createCompanyIndex makes company names unique, per tenant when
+// multi-tenancy is enabled. The deleted companies kept until their events
+// are delivered have their name moved to DeletedName, out of the index.
+func (db *MongoStore) createCompanyIndex(ctx context.Context, c *mongo.Collection) error {
+	keys, name := bson.D{{Key: Name, Value: 1}}, companyIndex
+	if db.config.Tenancy != tenant.ModeNone {
+		keys = bson.D{{Key: TenantID, Value: 1}, {Key: Name, Value: 1}}
+		name = tenantCompanyIndex
+	}
+
+	_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName(name).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{Name: bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// dropLegacyCompanyIndexes drops the name indexes which don't apply, if
+// any: the former one, which would keep deleted companies their names, and
+// with multi-tenancy the global one, which would keep tenants from using
+// the same names
+func (db *MongoStore) dropLegacyCompanyIndexes(ctx context.Context) error {
+	names := []string{legacyCompanyIndex}
+	if db.config.Tenancy != tenant.ModeNone {
+		names = append(names, companyIndex)
+	}
+
+	for _, name := range names {
+		_, err := db.companiesOf("").Indexes().DropOne(ctx, name)
+		var cerr mongo.CommandError
+		if errors.As(err, &cerr) && (cerr.HasErrorCode(errNamespaceNotFound) || cerr.HasErrorCode(errIndexNotFound)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package mongo
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/arpsch/xm/tracing"
+)
+
+// startSpan starts the span of a store operation running the Mongo
+// command dbOp
+func startSpan(ctx context.Context, op, dbOp string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "mongo."+op,
+		semconv.DBSystemMongoDB,
+		semconv.DBOperationKey.String(dbOp),
+	)
+}
+
+// setCollection tells the span which collection the operation runs on
+func setCollection(span trace.Span, c *mongo.Collection) {
+	span.SetAttributes(
+		semconv.DBNameKey.String(c.Database().Name()),
+		semconv.DBMongoDBCollectionKey.String(c.Name()),
+	)
+}
+
+// pipelineJSON renders an aggregation pipeline as extended JSON
+func pipelineJSON(pipeline []bson.M) string {
+	stages := make([]string, 0, len(pipeline))
+	for _, stage := range pipeline {
+		b, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			stages = append(stages, `{"error":"failed to encode the stage"}`)
+			continue
+		}
+		stages = append(stages, string(b))
+	}
+	return "[" + strings.Join(stages, ",") + "]"
+}
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+
+	"github.com/arpsch/xm/model"
+)
+
+// EventFunc returns the event of a change of a company, given the company
+// before (nil on creation) and after (nil on deletion) the change, or nil
+// if the change makes none
+type EventFunc func(before, after *model.Company) *model.Event
+
+// OutboxStore represents behavour on the storage writing the company
+// changes along with their events. The events are kept until delivered,
+// so none is lost if the process stops after the change is stored.
+type OutboxStore interface {
+	CreateCompanyWithEvent(ctx context.Context, c model.Company, ev EventFunc) (string, error)
+	UpdateCompanyWithEvent(ctx context.Context, id string, cu model.CompanyUpdate, ev EventFunc) error
+	DeleteCompanyWithEvent(ctx context.Context, id string, ev EventFunc) error
+
+	// PendingEvents returns up to limit undelivered events, the events of
+	// a company in the order of their Seq, but those of the skipped
+	// companies
+	PendingEvents(ctx context.Context, limit int, skip []string) ([]model.Event, error)
+	// MarkEventDelivered drops a delivered event
+	MarkEventDelivered(ctx context.Context, e model.Event) error
+}
@@ -23,4 +23,8 @@ type ListQuery struct {
 	Limit   int
 	Filters []Filter
 	Sort    *Sort
+
+	// AnyOf further narrows the query down to the companies matching all
+	// the filters of at least one of the groups, when set
+	AnyOf [][]Filter
 }
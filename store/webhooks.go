@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/arpsch/xm/model"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("delivery not found")
+)
+
+// WebhookStore represents behavour on the webhook storage. The webhooks
+// and their deliveries belong to the tenant of the context, except for the
+// dispatcher's operations which span the tenants.
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, w model.Webhook) (string, error)
+	ListWebhooks(ctx context.Context) ([]model.Webhook, error)
+	GetWebhook(ctx context.Context, id string) (*model.Webhook, error)
+	UpdateWebhook(ctx context.Context, id string, wu model.WebhookUpdate) error
+	// DeleteWebhook deletes the webhook along with its deliveries
+	DeleteWebhook(ctx context.Context, id string) error
+
+	// ListDeliveries lists the deliveries of the webhook, latest first,
+	// of the status if not empty
+	ListDeliveries(ctx context.Context, webhookID, status string, skip, limit int) ([]model.Delivery, error)
+	// RetryDelivery makes a delivery pending again, with a fresh set of
+	// attempts
+	RetryDelivery(ctx context.Context, webhookID, id string) error
+
+	// WebhooksFor returns the webhooks of the tenant subscribed to the
+	// events of the type
+	WebhooksFor(ctx context.Context, tenantID, eventType string) ([]model.Webhook, error)
+	// CreateDelivery stores a new delivery; creating it again is a no-op
+	CreateDelivery(ctx context.Context, d model.Delivery) error
+	// ClaimDeliveries returns up to limit pending deliveries due at now,
+	// postponed by lease so no other dispatcher attempts them meanwhile
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Delivery, error)
+	// SaveDeliveryAttempt records an attempt and the resulting status and
+	// next attempt time of the delivery
+	SaveDeliveryAttempt(ctx context.Context, d model.Delivery, a model.DeliveryAttempt) error
+}
@@ -0,0 +1,215 @@
+// Package stream fans the company events out to the live subscribers of
+// the API, like the Server-Sent Events stream
+package stream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/utils"
+)
+
+const (
+	DefaultReplaySize = 1000
+	DefaultBufferSize = 64
+	DefaultHeartbeat  = 15 * time.Second
+)
+
+var (
+	// ErrSlowConsumer ends the subscriptions which fell behind by more
+	// than their buffer
+	ErrSlowConsumer = errors.New("stream: subscriber too slow, dropped")
+	// ErrClosed ends the subscriptions when the broker closes
+	ErrClosed = errors.New("stream: closed")
+)
+
+// Config configures the streams
+type Config struct {
+	// ReplaySize is the number of the latest events kept to resume
+	// streams from, default 1000
+	ReplaySize int `json:"replay_size"`
+
+	// BufferSize is the number of events a subscriber may lag behind
+	// before it's dropped, default 64
+	BufferSize int `json:"buffer_size"`
+
+	// Heartbeat is how often idle streams are kept alive, default 15s
+	Heartbeat utils.Duration `json:"heartbeat"`
+}
+
+// Message is an event with its position in the stream
+type Message struct {
+	// ID resumes the stream after this message, see Broker.Subscribe
+	ID    string
+	Event model.Event
+}
+
+// Broker keeps the latest events and delivers the new ones to its
+// subscribers. It doesn't block the publisher: a subscriber whose buffer is
+// full is dropped.
+type Broker struct {
+	// epoch tells the ids of this broker from those of an earlier process
+	epoch     string
+	buffer    int
+	heartbeat time.Duration
+
+	mu     sync.Mutex
+	seq    uint64
+	replay []Message
+	size   int
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func NewBroker(conf Config) *Broker {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	br := &Broker{
+		epoch:     hex.EncodeToString(b),
+		buffer:    conf.BufferSize,
+		heartbeat: conf.Heartbeat.Duration(),
+		size:      conf.ReplaySize,
+		subs:      map[*Subscription]struct{}{},
+	}
+	if br.buffer <= 0 {
+		br.buffer = DefaultBufferSize
+	}
+	if br.size <= 0 {
+		br.size = DefaultReplaySize
+	}
+	if br.heartbeat <= 0 {
+		br.heartbeat = DefaultHeartbeat
+	}
+	return br
+}
+
+// Heartbeat is how often the streams of the subscribers send a keep-alive
+// when idle
+func (b *Broker) Heartbeat() time.Duration {
+	return b.heartbeat
+}
+
+// Handle streams the event to the subscribers; it is an events.Handler
+func (b *Broker) Handle(ctx context.Context, e model.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+
+	b.seq++
+	m := Message{ID: b.epoch + "-" + strconv.FormatUint(b.seq, 10), Event: e}
+	if len(b.replay) == b.size {
+		copy(b.replay, b.replay[1:])
+		b.replay = b.replay[:len(b.replay)-1]
+	}
+	b.replay = append(b.replay, m)
+
+	for s := range b.subs {
+		select {
+		case s.c <- m:
+		default:
+			b.drop(s, ErrSlowConsumer)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the events published from now on. With the id
+// of the last message received, the messages kept since are returned to
+// resume the stream; complete is false when some are no longer kept, or
+// the id is unknown, then the subscriber missed events.
+func (b *Broker) Subscribe(lastID string) (s *Subscription, replay []Message, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s = &Subscription{b: b, c: make(chan Message, b.buffer)}
+	if b.closed {
+		s.err = ErrClosed
+		close(s.c)
+		return s, nil, true
+	}
+	b.subs[s] = struct{}{}
+
+	if lastID == "" {
+		return s, nil, true
+	}
+	seq, ok := b.parseID(lastID)
+	if !ok || seq > b.seq {
+		return s, nil, false
+	}
+
+	// the replay holds the seq ids b.seq-len(b.replay)+1 to b.seq
+	first := b.seq - uint64(len(b.replay)) + 1
+	if seq+1 < first {
+		return s, append([]Message(nil), b.replay...), false
+	}
+	return s, append([]Message(nil), b.replay[seq+1-first:]...), true
+}
+
+func (b *Broker) parseID(id string) (uint64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// Close ends the subscriptions, for the streams to finish on shutdown
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		b.drop(s, ErrClosed)
+	}
+}
+
+// drop ends the subscription, with the broker locked
+func (b *Broker) drop(s *Subscription, err error) {
+	delete(b.subs, s)
+	s.err = err
+	close(s.c)
+}
+
+// Subscription receives the events published after it was made
+type Subscription struct {
+	b   *Broker
+	c   chan Message
+	err error
+}
+
+// C receives the messages; it is closed when the subscription ends, see
+// Err
+func (s *Subscription) C() <-chan Message {
+	return s.c
+}
+
+// Err tells why the subscription ended: ErrSlowConsumer, ErrClosed, or
+// nil when closed by the subscriber
+func (s *Subscription) Err() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if _, ok := s.b.subs[s]; ok {
+		delete(s.b.subs, s)
+		close(s.c)
+	}
+}
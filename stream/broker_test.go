@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+)
+
+func publish(b *Broker, ids ...string) {
+	for _, id := range ids {
+		b.Handle(context.Background(), model.Event{ID: id})
+	}
+}
+
+func eventIDs(ms []Message) []string {
+	ids := []string{}
+	for _, m := range ms {
+		ids = append(ids, m.Event.ID)
+	}
+	return ids
+}
+
+func TestBrokerResume(t *testing.T) {
+	b := NewBroker(Config{ReplaySize: 3})
+
+	s, replay, complete := b.Subscribe("")
+	assert.Empty(t, replay)
+	assert.True(t, complete)
+
+	publish(b, "1", "2")
+	first := <-s.C()
+	assert.Equal(t, "1", first.Event.ID)
+	s.Close()
+
+	publish(b, "3", "4")
+
+	tt := []struct {
+		name     string
+		lastID   string
+		replay   []string
+		complete bool
+	}{
+		{name: "resumed", lastID: first.ID, replay: []string{"2", "3", "4"}, complete: true},
+		{name: "up to date", lastID: b.epoch + "-4", replay: []string{}, complete: true},
+		{name: "no longer kept", lastID: b.epoch + "-0", replay: []string{"2", "3", "4"}},
+		{name: "earlier process", lastID: "00000000-1", replay: []string{}},
+		{name: "future", lastID: b.epoch + "-9", replay: []string{}},
+		{name: "garbage", lastID: "x", replay: []string{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, replay, complete := b.Subscribe(tc.lastID)
+			defer s.Close()
+			assert.Equal(t, tc.replay, eventIDs(replay))
+			assert.Equal(t, tc.complete, complete)
+		})
+	}
+}
+
+func TestBrokerSlowConsumer(t *testing.T) {
+	b := NewBroker(Config{BufferSize: 2})
+
+	slow, _, _ := b.Subscribe("")
+	fast, _, _ := b.Subscribe("")
+
+	var got []string
+	for _, id := range []string{"1", "2", "3"} {
+		publish(b, id)
+		got = append(got, (<-fast.C()).Event.ID)
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, got)
+
+	// dropped once its buffer overflowed, after what it had
+	assert.Len(t, slow.C(), 2)
+	for range slow.C() {
+	}
+	assert.Equal(t, ErrSlowConsumer, slow.Err())
+	slow.Close()
+
+	b.Close()
+	_, ok := <-fast.C()
+	assert.False(t, ok)
+	assert.Equal(t, ErrClosed, fast.Err())
+
+	late, _, _ := b.Subscribe("")
+	_, ok = <-late.C()
+	assert.False(t, ok)
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"context"
+
+	"github.com/arpsch/xm/comp"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+)
+
+// Visibility tells which events a subscriber gets: those of its tenant,
+// about the companies it may read, matching the filters
+type Visibility struct {
+	ctx     context.Context
+	tenant  string
+	authz   comp.ReadAuthorizer
+	filters []store.Filter
+}
+
+// NewVisibility returns the visibility of the subscriber of ctx. It fails
+// with comp.ErrForbidden when the subscriber may read no company.
+func NewVisibility(ctx context.Context, app comp.CompanyApp, filters []store.Filter) (*Visibility, error) {
+	v := &Visibility{ctx: ctx, filters: filters}
+	v.tenant, _ = tenant.FromContext(ctx)
+
+	if authz, ok := app.(comp.ReadAuthorizer); ok {
+		if err := authz.AuthorizeRead(ctx, nil); err != nil {
+			return nil, err
+		}
+		v.authz = authz
+	}
+	return v, nil
+}
+
+// Visible tells whether the subscriber gets the event
+func (v *Visibility) Visible(e model.Event) bool {
+	if e.TenantID != v.tenant {
+		return false
+	}
+	c := e.Company()
+	if c == nil || !store.Matches(v.filters, c) {
+		return false
+	}
+	return v.authz == nil || v.authz.AuthorizeRead(v.ctx, c) == nil
+}
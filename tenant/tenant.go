@@ -0,0 +1,135 @@
+// Package tenant carries the tenant of a request, isolating the data of the
+// business units sharing a deployment
+package tenant
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/auth"
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/model"
+)
+
+// tenancy modes
+const (
+	// ModeNone disables multi-tenancy
+	ModeNone = ""
+	// ModeShared keeps all tenants in one database, scoped by tenant_id
+	ModeShared = "shared"
+	// ModeDatabase keeps every tenant in its own database
+	ModeDatabase = "database"
+)
+
+// HdrTenantID names the tenant of callers whose credentials don't
+const HdrTenantID = "X-Tenant-ID"
+
+var (
+	ErrNoTenant      = errors.New("missing tenant")
+	ErrForeignTenant = errors.New("not the caller's tenant")
+	ErrUnbound       = errors.New("caller bound to no tenant")
+)
+
+// Config configures multi-tenancy
+type Config struct {
+	Mode string `json:"mode"`
+
+	// Header carries the tenant id, default X-Tenant-ID
+	Header string `json:"header"`
+}
+
+// HeaderName is the header carrying the tenant id
+func (c Config) HeaderName() string {
+	if c.Header == "" {
+		return HdrTenantID
+	}
+	return c.Header
+}
+
+// Validate checks the mode is known
+func (c Config) Validate() error {
+	switch c.Mode {
+	case ModeNone, ModeShared, ModeDatabase:
+		return nil
+	}
+	return errors.Errorf("tenancy: unknown mode %q", c.Mode)
+}
+
+type tenantKey struct{}
+
+// WithID returns a context carrying the tenant id
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// FromContext returns the tenant id of the request, if any
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Resolve returns the tenant of a request naming the requested one, which
+// may be empty. The tenant of the authenticated principal wins; the request
+// may only repeat it. Principals without one name their tenant only with
+// the auth.ScopeTenantsAll scope, unauthenticated callers always. It fails
+// with ErrForeignTenant, ErrUnbound, ErrNoTenant or a validation error.
+func Resolve(ctx context.Context, requested string) (string, error) {
+	id := requested
+	if p, ok := auth.PrincipalFromContext(ctx); ok {
+		own := p.Attributes[auth.AttributeTenant]
+		switch {
+		case own != "":
+			if id != "" && id != own {
+				return "", errors.Wrap(ErrForeignTenant, id)
+			}
+			id = own
+		case !p.HasScope(auth.ScopeTenantsAll):
+			return "", ErrUnbound
+		}
+	}
+
+	if id == "" {
+		return "", ErrNoTenant
+	}
+	if err := model.ValidateTenantID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Middleware puts the tenant of the request in its context, see Resolve;
+// the header names the requested tenant. Requests of another tenant get
+// 403, as do those of callers bound to no tenant, without a valid tenant
+// 400. Multi-tenancy disabled, next is
+// returned as is.
+func Middleware(conf Config, next http.HandlerFunc) http.HandlerFunc {
+	if conf.Mode == ModeNone {
+		return next
+	}
+
+	header := conf.HeaderName()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := Resolve(r.Context(), r.Header.Get(header))
+		switch {
+		case errors.Is(err, ErrForeignTenant):
+			http.Error(w, "forbidden: tenant "+r.Header.Get(header)+" is not the caller's", http.StatusForbidden)
+			return
+		case errors.Is(err, ErrUnbound):
+			http.Error(w, "forbidden: "+ErrUnbound.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrNoTenant):
+			http.Error(w, ErrNoTenant.Error()+": set the "+header+" header", http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := WithID(r.Context(), id)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("tenant", id))
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,140 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/auth"
+)
+
+func TestMiddleware(t *testing.T) {
+	bound := &auth.Principal{ID: "k1", Kind: auth.KindAPIKey,
+		Attributes: map[string]string{auth.AttributeTenant: "acme"}}
+	unbound := &auth.Principal{ID: "k2", Kind: auth.KindAPIKey}
+	crossTenant := &auth.Principal{ID: "a", Kind: auth.KindJWT, Scopes: []string{auth.ScopeTenantsAll}}
+
+	tt := []struct {
+		name       string
+		conf       Config
+		principal  *auth.Principal
+		header     string
+		statusCode int
+		tenant     string
+	}{
+		{
+			name:       "disabled",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "header",
+			conf:       Config{Mode: ModeShared},
+			header:     "acme",
+			statusCode: http.StatusOK,
+			tenant:     "acme",
+		},
+		{
+			name:       "custom header",
+			conf:       Config{Mode: ModeShared, Header: "X-Org"},
+			header:     "acme",
+			statusCode: http.StatusOK,
+			tenant:     "acme",
+		},
+		{
+			name:       "missing",
+			conf:       Config{Mode: ModeShared},
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "unbound",
+			conf:       Config{Mode: ModeShared},
+			principal:  unbound,
+			header:     "acme",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "unbound without header",
+			conf:       Config{Mode: ModeDatabase},
+			principal:  unbound,
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "cross-tenant",
+			conf:       Config{Mode: ModeDatabase},
+			principal:  crossTenant,
+			header:     "globex",
+			statusCode: http.StatusOK,
+			tenant:     "globex",
+		},
+		{
+			name:       "cross-tenant missing",
+			conf:       Config{Mode: ModeShared},
+			principal:  crossTenant,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid",
+			conf:       Config{Mode: ModeDatabase},
+			header:     "../admin",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "principal's tenant",
+			conf:       Config{Mode: ModeShared},
+			principal:  bound,
+			statusCode: http.StatusOK,
+			tenant:     "acme",
+		},
+		{
+			name:       "principal's tenant repeated",
+			conf:       Config{Mode: ModeShared},
+			principal:  bound,
+			header:     "acme",
+			statusCode: http.StatusOK,
+			tenant:     "acme",
+		},
+		{
+			name:       "another tenant",
+			conf:       Config{Mode: ModeShared},
+			principal:  bound,
+			header:     "globex",
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var tenant string
+			next := func(w http.ResponseWriter, r *http.Request) {
+				tenant, _ = FromContext(r.Context())
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/companies", nil)
+			if tc.header != "" {
+				header := tc.conf.Header
+				if header == "" {
+					header = HdrTenantID
+				}
+				req.Header.Set(header, tc.header)
+			}
+			if tc.principal != nil {
+				req = req.WithContext(auth.WithPrincipal(req.Context(), tc.principal))
+			}
+
+			rec := httptest.NewRecorder()
+			Middleware(tc.conf, next)(rec, req)
+
+			assert.Equal(t, tc.statusCode, rec.Code)
+			assert.Equal(t, tc.tenant, tenant)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Mode: ModeShared}.Validate())
+	assert.NoError(t, Config{Mode: ModeDatabase}.Validate())
+	assert.Error(t, Config{Mode: "schema"}.Validate())
+}
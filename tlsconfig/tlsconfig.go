@@ -0,0 +1,277 @@
+// Package tlsconfig builds the TLS settings of the listener, reloading the
+// certificates when they're rotated on disk
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/utils"
+)
+
+// client certificate policies
+const (
+	// ClientAuthNone asks no client certificate
+	ClientAuthNone = ""
+
+	// ClientAuthOptional verifies the certificate of the clients which
+	// send one
+	ClientAuthOptional = "optional"
+
+	// ClientAuthRequire rejects the clients without a valid certificate
+	ClientAuthRequire = "require"
+)
+
+// DefaultReloadInterval is how often the files are checked for changes
+const DefaultReloadInterval = time.Minute
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config configures the TLS listener
+type Config struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, default 1.2
+	MinVersion string `json:"min_version"`
+
+	// CipherSuites are the names of the suites allowed with TLS 1.2 and
+	// below, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; empty allows
+	// Go's secure defaults. TLS 1.3 suites aren't configurable.
+	CipherSuites []string `json:"cipher_suites"`
+
+	// ClientCAFile is the PEM bundle of the CAs issuing the client
+	// certificates, required by the optional and require client auth
+	ClientCAFile string `json:"client_ca_file"`
+
+	// ClientAuth is none (empty), optional or require
+	ClientAuth string `json:"client_auth"`
+
+	// ReloadInterval is how often the files are checked for changes,
+	// default 1m
+	ReloadInterval utils.Duration `json:"reload_interval"`
+}
+
+// Validate checks the settings, not the files
+func (c Config) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls: cert_file and key_file are required")
+	}
+	if c.MinVersion != "" {
+		if _, ok := versions[c.MinVersion]; !ok {
+			return errors.Errorf("tls: unknown min_version %q", c.MinVersion)
+		}
+	}
+	if _, err := cipherSuites(c.CipherSuites); err != nil {
+		return err
+	}
+
+	switch c.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if c.ClientCAFile == "" {
+			return errors.Errorf("tls: client_auth %s needs a client_ca_file", c.ClientAuth)
+		}
+	default:
+		return errors.Errorf("tls: unknown client_auth %q", c.ClientAuth)
+	}
+	return nil
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, errors.Errorf("tls: unknown or insecure cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Reloader holds the certificate and client CAs loaded from the files,
+// reloading them once they change
+type Reloader struct {
+	conf     Config
+	interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+	checked   time.Time
+
+	now func() time.Time
+}
+
+// New returns the TLS settings of the listener. The certificate and
+// client CAs are reloaded on the handshakes following a change of the
+// files, a failed reload keeps the previous ones.
+func New(conf Config) (*tls.Config, error) {
+	r, err := NewReloader(conf)
+	if err != nil {
+		return nil, err
+	}
+	return r.TLSConfig(), nil
+}
+
+// NewReloader loads the files
+func NewReloader(conf Config) (*Reloader, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	interval := conf.ReloadInterval.Duration()
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	r := &Reloader{
+		conf:     conf,
+		interval: interval,
+		now:      time.Now,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.conf.CertFile, r.conf.KeyFile}
+	if r.conf.ClientCAFile != "" {
+		files = append(files, r.conf.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the files; the caller holds mu, or r isn't shared yet
+func (r *Reloader) load() error {
+	var modTimes []time.Time
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return errors.Wrap(err, "tls: failed to stat "+f)
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "tls: failed to load the certificate")
+	}
+
+	var pool *x509.CertPool
+	if r.conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "tls: failed to read the client CAs")
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("tls: no certificate found in " + r.conf.ClientCAFile)
+		}
+	}
+
+	r.cert, r.clientCAs, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and client CAs, reloading them when the
+// files changed since they were last checked, at most every interval
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.checked) < r.interval {
+		return r.cert, r.clientCAs
+	}
+	r.checked = now
+
+	if r.changed() {
+		if err := r.load(); err != nil {
+			logging.Default().Error("tls: failed to reload the certificates, keeping the previous ones",
+				"error", err)
+		} else {
+			logging.Default().Info("tls: reloaded the certificates",
+				"files", strings.Join(r.files(), ","))
+		}
+	}
+	return r.cert, r.clientCAs
+}
+
+func (r *Reloader) changed() bool {
+	for i, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// mid rotation, retry on the next check
+			return false
+		}
+		if !fi.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig returns the TLS settings serving the current certificate
+func (r *Reloader) TLSConfig() *tls.Config {
+	ciphers, _ := cipherSuites(r.conf.CipherSuites)
+	minVersion := uint16(tls.VersionTLS12)
+	if v, ok := versions[r.conf.MinVersion]; ok {
+		minVersion = v
+	}
+
+	clientAuth := tls.NoClientCert
+	switch r.conf.ClientAuth {
+	case ClientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	base := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: ciphers,
+		ClientAuth:   clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	conf := base.Clone()
+	conf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := r.current()
+		return cert, nil
+	}
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, clientCAs := r.current()
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*cert}
+		c.ClientCAs = clientCAs
+		return c, nil
+	}
+	return conf
+}
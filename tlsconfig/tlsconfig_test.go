@@ -0,0 +1,205 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issue returns a certificate for cn signed by ca, self-signed without ca
+func issue(t *testing.T, cn string, ca *keyPair) *keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &keyPair{cert: cert, key: key, der: der}
+}
+
+func (kp *keyPair) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.der})
+}
+
+func (kp *keyPair) keyPEM(t *testing.T) []byte {
+	b, err := x509.MarshalECPrivateKey(kp.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+func (kp *keyPair) tlsCert(t *testing.T) tls.Certificate {
+	c, err := tls.X509KeyPair(kp.certPEM(), kp.keyPEM(t))
+	assert.NoError(t, err)
+	return c
+}
+
+// write writes the pair and moves its modification time to mtime
+func write(t *testing.T, kp *keyPair, certFile, keyFile string, mtime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(certFile, kp.certPEM(), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, kp.keyPEM(t), 0600))
+	assert.NoError(t, os.Chtimes(certFile, mtime, mtime))
+	assert.NoError(t, os.Chtimes(keyFile, mtime, mtime))
+}
+
+func TestValidate(t *testing.T) {
+	files := Config{CertFile: "c.pem", KeyFile: "k.pem"}
+	with := func(f func(c *Config)) Config {
+		c := files
+		f(&c)
+		return c
+	}
+
+	testCases := map[string]struct {
+		conf Config
+		err  bool
+	}{
+		"ok":              {conf: files},
+		"no cert":         {conf: Config{KeyFile: "k.pem"}, err: true},
+		"min version":     {conf: with(func(c *Config) { c.MinVersion = "1.3" })},
+		"bad min version": {conf: with(func(c *Config) { c.MinVersion = "3" }), err: true},
+		"ciphers": {conf: with(func(c *Config) {
+			c.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+		})},
+		"insecure cipher": {conf: with(func(c *Config) {
+			c.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+		}), err: true},
+		"mtls": {conf: with(func(c *Config) {
+			c.ClientAuth, c.ClientCAFile = ClientAuthRequire, "ca.pem"
+		})},
+		"mtls, no ca": {conf: with(func(c *Config) { c.ClientAuth = ClientAuthOptional }), err: true},
+		"bad auth":    {conf: with(func(c *Config) { c.ClientAuth = "always" }), err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.conf.Validate()
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReloaderMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	caFile := filepath.Join(dir, "clients-ca.pem")
+
+	serverCA := issue(t, "server ca", nil)
+	clientCA := issue(t, "client ca", nil)
+	assert.NoError(t, ioutil.WriteFile(caFile, clientCA.certPEM(), 0600))
+
+	mtime := time.Now().Add(-time.Hour)
+	write(t, issue(t, "server-1", serverCA), certFile, keyFile, mtime)
+
+	r, err := NewReloader(Config{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   ClientAuthRequire,
+		MinVersion:   "1.2",
+	})
+	assert.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	get := func(clientCert *tls.Certificate) (string, string, error) {
+		conf := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			conf.Certificates = []tls.Certificate{*clientCert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf, DisableKeepAlives: true}}
+		rsp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.TLS.PeerCertificates[0].Subject.CommonName, string(body), nil
+	}
+
+	billing := issue(t, "billing", clientCA).tlsCert(t)
+	server, client, err := get(&billing)
+	assert.NoError(t, err)
+	assert.Equal(t, "server-1", server)
+	assert.Equal(t, "billing", client)
+
+	// no client certificate
+	_, _, err = get(nil)
+	assert.Error(t, err)
+
+	// a client certificate of another CA
+	rogue := issue(t, "billing", issue(t, "rogue ca", nil)).tlsCert(t)
+	_, _, err = get(&rogue)
+	assert.Error(t, err)
+
+	// rotated, picked up once the interval passed
+	write(t, issue(t, "server-2", serverCA), certFile, keyFile, mtime.Add(time.Minute))
+	server, _, err = get(&billing)
+	assert.NoError(t, err)
+	assert.Equal(t, "server-1", server)
+
+	now = now.Add(DefaultReloadInterval)
+	server, _, err = get(&billing)
+	assert.NoError(t, err)
+	assert.Equal(t, "server-2", server)
+
+	// a broken rotation keeps the previous certificate
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	now = now.Add(DefaultReloadInterval)
+	server, _, err = get(&billing)
+	assert.NoError(t, err)
+	assert.Equal(t, "server-2", server)
+}
@@ -0,0 +1,183 @@
+// Package tracing traces requests with OpenTelemetry, propagating the W3C
+// trace context in and out of the service
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span exporters
+const (
+	// ExporterNone records no spans, the trace context is still propagated
+	ExporterNone = ""
+
+	// ExporterStdout writes the spans as JSON to stdout
+	ExporterStdout = "stdout"
+
+	// ExporterFile appends the spans as JSON to File
+	ExporterFile = "file"
+
+	// ExporterOTLP sends the spans to an OTLP/HTTP collector
+	ExporterOTLP = "otlp"
+)
+
+const (
+	DefaultServiceName = "xm"
+
+	instrumentation = "github.com/arpsch/xm"
+)
+
+// Config configures the tracing
+type Config struct {
+	// Exporter is none (empty), stdout, file or otlp
+	Exporter string `json:"exporter"`
+
+	// File is the file of the file exporter
+	File string `json:"file"`
+
+	// Endpoint is the host:port of the OTLP/HTTP collector, defaults to
+	// localhost:4318
+	Endpoint string `json:"endpoint"`
+
+	// Insecure sends the spans to the collector over plain HTTP
+	Insecure bool `json:"insecure"`
+
+	// ServiceName defaults to xm
+	ServiceName string `json:"service_name"`
+
+	// SampleRatio is the share of the traces started here which are
+	// recorded, between 0 and 1, default 1. Traces started by the callers
+	// follow their sampling decision.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Validate checks the exporter settings
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+	case ExporterFile:
+		if c.File == "" {
+			return errors.New("tracing: the file exporter needs a file")
+		}
+	default:
+		return errors.Errorf("tracing: unknown exporter %q", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.New("tracing: the sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Setup installs the W3C trace context propagator and, unless the exporter
+// is none, a tracer provider exporting the spans. The returned function
+// flushes the spans left and releases the exporter.
+func Setup(ctx context.Context, conf Config) (func(context.Context) error, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	noop := func(context.Context) error { return nil }
+
+	var (
+		exp    sdktrace.SpanExporter
+		closer io.Closer
+		err    error
+	)
+	switch conf.Exporter {
+	case ExporterNone:
+		return noop, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "tracing: failed to open the span file")
+		}
+		closer = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "tracing: failed to create the exporter")
+	}
+
+	name := conf.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+	ratio := conf.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(name),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span, child of the span of ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the id of the trace of ctx, if any
+func TraceID(ctx context.Context) (string, bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return "", false
+	}
+	return sc.TraceID().String(), true
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record installs a tracer provider recording the ended spans
+func record(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return rec
+}
+
+func TestValidate(t *testing.T) {
+	testCases := map[string]struct {
+		conf Config
+		err  bool
+	}{
+		"none":          {conf: Config{}},
+		"stdout":        {conf: Config{Exporter: ExporterStdout, SampleRatio: 0.5}},
+		"otlp":          {conf: Config{Exporter: ExporterOTLP, Endpoint: "collector:4318"}},
+		"file":          {conf: Config{Exporter: ExporterFile, File: "/tmp/spans.json"}},
+		"file, no file": {conf: Config{Exporter: ExporterFile}, err: true},
+		"unknown":       {conf: Config{Exporter: "jaeger"}, err: true},
+		"bad ratio":     {conf: Config{SampleRatio: 2}, err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.conf.Validate()
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSetupFile(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "spans.json")
+
+	shutdown, err := Setup(ctx, Config{Exporter: ExporterFile, File: file, ServiceName: "xm-test"})
+	assert.NoError(t, err)
+
+	_, span := Start(ctx, "comp.GetCompany")
+	End(span, errors.New("boom"))
+	assert.NoError(t, shutdown(ctx))
+
+	b, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"Name":"comp.GetCompany"`)
+	assert.Contains(t, string(b), `"xm-test"`)
+	assert.Contains(t, string(b), `boom`)
+}
+
+func TestPropagation(t *testing.T) {
+	rec := record(t)
+
+	// the outgoing request carries the trace context
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: Transport(nil)}
+
+	req, _ := http.NewRequest("GET", "/api/v1/companies/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	r, span := StartServer(req, "/api/v1/companies/:id")
+	id, ok := TraceID(r.Context())
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", id)
+
+	out, _ := http.NewRequest("GET", upstream.URL, nil)
+	rsp, err := client.Do(out.WithContext(r.Context()))
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	EndServer(span, http.StatusInternalServerError)
+
+	assert.Regexp(t, "^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$", traceparent)
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 2)
+
+	client0, server := spans[0], spans[1]
+	assert.Equal(t, "HTTP GET", client0.Name())
+	assert.Equal(t, server.SpanContext().SpanID(), client0.Parent().SpanID())
+	assert.Equal(t, codes.Error, client0.Status().Code)
+
+	assert.Equal(t, "GET /api/v1/companies/:id", server.Name())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.True(t, server.Parent().IsRemote())
+	assert.Equal(t, codes.Error, server.Status().Code)
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HdrForwarded     = "Forwarded"
+	HdrXForwardedFor = "X-Forwarded-For"
+	HdrXRealIP       = "X-Real-IP"
+)
+
+// ClientIPResolver extracts the originating client IP of a request.
+// Forwarding headers (RFC 7239 Forwarded, X-Forwarded-For, X-Real-IP) are
+// only honored when the request comes from one of the trusted proxies;
+// otherwise the peer address is the client.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIPResolver takes the trusted proxy CIDRs (or single IPs)
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	res := &ClientIPResolver{}
+	for _, p := range trustedProxies {
+		n, err := ParseNetwork(p)
+		if err != nil {
+			return nil, err
+		}
+		res.trusted = append(res.trusted, n)
+	}
+	return res, nil
+}
+
+// ClientIP returns the client IP for the request
+func (res *ClientIPResolver) ClientIP(r *http.Request) (string, error) {
+	remoteIP, err := RetrievRemoteIP(r)
+	if err != nil {
+		return "", err
+	}
+
+	if res == nil || !res.isTrusted(remoteIP) {
+		return remoteIP, nil
+	}
+
+	// hops are ordered client first, the peer is appended as the last one
+	hops, ok := forwardedFor(r.Header)
+	if !ok {
+		hops, ok = xForwardedFor(r.Header)
+	}
+	if !ok {
+		if ip := normalizeIP(r.Header.Get(HdrXRealIP)); ip != "" {
+			hops = []string{ip}
+		}
+	}
+	hops = append(hops, remoteIP)
+
+	// walk the chain from the peer towards the client, the first hop we
+	// do not trust is the client
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			// unknown or obfuscated hop, the chain can't be followed
+			return hops[i+1], nil
+		}
+		if !res.isTrusted(hops[i]) {
+			return hops[i], nil
+		}
+	}
+
+	// every hop is a trusted proxy, take the farthest one
+	return hops[0], nil
+}
+
+func (res *ClientIPResolver) isTrusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range res.trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= parameters of the RFC 7239 Forwarded headers
+func forwardedFor(h http.Header) ([]string, bool) {
+	values := h.Values(HdrForwarded)
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				hops = append(hops, normalizeIP(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return hops, len(hops) > 0
+}
+
+// xForwardedFor returns the addresses listed in the X-Forwarded-For headers
+func xForwardedFor(h http.Header) ([]string, bool) {
+	values := h.Values(HdrXForwardedFor)
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	var hops []string
+	for _, v := range values {
+		for _, ip := range strings.Split(v, ",") {
+			hops = append(hops, normalizeIP(ip))
+		}
+	}
+	return hops, len(hops) > 0
+}
+
+// normalizeIP strips brackets and ports from a node identifier, returns ""
+// when it isn't an IP (e.g. "unknown" or an obfuscated "_hidden")
+func normalizeIP(node string) string {
+	node = strings.TrimSpace(node)
+	if node == "" {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+
+	ip := net.ParseIP(node)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// ParseNetwork accepts both CIDR notation and plain IP addresses
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid IP %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CIDR %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	res, err := NewClientIPResolver([]string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"})
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "185.193.151.255:8080",
+			want:       "185.193.151.255",
+		},
+		{
+			name:       "untrusted peer can't spoof X-Forwarded-For",
+			remoteAddr: "185.193.151.255:8080",
+			headers:    map[string][]string{HdrXForwardedFor: {"1.2.3.4"}},
+			want:       "185.193.151.255",
+		},
+		{
+			name:       "trusted peer with X-Forwarded-For",
+			remoteAddr: "10.0.0.5:1234",
+			headers:    map[string][]string{HdrXForwardedFor: {"185.193.151.255"}},
+			want:       "185.193.151.255",
+		},
+		{
+			name:       "multi-hop chain skips trusted proxies only",
+			remoteAddr: "10.0.0.5:1234",
+			headers: map[string][]string{
+				HdrXForwardedFor: {"1.2.3.4, 185.193.151.255", "192.0.2.1"},
+			},
+			want: "185.193.151.255",
+		},
+		{
+			name:       "all hops trusted",
+			remoteAddr: "10.0.0.5:1234",
+			headers:    map[string][]string{HdrXForwardedFor: {"10.1.1.1, 10.2.2.2"}},
+			want:       "10.1.1.1",
+		},
+		{
+			name:       "X-Real-IP",
+			remoteAddr: "10.0.0.5:1234",
+			headers:    map[string][]string{HdrXRealIP: {"185.193.151.255"}},
+			want:       "185.193.151.255",
+		},
+		{
+			name:       "Forwarded takes precedence",
+			remoteAddr: "10.0.0.5:1234",
+			headers: map[string][]string{
+				HdrForwarded:     {`for=185.193.151.255;proto=https, for=10.0.0.7`},
+				HdrXForwardedFor: {"1.2.3.4"},
+			},
+			want: "185.193.151.255",
+		},
+		{
+			name:       "Forwarded with quoted IPv6 and port",
+			remoteAddr: "[fd00::1]:443",
+			headers: map[string][]string{
+				HdrForwarded: {`For="[2001:db8:cafe::17]:4711"`},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:       "Forwarded with an obfuscated hop",
+			remoteAddr: "10.0.0.5:1234",
+			headers: map[string][]string{
+				HdrForwarded: {`for=185.193.151.255, for=_hidden, for=10.0.0.7`},
+			},
+			want: "10.0.0.7",
+		},
+		{
+			name:       "IPv6 direct client",
+			remoteAddr: "[2001:db8::1]:8080",
+			want:       "2001:db8::1",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, vs := range tc.headers {
+				for _, v := range vs {
+					req.Header.Add(k, v)
+				}
+			}
+
+			ip, err := res.ClientIP(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, ip)
+		})
+	}
+}
+
+func TestNewClientIPResolverInvalid(t *testing.T) {
+	_, err := NewClientIPResolver([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
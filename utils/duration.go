@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Duration is a time.Duration which (un)marshals from JSON strings like
+// "1m30s", plain numbers are taken as seconds
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case float64:
+		*d = Duration(val * float64(time.Second))
+	case string:
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+	default:
+		return errors.New("invalid duration")
+	}
+	return nil
+}
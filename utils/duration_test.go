@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	var v struct {
+		A Duration `json:"a"`
+		B Duration `json:"b"`
+	}
+
+	err := json.Unmarshal([]byte(`{"a": "1m30s", "b": 2}`), &v)
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, v.A.Duration())
+	assert.Equal(t, 2*time.Second, v.B.Duration())
+
+	err = json.Unmarshal([]byte(`{"a": "forever"}`), &v)
+	assert.Error(t, err)
+
+	err = json.Unmarshal([]byte(`{"a": true}`), &v)
+	assert.Error(t, err)
+}
+
+func TestDurationMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(Duration(90 * time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(b))
+}
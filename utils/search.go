@@ -1,5 +1,7 @@
 package utils
 
+import "strings"
+
 // Check if string is presnt in an array. Would use interface{} but
 // whatever.
 func ContainsString(val string, vals []string) bool {
@@ -11,3 +13,25 @@ func ContainsString(val string, vals []string) bool {
 	}
 	return false
 }
+
+// MatchRoute tells whether the route registered for method and path is
+// covered by the methods and path patterns. Empty lists match everything,
+// a pattern ending in * matches a path prefix.
+func MatchRoute(methods, paths []string, method, path string) bool {
+	if len(methods) > 0 && !ContainsString(method, methods) {
+		return false
+	}
+	if len(paths) == 0 {
+		return true
+	}
+	for _, pattern := range paths {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == path {
+			return true
+		}
+	}
+	return false
+}
@@ -12,3 +12,25 @@ func TestContainsString(t *testing.T) {
 		t.Errorf("string found, expected not found")
 	}
 }
+
+func TestMatchRoute(t *testing.T) {
+	tt := []struct {
+		methods []string
+		paths   []string
+		method  string
+		path    string
+		match   bool
+	}{
+		{method: "GET", path: "/api/v1/companies", match: true},
+		{methods: []string{"POST"}, method: "GET", path: "/api/v1/companies", match: false},
+		{paths: []string{"/api/v1/companies"}, method: "GET", path: "/api/v1/companies/:id", match: false},
+		{paths: []string{"/api/v1/companies*"}, method: "GET", path: "/api/v1/companies/:id", match: true},
+		{methods: []string{"DELETE"}, paths: []string{"/api/v1/companies/:id"}, method: "DELETE", path: "/api/v1/companies/:id", match: true},
+	}
+
+	for _, tc := range tt {
+		if MatchRoute(tc.methods, tc.paths, tc.method, tc.path) != tc.match {
+			t.Errorf("MatchRoute(%v, %v, %s, %s) != %v", tc.methods, tc.paths, tc.method, tc.path, tc.match)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/logging"
+	"github.com/arpsch/xm/metrics"
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/tenant"
+	"github.com/arpsch/xm/tracing"
+	"github.com/arpsch/xm/utils"
+)
+
+// attempt outcomes
+const (
+	outcomeDelivered = "delivered"
+	outcomeRetry     = "retry"
+	outcomeDead      = "dead"
+)
+
+const maxResponseLen = 64 << 10
+
+var webhookDeliveries = metrics.NewCounterVec(
+	"xm_webhook_delivery_attempts_total",
+	"Webhook delivery attempts by outcome (delivered, retry or dead).",
+	"outcome")
+
+func init() {
+	metrics.MustRegister(webhookDeliveries)
+}
+
+// Dispatcher turns the events into deliveries to the subscribed webhooks
+// and attempts them
+type Dispatcher struct {
+	store  store.WebhookStore
+	client *http.Client
+
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	timeout     time.Duration
+	interval    time.Duration
+	batch       int
+
+	insecureHosts []string
+	allowed       []*net.IPNet
+
+	now    func() time.Time
+	jitter func(n int64) int64
+}
+
+func NewDispatcher(s store.WebhookStore, conf Config) (*Dispatcher, error) {
+	d := &Dispatcher{
+		store:         s,
+		maxAttempts:   conf.MaxAttempts,
+		backoff:       conf.Backoff.Duration(),
+		maxBackoff:    conf.MaxBackoff.Duration(),
+		timeout:       conf.Timeout.Duration(),
+		interval:      conf.Interval.Duration(),
+		batch:         conf.Batch,
+		insecureHosts: conf.InsecureHosts,
+		now:           time.Now,
+		jitter:        rand.Int63n,
+	}
+	for _, n := range conf.AllowedNetworks {
+		network, err := utils.ParseNetwork(n)
+		if err != nil {
+			return nil, errors.Wrap(err, "webhook: allowed networks")
+		}
+		d.allowed = append(d.allowed, network)
+	}
+	d.client = &http.Client{
+		Transport: tracing.Transport(d.transport()),
+		// the 3xx are answers like the others, not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = DefaultMaxAttempts
+	}
+	if d.backoff <= 0 {
+		d.backoff = DefaultBackoff
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = DefaultMaxBackoff
+	}
+	if d.timeout <= 0 {
+		d.timeout = DefaultTimeout
+	}
+	if d.interval <= 0 {
+		d.interval = DefaultInterval
+	}
+	if d.batch <= 0 {
+		d.batch = DefaultBatch
+	}
+	return d, nil
+}
+
+// transport dials the public addresses and the allowed networks only. The
+// check is on the address dialed, once the host is resolved, so a host
+// can't resolve to a permitted address when the webhook is created and to
+// another when it's delivered. The proxies, which would dial in its place,
+// are bypassed.
+func (d *Dispatcher) transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   d.checkAddress,
+	}
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// reservedNetworks are not public either: shared (carrier-grade NAT)
+// addresses and "this network"
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("0.0.0.0/8"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// checkAddress refuses to connect to the loopback, link-local, private,
+// reserved and unspecified addresses, but for the allowed networks
+func (d *Dispatcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("webhook: invalid address %q", address)
+	}
+
+	for _, n := range d.allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return errors.Errorf("webhook: address %s is not public", ip)
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return errors.Errorf("webhook: address %s is not public", ip)
+		}
+	}
+	return nil
+}
+
+// Handle queues a delivery of the event to every webhook of its tenant
+// subscribed to it; it is an events.Handler. Handling an event again
+// doesn't queue it twice.
+func (d *Dispatcher) Handle(ctx context.Context, e model.Event) error {
+	hooks, err := d.store.WebhooksFor(ctx, e.TenantID, e.Type)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "webhook: failed to encode the event")
+	}
+
+	for _, h := range hooks {
+		err := d.store.CreateDelivery(ctx, model.Delivery{
+			ID:            e.ID + "-" + h.ID,
+			WebhookID:     h.ID,
+			TenantID:      h.TenantID,
+			EventID:       e.ID,
+			EventType:     e.Type,
+			Payload:       payload,
+			Status:        model.DeliveryPending,
+			NextAttemptTs: d.now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run attempts the due deliveries until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+
+	for {
+		for {
+			n, err := d.Flush(ctx)
+			if err != nil || n < d.batch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Flush attempts a batch of due deliveries, concurrently, and returns how
+// many were attempted
+func (d *Dispatcher) Flush(ctx context.Context) (int, error) {
+	// claimed for longer than the attempts may take
+	lease := d.timeout + time.Minute
+	deliveries, err := d.store.ClaimDeliveries(ctx, d.now(), lease, d.batch)
+	if err != nil {
+		logging.FromContext(ctx).Error("webhook: failed to claim the deliveries", "error", err)
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, dl := range deliveries {
+		wg.Add(1)
+		go func(dl model.Delivery) {
+			defer wg.Done()
+			d.attempt(ctx, dl)
+		}(dl)
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// attempt posts the delivery and records the outcome: delivered on a 2xx,
+// else retried later or, out of attempts, dead-lettered
+func (d *Dispatcher) attempt(ctx context.Context, dl model.Delivery) {
+	l := logging.FromContext(ctx).With("webhook", dl.WebhookID, "delivery", dl.ID)
+
+	a := model.DeliveryAttempt{Ts: d.now()}
+	hook, err := d.store.GetWebhook(tenant.WithID(ctx, dl.TenantID), dl.WebhookID)
+	if err == nil {
+		a.StatusCode, err = d.post(ctx, hook, dl)
+	}
+	a.LatencyMs = float64(d.now().Sub(a.Ts).Microseconds()) / 1000
+
+	outcome := outcomeDelivered
+	switch {
+	case err == nil && a.StatusCode >= 200 && a.StatusCode < 300:
+		dl.Status = model.DeliveryDelivered
+		dl.NextAttemptTs = time.Time{}
+	case errors.Is(err, store.ErrWebhookNotFound):
+		// deleted meanwhile
+		return
+	default:
+		if err != nil {
+			a.Error = err.Error()
+		} else {
+			a.Error = "unexpected response status " + strconv.Itoa(a.StatusCode)
+		}
+
+		attempts := len(dl.Attempts) + 1
+		if attempts >= d.maxAttempts {
+			outcome = outcomeDead
+			dl.Status = model.DeliveryDead
+			dl.NextAttemptTs = time.Time{}
+			l.Error("webhook: delivery failed, dead-lettered", "attempts", attempts, "error", a.Error)
+		} else {
+			outcome = outcomeRetry
+			dl.NextAttemptTs = d.now().Add(d.retryDelay(attempts))
+			l.Info("webhook: delivery failed, retrying", "attempts", attempts,
+				"next_attempt", dl.NextAttemptTs, "error", a.Error)
+		}
+	}
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+
+	if err := d.store.SaveDeliveryAttempt(ctx, dl, a); err != nil {
+		// attempted again once the lease expires
+		l.Error("webhook: failed to save the delivery attempt", "error", err)
+	}
+}
+
+// post sends the signed delivery and returns the response status
+func (d *Dispatcher) post(ctx context.Context, hook *model.Webhook, dl model.Delivery) (int, error) {
+	// stored before the insecure hosts changed
+	if err := model.CheckWebhookURL(hook.URL, d.insecureHosts); err != nil {
+		return 0, errors.Wrap(err, "webhook: url")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HdrEvent, dl.EventType)
+	req.Header.Set(HdrDelivery, dl.ID)
+	ts := d.now()
+	req.Header.Set(HdrTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set(HdrSignature, Sign(hook.Secret, ts, dl.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drained, for the connection to be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxResponseLen))
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// retryDelay is the exponential backoff after the attempts, with equal
+// jitter: half of it is random
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + d.jitter(half+1))
+}
@@ -0,0 +1,117 @@
+// Package webhook pushes the company events to the URLs the tenants
+// subscribe, signed and retried until delivered or dead-lettered
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/arpsch/xm/utils"
+)
+
+// delivery request headers
+const (
+	// HdrSignature is "sha256=" and the hex HMAC-SHA256, keyed with the
+	// webhook secret, of the timestamp, a dot and the body
+	HdrSignature = "X-XM-Signature"
+	// HdrTimestamp is the Unix time of the attempt, receivers should
+	// reject old ones to prevent replays
+	HdrTimestamp = "X-XM-Timestamp"
+	HdrEvent     = "X-XM-Event"
+	HdrDelivery  = "X-XM-Delivery"
+
+	signaturePrefix = "sha256="
+)
+
+const (
+	DefaultMaxAttempts = 8
+	DefaultBackoff     = 10 * time.Second
+	DefaultMaxBackoff  = time.Hour
+	DefaultTimeout     = 10 * time.Second
+	DefaultInterval    = time.Second
+	DefaultBatch       = 20
+
+	// DefaultTolerance is how old a timestamp Verify accepts
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrStaleTimestamp   = errors.New("webhook: timestamp out of tolerance")
+)
+
+// Config configures the webhook deliveries
+type Config struct {
+	// MaxAttempts is the number of attempts before a delivery is
+	// dead-lettered, default 8
+	MaxAttempts int `json:"max_attempts"`
+
+	// Backoff is the delay before the first retry, doubled by every
+	// retry up to MaxBackoff, with jitter; default 10s and 1h
+	Backoff    utils.Duration `json:"backoff"`
+	MaxBackoff utils.Duration `json:"max_backoff"`
+
+	// Timeout bounds an attempt, default 10s
+	Timeout utils.Duration `json:"timeout"`
+
+	// Interval is how often the due deliveries are checked, default 1s
+	Interval utils.Duration `json:"interval"`
+
+	// Batch is the number of deliveries attempted at once, default 20
+	Batch int `json:"batch"`
+
+	// InsecureHosts are the hosts the webhooks may reach over plain http,
+	// the others must be https
+	InsecureHosts []string `json:"insecure_hosts"`
+
+	// AllowedNetworks are the IPs or CIDR networks the deliveries may
+	// reach although loopback, link-local or private; the other such
+	// addresses are refused
+	AllowedNetworks []string `json:"allowed_networks"`
+}
+
+// NewSecret returns a random webhook secret
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "webhook: failed to generate a secret")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the HdrSignature of the body sent at ts
+func Sign(secret string, ts time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received at now, for the
+// receivers written in Go
+func Verify(secret string, h http.Header, body []byte, tolerance time.Duration, now time.Time) error {
+	unix, err := strconv.ParseInt(h.Get(HdrTimestamp), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	ts := time.Unix(unix, 0)
+	if now.Sub(ts) > tolerance || ts.Sub(now) > tolerance {
+		return ErrStaleTimestamp
+	}
+
+	sig := h.Get(HdrSignature)
+	if !strings.HasPrefix(sig, signaturePrefix) ||
+		!hmac.Equal([]byte(sig), []byte(Sign(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
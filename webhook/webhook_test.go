@@ -0,0 +1,303 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arpsch/xm/model"
+	"github.com/arpsch/xm/store"
+	"github.com/arpsch/xm/utils"
+)
+
+// memStore is an in-memory WebhookStore of the dispatcher's operations
+type memStore struct {
+	store.WebhookStore
+
+	mu         sync.Mutex
+	hooks      []model.Webhook
+	deliveries map[string]*model.Delivery
+}
+
+func newMemStore(hooks ...model.Webhook) *memStore {
+	return &memStore{hooks: hooks, deliveries: map[string]*model.Delivery{}}
+}
+
+func (m *memStore) WebhooksFor(ctx context.Context, tenantID, eventType string) ([]model.Webhook, error) {
+	var res []model.Webhook
+	for _, h := range m.hooks {
+		if h.TenantID == tenantID && h.Wants(eventType) {
+			res = append(res, h)
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	for _, h := range m.hooks {
+		if h.ID == id {
+			return &h, nil
+		}
+	}
+	return nil, store.ErrWebhookNotFound
+}
+
+func (m *memStore) CreateDelivery(ctx context.Context, d model.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deliveries[d.ID]; !ok {
+		m.deliveries[d.ID] = &d
+	}
+	return nil
+}
+
+func (m *memStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []model.Delivery
+	for _, d := range m.deliveries {
+		if len(res) < limit && d.Status == model.DeliveryPending && !d.NextAttemptTs.After(now) {
+			d.NextAttemptTs = now.Add(lease)
+			res = append(res, *d)
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) SaveDeliveryAttempt(ctx context.Context, d model.Delivery, a model.DeliveryAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.deliveries[d.ID]
+	stored.Status = d.Status
+	stored.NextAttemptTs = d.NextAttemptTs
+	stored.Attempts = append(stored.Attempts, a)
+	return nil
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"1"}`)
+
+	h := http.Header{}
+	h.Set(HdrTimestamp, "1700000000")
+	h.Set(HdrSignature, Sign("secret", now, body))
+
+	assert.NoError(t, Verify("secret", h, body, DefaultTolerance, now.Add(time.Minute)))
+	assert.Equal(t, ErrInvalidSignature, Verify("other", h, body, DefaultTolerance, now))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", h, []byte(`{"id":"2"}`), DefaultTolerance, now))
+	assert.Equal(t, ErrStaleTimestamp, Verify("secret", h, body, DefaultTolerance, now.Add(time.Hour)))
+}
+
+func TestRetryDelay(t *testing.T) {
+	d, err := NewDispatcher(newMemStore(), Config{
+		Backoff:    utils.Duration(time.Second),
+		MaxBackoff: utils.Duration(10 * time.Second),
+	})
+	assert.NoError(t, err)
+
+	tt := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: time.Second},
+		{attempts: 2, max: 2 * time.Second},
+		{attempts: 3, max: 4 * time.Second},
+		{attempts: 5, max: 10 * time.Second},
+		{attempts: 60, max: 10 * time.Second},
+	}
+	for _, tc := range tt {
+		d.jitter = func(n int64) int64 { return 0 }
+		assert.Equal(t, tc.max/2, d.retryDelay(tc.attempts))
+		d.jitter = func(n int64) int64 { return n - 1 }
+		assert.Equal(t, tc.max, d.retryDelay(tc.attempts))
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu       sync.Mutex
+		received []string
+		fail     = true
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify("s3cr3t-s3cr3t-s3cr3t", r.Header, body, DefaultTolerance, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, r.Header.Get(HdrEvent))
+	}))
+	defer receiver.Close()
+
+	s := newMemStore(
+		model.Webhook{ID: "all", TenantID: "acme", URL: receiver.URL, Secret: "s3cr3t-s3cr3t-s3cr3t"},
+		model.Webhook{ID: "deleted", TenantID: "acme", URL: receiver.URL, Secret: "s3cr3t-s3cr3t-s3cr3t",
+			EventTypes: []string{model.EventCompanyDeleted}},
+		model.Webhook{ID: "other", TenantID: "globex", URL: receiver.URL, Secret: "s3cr3t-s3cr3t-s3cr3t"},
+	)
+	d, err := NewDispatcher(s, Config{
+		MaxAttempts:     2,
+		InsecureHosts:   []string{"127.0.0.1"},
+		AllowedNetworks: []string{"127.0.0.1"},
+	})
+	assert.NoError(t, err)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	e := model.Event{ID: "e1", Type: model.EventCompanyCreated, TenantID: "acme", CompanyID: "c1"}
+	assert.NoError(t, d.Handle(ctx, e))
+	// handled again, not queued twice
+	assert.NoError(t, d.Handle(ctx, e))
+	if !assert.Len(t, s.deliveries, 1) {
+		return
+	}
+	dl := s.deliveries["e1-all"]
+
+	// failed, retried after the backoff
+	n, err := d.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, model.DeliveryPending, dl.Status)
+	assert.Len(t, dl.Attempts, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, dl.Attempts[0].StatusCode)
+	assert.True(t, dl.NextAttemptTs.After(now))
+
+	n, _ = d.Flush(ctx)
+	assert.Equal(t, 0, n)
+
+	// out of attempts, dead-lettered
+	now = dl.NextAttemptTs
+	d.Flush(ctx)
+	assert.Equal(t, model.DeliveryDead, dl.Status)
+	assert.Len(t, dl.Attempts, 2)
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	assert.NoError(t, d.Handle(ctx, model.Event{ID: "e2", Type: model.EventCompanyDeleted, TenantID: "acme"}))
+	n, _ = d.Flush(ctx)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, model.DeliveryDelivered, s.deliveries["e2-all"].Status)
+	assert.Equal(t, model.DeliveryDelivered, s.deliveries["e2-deleted"].Status)
+	assert.Equal(t, []string{model.EventCompanyDeleted, model.EventCompanyDeleted}, received)
+}
+
+func TestDispatcherRefusals(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		reached []string
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		reached = append(reached, r.URL.Path)
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL+"/internal", http.StatusFound))
+	defer redirect.Close()
+
+	tt := []struct {
+		name string
+		conf Config
+		url  string
+
+		status int
+		err    string
+	}{
+		{
+			name:   "allowed",
+			conf:   Config{InsecureHosts: []string{"127.0.0.1"}, AllowedNetworks: []string{"127.0.0.0/8"}},
+			url:    target.URL + "/hook",
+			status: http.StatusOK,
+		},
+		{
+			name: "plain http",
+			conf: Config{AllowedNetworks: []string{"127.0.0.0/8"}},
+			url:  target.URL + "/hook",
+			err:  "must be an https URL",
+		},
+		{
+			name: "loopback",
+			conf: Config{InsecureHosts: []string{"127.0.0.1"}},
+			url:  target.URL + "/hook",
+			err:  "address 127.0.0.1 is not public",
+		},
+		{
+			name: "resolved to loopback",
+			conf: Config{InsecureHosts: []string{"localhost"}},
+			url:  strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/hook",
+			err:  "is not public",
+		},
+		{
+			name: "carrier-grade NAT",
+			conf: Config{InsecureHosts: []string{"100.64.0.1"}},
+			url:  "http://100.64.0.1:8080/hook",
+			err:  "address 100.64.0.1 is not public",
+		},
+		{
+			name: "this network",
+			conf: Config{InsecureHosts: []string{"0.0.0.1"}},
+			url:  "http://0.0.0.1:8080/hook",
+			err:  "address 0.0.0.1 is not public",
+		},
+		{
+			name:   "redirect not followed",
+			conf:   Config{InsecureHosts: []string{"127.0.0.1"}, AllowedNetworks: []string{"127.0.0.0/8"}},
+			url:    redirect.URL,
+			status: http.StatusFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			reached = nil
+			mu.Unlock()
+
+			s := newMemStore(model.Webhook{ID: "h", TenantID: "acme", URL: tc.url, Secret: "s3cr3t-s3cr3t-s3cr3t"})
+			tc.conf.MaxAttempts = 1
+			d, err := NewDispatcher(s, tc.conf)
+			assert.NoError(t, err)
+
+			assert.NoError(t, d.Handle(ctx, model.Event{ID: "e", Type: model.EventCompanyCreated, TenantID: "acme"}))
+			d.Flush(ctx)
+
+			dl := s.deliveries["e-h"]
+			if !assert.Len(t, dl.Attempts, 1) {
+				return
+			}
+			assert.Equal(t, tc.status, dl.Attempts[0].StatusCode)
+			if tc.err != "" {
+				assert.Contains(t, dl.Attempts[0].Error, tc.err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.status == http.StatusOK {
+				assert.Equal(t, []string{"/hook"}, reached)
+			} else {
+				assert.Empty(t, reached)
+			}
+		})
+	}
+
+	_, err := NewDispatcher(newMemStore(), Config{AllowedNetworks: []string{"intranet"}})
+	assert.Error(t, err)
+}